@@ -13,46 +13,60 @@ import (
 
 var BuildVersion string // Set the git commit version from linker flags at build time
 
-func init() {
-	var level log.Level
-	var err error
-
-	log.SetOutput(os.Stderr)
+func main() {
+	// "config print" shows the effective configuration, with secrets redacted, instead of starting the server
+	args := os.Args[1:]
+	printConfig := len(args) >= 2 && args[0] == "config" && args[1] == "print"
+	if printConfig {
+		args = args[2:]
+	}
 
-	if _, isLocal := os.LookupEnv("RUNNING_LOCALLY"); isLocal {
-		log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
-	} else {
-		log.SetFormatter(&log.JSONFormatter{})
+	fs := flag.NewFlagSet(api.ServiceName, flag.ExitOnError)
+	version := fs.Bool("version", false, "Returns the version of user-mgmt-service-api binary")
+	cfg, err := api.LoadConfig(fs, args)
+	if *version {
+		fmt.Printf("user-mgmt-service-api version: %s (OS: %s) (Arch: %s)\n", BuildVersion, runtime.GOOS, runtime.GOARCH)
+		os.Exit(0)
 	}
 
-	llEnv, ok := os.LookupEnv("LOG_LEVEL")
-	if !ok {
-		// default to warnings
-		log.SetLevel(log.WarnLevel)
-	} else {
-		level, err = log.ParseLevel(llEnv)
-		if err != nil {
-			log.WithError(err).Fatal("parsing logrus log level from LOG_LEVEL envar")
+	if printConfig {
+		out, marshalErr := cfg.Redacted().YAML()
+		if marshalErr != nil {
+			fmt.Fprintf(os.Stderr, "marshalling config: %v\n", marshalErr)
+			os.Exit(1)
 		}
-		log.SetLevel(level)
+		fmt.Print(string(out))
 	}
-	log.Infof("Log level: %v", level)
-
-	version := flag.Bool("version", false, "Returns the version of user-mgmt-service-api binary")
-	flag.Parse()
-	if *version {
-		fmt.Printf("user-mgmt-service-api version: %s (OS: %s) (Arch: %s)\n", BuildVersion, runtime.GOOS, runtime.GOARCH)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n%v\n", err)
+		os.Exit(1)
+	}
+	if printConfig {
 		os.Exit(0)
 	}
 
-	api.EnvConfig, err = api.OpenDBConnection()
+	configureLogging(cfg.Log)
+
+	api.EnvConfig, err = api.OpenDBConnection(cfg)
 	if err != nil {
 		log.WithError(err).Fatal("opening DB connection")
 	}
 
 	api.EnvConfig.BuildVersion = BuildVersion
+	api.RunAPIServer()
 }
 
-func main() {
-	api.RunAPIServer()
+// configureLogging sets the logrus output, format and level. The config has already been validated so the level always parses
+func configureLogging(cfg api.LogConfig) {
+	log.SetOutput(os.Stderr)
+
+	if cfg.Format == "text" {
+		log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
+	} else {
+		log.SetFormatter(&log.JSONFormatter{})
+	}
+
+	level, _ := log.ParseLevel(cfg.Level)
+	log.SetLevel(level)
+	log.Infof("Log level: %v", level)
 }
@@ -21,14 +21,11 @@ if [ -z "${DB_NAME}" ]; then
 fi
 
 
-# Create table
-if ! psql --host="${RDS_ENDPOINT}" --dbname="${DB_NAME}" --username="${RDS_USERNAME}" --file=/sql-scripts/01-create-table.sql; then
-  echo "Problem creating SQL table"
-fi
-
-# Import sample rows to test against
-if ! psql --host="${RDS_ENDPOINT}" --dbname="${DB_NAME}" --username="${RDS_USERNAME}" --file=/sql-scripts/02-insert-users.sql; then
-  echo "Problem inserting rows into table"
-fi
+# Create the tables and import sample rows to test against. Scripts are prefixed with a number so that the glob runs them in order
+for script in /sql-scripts/*.sql; do
+  if ! psql --host="${RDS_ENDPOINT}" --dbname="${DB_NAME}" --username="${RDS_USERNAME}" --file="${script}"; then
+    echo "Problem running SQL script ${script}"
+  fi
+done
 
 echo "SQL commands run successfully"
\ No newline at end of file
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"regexp"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// validRequestID restricts client supplied request IDs, so that they can't be used to inject content into logs or headers
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type requestInfoKey struct{}
+
+// requestInfo holds the details of a request which are shared between the middleware and handlers
+type requestInfo struct {
+	id           string
+	errorMessage string
+}
+
+// requestInfoFromContext returns the requestInfo stored by requestIDHandler, or nil if there is none
+func requestInfoFromContext(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// requestIDFromContext returns the ID of the request being served, or an empty string if there is none
+func requestIDFromContext(ctx context.Context) string {
+	if info := requestInfoFromContext(ctx); info != nil {
+		return info.id
+	}
+	return ""
+}
+
+// requestIDHandler is mux middleware which assigns each request an ID, or propagates the one passed in the X-Request-ID
+// header. The ID is echoed in the response headers and is added to any logs made using log.WithContext
+func requestIDHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("request.id", id))
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, &requestInfo{id: id})))
+	})
+}
+
+// newRequestID returns a random 128-bit hex encoded ID
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// accessLogHandler is mux middleware which writes a single log line for every request once it has been served.
+// Server errors are logged at error level along with the message which was sent to the client
+func accessLogHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		fields := log.Fields{
+			"status_code": recorder.status(),
+			"bytes":       recorder.bytes,
+			"duration_ms": float64(time.Since(start).Microseconds()) / 1000,
+			"method":      r.Method,
+			"url":         getFullPathIncludingQueryParams(r.URL),
+			"route":       routeTemplate(r),
+			"remote_ip":   remoteIP(r),
+			"user_agent":  r.UserAgent(),
+		}
+		if info := requestInfoFromContext(r.Context()); info != nil && info.errorMessage != "" {
+			fields["error"] = info.errorMessage
+		}
+
+		entry := log.WithContext(r.Context()).WithFields(fields)
+		if recorder.status() >= 500 {
+			entry.Error("served request")
+		} else {
+			entry.Info("served request")
+		}
+	})
+}
+
+// remoteIP returns the IP address of the client, without the port
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// requestIDHook adds the request ID to log entries made using log.WithContext, so that all logs for a request can be matched up
+type requestIDHook struct{}
+
+func (requestIDHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (requestIDHook) Fire(entry *log.Entry) error {
+	if entry.Context == nil {
+		return nil
+	}
+	if id := requestIDFromContext(entry.Context); id != "" {
+		entry.Data["request_id"] = id
+	}
+	return nil
+}
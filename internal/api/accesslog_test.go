@@ -0,0 +1,126 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupAccessLogRouter() *mux.Router {
+	env := &Env{UsersDB: newTestMemoryStore()}
+	middleware := []mux.MiddlewareFunc{requestIDHandler, accessLogHandler}
+	router := mux.NewRouter()
+	router.HandleFunc("/users/{logon_name}", env.deleteUser).Methods("DELETE")
+	router.Use(middleware...)
+	router.NotFoundHandler = withMiddleware(http.NotFoundHandler(), middleware)
+	return router
+}
+
+// captureLogs records log entries at info level and above for the duration of the test
+func captureLogs(t *testing.T) *test.Hook {
+	hook := test.NewGlobal()
+	level := log.GetLevel()
+	log.SetLevel(log.InfoLevel)
+	log.AddHook(requestIDHook{})
+	t.Cleanup(func() {
+		log.SetLevel(level)
+		log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+	})
+	return hook
+}
+
+// TestRequestIDGenerated tests that requests without an X-Request-ID are assigned one, which is returned in error responses
+func TestRequestIDGenerated(t *testing.T) {
+	router := setupAccessLogRouter()
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("DELETE", "/users/unknown", nil)
+	router.ServeHTTP(recorder, req)
+
+	id := recorder.Header().Get(requestIDHeader)
+	assert.Regexp(t, regexp.MustCompile(`^[0-9a-f]{32}$`), id)
+
+	var resp Problem
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatal("unable to unmarshal JSON response")
+	}
+	assert.Equal(t, 404, resp.Status)
+	assert.Equal(t, id, resp.RequestID)
+}
+
+// TestRequestIDPropagated tests that a valid X-Request-ID is echoed back, and that an invalid one is replaced
+func TestRequestIDPropagated(t *testing.T) {
+	tests := []struct {
+		requestID string
+		echoed    bool
+	}{
+		{"checkout-7f3a9c", true},
+		{"bad id\nwith newline", false},
+		{string(make([]byte, 129)), false},
+	}
+
+	for _, tc := range tests {
+		router := setupAccessLogRouter()
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("DELETE", "/users/mark9", nil)
+		req.Header.Set(requestIDHeader, tc.requestID)
+		router.ServeHTTP(recorder, req)
+
+		assert.Equal(t, 204, recorder.Code)
+		if tc.echoed {
+			assert.Equal(t, tc.requestID, recorder.Header().Get(requestIDHeader))
+		} else {
+			assert.NotEqual(t, tc.requestID, recorder.Header().Get(requestIDHeader))
+			assert.NotEmpty(t, recorder.Header().Get(requestIDHeader))
+		}
+	}
+}
+
+// TestAccessLog tests that exactly one access log line is written per request, including requests which match no route
+func TestAccessLog(t *testing.T) {
+	hook := captureLogs(t)
+	router := setupAccessLogRouter()
+
+	req, _ := http.NewRequest("DELETE", "/users/mark9", nil)
+	req.Header.Set(requestIDHeader, "req-1")
+	req.Header.Set("User-Agent", "access-log-test")
+	req.RemoteAddr = "10.0.0.5:51234"
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	req, _ = http.NewRequest("DELETE", "/users/unknown", nil)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	req, _ = http.NewRequest("GET", "/not-a-route", nil)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	entries := hook.AllEntries()
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 log entries. Got %d", len(entries))
+	}
+
+	deleted := entries[0]
+	assert.Equal(t, "served request", deleted.Message)
+	assert.Equal(t, 204, deleted.Data["status_code"])
+	assert.Equal(t, "DELETE", deleted.Data["method"])
+	assert.Equal(t, "/users/{logon_name}", deleted.Data["route"])
+	assert.Equal(t, "/users/mark9", deleted.Data["url"])
+	assert.Equal(t, "10.0.0.5", deleted.Data["remote_ip"])
+	assert.Equal(t, "access-log-test", deleted.Data["user_agent"])
+	assert.Equal(t, "req-1", deleted.Data["request_id"])
+	assert.Contains(t, deleted.Data, "duration_ms")
+
+	notFound := entries[1]
+	assert.Equal(t, 404, notFound.Data["status_code"])
+	assert.Equal(t, "'unknown' does not exist. No deletion required", notFound.Data["error"])
+	assert.Greater(t, notFound.Data["bytes"], 0)
+
+	assert.Equal(t, unmatchedRoute, entries[2].Data["route"])
+	assert.Equal(t, 404, entries[2].Data["status_code"])
+}
@@ -0,0 +1,218 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const batchMaxOperations = 100
+
+// errBatchOperationFailed is returned from within a batch transaction to trigger a rollback when an operation fails
+var errBatchOperationFailed = errors.New("batch operation failed")
+
+// batchUsers is an HTTP handler for POST /users:batch
+// When atomic (the default) every operation runs in a single transaction which is rolled back if any of them fail.
+// Otherwise each operation is applied independently and failures do not affect the others
+func (env *Env) batchUsers(w http.ResponseWriter, r *http.Request) {
+	var err error
+	atomic := true
+
+	if atomicParam := r.URL.Query().Get("atomic"); atomicParam != "" {
+		atomic, err = strconv.ParseBool(atomicParam)
+		if err != nil {
+			jsonHTTPErrorResponseWriter(w, r, 400, CodeInvalidQueryParameter, fmt.Sprintf("atomic query string must be either true or false: %v", err))
+			return
+		}
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		jsonHTTPErrorResponseWriter(w, r, 400, CodeInvalidRequestBody, fmt.Sprintf("reading http request body: %v", err))
+		return
+	}
+	batch := BatchRequest{}
+	err = json.Unmarshal(body, &batch)
+	if err != nil {
+		jsonHTTPErrorResponseWriter(w, r, 400, CodeInvalidRequestBody, fmt.Sprintf("unmarshalling http request body: %v", err))
+		return
+	}
+
+	if len(batch.Operations) == 0 || len(batch.Operations) > batchMaxOperations {
+		jsonHTTPErrorResponseWriter(w, r, 400, CodeInvalidBatch, fmt.Sprintf("a batch must contain between 1 and %d operations. Currently %d", batchMaxOperations, len(batch.Operations)))
+		return
+	}
+
+	response := BatchResponse{Atomic: atomic, Committed: true, Results: make([]BatchOperationResult, len(batch.Operations))}
+
+	if atomic {
+		failedIndex := -1
+		err = env.UsersDB.WithTx(r.Context(), func(tx UserStore) error {
+			txEnv := &Env{UsersDB: tx, Validator: env.Validator}
+			for i, op := range batch.Operations {
+				response.Results[i] = txEnv.runBatchOperation(r.Context(), i, op)
+				if response.Results[i].Status >= 400 {
+					failedIndex = i
+					return errBatchOperationFailed
+				}
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, errBatchOperationFailed) {
+			databaseErrorResponseWriter(w, r, err, 500, fmt.Sprintf("running batch transaction: %v", err))
+			return
+		}
+
+		if failedIndex >= 0 {
+			// Nothing was persisted, so report every other operation as not applied
+			response.Committed = false
+			for i, op := range batch.Operations {
+				if i == failedIndex {
+					continue
+				}
+				response.Results[i] = BatchOperationResult{
+					Index:     i,
+					Method:    strings.ToUpper(op.Method),
+					LogonName: batchOperationLogonName(op),
+					Status:    http.StatusFailedDependency,
+					Code:      CodeBatchRolledBack,
+					Message:   fmt.Sprintf("not applied as operation %d failed and the batch was rolled back", failedIndex),
+				}
+			}
+		}
+	} else {
+		for i, op := range batch.Operations {
+			// Each operation still gets its own transaction so that its check and write are applied together
+			err = env.UsersDB.WithTx(r.Context(), func(tx UserStore) error {
+				response.Results[i] = (&Env{UsersDB: tx, Validator: env.Validator}).runBatchOperation(r.Context(), i, op)
+				if response.Results[i].Status >= 400 {
+					return errBatchOperationFailed
+				}
+				return nil
+			})
+			if err != nil && !errors.Is(err, errBatchOperationFailed) {
+				log.WithContext(r.Context()).WithError(err).WithField("index", i).Error("running batch operation transaction")
+				statusCode := databaseErrorStatus(err, 500)
+				response.Results[i] = BatchOperationResult{
+					Index:     i,
+					Method:    strings.ToUpper(op.Method),
+					LogonName: batchOperationLogonName(op),
+					Status:    statusCode,
+					Code:      databaseErrorCode(statusCode, CodeInternalError),
+					Message:   publicErrorMessage(statusCode, err.Error()),
+				}
+			}
+		}
+	}
+
+	statusCode := 200
+	for _, result := range response.Results {
+		if result.Status >= 400 {
+			statusCode = http.StatusMultiStatus
+			break
+		}
+	}
+
+	err = writeJSONHTTPResponse(w, statusCode, response)
+	if err != nil {
+		jsonHTTPErrorResponseWriter(w, r, 500, CodeInternalError, fmt.Sprintf("writing HTTP response: %v", err))
+		return
+	}
+}
+
+// runBatchOperation applies a single batch operation, applying the same validation and returning the same status codes
+// as the POST /users, PUT /users/<logon_name> and DELETE /users/<logon_name> endpoints
+func (env *Env) runBatchOperation(ctx context.Context, index int, op BatchOperation) BatchOperationResult {
+	result := BatchOperationResult{Index: index, Method: strings.ToUpper(op.Method), LogonName: batchOperationLogonName(op)}
+
+	fail := func(statusCode int, code ErrorCode, message string, fieldErrors ...FieldError) BatchOperationResult {
+		if statusCode >= 500 {
+			log.WithContext(ctx).WithField("index", index).Error(message)
+		}
+		result.Status = statusCode
+		result.Code = code
+		result.Message = publicErrorMessage(statusCode, message)
+		result.Errors = fieldErrors
+		return result
+	}
+	failDatabase := func(err error, message string) BatchOperationResult {
+		statusCode := databaseErrorStatus(err, 500)
+		return fail(statusCode, databaseErrorCode(statusCode, CodeInternalError), message)
+	}
+	failValidation := func(err error) BatchOperationResult {
+		var invalid ValidationError
+		if !errors.As(err, &invalid) {
+			return failDatabase(err, err.Error())
+		}
+		code, fieldErrors := fieldErrorDetails(invalid, CodeValidationFailed)
+		return fail(http.StatusUnprocessableEntity, code, invalid.Error(), fieldErrors...)
+	}
+
+	switch result.Method {
+	case http.MethodPost:
+		if err := env.validateUser(ctx, op.User, validateCreate); err != nil {
+			return failValidation(err)
+		}
+		user, err := env.UsersDB.AddUser(ctx, op.User)
+		if errors.Is(err, ErrLogonNameTaken) {
+			return failValidation(ValidationError{Errors: []FieldError{logonNameTakenError(op.User.LogonName)}})
+		}
+		if err != nil {
+			return failDatabase(err, fmt.Sprintf("adding user to DB users table: %v", err))
+		}
+		result.Status = 201
+		result.User = &user
+
+	case http.MethodPut:
+		user := op.User
+		user.LogonName = op.LogonName
+		if err := env.validateUser(ctx, user, validateUpdate); err != nil {
+			if env.userNotFound(ctx, op.LogonName) {
+				return fail(404, CodeUserNotFound, fmt.Sprintf("'%s' does not exist. No action required", op.LogonName))
+			}
+			return failValidation(err)
+		}
+		user, err := env.UsersDB.UpdateUser(ctx, user)
+		if errors.Is(err, ErrUserNotFound) {
+			return fail(404, CodeUserNotFound, fmt.Sprintf("'%s' does not exist. No action required", op.LogonName))
+		}
+		if err != nil {
+			return failDatabase(err, fmt.Sprintf("updating record for user '%s' in DB: %v", op.LogonName, err))
+		}
+		result.Status = 200
+		result.User = &user
+
+	case http.MethodDelete:
+		if op.LogonName == "" {
+			return failValidation(ValidationError{Errors: []FieldError{requiredFieldError("logon_name")}})
+		}
+		err := env.UsersDB.DeleteUser(ctx, op.LogonName)
+		if errors.Is(err, ErrUserNotFound) {
+			return fail(404, CodeUserNotFound, fmt.Sprintf("'%s' does not exist. No deletion required", op.LogonName))
+		}
+		if err != nil {
+			return failDatabase(err, fmt.Sprintf("deleting user from DB: %v", err))
+		}
+		result.Status = 204
+
+	default:
+		return fail(400, CodeUnsupportedMethod, fmt.Sprintf("method '%s' is not supported. Must be one of POST, PUT or DELETE", op.Method))
+	}
+
+	return result
+}
+
+// batchOperationLogonName returns the logon_name which a batch operation targets
+func batchOperationLogonName(op BatchOperation) string {
+	if op.LogonName != "" {
+		return op.LogonName
+	}
+	return op.User.LogonName
+}
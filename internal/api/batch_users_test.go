@@ -0,0 +1,140 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestMemoryStore returns an in-memory store seeded with two users. Changes are only kept if a transaction succeeds
+func newTestMemoryStore() *MemoryUserModel {
+	return NewMemoryUserModel(
+		User{UserID: 1, LogonName: "mark9", FullName: "mark", Email: "mark@email.com"},
+		User{UserID: 2, LogonName: "bob44", FullName: "bob", Email: "bob@email.com"},
+	)
+}
+
+// userExists reports whether logonName is in store
+func userExists(t *testing.T, store UserStore, logonName string) bool {
+	count, err := store.QueryRecordCount(context.Background(), "", logonName)
+	if err != nil {
+		t.Fatalf("counting users: %v", err)
+	}
+	return count == 1
+}
+
+func setupMockBatchUsersHTTPHandler(t *testing.T, model UserStore, url string, batch BatchRequest) (*httptest.ResponseRecorder, BatchResponse) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(batch); err != nil {
+		t.Fatal("unable to encode into buffer")
+	}
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", url, &buf)
+	env := &Env{UsersDB: model}
+	http.HandlerFunc(env.batchUsers).ServeHTTP(recorder, req)
+
+	var resp BatchResponse
+	_ = json.Unmarshal(recorder.Body.Bytes(), &resp)
+	return recorder, resp
+}
+
+// TestBatchUsersAtomicSuccess tests a mixture of operations which all succeed and are committed together
+func TestBatchUsersAtomicSuccess(t *testing.T) {
+	model := newTestMemoryStore()
+	rec, resp := setupMockBatchUsersHTTPHandler(t, model, "/users:batch", BatchRequest{Operations: []BatchOperation{
+		{Method: "POST", User: User{LogonName: "testuser1", FullName: "Test User 1", Email: "test1@email.com"}},
+		{Method: "put", LogonName: "mark9", User: User{Email: "mark.updated@email.com"}},
+		{Method: "DELETE", LogonName: "bob44"},
+	}})
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.True(t, resp.Atomic)
+	assert.True(t, resp.Committed)
+	assert.Equal(t, 3, len(resp.Results))
+	assert.Equal(t, 201, resp.Results[0].Status)
+	assert.Equal(t, 3, resp.Results[0].User.UserID)
+	assert.Equal(t, 200, resp.Results[1].Status)
+	assert.Equal(t, "PUT", resp.Results[1].Method)
+	assert.Equal(t, "mark.updated@email.com", resp.Results[1].User.Email)
+	assert.Equal(t, 204, resp.Results[2].Status)
+
+	assert.True(t, userExists(t, model, "testuser1"))
+	assert.False(t, userExists(t, model, "bob44"))
+}
+
+// TestBatchUsersAtomicRollback tests that a failing operation rolls back the whole batch
+func TestBatchUsersAtomicRollback(t *testing.T) {
+	model := newTestMemoryStore()
+	rec, resp := setupMockBatchUsersHTTPHandler(t, model, "/users:batch?atomic=true", BatchRequest{Operations: []BatchOperation{
+		{Method: "POST", User: User{LogonName: "testuser1", FullName: "Test User 1", Email: "test1@email.com"}},
+		{Method: "DELETE", LogonName: "doesnotexist"},
+		{Method: "DELETE", LogonName: "bob44"},
+	}})
+
+	assert.Equal(t, http.StatusMultiStatus, rec.Code)
+	assert.False(t, resp.Committed)
+	assert.Equal(t, http.StatusFailedDependency, resp.Results[0].Status)
+	assert.Equal(t, 404, resp.Results[1].Status)
+	assert.Equal(t, "'doesnotexist' does not exist. No deletion required", resp.Results[1].Message)
+	assert.Equal(t, http.StatusFailedDependency, resp.Results[2].Status)
+
+	assert.False(t, userExists(t, model, "testuser1"))
+	assert.True(t, userExists(t, model, "bob44"))
+}
+
+// TestBatchUsersNonAtomic tests that failures are isolated to the failing operation when atomic=false
+func TestBatchUsersNonAtomic(t *testing.T) {
+	model := newTestMemoryStore()
+	rec, resp := setupMockBatchUsersHTTPHandler(t, model, "/users:batch?atomic=false", BatchRequest{Operations: []BatchOperation{
+		{Method: "POST", User: User{LogonName: "testuser1", FullName: "Test User 1", Email: "test1@email.com"}},
+		{Method: "POST", User: User{LogonName: "testuser1", FullName: "Test User 1 Again", Email: "test1@email.com"}},
+		{Method: "PUT", LogonName: "bob44", User: User{Email: "bad.email@"}},
+		{Method: "DELETE", LogonName: "bob44"},
+	}})
+
+	assert.Equal(t, http.StatusMultiStatus, rec.Code)
+	assert.False(t, resp.Atomic)
+	assert.Equal(t, 201, resp.Results[0].Status)
+	assert.Equal(t, 422, resp.Results[1].Status)
+	assert.Equal(t, "logon_name 'testuser1' already taken. Please choose another one", resp.Results[1].Message)
+	assert.Equal(t, 422, resp.Results[2].Status)
+	assert.Contains(t, resp.Results[2].Message, "not a valid email address field")
+	assert.Equal(t, CodeInvalidEmail, resp.Results[2].Code)
+	assert.Equal(t, 204, resp.Results[3].Status)
+
+	assert.True(t, userExists(t, model, "testuser1"))
+	assert.False(t, userExists(t, model, "bob44"))
+}
+
+// TestBatchUsersUnsupportedMethod tests an operation with a method other than POST, PUT or DELETE
+func TestBatchUsersUnsupportedMethod(t *testing.T) {
+	_, resp := setupMockBatchUsersHTTPHandler(t, newTestMemoryStore(), "/users:batch", BatchRequest{Operations: []BatchOperation{
+		{Method: "PATCH", LogonName: "mark9"},
+	}})
+
+	assert.Equal(t, 400, resp.Results[0].Status)
+	assert.Contains(t, resp.Results[0].Message, "method 'PATCH' is not supported")
+}
+
+// TestBatchUsersInvalidRequests tests batches which are rejected before any operation is run
+func TestBatchUsersInvalidRequests(t *testing.T) {
+	rec, _ := setupMockBatchUsersHTTPHandler(t, newTestMemoryStore(), "/users:batch", BatchRequest{})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec, _ = setupMockBatchUsersHTTPHandler(t, newTestMemoryStore(), "/users:batch?atomic=maybe", BatchRequest{Operations: []BatchOperation{
+		{Method: "DELETE", LogonName: "mark9"},
+	}})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	tooMany := BatchRequest{}
+	for i := 0; i <= batchMaxOperations; i++ {
+		tooMany.Operations = append(tooMany.Operations, BatchOperation{Method: "DELETE", LogonName: "mark9"})
+	}
+	rec, _ = setupMockBatchUsersHTTPHandler(t, newTestMemoryStore(), "/users:batch", tooMany)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
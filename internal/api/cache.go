@@ -0,0 +1,382 @@
+package api
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultCacheMaxEntries   = 10000
+	defaultCacheMaxStaleness = time.Second * 5
+
+	cacheUsers = "user"
+	cachePages = "page"
+
+	invalidationLocal        = "local"
+	invalidationNotification = "notification"
+)
+
+// CacheConfig configures the optional in-process cache of user reads
+type CacheConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// MaxEntries bounds each of the single user and page caches. The least recently used entries are evicted first
+	MaxEntries int `yaml:"max_entries"`
+	// MaxStaleness is the oldest a cached read can be. Entries expire once this long has passed since they were read from
+	// the database, even if an invalidation was missed
+	MaxStaleness time.Duration `yaml:"max_staleness"`
+}
+
+type lruEntry[V any] struct {
+	key     string
+	value   V
+	expires time.Time
+}
+
+// lruCache is a size bounded cache whose entries expire after ttl. Every invalidation bumps its generation, and reads which
+// started in an earlier generation aren't stored, so that a read which raced with a write can't put stale data back
+type lruCache[V any] struct {
+	maxEntries int
+	ttl        time.Duration
+	now        func() time.Time // replaced in tests
+
+	mu         sync.Mutex
+	entries    map[string]*list.Element
+	order      *list.List // most recently used at the front
+	generation uint64
+}
+
+func newLRUCache[V any](maxEntries int, ttl time.Duration) *lruCache[V] {
+	return &lruCache[V]{maxEntries: maxEntries, ttl: ttl, now: time.Now, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// get returns the value for key, if it is cached and hasn't expired
+func (c *lruCache[V]) get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var zero V
+	element, ok := c.entries[key]
+	if !ok {
+		return zero, false
+	}
+	entry := element.Value.(*lruEntry[V])
+	if !c.now().Before(entry.expires) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return zero, false
+	}
+	c.order.MoveToFront(element)
+	return entry.value, true
+}
+
+// begin must be called before reading a value from the database. The returned time and generation are passed to put
+func (c *lruCache[V]) begin() (time.Time, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now(), c.generation
+}
+
+// put caches value until ttl after readAt. It is dropped if the cache has been invalidated since generation
+func (c *lruCache[V]) put(key string, value V, readAt time.Time, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+	entry := &lruEntry[V]{key: key, value: value, expires: readAt.Add(c.ttl)}
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry[V]).key)
+	}
+}
+
+// remove invalidates the entries for keys
+func (c *lruCache[V]) remove(keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	for _, key := range keys {
+		if element, ok := c.entries[key]; ok {
+			c.order.Remove(element)
+			delete(c.entries, key)
+		}
+	}
+}
+
+// clear invalidates every entry
+func (c *lruCache[V]) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	clear(c.entries)
+	c.order.Init()
+}
+
+func (c *lruCache[V]) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// UsersCache caches single user and page reads in front of a UserStore. The users written through it are invalidated
+// straight away. Writes made by other replicas are invalidated by Run, which follows the change feed, and MaxStaleness bounds
+// how long a missed invalidation can go unnoticed. Any change clears every cached page, as it could move users between pages
+type UsersCache struct {
+	next  UserStore
+	users *lruCache[User]
+	pages *lruCache[UsersPage]
+
+	onLookup     func(cache string, hit bool) // optional
+	onInvalidate func(source string)          // optional
+}
+
+// NewUsersCache returns a cache in front of store. metrics is optional
+func NewUsersCache(store UserStore, cfg CacheConfig, metrics *Metrics) *UsersCache {
+	c := &UsersCache{
+		next:  store,
+		users: newLRUCache[User](cfg.MaxEntries, cfg.MaxStaleness),
+		pages: newLRUCache[UsersPage](cfg.MaxEntries, cfg.MaxStaleness),
+	}
+	if metrics != nil {
+		c.onLookup = metrics.observeCacheLookup
+		c.onInvalidate = metrics.observeCacheInvalidation
+		metrics.registerCache(c)
+	}
+	return c
+}
+
+// enableCache puts a UsersCache in front of e.UsersDB, if cfg enables it. It must be called once UsersDB is fully wrapped,
+// so that cache hits skip the database metrics, timeouts and retries
+func (e *Env) enableCache(cfg CacheConfig) {
+	if !cfg.Enabled {
+		return
+	}
+	e.Cache = NewUsersCache(e.UsersDB, cfg, e.Metrics)
+	e.UsersDB = e.Cache
+}
+
+// cacheable returns false for reads which must go to the database. A client which passed a consistency token wants to read
+// its own write, which may have been made through another replica whose invalidation hasn't arrived yet
+func cacheable(ctx context.Context) bool {
+	return ctx.Value(consistencyTokenKey{}) == nil
+}
+
+func (c *UsersCache) lookup(cache string, hit bool) {
+	if c.onLookup != nil {
+		c.onLookup(cache, hit)
+	}
+}
+
+// invalidate removes the users with logonNames and clears every cached page
+func (c *UsersCache) invalidate(source string, logonNames ...string) {
+	c.users.remove(logonNames...)
+	c.pages.clear()
+	if c.onInvalidate != nil {
+		c.onInvalidate(source)
+	}
+}
+
+// cachedPage returns the page for key from the cache, or from read if it isn't cached. The whole page is kept, with its
+// users copied so that callers can't change the cached ones
+func (c *UsersCache) cachedPage(ctx context.Context, key string, read func() (UsersPage, error)) (UsersPage, error) {
+	if !cacheable(ctx) {
+		return read()
+	}
+	if page, ok := c.pages.get(key); ok {
+		c.lookup(cachePages, true)
+		page.Users = slices.Clone(page.Users)
+		return page, nil
+	}
+	c.lookup(cachePages, false)
+
+	readAt, generation := c.pages.begin()
+	page, err := read()
+	if err == nil {
+		cached := page
+		cached.Users = slices.Clone(page.Users)
+		c.pages.put(key, cached, readAt, generation)
+	}
+	return page, err
+}
+
+// GetUser caches users which exist. Lookups of users which don't exist always go to the database, so that a user is
+// found as soon as it has been added
+func (c *UsersCache) GetUser(ctx context.Context, logonName string) (User, error) {
+	if !cacheable(ctx) {
+		return c.next.GetUser(ctx, logonName)
+	}
+	if user, ok := c.users.get(logonName); ok {
+		c.lookup(cacheUsers, true)
+		return user, nil
+	}
+	c.lookup(cacheUsers, false)
+
+	readAt, generation := c.users.begin()
+	user, err := c.next.GetUser(ctx, logonName)
+	if err == nil {
+		c.users.put(logonName, user, readAt, generation)
+	}
+	return user, err
+}
+
+func (c *UsersCache) QueryUsers(ctx context.Context, offset, limit int, nameFilter string) (UsersPage, error) {
+	// The filter is last, so that it can't be confused with the other parts of the key
+	key := fmt.Sprintf("list|%d|%d|%s", offset, limit, nameFilter)
+	return c.cachedPage(ctx, key, func() (UsersPage, error) {
+		return c.next.QueryUsers(ctx, offset, limit, nameFilter)
+	})
+}
+
+func (c *UsersCache) SearchUsers(ctx context.Context, query string, minScore float64, offset, limit int) (UsersPage, error) {
+	key := fmt.Sprintf("search|%g|%d|%d|%s", minScore, offset, limit, query)
+	return c.cachedPage(ctx, key, func() (UsersPage, error) {
+		return c.next.SearchUsers(ctx, query, minScore, offset, limit)
+	})
+}
+
+// QueryRecordCount isn't cached, as it checks whether a logon_name is free before adding a user
+func (c *UsersCache) QueryRecordCount(ctx context.Context, nameFilter, logonNameFilter string) (int, error) {
+	return c.next.QueryRecordCount(ctx, nameFilter, logonNameFilter)
+}
+
+// StreamUsers isn't cached, as exports are too large to hold in memory
+func (c *UsersCache) StreamUsers(ctx context.Context, nameFilter string, fn func(User) error) error {
+	return c.next.StreamUsers(ctx, nameFilter, fn)
+}
+
+// The writes invalidate their user whether or not they succeed, as a write which failed with a transient error may still
+// have been committed
+
+func (c *UsersCache) AddUser(ctx context.Context, user User) (User, error) {
+	defer c.invalidate(invalidationLocal, user.LogonName)
+	return c.next.AddUser(ctx, user)
+}
+
+func (c *UsersCache) DeleteUser(ctx context.Context, logonName string) error {
+	defer c.invalidate(invalidationLocal, logonName)
+	return c.next.DeleteUser(ctx, logonName)
+}
+
+func (c *UsersCache) UpdateUser(ctx context.Context, user User) (User, error) {
+	defer c.invalidate(invalidationLocal, user.LogonName)
+	return c.next.UpdateUser(ctx, user)
+}
+
+// WithTx invalidates every user written within the transaction once it has finished. Reads within the transaction aren't cached
+func (c *UsersCache) WithTx(ctx context.Context, fn func(UserStore) error) error {
+	var written []string
+	defer func() { c.invalidate(invalidationLocal, written...) }()
+	return c.next.WithTx(ctx, func(tx UserStore) error {
+		return fn(&writeRecorder{UserStore: tx, written: &written})
+	})
+}
+
+// writeRecorder records the logon_names written through a transaction's UserStore
+type writeRecorder struct {
+	UserStore
+	written *[]string
+}
+
+func (r *writeRecorder) AddUser(ctx context.Context, user User) (User, error) {
+	*r.written = append(*r.written, user.LogonName)
+	return r.UserStore.AddUser(ctx, user)
+}
+
+func (r *writeRecorder) DeleteUser(ctx context.Context, logonName string) error {
+	*r.written = append(*r.written, logonName)
+	return r.UserStore.DeleteUser(ctx, logonName)
+}
+
+func (r *writeRecorder) UpdateUser(ctx context.Context, user User) (User, error) {
+	*r.written = append(*r.written, user.LogonName)
+	return r.UserStore.UpdateUser(ctx, user)
+}
+
+func (r *writeRecorder) WithTx(ctx context.Context, fn func(UserStore) error) error {
+	return r.UserStore.WithTx(ctx, func(tx UserStore) error {
+		return fn(&writeRecorder{UserStore: tx, written: r.written})
+	})
+}
+
+// Run invalidates the users changed by any replica until ctx is cancelled. It is woken by the change feed, and reads the
+// events since the position of the last one it saw to find which users changed. Events which can't be read clear the whole cache
+func (c *UsersCache) Run(ctx context.Context, feed *ChangeFeed) {
+	wake, unsubscribe := feed.subscribe()
+	defer unsubscribe()
+
+	lastPosition, err := feed.Store.latestPosition(ctx)
+	if err != nil {
+		log.WithError(err).Error("querying latest event position for the users cache. Clearing the cache on every change")
+		lastPosition = -1
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-wake:
+			lastPosition = c.invalidateSince(ctx, feed.Store, lastPosition)
+		}
+	}
+}
+
+// invalidateSince invalidates the users in every event after lastPosition, returning the position of the last event read.
+// A negative lastPosition means the last event isn't known, so the whole cache is cleared instead
+func (c *UsersCache) invalidateSince(ctx context.Context, store changeStore, lastPosition int64) int64 {
+	if lastPosition < 0 {
+		c.clear()
+		latest, err := store.latestPosition(ctx)
+		if err != nil {
+			return -1
+		}
+		return latest
+	}
+
+	var changed []string
+	for {
+		events, err := store.queryEventsSince(ctx, lastPosition, changeFeedBatchSize)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.WithError(err).Error("reading user events to invalidate the users cache. Clearing the cache")
+			}
+			c.clear()
+			return -1
+		}
+		for _, event := range events {
+			changed = append(changed, event.LogonName)
+			lastPosition = event.Position
+		}
+		if len(events) < changeFeedBatchSize {
+			break
+		}
+	}
+	if len(changed) > 0 {
+		c.invalidate(invalidationNotification, changed...)
+	}
+	return lastPosition
+}
+
+// clear invalidates every cached read
+func (c *UsersCache) clear() {
+	c.users.clear()
+	c.pages.clear()
+	if c.onInvalidate != nil {
+		c.onInvalidate(invalidationNotification)
+	}
+}
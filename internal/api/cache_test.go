@@ -0,0 +1,290 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingUsersStore counts the reads which reach the wrapped UserStore
+type countingUsersStore struct {
+	UserStore
+	mu    sync.Mutex
+	reads int
+}
+
+func (s *countingUsersStore) count() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reads++
+}
+
+func (s *countingUsersStore) readCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reads
+}
+
+func (s *countingUsersStore) GetUser(ctx context.Context, logonName string) (User, error) {
+	s.count()
+	return s.UserStore.GetUser(ctx, logonName)
+}
+
+func (s *countingUsersStore) QueryUsers(ctx context.Context, offset, limit int, nameFilter string) (UsersPage, error) {
+	s.count()
+	return s.UserStore.QueryUsers(ctx, offset, limit, nameFilter)
+}
+
+func (s *countingUsersStore) SearchUsers(ctx context.Context, query string, minScore float64, offset, limit int) (UsersPage, error) {
+	s.count()
+	return s.UserStore.SearchUsers(ctx, query, minScore, offset, limit)
+}
+
+// mockCacheChangeStore returns the user events recorded by other replicas
+type mockCacheChangeStore struct {
+	mu     sync.Mutex
+	events []UserEvent
+	err    error
+}
+
+func (m *mockCacheChangeStore) queryEventsSince(_ context.Context, afterPosition int64, limit int) ([]UserEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	events := make([]UserEvent, 0)
+	for _, event := range m.events {
+		if event.Position > afterPosition && len(events) < limit {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+func (m *mockCacheChangeStore) latestPosition(_ context.Context) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.events) == 0 {
+		return 0, nil
+	}
+	return m.events[len(m.events)-1].Position, nil
+}
+
+func (m *mockCacheChangeStore) record(logonName string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events = append(m.events, UserEvent{EventID: int64(len(m.events) + 1), Position: int64(len(m.events) + 1), EventType: EventUserUpdated, LogonName: logonName})
+}
+
+func setupTestCache(users ...User) (*UsersCache, *countingUsersStore, *MemoryUserModel) {
+	memory := NewMemoryUserModel(users...)
+	counting := &countingUsersStore{UserStore: memory}
+	return NewUsersCache(counting, CacheConfig{Enabled: true, MaxEntries: 10, MaxStaleness: time.Minute}, nil), counting, memory
+}
+
+var cacheTestUser = User{LogonName: "mark9", FullName: "mark", Email: "mark@email.com"}
+
+// TestUsersCacheHits tests that repeated reads are served from the cache, and that misses and reads with a consistency
+// token go to the store
+func TestUsersCacheHits(t *testing.T) {
+	cache, counting, _ := setupTestCache(cacheTestUser)
+	ctx := context.Background()
+
+	for range 3 {
+		user, err := cache.GetUser(ctx, "mark9")
+		assert.NoError(t, err)
+		assert.Equal(t, "mark@email.com", user.Email)
+		page, err := cache.QueryUsers(ctx, 0, 10, "")
+		assert.NoError(t, err)
+		assert.Equal(t, 1, page.Total)
+	}
+	assert.Equal(t, 2, counting.readCount())
+
+	for range 2 {
+		_, err := cache.GetUser(ctx, "missing")
+		assert.ErrorIs(t, err, ErrUserNotFound)
+	}
+	assert.Equal(t, 4, counting.readCount(), "users which don't exist should not be cached")
+
+	_, err := cache.GetUser(context.WithValue(ctx, consistencyTokenKey{}, "0/1"), "mark9")
+	assert.NoError(t, err)
+	assert.Equal(t, 5, counting.readCount(), "reads with a consistency token should skip the cache")
+}
+
+// TestUsersCacheCopiesPages tests that callers can't modify the cached pages
+func TestUsersCacheCopiesPages(t *testing.T) {
+	cache, _, _ := setupTestCache(cacheTestUser)
+
+	page, err := cache.QueryUsers(context.Background(), 0, 10, "")
+	assert.NoError(t, err)
+	page.Users[0].Email = "changed@email.com"
+
+	page, err = cache.QueryUsers(context.Background(), 0, 10, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "mark@email.com", page.Users[0].Email)
+}
+
+// TestUsersCacheLocalInvalidation tests that writes, including those made within a transaction, invalidate the cache
+func TestUsersCacheLocalInvalidation(t *testing.T) {
+	cache, _, _ := setupTestCache(cacheTestUser)
+	ctx := context.Background()
+
+	_, _ = cache.GetUser(ctx, "mark9")
+	_, _ = cache.QueryUsers(ctx, 0, 10, "")
+	_, err := cache.UpdateUser(ctx, User{LogonName: "mark9", Email: "new@email.com"})
+	assert.NoError(t, err)
+
+	user, err := cache.GetUser(ctx, "mark9")
+	assert.NoError(t, err)
+	assert.Equal(t, "new@email.com", user.Email)
+	page, err := cache.QueryUsers(ctx, 0, 10, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "new@email.com", page.Users[0].Email)
+
+	err = cache.WithTx(ctx, func(tx UserStore) error {
+		return tx.WithTx(ctx, func(nested UserStore) error {
+			return nested.DeleteUser(ctx, "mark9")
+		})
+	})
+	assert.NoError(t, err)
+	_, err = cache.GetUser(ctx, "mark9")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+	page, err = cache.QueryUsers(ctx, 0, 10, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, page.Total)
+}
+
+// TestUsersCacheNotificationInvalidation tests that users changed by other replicas are invalidated once the change feed
+// wakes the cache up
+func TestUsersCacheNotificationInvalidation(t *testing.T) {
+	cache, counting, memory := setupTestCache(cacheTestUser, User{LogonName: "bob1", FullName: "bob", Email: "bob@email.com"})
+	changes := &mockCacheChangeStore{}
+	feed := &ChangeFeed{Store: changes}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Wait until Run has subscribed, so that the wake-up below isn't missed
+	go cache.Run(ctx, feed)
+	assert.Eventually(t, func() bool {
+		feed.mu.Lock()
+		defer feed.mu.Unlock()
+		return len(feed.subscribers) == 1
+	}, time.Second, time.Millisecond)
+
+	_, _ = cache.GetUser(ctx, "mark9")
+	_, _ = cache.GetUser(ctx, "bob1")
+	assert.Equal(t, 2, counting.readCount())
+
+	// Another replica updates mark9
+	_, err := memory.UpdateUser(ctx, User{LogonName: "mark9", Email: "new@email.com"})
+	assert.NoError(t, err)
+	changes.record("mark9")
+	feed.notify()
+
+	assert.Eventually(t, func() bool {
+		user, err := cache.GetUser(ctx, "mark9")
+		return err == nil && user.Email == "new@email.com"
+	}, time.Second, time.Millisecond)
+	reads := counting.readCount()
+	_, _ = cache.GetUser(ctx, "bob1")
+	assert.Equal(t, reads, counting.readCount(), "users which didn't change should stay cached")
+}
+
+// TestUsersCacheInvalidateSinceError tests that the whole cache is cleared when the changed users can't be read
+func TestUsersCacheInvalidateSinceError(t *testing.T) {
+	cache, counting, _ := setupTestCache(cacheTestUser)
+	changes := &mockCacheChangeStore{err: assert.AnError}
+	ctx := context.Background()
+
+	_, _ = cache.GetUser(ctx, "mark9")
+	assert.Equal(t, int64(-1), cache.invalidateSince(ctx, changes, 5))
+	_, _ = cache.GetUser(ctx, "mark9")
+	assert.Equal(t, 2, counting.readCount())
+
+	changes.err = nil
+	changes.record("bob1")
+	assert.Equal(t, int64(1), cache.invalidateSince(ctx, changes, -1))
+}
+
+// TestLRUCacheExpiry tests that entries are never served once MaxStaleness has passed since they were read
+func TestLRUCacheExpiry(t *testing.T) {
+	now := time.Now()
+	cache := newLRUCache[int](10, time.Second)
+	cache.now = func() time.Time { return now }
+
+	readAt, generation := cache.begin()
+	now = now.Add(time.Millisecond * 600) // the read took a while
+	cache.put("a", 1, readAt, generation)
+
+	_, ok := cache.get("a")
+	assert.True(t, ok)
+	now = now.Add(time.Millisecond * 400)
+	_, ok = cache.get("a")
+	assert.False(t, ok, "the entry should expire a second after the read started")
+	assert.Equal(t, 0, cache.len())
+}
+
+// TestLRUCacheEviction tests that the least recently used entry is evicted once the cache is full
+func TestLRUCacheEviction(t *testing.T) {
+	cache := newLRUCache[int](2, time.Minute)
+	put := func(key string, value int) {
+		readAt, generation := cache.begin()
+		cache.put(key, value, readAt, generation)
+	}
+
+	put("a", 1)
+	put("b", 2)
+	_, _ = cache.get("a")
+	put("c", 3)
+
+	_, ok := cache.get("b")
+	assert.False(t, ok)
+	for _, key := range []string{"a", "c"} {
+		_, ok = cache.get(key)
+		assert.True(t, ok, key)
+	}
+}
+
+// TestLRUCacheRacingRead tests that a read which started before an invalidation isn't cached, as it may be older than the write
+func TestLRUCacheRacingRead(t *testing.T) {
+	cache := newLRUCache[int](10, time.Minute)
+
+	readAt, generation := cache.begin()
+	cache.remove("a")
+	cache.put("a", 1, readAt, generation)
+
+	_, ok := cache.get("a")
+	assert.False(t, ok)
+}
+
+// TestUsersCacheMetrics tests that hits, misses, invalidations and the number of entries are exported
+func TestUsersCacheMetrics(t *testing.T) {
+	metrics := NewMetrics(nil)
+	cache := NewUsersCache(NewMemoryUserModel(cacheTestUser), CacheConfig{Enabled: true, MaxEntries: 10, MaxStaleness: time.Minute}, metrics)
+	env := &Env{UsersDB: cache}
+	router := mux.NewRouter()
+	router.HandleFunc("/users/{logon_name}", env.getUser).Methods("GET")
+	router.Handle("/metrics", metrics.handler()).Methods("GET")
+
+	for range 3 {
+		req, _ := http.NewRequest("GET", "/users/mark9", nil)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	body := scrapeMetrics(t, router)
+	assert.Contains(t, body, `user_mgmt_cache_requests_total{cache="user",result="hit"} 2`)
+	assert.Contains(t, body, `user_mgmt_cache_requests_total{cache="user",result="miss"} 1`)
+	assert.Contains(t, body, `user_mgmt_cache_entries{cache="user"} 1`)
+	assert.Contains(t, body, `user_mgmt_cache_entries{cache="page"} 0`)
+
+	assert.NoError(t, cache.DeleteUser(context.Background(), "mark9"))
+	body = scrapeMetrics(t, router)
+	assert.Contains(t, body, `user_mgmt_cache_invalidations_total{source="local"} 1`)
+	assert.Contains(t, body, `user_mgmt_cache_entries{cache="user"} 0`)
+}
@@ -0,0 +1,360 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	changeFeedChannel       = "user_changes"
+	changeFeedBatchSize     = 100
+	changeFeedHeartbeat     = time.Second * 15
+	changeFeedRetryMillis   = 3000
+	changeFeedListenerPing  = time.Second * 90
+	changeFeedMinReconnect  = time.Second * 10
+	changeFeedMaxReconnect  = time.Minute
+	lastEventIDHeader       = "Last-Event-ID"
+	changeFeedSinceQueryKey = "since"
+
+	// changeFeedSequencedChannel is notified once newly committed events have been given their feed positions
+	changeFeedSequencedChannel = "user_changes_sequenced"
+	// changeFeedSequencerInterval is how often the sequencer assigns positions when it hasn't been woken by a notification
+	changeFeedSequencerInterval = time.Second
+	// changeFeedSequencerRetry is how often a replica which isn't sequencing tries to take over
+	changeFeedSequencerRetry = time.Second * 5
+	// changeFeedSequencerLockID is an arbitrary key for the Postgres advisory lock held by the replica which assigns feed positions
+	changeFeedSequencerLockID = 732585
+)
+
+// changeStore reads the persistent sequence of user events which backs the change feed. Events are read by their feed
+// position, which follows the order the events were committed in rather than their event_id
+type changeStore interface {
+	// queryEventsSince returns up to limit events with a position greater than afterPosition, in order
+	queryEventsSince(ctx context.Context, afterPosition int64, limit int) ([]UserEvent, error)
+	latestPosition(ctx context.Context) (int64, error)
+}
+
+// eventSequencer gives newly committed events their feed positions
+type eventSequencer interface {
+	// runSequencer assigns positions whenever wake fires, until ctx is cancelled or it fails. Only one replica sequences at a
+	// time, so it returns nil straight away if another one already is
+	runSequencer(ctx context.Context, wake <-chan struct{}) error
+}
+
+// changeListener receives the Postgres notifications for the change feed. It is a *pq.Listener outside of tests
+type changeListener interface {
+	Listen(channel string) error
+	Ping() error
+	Close() error
+	NotificationChannel() <-chan *pq.Notification
+}
+
+// newPQListener returns a pq.Listener for connectionString, which logs its connection errors
+func newPQListener(connectionString string) changeListener {
+	return pq.NewListener(connectionString, changeFeedMinReconnect, changeFeedMaxReconnect, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.WithError(err).WithField("event", event).Error("change feed listener connection")
+		}
+	})
+}
+
+// ChangeFeed wakes up the connected change stream clients whenever user events have been given their feed positions.
+// Every replica LISTENs on the same Postgres channels, so each one hears about changes made by any other. Newly recorded
+// events wake the Sequencer, which runs on one replica at a time and announces the positions it assigns to every replica
+type ChangeFeed struct {
+	Store changeStore
+	// Sequencer, when set, is run alongside the listener to assign feed positions
+	Sequencer eventSequencer
+	// ConnectionString returns the current connection string, which changes when the database password is rotated
+	ConnectionString func() string
+
+	mu          sync.Mutex
+	subscribers map[chan struct{}]struct{}
+	stopped     chan struct{}
+	recorded    chan struct{} // wakes the sequencer
+
+	newListener  func(connectionString string) changeListener // replaced in tests
+	pingInterval time.Duration                                // replaced in tests
+	listenRetry  time.Duration                                // the first delay before retrying a failed LISTEN. Replaced in tests
+}
+
+// done returns a channel which is closed once Run has stopped, so that open streams end and don't hold up a graceful shutdown
+func (f *ChangeFeed) done() <-chan struct{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.stopped == nil {
+		f.stopped = make(chan struct{})
+	}
+	return f.stopped
+}
+
+// subscribe registers for wake-ups. The returned function must be called to unsubscribe
+func (f *ChangeFeed) subscribe() (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	f.mu.Lock()
+	if f.subscribers == nil {
+		f.subscribers = make(map[chan struct{}]struct{})
+	}
+	f.subscribers[ch] = struct{}{}
+	f.mu.Unlock()
+
+	return ch, func() {
+		f.mu.Lock()
+		delete(f.subscribers, ch)
+		f.mu.Unlock()
+	}
+}
+
+// notify wakes up every subscriber. Subscribers which already have a wake-up pending are skipped, as they will read
+// every new event regardless
+func (f *ChangeFeed) notify() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for ch := range f.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// wakeSequencer wakes the sequencer, unless a wake-up is already pending
+func (f *ChangeFeed) wakeSequencer() {
+	select {
+	case f.recorded <- struct{}{}:
+	default:
+	}
+}
+
+// Run listens for Postgres notifications, and runs the Sequencer if there is one, until ctx is cancelled
+func (f *ChangeFeed) Run(ctx context.Context) {
+	_ = f.done()
+	f.recorded = make(chan struct{}, 1)
+	var sequencing sync.WaitGroup
+	defer func() {
+		sequencing.Wait()
+		f.mu.Lock()
+		close(f.stopped)
+		f.mu.Unlock()
+		log.Info("Change feed listener stopped")
+	}()
+
+	if f.Sequencer != nil {
+		sequencing.Add(1)
+		go func() {
+			defer sequencing.Done()
+			f.sequence(ctx)
+		}()
+	}
+
+	retry := f.listenRetry
+	if retry == 0 {
+		retry = changeFeedMinReconnect
+	}
+	backoff := retry
+	for ctx.Err() == nil {
+		if err := f.listen(ctx); err != nil {
+			// Streams still pick up changes on every heartbeat in the meantime
+			log.WithError(err).Errorf("listening for user changes. Retrying in %s, with the change feed polling until then", backoff)
+			select {
+			case <-ctx.Done():
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, changeFeedMaxReconnect)
+			continue
+		}
+		backoff = retry
+	}
+}
+
+// sequence runs the Sequencer until ctx is cancelled. A replica which isn't sequencing keeps trying to take over, so that
+// another one carries on if the replica which was sequencing stops
+func (f *ChangeFeed) sequence(ctx context.Context) {
+	for ctx.Err() == nil {
+		if err := f.Sequencer.runSequencer(ctx, f.recorded); err != nil && ctx.Err() == nil {
+			log.WithError(err).Error("assigning change feed positions")
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(changeFeedSequencerRetry):
+		}
+	}
+}
+
+// listen listens for Postgres notifications until ctx is cancelled, or the listener has lost its connection and the
+// database credentials have changed since it was started. The listener reconnects with the credentials it was created with,
+// so has to be replaced for it to pick up a rotated password. An error is returned if LISTEN fails, so that it can be retried
+func (f *ChangeFeed) listen(ctx context.Context) error {
+	newListener, pingInterval := f.newListener, f.pingInterval
+	if newListener == nil {
+		newListener = newPQListener
+	}
+	if pingInterval == 0 {
+		pingInterval = changeFeedListenerPing
+	}
+
+	connectionString := f.ConnectionString()
+	listener := newListener(connectionString)
+	defer func() {
+		if err := listener.Close(); err != nil {
+			log.WithError(err).Error("closing change feed listener")
+		}
+	}()
+
+	for _, channel := range []string{changeFeedChannel, changeFeedSequencedChannel} {
+		if err := listener.Listen(channel); err != nil {
+			return fmt.Errorf("listening on channel '%s': %v", channel, err)
+		}
+	}
+	log.Infof("Listening for user changes on channels '%s' and '%s'", changeFeedChannel, changeFeedSequencedChannel)
+	// Changes may have been recorded whilst nothing was listening
+	f.wakeSequencer()
+	f.notify()
+	notify := listener.NotificationChannel()
+
+	// The ticker is created once, so that the connection is still pinged while notifications keep arriving
+	ping := time.NewTicker(pingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case notification := <-notify:
+			// A nil notification means the connection was re-established and notifications may have been missed,
+			// which is handled the same way as any other wake-up as clients always read from their last event ID
+			if notification == nil || notification.Channel == changeFeedChannel {
+				f.wakeSequencer()
+			}
+			if notification == nil || notification.Channel == changeFeedSequencedChannel {
+				f.notify()
+			}
+		case <-ping.C:
+			if err := listener.Ping(); err != nil {
+				log.WithError(err).Error("pinging change feed listener connection")
+				if f.ConnectionString() != connectionString {
+					log.Info("Database credentials have changed. Restarting the change feed listener")
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// streamUserChanges is an HTTP handler for GET /users/changes
+// Events are streamed using Server-Sent Events, with each event's feed position as its ID. Clients resume from where they left
+// off by sending the Last-Event-ID header (which browsers do automatically on reconnect), or the since query string.
+// Otherwise only new events are streamed
+func (env *Env) streamUserChanges(w http.ResponseWriter, r *http.Request) {
+	var err error
+	var lastEventID int64
+
+	resumeFrom := r.Header.Get(lastEventIDHeader)
+	if resumeFrom == "" {
+		resumeFrom = r.URL.Query().Get(changeFeedSinceQueryKey)
+	}
+	if resumeFrom != "" {
+		lastEventID, err = strconv.ParseInt(resumeFrom, 10, 64)
+		if err != nil || lastEventID < 0 {
+			jsonHTTPErrorResponseWriter(w, r, 400, CodeInvalidLastEventID, fmt.Sprintf("%s header and %s query string must be a positive integer", lastEventIDHeader, changeFeedSinceQueryKey))
+			return
+		}
+	} else {
+		lastEventID, err = env.Changes.Store.latestPosition(r.Context())
+		if err != nil {
+			jsonHTTPErrorResponseWriter(w, r, 500, CodeInternalError, fmt.Sprintf("querying latest event position: %v", err))
+			return
+		}
+	}
+
+	// Subscribe before the first read, so that no wake-up can be missed between reading and waiting
+	wake, unsubscribe := env.Changes.subscribe()
+	defer unsubscribe()
+	stopped := env.Changes.done()
+
+	// The stream is long-lived so lift the server wide WriteTimeout for this response only
+	rc := http.NewResponseController(w)
+	if err = rc.SetWriteDeadline(time.Time{}); err != nil {
+		log.WithError(err).Debug("unable to clear the write deadline for change stream")
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(200)
+	if _, err = fmt.Fprintf(w, "retry: %d\n\n", changeFeedRetryMillis); err != nil {
+		return
+	}
+	if err = rc.Flush(); err != nil {
+		log.WithError(err).Debug("unable to flush change stream")
+	}
+
+	logger := log.WithContext(r.Context())
+	logger.WithField("last_event_id", lastEventID).Info("change stream client connected")
+
+	heartbeat := time.NewTicker(changeFeedHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		events, err := env.Changes.Store.queryEventsSince(r.Context(), lastEventID, changeFeedBatchSize)
+		if err != nil {
+			if r.Context().Err() == nil {
+				logger.WithError(err).Error("reading events for change stream")
+			}
+			return
+		}
+		for _, event := range events {
+			if err = writeServerSentEvent(w, event); err != nil {
+				logger.WithError(err).Info("change stream client disconnected")
+				return
+			}
+			lastEventID = event.Position
+		}
+		if len(events) > 0 {
+			if err = rc.Flush(); err != nil {
+				logger.WithError(err).Debug("unable to flush change stream")
+			}
+		}
+		if len(events) == changeFeedBatchSize {
+			// Catching up on a backlog
+			continue
+		}
+
+		select {
+		case <-r.Context().Done():
+			logger.WithField("last_event_id", lastEventID).Info("change stream client disconnected")
+			return
+		case <-stopped:
+			logger.WithField("last_event_id", lastEventID).Info("closing change stream as the server is shutting down")
+			return
+		case <-wake:
+		case <-heartbeat.C:
+			// Comments keep proxies from closing an idle connection. Reading the store again afterwards also picks up
+			// any changes whose notification was lost
+			if _, err = fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			if err = rc.Flush(); err != nil {
+				logger.WithError(err).Debug("unable to flush change stream")
+			}
+		}
+	}
+}
+
+// writeServerSentEvent writes a single user event in the text/event-stream format
+func writeServerSentEvent(w http.ResponseWriter, event UserEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("marshalling event %d: %v", event.EventID, err)
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Position, event.EventType, data)
+	return err
+}
@@ -0,0 +1,299 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockChangeStore is used to mock the Postgres user_events table
+type mockChangeStore struct {
+	mu     sync.Mutex
+	events []UserEvent
+}
+
+func (m *mockChangeStore) queryEventsSince(_ context.Context, afterPosition int64, limit int) ([]UserEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	events := make([]UserEvent, 0)
+	for _, event := range m.events {
+		if event.Position > afterPosition && len(events) < limit {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+func (m *mockChangeStore) latestPosition(_ context.Context) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.events) == 0 {
+		return 0, nil
+	}
+	return m.events[len(m.events)-1].Position, nil
+}
+
+func (m *mockChangeStore) record(eventType, logonName string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events = append(m.events, UserEvent{EventID: int64(len(m.events) + 1), Position: int64(len(m.events) + 1), EventType: eventType, LogonName: logonName, User: User{LogonName: logonName}})
+}
+
+// mockListener is used to mock a Postgres LISTEN connection
+type mockListener struct {
+	notifications chan *pq.Notification
+	listenErr     error // returned by Listen
+	pings         atomic.Int32
+	closed        atomic.Bool
+}
+
+func newMockListener() *mockListener {
+	return &mockListener{notifications: make(chan *pq.Notification)}
+}
+
+func (l *mockListener) Listen(_ string) error { return l.listenErr }
+
+func (l *mockListener) Ping() error {
+	l.pings.Add(1)
+	return nil
+}
+
+func (l *mockListener) Close() error {
+	l.closed.Store(true)
+	return nil
+}
+
+func (l *mockListener) NotificationChannel() <-chan *pq.Notification { return l.notifications }
+
+func setupMockChangesServer(t *testing.T, store *mockChangeStore) (*ChangeFeed, *httptest.Server) {
+	feed := &ChangeFeed{Store: store}
+	env := &Env{Changes: feed}
+	router := mux.NewRouter()
+	router.HandleFunc("/users/changes", env.streamUserChanges).Methods("GET")
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return feed, server
+}
+
+// openChangeStream connects to the change feed and returns a function which reads the next event's id and event type
+func openChangeStream(t *testing.T, url, lastEventID string) func() (string, string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if lastEventID != "" {
+		req.Header.Set(lastEventIDHeader, lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	return func() (string, string) {
+		var id, eventType string
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					t.Fatal("change stream closed")
+				}
+				switch {
+				case strings.HasPrefix(line, "id: "):
+					id = strings.TrimPrefix(line, "id: ")
+				case strings.HasPrefix(line, "event: "):
+					eventType = strings.TrimPrefix(line, "event: ")
+				case line == "" && id != "":
+					return id, eventType
+				}
+			case <-time.After(time.Second * 2):
+				t.Fatal("timed out waiting for change event")
+			}
+		}
+	}
+}
+
+// TestStreamUserChangesResume tests that a client resuming with Last-Event-ID receives the events it missed, then new events
+func TestStreamUserChangesResume(t *testing.T) {
+	store := &mockChangeStore{}
+	store.record(EventUserCreated, "mark9")
+	store.record(EventUserUpdated, "mark9")
+	store.record(EventUserCreated, "sally1")
+	feed, server := setupMockChangesServer(t, store)
+
+	next := openChangeStream(t, server.URL+"/users/changes", "1")
+
+	id, eventType := next()
+	assert.Equal(t, "2", id)
+	assert.Equal(t, EventUserUpdated, eventType)
+	id, _ = next()
+	assert.Equal(t, "3", id)
+
+	store.record(EventUserDeleted, "mark9")
+	feed.notify()
+	id, eventType = next()
+	assert.Equal(t, "4", id)
+	assert.Equal(t, EventUserDeleted, eventType)
+}
+
+// TestStreamUserChangesNewOnly tests that a client without a Last-Event-ID only receives events recorded after it connected
+func TestStreamUserChangesNewOnly(t *testing.T) {
+	store := &mockChangeStore{}
+	store.record(EventUserCreated, "mark9")
+	feed, server := setupMockChangesServer(t, store)
+
+	next := openChangeStream(t, server.URL+"/users/changes", "")
+
+	store.record(EventUserCreated, "sally1")
+	feed.notify()
+	id, _ := next()
+	assert.Equal(t, "2", id)
+}
+
+// TestStreamUserChangesInvalidLastEventID tests that an invalid Last-Event-ID header is rejected
+func TestStreamUserChangesInvalidLastEventID(t *testing.T) {
+	_, server := setupMockChangesServer(t, &mockChangeStore{})
+
+	req, _ := http.NewRequest("GET", server.URL+"/users/changes?since=abc", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	assert.Equal(t, 400, resp.StatusCode)
+}
+
+// TestChangeFeedPingsDuringTraffic tests that the listener connection is still pinged while notifications keep arriving
+func TestChangeFeedPingsDuringTraffic(t *testing.T) {
+	listener := newMockListener()
+	feed := &ChangeFeed{
+		Store:            &mockChangeStore{},
+		ConnectionString: func() string { return "" },
+		newListener:      func(string) changeListener { return listener },
+		pingInterval:     time.Millisecond * 20,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go feed.Run(ctx)
+
+	for deadline := time.Now().Add(time.Millisecond * 200); time.Now().Before(deadline); {
+		listener.notifications <- &pq.Notification{Channel: changeFeedChannel}
+		time.Sleep(time.Millisecond * 5)
+	}
+	assert.Greater(t, listener.pings.Load(), int32(0))
+}
+
+// TestChangeFeedRetriesListen tests that a failed LISTEN is retried with a new listener, and that streams are woken once it succeeds
+func TestChangeFeedRetriesListen(t *testing.T) {
+	failing := newMockListener()
+	failing.listenErr = errors.New("connection refused")
+	listening := newMockListener()
+	listeners := make(chan *mockListener, 2)
+	listeners <- failing
+	listeners <- listening
+
+	feed := &ChangeFeed{
+		Store:            &mockChangeStore{},
+		ConnectionString: func() string { return "" },
+		newListener:      func(string) changeListener { return <-listeners },
+		listenRetry:      time.Millisecond,
+	}
+	wake, unsubscribe := feed.subscribe()
+	defer unsubscribe()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go feed.Run(ctx)
+
+	select {
+	case <-wake:
+	case <-time.After(time.Second * 2):
+		t.Fatal("timed out waiting for the change feed to listen again")
+	}
+	assert.True(t, failing.closed.Load())
+	assert.Empty(t, listeners)
+}
+
+// mockSequencer records how often it has been woken
+type mockSequencer struct {
+	woken chan struct{}
+}
+
+func (m *mockSequencer) runSequencer(ctx context.Context, wake <-chan struct{}) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-wake:
+			m.woken <- struct{}{}
+		}
+	}
+}
+
+// TestChangeFeedWakesSequencer tests that recorded events wake the sequencer, and that subscribers are only woken once the
+// sequencer has announced new positions
+func TestChangeFeedWakesSequencer(t *testing.T) {
+	listener := newMockListener()
+	sequencer := &mockSequencer{woken: make(chan struct{}, 10)}
+	feed := &ChangeFeed{
+		Store:            &mockChangeStore{},
+		Sequencer:        sequencer,
+		ConnectionString: func() string { return "" },
+		newListener:      func(string) changeListener { return listener },
+	}
+	wake, unsubscribe := feed.subscribe()
+	defer unsubscribe()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go feed.Run(ctx)
+
+	// Both are woken once listening, to catch up on anything recorded beforehand
+	for _, woken := range []<-chan struct{}{sequencer.woken, wake} {
+		select {
+		case <-woken:
+		case <-time.After(time.Second * 2):
+			t.Fatal("timed out waiting for the initial wake-up")
+		}
+	}
+
+	listener.notifications <- &pq.Notification{Channel: changeFeedChannel}
+	select {
+	case <-sequencer.woken:
+	case <-time.After(time.Second * 2):
+		t.Fatal("timed out waiting for the sequencer to be woken")
+	}
+	select {
+	case <-wake:
+		t.Fatal("subscriber woken before the event had a position")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	listener.notifications <- &pq.Notification{Channel: changeFeedSequencedChannel}
+	select {
+	case <-wake:
+	case <-time.After(time.Second * 2):
+		t.Fatal("timed out waiting for the subscriber to be woken")
+	}
+	assert.Empty(t, sequencer.woken)
+}
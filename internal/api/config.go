@@ -0,0 +1,505 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const redacted = "REDACTED"
+
+// Config is the effective configuration of the service. It starts from DefaultConfig, and is then overridden by the YAML
+// config file, then the envars and finally the command line flags
+type Config struct {
+	Server         ServerConfig         `yaml:"server"`
+	Log            LogConfig            `yaml:"log"`
+	Storage        StorageConfig        `yaml:"storage"`
+	Database       DBCredentials        `yaml:"database"`
+	QueryTimeouts  QueryTimeouts        `yaml:"query_timeouts"`
+	Retries        RetriesConfig        `yaml:"retries"`
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit_breaker"`
+	Idempotency    IdempotencyConfig    `yaml:"idempotency"`
+	Events         EventsConfig         `yaml:"events"`
+	Webhooks       WebhooksConfig       `yaml:"webhooks"`
+	Tracing        TracingConfig        `yaml:"tracing"`
+	Probes         ProbesConfig         `yaml:"probes"`
+	Cache          CacheConfig          `yaml:"cache"`
+	HTTPCache      HTTPCacheConfig      `yaml:"http_cache"`
+	Validation     ValidationConfig     `yaml:"validation"`
+}
+
+type ServerConfig struct {
+	Port               int           `yaml:"port"`
+	ShutdownTimeout    time.Duration `yaml:"shutdown_timeout"`
+	HealthCheckTimeout time.Duration `yaml:"health_check_timeout"`
+	MaxPageSize        int           `yaml:"max_page_size"`
+}
+
+type LogConfig struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"` // json or text
+}
+
+type StorageConfig struct {
+	Backend    string `yaml:"backend"`
+	SQLitePath string `yaml:"sqlite_path"`
+}
+
+type IdempotencyConfig struct {
+	KeyTTL time.Duration `yaml:"key_ttl"`
+}
+
+type EventsConfig struct {
+	Publisher     string        `yaml:"publisher"`
+	FilePath      string        `yaml:"file_path"`
+	WebhookURL    string        `yaml:"webhook_url"`
+	RelayInterval time.Duration `yaml:"relay_interval"`
+}
+
+type WebhooksConfig struct {
+	MaxAttempts int           `yaml:"max_attempts"`
+	BaseBackoff time.Duration `yaml:"base_backoff"`
+}
+
+type TracingConfig struct {
+	Exporter string `yaml:"exporter"`
+}
+
+// DefaultConfig returns the configuration used for any setting which is not set in the config file, envars or flags
+func DefaultConfig() Config {
+	return Config{
+		Server: ServerConfig{
+			Port:               8080,
+			ShutdownTimeout:    time.Second * 10,
+			HealthCheckTimeout: time.Second * 5,
+			MaxPageSize:        10,
+		},
+		Log:     LogConfig{Level: log.WarnLevel.String(), Format: "json"},
+		Storage: StorageConfig{Backend: BackendPostgres, SQLitePath: defaultSQLitePath},
+		Database: DBCredentials{
+			PasswordFilePollInterval: defaultPasswordFilePollInterval,
+			ReplicaCheckInterval:     defaultReplicaCheckInterval,
+			Pool: PoolConfig{
+				MaxOpenConns:       defaultMaxOpenConns,
+				MaxIdleConns:       defaultMaxIdleConns,
+				ConnMaxLifetime:    defaultConnMaxLifetime,
+				ConnMaxIdleTime:    defaultConnMaxIdleTime,
+				PreparedStatements: true,
+			},
+		},
+		QueryTimeouts: QueryTimeouts{
+			Count:  defaultQueryTimeout,
+			List:   defaultQueryTimeout,
+			Add:    defaultQueryTimeout,
+			Update: defaultQueryTimeout,
+			Delete: defaultQueryTimeout,
+			// Exports stream every user so have no timeout by default
+		},
+		Retries: RetriesConfig{MaxAttempts: defaultRetryMaxAttempts, BaseBackoff: defaultRetryBaseBackoff, MaxBackoff: defaultRetryMaxBackoff},
+		CircuitBreaker: CircuitBreakerConfig{
+			FailureThreshold: defaultCircuitBreakerFailureThreshold,
+			OpenDuration:     defaultCircuitBreakerOpenDuration,
+		},
+		Idempotency: IdempotencyConfig{KeyTTL: defaultIdempotencyKeyTTL},
+		Events:      EventsConfig{Publisher: eventPublisherNone, RelayInterval: defaultEventRelayInterval},
+		Webhooks:    WebhooksConfig{MaxAttempts: defaultWebhookMaxAttempts, BaseBackoff: defaultWebhookBaseBackoff},
+		Tracing:     TracingConfig{Exporter: tracingExporterNone},
+		Probes: ProbesConfig{
+			CriticalChecks:        []string{checkPrimary, checkMigrations},
+			EventBacklogThreshold: defaultEventBacklogThreshold,
+			DrainDelay:            defaultReadinessDrainDelay,
+		},
+		Cache:     CacheConfig{MaxEntries: defaultCacheMaxEntries, MaxStaleness: defaultCacheMaxStaleness},
+		HTTPCache: HTTPCacheConfig{ListUsers: defaultCacheControl, GetUser: defaultCacheControl},
+		Validation: ValidationConfig{
+			LogonName: FieldRule{MaxLength: userColumnSizes["logon_name"]},
+			FullName:  FieldRule{MaxLength: userColumnSizes["full_name"]},
+			Email:     FieldRule{MaxLength: userColumnSizes["email"]},
+		},
+	}
+}
+
+// configSetting binds a Config field to its envar and command line flag. Flags are named after the field's path in the config file
+type configSetting struct {
+	flag    string
+	envar   string
+	usage   string
+	setFlag func(c *Config, value string) error
+	setEnv  func(c *Config, value string) error
+}
+
+func stringSetting(flag, envar, usage string, field func(*Config) *string) configSetting {
+	set := func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}
+	return configSetting{flag: flag, envar: envar, usage: usage, setFlag: set, setEnv: set}
+}
+
+func intSetting[T int | int64](flag, envar, usage string, field func(*Config) *T) configSetting {
+	set := func(c *Config, value string) error {
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("'%s' is not an integer", value)
+		}
+		*field(c) = T(i)
+		return nil
+	}
+	return configSetting{flag: flag, envar: envar, usage: usage, setFlag: set, setEnv: set}
+}
+
+func boolSetting(flag, envar, usage string, field func(*Config) *bool) configSetting {
+	set := func(c *Config, value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("'%s' is not true or false", value)
+		}
+		*field(c) = b
+		return nil
+	}
+	return configSetting{flag: flag, envar: envar, usage: usage, setFlag: set, setEnv: set}
+}
+
+// stringListSetting binds a list. The envar and flag take a comma separated list, with an empty value clearing it
+func stringListSetting(flag, envar, usage string, field func(*Config) *[]string) configSetting {
+	set := func(c *Config, value string) error {
+		list := make([]string, 0)
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		*field(c) = list
+		return nil
+	}
+	return configSetting{flag: flag, envar: envar, usage: usage, setFlag: set, setEnv: set}
+}
+
+// durationSetting binds a duration. Flags take a Go duration such as 1m30s, whilst the envar is an integer number of
+// envarUnit, which keeps the envars compatible with earlier releases
+func durationSetting(flag, envar, usage string, envarUnit time.Duration, field func(*Config) *time.Duration) configSetting {
+	return configSetting{flag: flag, envar: envar, usage: usage,
+		setFlag: func(c *Config, value string) error {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("'%s' is not a duration such as 5s", value)
+			}
+			*field(c) = d
+			return nil
+		},
+		setEnv: func(c *Config, value string) error {
+			i, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("'%s' is not an integer", value)
+			}
+			*field(c) = time.Duration(i) * envarUnit
+			return nil
+		},
+	}
+}
+
+var configSettings = []configSetting{
+	intSetting("server.port", "server_port", "port to listen on", func(c *Config) *int { return &c.Server.Port }),
+	durationSetting("server.shutdown_timeout", "server_shutdown_timeout_ms", "how long to wait for in-flight requests when shutting down", time.Millisecond, func(c *Config) *time.Duration { return &c.Server.ShutdownTimeout }),
+	durationSetting("server.health_check_timeout", "server_health_check_timeout_ms", "timeout of the /health database check", time.Millisecond, func(c *Config) *time.Duration { return &c.Server.HealthCheckTimeout }),
+	intSetting("server.max_page_size", "server_max_page_size", "maximum per_page for GET /users", func(c *Config) *int { return &c.Server.MaxPageSize }),
+	stringSetting("log.level", "LOG_LEVEL", "logrus log level", func(c *Config) *string { return &c.Log.Level }),
+	stringSetting("log.format", "log_format", "json or text", func(c *Config) *string { return &c.Log.Format }),
+	stringSetting("storage.backend", "store_backend", "postgres, sqlite or memory", func(c *Config) *string { return &c.Storage.Backend }),
+	stringSetting("storage.sqlite_path", "sqlite_path", "SQLite database file used by the sqlite backend", func(c *Config) *string { return &c.Storage.SQLitePath }),
+	stringSetting("database.host_name", "database_host_name", "Postgres host name", func(c *Config) *string { return &c.Database.HostName }),
+	intSetting("database.port", "database_port", "Postgres port", func(c *Config) *int64 { return &c.Database.Port }),
+	stringSetting("database.name", "database_name", "Postgres database name", func(c *Config) *string { return &c.Database.DBName }),
+	stringSetting("database.username", "database_username", "Postgres username", func(c *Config) *string { return &c.Database.DBUsername }),
+	stringSetting("database.password", "database_password", "Postgres password", func(c *Config) *string { return &c.Database.DBPassword }),
+	stringSetting("database.password_file", "database_password_FILE", "file containing the Postgres password, which is watched for rotations", func(c *Config) *string { return &c.Database.PasswordFile }),
+	durationSetting("database.password_file_poll_interval", "database_password_file_poll_interval_ms", "how often the password file is checked for changes", time.Millisecond, func(c *Config) *time.Duration { return &c.Database.PasswordFilePollInterval }),
+	stringSetting("database.replica_host_name", "database_replica_host_name", "optional read replica host name, e.g. an Aurora reader endpoint", func(c *Config) *string { return &c.Database.ReplicaHostName }),
+	durationSetting("database.replica_check_interval", "database_replica_check_interval_ms", "how often the read replica's health is checked", time.Millisecond, func(c *Config) *time.Duration { return &c.Database.ReplicaCheckInterval }),
+	intSetting("database.pool.max_open_conns", "db_max_open_conns", "maximum open connections per pool. 0 is unlimited", func(c *Config) *int { return &c.Database.Pool.MaxOpenConns }),
+	intSetting("database.pool.max_idle_conns", "db_max_idle_conns", "maximum idle connections kept per pool", func(c *Config) *int { return &c.Database.Pool.MaxIdleConns }),
+	durationSetting("database.pool.conn_max_lifetime", "db_conn_max_lifetime_ms", "how long a connection is reused for. 0 is forever", time.Millisecond, func(c *Config) *time.Duration { return &c.Database.Pool.ConnMaxLifetime }),
+	durationSetting("database.pool.conn_max_idle_time", "db_conn_max_idle_time_ms", "how long a connection can be idle before it is closed. 0 is forever", time.Millisecond, func(c *Config) *time.Duration { return &c.Database.Pool.ConnMaxIdleTime }),
+	boolSetting("database.pool.prepared_statements", "db_prepared_statements", "run the users queries as prepared statements", func(c *Config) *bool { return &c.Database.Pool.PreparedStatements }),
+	intSetting("database.approximate_count_above", "db_approximate_count_above", "estimate the total for GET /users without a name_filter once there are more users than this. 0 always counts them", func(c *Config) *int { return &c.Database.ApproximateCountAbove }),
+	stringSetting("database.ssl_mode", "database_ssl_mode", "Postgres sslmode", func(c *Config) *string { return &c.Database.SSLMode }),
+	durationSetting("query_timeouts.count", "db_count_timeout_ms", "timeout for counting users", time.Millisecond, func(c *Config) *time.Duration { return &c.QueryTimeouts.Count }),
+	durationSetting("query_timeouts.list", "db_list_timeout_ms", "timeout for fetching a page of users", time.Millisecond, func(c *Config) *time.Duration { return &c.QueryTimeouts.List }),
+	durationSetting("query_timeouts.export", "db_export_timeout_ms", "timeout for exporting users", time.Millisecond, func(c *Config) *time.Duration { return &c.QueryTimeouts.Export }),
+	durationSetting("query_timeouts.add", "db_add_timeout_ms", "timeout for adding a user", time.Millisecond, func(c *Config) *time.Duration { return &c.QueryTimeouts.Add }),
+	durationSetting("query_timeouts.update", "db_update_timeout_ms", "timeout for updating a user", time.Millisecond, func(c *Config) *time.Duration { return &c.QueryTimeouts.Update }),
+	durationSetting("query_timeouts.delete", "db_delete_timeout_ms", "timeout for deleting a user", time.Millisecond, func(c *Config) *time.Duration { return &c.QueryTimeouts.Delete }),
+	intSetting("retries.max_attempts", "db_retry_max_attempts", "attempts of idempotent database calls which fail with a transient error", func(c *Config) *int { return &c.Retries.MaxAttempts }),
+	durationSetting("retries.base_backoff", "db_retry_base_backoff_ms", "delay before the first retry of a database call", time.Millisecond, func(c *Config) *time.Duration { return &c.Retries.BaseBackoff }),
+	durationSetting("retries.max_backoff", "db_retry_max_backoff_ms", "maximum delay between retries of a database call", time.Millisecond, func(c *Config) *time.Duration { return &c.Retries.MaxBackoff }),
+	intSetting("circuit_breaker.failure_threshold", "db_circuit_breaker_failure_threshold", "consecutive database failures which open the circuit breaker", func(c *Config) *int { return &c.CircuitBreaker.FailureThreshold }),
+	durationSetting("circuit_breaker.open_duration", "db_circuit_breaker_open_ms", "how long the circuit breaker fails database calls fast for", time.Millisecond, func(c *Config) *time.Duration { return &c.CircuitBreaker.OpenDuration }),
+	durationSetting("idempotency.key_ttl", "idempotency_key_ttl_seconds", "how long idempotency keys are kept", time.Second, func(c *Config) *time.Duration { return &c.Idempotency.KeyTTL }),
+	stringSetting("events.publisher", "event_publisher", "none, stdout, file or webhook", func(c *Config) *string { return &c.Events.Publisher }),
+	stringSetting("events.file_path", "event_publisher_file_path", "file appended to by the file publisher", func(c *Config) *string { return &c.Events.FilePath }),
+	stringSetting("events.webhook_url", "event_publisher_webhook_url", "URL posted to by the webhook publisher", func(c *Config) *string { return &c.Events.WebhookURL }),
+	durationSetting("events.relay_interval", "event_relay_interval_ms", "how often the outbox is polled", time.Millisecond, func(c *Config) *time.Duration { return &c.Events.RelayInterval }),
+	intSetting("webhooks.max_attempts", "webhook_max_attempts", "delivery attempts before a webhook is dead-lettered", func(c *Config) *int { return &c.Webhooks.MaxAttempts }),
+	durationSetting("webhooks.base_backoff", "webhook_base_backoff_ms", "delay before the first webhook retry", time.Millisecond, func(c *Config) *time.Duration { return &c.Webhooks.BaseBackoff }),
+	stringSetting("tracing.exporter", "tracing_exporter", "none, stdout or otlp", func(c *Config) *string { return &c.Tracing.Exporter }),
+	stringListSetting("probes.critical_checks", "readiness_critical_checks", "dependency checks which fail /readyz. Any of primary, replica, migrations & event_backlog", func(c *Config) *[]string { return &c.Probes.CriticalChecks }),
+	intSetting("probes.event_backlog_threshold", "readiness_event_backlog_threshold", "unpublished events above which the event_backlog check fails", func(c *Config) *int { return &c.Probes.EventBacklogThreshold }),
+	durationSetting("probes.drain_delay", "readiness_drain_delay_ms", "how long /readyz fails before the server stops accepting connections when shutting down", time.Millisecond, func(c *Config) *time.Duration { return &c.Probes.DrainDelay }),
+	boolSetting("cache.enabled", "users_cache_enabled", "cache user reads in memory", func(c *Config) *bool { return &c.Cache.Enabled }),
+	intSetting("cache.max_entries", "users_cache_max_entries", "maximum users and maximum pages cached", func(c *Config) *int { return &c.Cache.MaxEntries }),
+	durationSetting("cache.max_staleness", "users_cache_max_staleness_ms", "how long a cached read is served for", time.Millisecond, func(c *Config) *time.Duration { return &c.Cache.MaxStaleness }),
+	stringSetting("http_cache.list_users", "http_cache_control_list_users", "Cache-Control header for GET /users. Empty sends none", func(c *Config) *string { return &c.HTTPCache.ListUsers }),
+	stringSetting("http_cache.get_user", "http_cache_control_get_user", "Cache-Control header for GET /users/{logon_name}. Empty sends none", func(c *Config) *string { return &c.HTTPCache.GetUser }),
+	intSetting("validation.logon_name.min_length", "validation_logon_name_min_length", "minimum length of a new logon_name", func(c *Config) *int { return &c.Validation.LogonName.MinLength }),
+	intSetting("validation.logon_name.max_length", "validation_logon_name_max_length", "maximum length of a new logon_name, up to the column size of 20", func(c *Config) *int { return &c.Validation.LogonName.MaxLength }),
+	stringSetting("validation.logon_name.pattern", "validation_logon_name_pattern", "regular expression which a new logon_name must match", func(c *Config) *string { return &c.Validation.LogonName.Pattern }),
+	intSetting("validation.full_name.min_length", "validation_full_name_min_length", "minimum length of full_name", func(c *Config) *int { return &c.Validation.FullName.MinLength }),
+	intSetting("validation.full_name.max_length", "validation_full_name_max_length", "maximum length of full_name, up to the column size of 100", func(c *Config) *int { return &c.Validation.FullName.MaxLength }),
+	stringSetting("validation.full_name.pattern", "validation_full_name_pattern", "regular expression which full_name must match", func(c *Config) *string { return &c.Validation.FullName.Pattern }),
+	intSetting("validation.email.min_length", "validation_email_min_length", "minimum length of email", func(c *Config) *int { return &c.Validation.Email.MinLength }),
+	intSetting("validation.email.max_length", "validation_email_max_length", "maximum length of email, up to the column size of 100", func(c *Config) *int { return &c.Validation.Email.MaxLength }),
+	stringSetting("validation.email.pattern", "validation_email_pattern", "regular expression which email must match", func(c *Config) *string { return &c.Validation.Email.Pattern }),
+	stringListSetting("validation.reserved_logon_names", "validation_reserved_logon_names", "logon_names which new users can't take", func(c *Config) *[]string { return &c.Validation.ReservedLogonNames }),
+	stringListSetting("validation.allowed_email_domains", "validation_allowed_email_domains", "if set, the only email domains which users can have", func(c *Config) *[]string { return &c.Validation.AllowedEmailDomains }),
+	stringListSetting("validation.denied_email_domains", "validation_denied_email_domains", "email domains which users can't have", func(c *Config) *[]string { return &c.Validation.DeniedEmailDomains }),
+	// Kept for compatibility. Any value switches to the text log format
+	{envar: "RUNNING_LOCALLY", setEnv: func(c *Config, _ string) error {
+		c.Log.Format = "text"
+		return nil
+	}},
+}
+
+// LoadConfig registers a flag for every setting on fs and parses args, then builds the Config. The YAML config file is
+// given by the --config flag or config_file envar. Every envar can instead be read from a file by setting <envar>_FILE to its
+// path. Every invalid setting is reported in the returned error, not just the first
+func LoadConfig(fs *flag.FlagSet, args []string) (Config, error) {
+	configFile := fs.String("config", os.Getenv("config_file"), "path to a YAML config file (envar config_file)")
+	flagValues := make(map[string]string)
+	for _, setting := range configSettings {
+		if setting.flag == "" {
+			continue
+		}
+		name := setting.flag
+		fs.Func(name, fmt.Sprintf("%s (envar %s)", setting.usage, setting.envar), func(value string) error {
+			flagValues[name] = value
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	cfg := DefaultConfig()
+	var errs []error
+
+	// passwordLayer and passwordFileLayer record the last layer (1 config file, 2 envars, 3 flags) which set each of them
+	var passwordLayer, passwordFileLayer int
+	setLayer := func(flag string, layer int) {
+		switch flag {
+		case "database.password":
+			passwordLayer = layer
+		case "database.password_file":
+			passwordFileLayer = layer
+		}
+	}
+
+	if *configFile != "" {
+		if err := cfg.loadFile(*configFile); err != nil {
+			errs = append(errs, err)
+		}
+		if cfg.Database.DBPassword != "" {
+			setLayer("database.password", 1)
+		}
+		if cfg.Database.PasswordFile != "" {
+			setLayer("database.password_file", 1)
+		}
+	}
+
+	for _, setting := range configSettings {
+		value, err := lookupEnv(setting.envar)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if value != "" {
+			if err = setting.setEnv(&cfg, value); err != nil {
+				errs = append(errs, fmt.Errorf("envar %s: %v", setting.envar, err))
+			}
+			setLayer(setting.flag, 2)
+		}
+	}
+
+	for _, setting := range configSettings {
+		if value, ok := flagValues[setting.flag]; ok {
+			if err := setting.setFlag(&cfg, value); err != nil {
+				errs = append(errs, fmt.Errorf("flag --%s: %v", setting.flag, err))
+			}
+			setLayer(setting.flag, 3)
+		}
+	}
+
+	// The password file takes precedence over database.password set at the same layer, as it is the one which is watched. A
+	// password set at a higher layer wins instead, and the password file is then ignored rather than watched
+	if passwordLayer > passwordFileLayer {
+		cfg.Database.PasswordFile = ""
+	}
+	if cfg.Database.PasswordFile != "" {
+		password, err := readSecretFile(cfg.Database.PasswordFile)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("database.password_file: %v", err))
+		}
+		cfg.Database.DBPassword = password
+	}
+
+	errs = append(errs, cfg.validate()...)
+	return cfg, errors.Join(errs...)
+}
+
+// lookupEnv returns the value of envar, or the contents of the file named by <envar>_FILE. It is an error to set both
+func lookupEnv(envar string) (string, error) {
+	value := os.Getenv(envar)
+	fileEnvar := envar + "_FILE"
+	path := os.Getenv(fileEnvar)
+	if path == "" || envar == "" {
+		return value, nil
+	}
+	if value != "" {
+		return "", fmt.Errorf("only one of envars %s and %s can be set", envar, fileEnvar)
+	}
+	value, err := readSecretFile(path)
+	if err != nil {
+		return "", fmt.Errorf("envar %s: %v", fileEnvar, err)
+	}
+	return value, nil
+}
+
+// loadFile overrides c with any settings in the YAML file at path. Unknown keys are rejected, so that typos aren't silently ignored
+func (c *Config) loadFile(path string) error {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %v", err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(contents))
+	decoder.KnownFields(true)
+	if err = decoder.Decode(c); err != nil {
+		return fmt.Errorf("parsing config file '%s': %v", path, err)
+	}
+	return nil
+}
+
+// validate returns every problem with the configuration
+func (c *Config) validate() []error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Server.Port > 0 && c.Server.Port <= 65535, "server.port must be between 1 and 65535. Currently %d", c.Server.Port)
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout must be greater than 0")
+	check(c.Server.HealthCheckTimeout > 0, "server.health_check_timeout must be greater than 0")
+	check(c.Server.MaxPageSize > 0, "server.max_page_size must be greater than 0. Currently %d", c.Server.MaxPageSize)
+
+	_, err := log.ParseLevel(c.Log.Level)
+	check(err == nil, "log.level: %v", err)
+	check(c.Log.Format == "json" || c.Log.Format == "text", "log.format must be json or text. Currently '%s'", c.Log.Format)
+
+	switch c.Storage.Backend {
+	case BackendPostgres:
+		required := map[string]string{"host_name": c.Database.HostName, "name": c.Database.DBName, "username": c.Database.DBUsername,
+			"password": c.Database.DBPassword, "ssl_mode": c.Database.SSLMode}
+		for _, key := range []string{"host_name", "name", "username", "password", "ssl_mode"} {
+			check(required[key] != "", "database.%s (envar database_%s) is required when storage.backend is %s", key, key, BackendPostgres)
+		}
+		check(c.Database.Port > 0 && c.Database.Port <= 65535, "database.port must be between 1 and 65535. Currently %d", c.Database.Port)
+		check(c.Database.PasswordFilePollInterval > 0, "database.password_file_poll_interval must be greater than 0")
+		check(c.Database.ReplicaHostName == "" || c.Database.ReplicaCheckInterval > 0, "database.replica_check_interval must be greater than 0")
+		pool := c.Database.Pool
+		check(pool.MaxOpenConns >= 0, "database.pool.max_open_conns must not be negative. Currently %d", pool.MaxOpenConns)
+		check(pool.MaxIdleConns >= 0, "database.pool.max_idle_conns must not be negative. Currently %d", pool.MaxIdleConns)
+		check(pool.MaxOpenConns == 0 || pool.MaxIdleConns <= pool.MaxOpenConns,
+			"database.pool.max_idle_conns must not be greater than database.pool.max_open_conns. Currently %d and %d", pool.MaxIdleConns, pool.MaxOpenConns)
+		check(pool.ConnMaxLifetime >= 0, "database.pool.conn_max_lifetime must not be negative")
+		check(pool.ConnMaxIdleTime >= 0, "database.pool.conn_max_idle_time must not be negative")
+		check(c.Database.ApproximateCountAbove >= 0, "database.approximate_count_above must not be negative. Currently %d", c.Database.ApproximateCountAbove)
+	case BackendSQLite:
+		check(c.Storage.SQLitePath != "", "storage.sqlite_path is required when storage.backend is %s", BackendSQLite)
+	case BackendMemory:
+	default:
+		check(false, "storage.backend must be one of %s, %s or %s. Currently '%s'", BackendPostgres, BackendSQLite, BackendMemory, c.Storage.Backend)
+	}
+
+	timeouts := map[string]time.Duration{"count": c.QueryTimeouts.Count, "list": c.QueryTimeouts.List, "export": c.QueryTimeouts.Export,
+		"add": c.QueryTimeouts.Add, "update": c.QueryTimeouts.Update, "delete": c.QueryTimeouts.Delete}
+	for _, key := range []string{"count", "list", "export", "add", "update", "delete"} {
+		check(timeouts[key] >= 0, "query_timeouts.%s must not be negative", key)
+	}
+
+	check(c.Retries.MaxAttempts > 0, "retries.max_attempts must be greater than 0. Currently %d", c.Retries.MaxAttempts)
+	check(c.Retries.BaseBackoff > 0, "retries.base_backoff must be greater than 0")
+	check(c.Retries.MaxBackoff >= c.Retries.BaseBackoff, "retries.max_backoff must not be less than retries.base_backoff")
+	check(c.CircuitBreaker.FailureThreshold > 0, "circuit_breaker.failure_threshold must be greater than 0. Currently %d", c.CircuitBreaker.FailureThreshold)
+	check(c.CircuitBreaker.OpenDuration > 0, "circuit_breaker.open_duration must be greater than 0")
+
+	check(c.Idempotency.KeyTTL > 0, "idempotency.key_ttl must be greater than 0")
+
+	switch c.Events.Publisher {
+	case eventPublisherNone, eventPublisherStdout:
+	case eventPublisherFile:
+		check(c.Events.FilePath != "", "events.file_path is required when events.publisher is %s", eventPublisherFile)
+	case eventPublisherWebhook:
+		check(c.Events.WebhookURL != "", "events.webhook_url is required when events.publisher is %s", eventPublisherWebhook)
+	default:
+		check(false, "events.publisher must be one of %s, %s, %s or %s. Currently '%s'",
+			eventPublisherNone, eventPublisherStdout, eventPublisherFile, eventPublisherWebhook, c.Events.Publisher)
+	}
+	check(c.Events.RelayInterval > 0, "events.relay_interval must be greater than 0")
+
+	check(c.Webhooks.MaxAttempts > 0, "webhooks.max_attempts must be greater than 0. Currently %d", c.Webhooks.MaxAttempts)
+	check(c.Webhooks.BaseBackoff > 0, "webhooks.base_backoff must be greater than 0")
+
+	switch c.Tracing.Exporter {
+	case tracingExporterNone, tracingExporterStdout, tracingExporterOTLP:
+	default:
+		check(false, "tracing.exporter must be one of %s, %s or %s. Currently '%s'",
+			tracingExporterNone, tracingExporterStdout, tracingExporterOTLP, c.Tracing.Exporter)
+	}
+
+	for _, name := range c.Probes.CriticalChecks {
+		check(slices.Contains(knownChecks, name), "probes.critical_checks: '%s' must be one of %s", name, strings.Join(knownChecks, ", "))
+	}
+	check(c.Probes.EventBacklogThreshold >= 0, "probes.event_backlog_threshold must not be negative")
+	check(c.Probes.DrainDelay >= 0, "probes.drain_delay must not be negative")
+
+	if c.Cache.Enabled {
+		check(c.Cache.MaxEntries > 0, "cache.max_entries must be greater than 0")
+		check(c.Cache.MaxStaleness > 0, "cache.max_staleness must be greater than 0")
+	}
+
+	errs = append(errs, c.Validation.validate()...)
+
+	return errs
+}
+
+// Redacted returns a copy of c with any secrets replaced, so that it is safe to print
+func (c Config) Redacted() Config {
+	if c.Database.DBPassword != "" {
+		c.Database.DBPassword = redacted
+	}
+	return c
+}
+
+// YAML returns c in the same format as the config file
+func (c Config) YAML() ([]byte, error) {
+	return yaml.Marshal(c)
+}
@@ -0,0 +1,187 @@
+package api
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// loadTestConfig loads the config from args, using a new flag set each time
+func loadTestConfig(args ...string) (Config, error) {
+	return LoadConfig(flag.NewFlagSet("test", flag.ContinueOnError), args)
+}
+
+func writeConfigFile(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("writing config file: %v", err)
+	}
+	return path
+}
+
+// TestLoadConfigDefaults tests that the defaults are valid once the backend doesn't need any database settings
+func TestLoadConfigDefaults(t *testing.T) {
+	t.Setenv("store_backend", BackendMemory)
+
+	cfg, err := loadTestConfig()
+	assert.NoError(t, err)
+	expected := DefaultConfig()
+	expected.Storage.Backend = BackendMemory
+	assert.Equal(t, expected, cfg)
+}
+
+// TestLoadConfigPrecedence tests that the config file overrides the defaults, envars override the file and flags override both
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+server:
+  port: 9000
+  max_page_size: 20
+storage:
+  backend: sqlite
+  sqlite_path: /tmp/from-file.db
+query_timeouts:
+  list: 2s
+  export: 1m
+`)
+	t.Setenv("config_file", path)
+	t.Setenv("server_max_page_size", "30")
+	t.Setenv("db_list_timeout_ms", "1500")
+	t.Setenv("sqlite_path", "/tmp/from-env.db")
+
+	cfg, err := loadTestConfig("--storage.sqlite_path=/tmp/from-flag.db", "--query_timeouts.export", "90s")
+	assert.NoError(t, err)
+	assert.Equal(t, 9000, cfg.Server.Port)
+	assert.Equal(t, 30, cfg.Server.MaxPageSize)
+	assert.Equal(t, BackendSQLite, cfg.Storage.Backend)
+	assert.Equal(t, "/tmp/from-flag.db", cfg.Storage.SQLitePath)
+	assert.Equal(t, time.Millisecond*1500, cfg.QueryTimeouts.List)
+	assert.Equal(t, time.Second*90, cfg.QueryTimeouts.Export)
+	assert.Equal(t, defaultQueryTimeout, cfg.QueryTimeouts.Count)
+}
+
+// TestLoadConfigReportsAllErrors tests that every invalid setting is reported, rather than just the first
+func TestLoadConfigReportsAllErrors(t *testing.T) {
+	t.Setenv("database_port", "five-four-three-two")
+	t.Setenv("idempotency_key_ttl_seconds", "-1")
+	t.Setenv("readiness_critical_checks", "primary, disk")
+	t.Setenv("db_max_idle_conns", "30")
+	t.Setenv("db_prepared_statements", "sometimes")
+	t.Setenv("validation_logon_name_max_length", "30")
+	t.Setenv("validation_email_pattern", "[a-z")
+
+	_, err := loadTestConfig("--server.port=0", "--tracing.exporter=zipkin", "--webhooks.base_backoff=soon")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, expected := range []string{
+		"envar database_port: 'five-four-three-two' is not an integer",
+		"flag --webhooks.base_backoff: 'soon' is not a duration",
+		"envar db_prepared_statements: 'sometimes' is not true or false",
+		"database.pool.max_idle_conns must not be greater than database.pool.max_open_conns. Currently 30 and 20",
+		"server.port must be between 1 and 65535",
+		"database.host_name (envar database_host_name) is required when storage.backend is postgres",
+		"idempotency.key_ttl must be greater than 0",
+		"tracing.exporter must be one of none, stdout or otlp. Currently 'zipkin'",
+		"probes.critical_checks: 'disk' must be one of primary, replica, migrations, event_backlog",
+		"validation.logon_name.max_length must be between 0 and 20, the column size. Currently 30",
+		"validation.email.pattern: error parsing regexp",
+	} {
+		assert.Contains(t, err.Error(), expected)
+	}
+}
+
+// TestLoadConfigUnknownFileKey tests that a misspelt setting in the config file is rejected rather than ignored
+func TestLoadConfigUnknownFileKey(t *testing.T) {
+	t.Setenv("store_backend", BackendMemory)
+	path := writeConfigFile(t, "server:\n  prot: 9000\n")
+
+	_, err := loadTestConfig("--config", path)
+	assert.ErrorContains(t, err, "field prot not found")
+}
+
+// TestConfigRedacted tests that secrets are removed from the printed config
+func TestConfigRedacted(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Database.DBPassword = "hunter2"
+
+	out, err := cfg.Redacted().YAML()
+	assert.NoError(t, err)
+	assert.NotContains(t, string(out), "hunter2")
+	assert.Contains(t, string(out), "password: "+redacted)
+	assert.Equal(t, "hunter2", cfg.Database.DBPassword)
+}
+
+// TestLoadConfigFromFileEnvars tests that envars can be read from the file named by <envar>_FILE, and that the password file is
+// recorded so that it can be watched
+func TestLoadConfigFromFileEnvars(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatalf("writing %s: %v", name, err)
+		}
+		return path
+	}
+	t.Setenv("database_host_name", "db.local")
+	t.Setenv("database_port", "5432")
+	t.Setenv("database_name", "users")
+	t.Setenv("database_ssl_mode", "disable")
+	t.Setenv("database_username_FILE", write("username", "svc-user\n"))
+	t.Setenv("database_password_FILE", write("password", "s3cret\n"))
+
+	cfg, err := loadTestConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, "svc-user", cfg.Database.DBUsername)
+	assert.Equal(t, "s3cret", cfg.Database.DBPassword)
+	assert.Equal(t, filepath.Join(dir, "password"), cfg.Database.PasswordFile)
+
+	t.Setenv("database_username", "other-user")
+	t.Setenv("event_publisher_webhook_url_FILE", filepath.Join(dir, "missing"))
+	_, err = loadTestConfig()
+	assert.ErrorContains(t, err, "only one of envars database_username and database_username_FILE can be set")
+	assert.ErrorContains(t, err, "envar event_publisher_webhook_url_FILE: reading secret file")
+}
+
+// TestLoadConfigPasswordFilePrecedence tests that the password file only replaces database.password set at the same or a lower
+// layer, so that a --database.password flag still overrides a password file from the config file or envars
+func TestLoadConfigPasswordFilePrecedence(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordFile, []byte("from-file\n"), 0600); err != nil {
+		t.Fatalf("writing password file: %v", err)
+	}
+	t.Setenv("config_file", writeConfigFile(t, fmt.Sprintf(`
+database:
+  host_name: db.local
+  port: 5432
+  name: users
+  username: svc-user
+  ssl_mode: disable
+  password: from-config
+  password_file: %s
+`, passwordFile)))
+
+	cfg, err := loadTestConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, "from-file", cfg.Database.DBPassword)
+	assert.Equal(t, passwordFile, cfg.Database.PasswordFile)
+
+	cfg, err = loadTestConfig("--database.password=from-flag")
+	assert.NoError(t, err)
+	assert.Equal(t, "from-flag", cfg.Database.DBPassword)
+	assert.Empty(t, cfg.Database.PasswordFile)
+
+	t.Setenv("database_password_FILE", passwordFile)
+	cfg, err = loadTestConfig("--database.password=from-flag")
+	assert.NoError(t, err)
+	assert.Equal(t, "from-flag", cfg.Database.DBPassword)
+	assert.Empty(t, cfg.Database.PasswordFile)
+
+	cfg, err = loadTestConfig("--database.password=from-flag", "--database.password_file", passwordFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "from-file", cfg.Database.DBPassword)
+}
@@ -0,0 +1,148 @@
+package api
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultPasswordFilePollInterval = time.Second * 10
+
+	pqInvalidPassword      = "28P01"
+	pqInvalidAuthorization = "28000"
+)
+
+// rotatingConnector opens Postgres connections using the current credentials, so that the password can be rotated without
+// restarting the service. When the password is read from a file, the file is re-read whenever it changes or a new connection
+// fails to authenticate. Postgres only checks the password when connecting, so open connections keep working throughout
+type rotatingConnector struct {
+	passwordFile string
+	// open is replaced in tests so that no database is needed
+	open func(ctx context.Context, credentials DBCredentials) (driver.Conn, error)
+	// onRotate is called after the password has changed, e.g. to close the idle connections in the pool
+	onRotate func()
+
+	mu          sync.RWMutex
+	credentials DBCredentials
+}
+
+// newRotatingConnector returns a connector which opens connections with credentials. If credentials.PasswordFile is set,
+// the password is re-read from it when it changes
+func newRotatingConnector(credentials DBCredentials) *rotatingConnector {
+	return &rotatingConnector{
+		passwordFile: credentials.PasswordFile,
+		open:         openPostgresConn,
+		credentials:  credentials,
+	}
+}
+
+// openPostgresConn opens a single lib/pq connection
+func openPostgresConn(ctx context.Context, credentials DBCredentials) (driver.Conn, error) {
+	connector, err := pq.NewConnector(credentials.connectionString())
+	if err != nil {
+		return nil, err
+	}
+	return connector.Connect(ctx)
+}
+
+// Connect opens a connection with the current credentials. If authentication fails the password file is re-read, as the
+// password may have been rotated before the change was noticed, and the connection retried once if the password has changed
+func (c *rotatingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.open(ctx, c.current())
+	if err == nil || !isAuthFailure(err) || c.passwordFile == "" {
+		return conn, err
+	}
+
+	changed, reloadErr := c.reloadPassword()
+	if reloadErr != nil {
+		log.WithError(reloadErr).Error("re-reading database password file after an authentication failure")
+	}
+	if !changed {
+		return nil, err
+	}
+	return c.open(ctx, c.current())
+}
+
+// Driver returns the lib/pq driver
+func (c *rotatingConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+// connectionString returns the lib/pq connection string for the current credentials
+func (c *rotatingConnector) connectionString() string {
+	return c.current().connectionString()
+}
+
+func (c *rotatingConnector) current() DBCredentials {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.credentials
+}
+
+// reloadPassword re-reads the password file, returning true if the password has changed
+func (c *rotatingConnector) reloadPassword() (bool, error) {
+	password, err := readSecretFile(c.passwordFile)
+	if err != nil {
+		return false, err
+	}
+	if password == "" {
+		return false, fmt.Errorf("password file '%s' is empty", c.passwordFile)
+	}
+
+	c.mu.Lock()
+	changed := password != c.credentials.DBPassword
+	c.credentials.DBPassword = password
+	c.mu.Unlock()
+
+	if changed {
+		log.Infof("Database password changed in '%s'", c.passwordFile)
+		if c.onRotate != nil {
+			c.onRotate()
+		}
+	}
+	return changed, nil
+}
+
+// Watch re-reads the password file every interval until ctx is cancelled. It returns straight away if there is no password file
+func (c *rotatingConnector) Watch(ctx context.Context, interval time.Duration) {
+	if c.passwordFile == "" {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := c.reloadPassword(); err != nil {
+				log.WithError(err).Error("re-reading database password file")
+			}
+		}
+	}
+}
+
+// isAuthFailure returns true if err is Postgres rejecting the credentials
+func isAuthFailure(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && (pqErr.Code == pqInvalidPassword || pqErr.Code == pqInvalidAuthorization)
+}
+
+// readSecretFile returns the contents of the file at path, without any trailing newline
+func readSecretFile(path string) (string, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading secret file: %v", err)
+	}
+	return strings.TrimRight(string(contents), "\r\n"), nil
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockConn struct {
+	driver.Conn
+	password string
+}
+
+// newTestConnector returns a connector reading its password from a file, which only accepts connections using validPassword
+func newTestConnector(t *testing.T, filePassword string, validPassword *atomic.Value) (*rotatingConnector, string) {
+	path := filepath.Join(t.TempDir(), "password")
+	writePassword(t, path, filePassword)
+
+	connector := newRotatingConnector(DBCredentials{DBPassword: filePassword, PasswordFile: path})
+	connector.open = func(_ context.Context, credentials DBCredentials) (driver.Conn, error) {
+		if credentials.DBPassword != validPassword.Load().(string) {
+			return nil, &pq.Error{Code: pqInvalidPassword, Message: "password authentication failed"}
+		}
+		return mockConn{password: credentials.DBPassword}, nil
+	}
+	return connector, path
+}
+
+func writePassword(t *testing.T, path, password string) {
+	if err := os.WriteFile(path, []byte(password+"\n"), 0600); err != nil {
+		t.Fatalf("writing password file: %v", err)
+	}
+}
+
+// TestRotatingConnectorAuthFailure tests that a rotated password is picked up from the file when a connection is rejected
+func TestRotatingConnectorAuthFailure(t *testing.T) {
+	var validPassword atomic.Value
+	validPassword.Store("old")
+	connector, path := newTestConnector(t, "old", &validPassword)
+	rotations := 0
+	connector.onRotate = func() { rotations++ }
+
+	conn, err := connector.Connect(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "old", conn.(mockConn).password)
+
+	// The database is rotated before the file is
+	validPassword.Store("new")
+	_, err = connector.Connect(context.Background())
+	assert.True(t, isAuthFailure(err))
+	assert.Equal(t, 0, rotations)
+
+	writePassword(t, path, "new")
+	conn, err = connector.Connect(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "new", conn.(mockConn).password)
+	assert.Equal(t, 1, rotations)
+	assert.Contains(t, connector.connectionString(), "password=new")
+}
+
+// TestRotatingConnectorWatch tests that a change to the password file is picked up without waiting for an authentication failure
+func TestRotatingConnectorWatch(t *testing.T) {
+	var validPassword atomic.Value
+	validPassword.Store("old")
+	connector, path := newTestConnector(t, "old", &validPassword)
+	rotated := make(chan struct{}, 1)
+	connector.onRotate = func() { rotated <- struct{}{} }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go connector.Watch(ctx, time.Millisecond*10)
+
+	// An empty file, e.g. part way through being rewritten, is ignored
+	writePassword(t, path, "")
+	time.Sleep(time.Millisecond * 50)
+	assert.Equal(t, "old", connector.current().DBPassword)
+
+	writePassword(t, path, "new")
+	select {
+	case <-rotated:
+	case <-time.After(time.Second):
+		t.Fatal("password file change not picked up")
+	}
+	assert.Equal(t, "new", connector.current().DBPassword)
+}
+
+// TestIsAuthFailure tests that only authentication errors cause the password to be re-read
+func TestIsAuthFailure(t *testing.T) {
+	assert.True(t, isAuthFailure(&pq.Error{Code: pqInvalidPassword}))
+	assert.True(t, isAuthFailure(&pq.Error{Code: pqInvalidAuthorization}))
+	assert.False(t, isAuthFailure(&pq.Error{Code: uniqueViolation}))
+	assert.False(t, isAuthFailure(errors.New("connection refused")))
+}
@@ -1,57 +1,321 @@
 package api
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"time"
 
+	"github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 )
 
-// queryRecordCount returns the count of records based one 1 of 3 filters (only 1 can be used at once)
+var (
+	// ErrUserNotFound is returned when getting, updating or deleting a logon_name which is not in the users table
+	ErrUserNotFound = errors.New("user not found")
+	// ErrLogonNameTaken is returned when adding a user whose logon_name is already in the users table
+	ErrLogonNameTaken = errors.New("logon_name already taken")
+)
+
+// uniqueViolation is the Postgres error code raised when a unique constraint is violated
+const uniqueViolation = "23505"
+
+// dbConn is the subset of methods shared by *sql.DB and *sql.Tx, so that UserModel queries can run either inside or outside a transaction
+type dbConn interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// conn returns the transaction if the model has been scoped to one by withTx, otherwise the connection pool, through the
+// prepared statements if there are any. Every query is traced
+func (m *UserModel) conn() dbConn {
+	switch {
+	case m.tx != nil:
+		return tracedConn{conn: m.tx, system: semconv.DBSystemPostgreSQL}
+	case m.Stmts != nil:
+		return tracedConn{conn: m.Stmts, system: semconv.DBSystemPostgreSQL}
+	}
+	return tracedConn{conn: m.DB, system: semconv.DBSystemPostgreSQL}
+}
+
+// readConn returns the connection for a read-only query. Reads outside a transaction go to the replica, if there is one and
+// the ReplicaRouter allows it. The second return value is true if the replica is being used
+func (m *UserModel) readConn(ctx context.Context) (dbConn, bool) {
+	if m.tx == nil && m.Replica != nil && m.Replica.useReplica(ctx) {
+		return m.Replica.conn(), true
+	}
+	return m.conn(), false
+}
+
+// read runs the read-only query on the connection from readConn. If it fails on the replica it is retried on the primary
+func (m *UserModel) read(ctx context.Context, query func(conn dbConn) error) error {
+	conn, onReplica := m.readConn(ctx)
+	err := query(conn)
+	if onReplica && m.Replica.fallBack(ctx, err) {
+		log.WithError(err).Warn("query failed on the database replica. Retrying on the primary")
+		return query(m.conn())
+	}
+	return err
+}
+
+// WithTx runs fn inside a database transaction, committing if fn returns nil and rolling back otherwise.
+// Calls on a model which is already scoped to a transaction reuse it rather than nesting
+func (m *UserModel) WithTx(ctx context.Context, fn func(UserStore) error) error {
+	if m.tx != nil {
+		return fn(m)
+	}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+
+	if err = fn(&UserModel{DB: m.DB, tx: tx}); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			log.WithError(rbErr).Error("rolling back transaction")
+		}
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("committing transaction: %w", err)
+	}
+	return nil
+}
+
+// QueryRecordCount returns the count of records based one 1 of 3 filters (only 1 can be used at once)
 // 1) records which have a full_name which have a wildcard match against nameFilter
 // 2) records which have a logon_name which has an exact match against logonNameFilter
 // 3) all records in the users table (no filters)
-func (m *UserModel) queryRecordCount(nameFilter, logonNameFilter string) (int, error) {
+func (m *UserModel) QueryRecordCount(ctx context.Context, nameFilter, logonNameFilter string) (int, error) {
 	var count int
-	var row *sql.Row
-	var err error
 
 	if nameFilter != "" && logonNameFilter != "" {
 		return 0, fmt.Errorf("cannot define both nameFilter and logonNameFilter for queryRecordCount function")
 	}
 
+	err := m.read(ctx, func(conn dbConn) (err error) {
+		if logonNameFilter != "" {
+			return conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM users WHERE logon_name = $1", logonNameFilter).Scan(&count)
+		}
+		count, err = countUsers(ctx, conn, nameFilter)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// countUsers counts the users whose full_name contains nameFilter on conn. With no filter every user is counted
+func countUsers(ctx context.Context, conn dbConn, nameFilter string) (int, error) {
+	var count int
+	var row *sql.Row
+	if nameFilter != "" {
+		row = conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM users WHERE full_name like '%' || $1 || '%'", nameFilter)
+	} else {
+		row = conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM users")
+	}
+	if err := row.Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// QueryUsers returns a page of the users whose full_name contains nameFilter, ordered by user_id, along with the total number
+// of users which match. The page and the total come from the same statement, so they always agree. LastModified is left zero,
+// as updated_at and the event times are when each transaction started rather than when it committed, so a write which
+// committed later could still carry an older time than one which has already been read
+func (m *UserModel) QueryUsers(ctx context.Context, offset, limit int, nameFilter string) (UsersPage, error) {
+	var page UsersPage
+	err := m.read(ctx, func(conn dbConn) (err error) {
+		if nameFilter == "" && m.ApproximateCountAbove > 0 {
+			var estimate int
+			if estimate, err = estimateUserCount(ctx, conn); err != nil {
+				return err
+			}
+			if estimate > m.ApproximateCountAbove {
+				page, err = queryUsersApproximate(ctx, conn, offset, limit, estimate)
+				return err
+			}
+		}
+		page, err = queryUsers(ctx, conn, offset, limit, nameFilter)
+		return err
+	})
+	return page, err
+}
+
+// queryUsers runs the query for QueryUsers on conn. COUNT(*) OVER() adds the number of rows which match the filter to every
+// row of the page. A page past the end has no rows to carry it, so the users are counted separately, which only affects the 404
+func queryUsers(ctx context.Context, conn dbConn, offset, limit int, nameFilter string) (UsersPage, error) {
+	page := UsersPage{Users: make([]User, 0)}
+	var err error
+	var rows *sql.Rows
+
 	if nameFilter != "" {
-		row = m.DB.QueryRow("SELECT COUNT(*) FROM users WHERE full_name like '%' || $1 || '%'", nameFilter)
-	} else if logonNameFilter != "" {
-		row = m.DB.QueryRow("SELECT COUNT(*) FROM users WHERE logon_name = $1", logonNameFilter)
+		rows, err = conn.QueryContext(ctx, `SELECT user_id, logon_name, full_name, email, COUNT(*) OVER() FROM users WHERE full_name like '%' || $1 || '%' ORDER BY user_id OFFSET $2 LIMIT $3`, nameFilter, offset, limit)
 	} else {
-		row = m.DB.QueryRow("SELECT COUNT(*) FROM users")
+		rows, err = conn.QueryContext(ctx, `SELECT user_id, logon_name, full_name, email, COUNT(*) OVER() FROM users ORDER BY user_id OFFSET $1 LIMIT $2`, offset, limit)
+	}
+	if err != nil {
+		return page, fmt.Errorf("querying database for users: %w", err)
+	}
+	if page.Users, err = scanUsers(rows, &page.Total); err != nil {
+		return page, err
 	}
 
-	err = row.Scan(&count)
+	if len(page.Users) == 0 && offset > 0 {
+		if page.Total, err = countUsers(ctx, conn, nameFilter); err != nil {
+			return page, fmt.Errorf("counting users: %w", err)
+		}
+	}
+	return page, nil
+}
+
+// SearchUsers returns a page of the users whose logon_name, full_name or email contain query, or have a word which is close
+// to it, ranked by similarity. The search ignores case & accents. Only users scoring at least minScore are returned
+func (m *UserModel) SearchUsers(ctx context.Context, query string, minScore float64, offset, limit int) (UsersPage, error) {
+	var page UsersPage
+	err := m.read(ctx, func(conn dbConn) (err error) {
+		page, err = searchUsers(ctx, conn, query, minScore, offset, limit)
+		return err
+	})
+	return page, err
+}
+
+// searchUsers runs the query for SearchUsers on conn. As with queryUsers, the total is returned with the page
+func searchUsers(ctx context.Context, conn dbConn, query string, minScore float64, offset, limit int) (UsersPage, error) {
+	page := UsersPage{Users: make([]User, 0)}
+	pattern := escapeLikePattern(query)
+	rows, err := conn.QueryContext(ctx, `SELECT user_id, logon_name, full_name, email, COUNT(*) OVER() FROM users
+	WHERE `+userSearchCondition+`
+	ORDER BY word_similarity(lower(immutable_unaccent($1)), user_search_text(logon_name, full_name, email)) DESC, user_id
+	OFFSET $4 LIMIT $5`, query, pattern, minScore, offset, limit)
 	if err != nil {
-		return 0, err
+		return page, fmt.Errorf("searching database for users: %w", err)
+	}
+	if page.Users, err = scanUsers(rows, &page.Total); err != nil {
+		return page, err
 	}
 
-	return count, nil
+	if len(page.Users) == 0 && offset > 0 {
+		err = conn.QueryRowContext(ctx, `SELECT COUNT(*) FROM users WHERE `+userSearchCondition, query, pattern, minScore).Scan(&page.Total)
+		if err != nil {
+			return page, fmt.Errorf("counting users matching search: %w", err)
+		}
+	}
+	return page, nil
+}
+
+// estimateUserCount returns the number of rows in the users table from the planner statistics, which are kept up to date by
+// autovacuum. It is -1 if the table has never been analysed
+func estimateUserCount(ctx context.Context, conn dbConn) (int, error) {
+	var estimate int
+	if err := conn.QueryRowContext(ctx, `SELECT reltuples::bigint FROM pg_class WHERE oid = 'users'::regclass`).Scan(&estimate); err != nil {
+		return 0, fmt.Errorf("estimating the number of users: %w", err)
+	}
+	return estimate, nil
 }
 
-// queryUsers returns a slice of Users from the users table based on the supplied offset, limit & nameFilter
-func (m *UserModel) queryUsers(offset, limit int, nameFilter string) ([]User, error) {
-	usersDBResponse := make([]User, 0)
+// queryUsersApproximate returns a page of every user, with estimate as the total. Counting every row of a very large table is
+// slow, whilst the estimate is read from the statistics. One extra row is fetched to tell whether there are more pages, so the
+// total is raised to cover them if the estimate is too low, and is exact when the page is the last one
+func queryUsersApproximate(ctx context.Context, conn dbConn, offset, limit, estimate int) (UsersPage, error) {
+	page := UsersPage{Users: make([]User, 0)}
+	rows, err := conn.QueryContext(ctx, `SELECT user_id, logon_name, full_name, email FROM users ORDER BY user_id OFFSET $1 LIMIT $2`, offset, limit+1)
+	if err != nil {
+		return page, fmt.Errorf("querying database for users: %w", err)
+	}
+	if page.Users, err = scanUsers(rows, nil); err != nil {
+		return page, err
+	}
+
+	switch {
+	case len(page.Users) > limit:
+		page.Users = page.Users[:limit]
+		page.Total = max(estimate, offset+limit+1)
+		page.Approximate = true
+	case len(page.Users) > 0 || offset == 0:
+		page.Total = offset + len(page.Users)
+	default:
+		// Past the last page, so only known to be no more than offset
+		page.Total = min(estimate, offset)
+		page.Approximate = true
+	}
+	return page, nil
+}
+
+// scanUsers reads every row into a User, closing rows. If total is not nil the rows have a trailing COUNT(*) OVER() column,
+// which is scanned into it
+func scanUsers(rows *sql.Rows, total *int) ([]User, error) {
+	users := make([]User, 0)
+	defer func(rows *sql.Rows) {
+		if err := rows.Close(); err != nil {
+			log.WithError(err).Error("closing DB rows response")
+		}
+	}(rows)
+
+	for rows.Next() {
+		user := User{}
+		dest := []any{&user.UserID, &user.LogonName, &user.FullName, &user.Email}
+		if total != nil {
+			dest = append(dest, total)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return users, fmt.Errorf("scanning over the DB results: %w", err)
+		}
+		users = append(users, user)
+	}
+
+	// Check for errors from iterating over rows.
+	if err := rows.Err(); err != nil {
+		return users, fmt.Errorf("iterating over the DB results: %w", err)
+	}
+
+	return users, nil
+}
+
+// GetUser returns the user with logonName, or ErrUserNotFound if there is none
+func (m *UserModel) GetUser(ctx context.Context, logonName string) (User, error) {
+	var user User
+	err := m.read(ctx, func(conn dbConn) error {
+		return conn.QueryRowContext(ctx, `SELECT user_id, logon_name, full_name, email FROM users WHERE logon_name = $1`, logonName).
+			Scan(&user.UserID, &user.LogonName, &user.FullName, &user.Email)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return user, ErrUserNotFound
+	}
+	if err != nil {
+		return user, fmt.Errorf("querying database for logon_name '%s': %w", logonName, err)
+	}
+	return user, nil
+}
+
+// StreamUsers iterates over every record in the users table which matches nameFilter, calling fn for each one.
+// Rows are read from the connection one at a time rather than buffered, and the query is cancelled if ctx is done
+func (m *UserModel) StreamUsers(ctx context.Context, nameFilter string, fn func(User) error) error {
 	var err error
 	var rows *sql.Rows
 
+	// Streams aren't retried on the primary if the replica fails, as some users may already have been passed to fn
+	conn, _ := m.readConn(ctx)
+
 	if nameFilter != "" {
-		rows, err = m.DB.Query(`SELECT user_id, logon_name, full_name, email FROM users WHERE full_name like '%' || $1 || '%' ORDER BY user_id OFFSET $2 LIMIT $3`, nameFilter, offset, limit)
+		rows, err = conn.QueryContext(ctx, `SELECT user_id, logon_name, full_name, email FROM users WHERE full_name like '%' || $1 || '%' ORDER BY user_id`, nameFilter)
 	} else {
-		rows, err = m.DB.Query(`SELECT user_id, logon_name, full_name, email FROM users ORDER BY user_id OFFSET $1 LIMIT $2`, offset, limit)
+		rows, err = conn.QueryContext(ctx, `SELECT user_id, logon_name, full_name, email FROM users ORDER BY user_id`)
 	}
 	if err != nil {
-		return usersDBResponse, fmt.Errorf("querying database for users: %v", err)
+		return fmt.Errorf("querying database for users export: %w", err)
 	}
 	defer func(rows *sql.Rows) {
-		err = rows.Close()
+		err := rows.Close()
 		if err != nil {
 			log.WithError(err).Error("closing DB rows response")
 		}
@@ -60,80 +324,579 @@ func (m *UserModel) queryUsers(offset, limit int, nameFilter string) ([]User, er
 	for rows.Next() {
 		user := User{}
 		if err = rows.Scan(&user.UserID, &user.LogonName, &user.FullName, &user.Email); err != nil {
-			return usersDBResponse, fmt.Errorf("scanning over the DB results: %v", err)
+			return fmt.Errorf("scanning over the DB results: %w", err)
+		}
+		if err = fn(user); err != nil {
+			return err
 		}
-		usersDBResponse = append(usersDBResponse, user)
 	}
 
-	// Check for errors from iterating over rows.
 	if err = rows.Err(); err != nil {
-		return usersDBResponse, fmt.Errorf("iterating over the DB results: %v", err)
+		return fmt.Errorf("iterating over the DB results: %w", err)
 	}
 
-	return usersDBResponse, nil
+	return nil
 }
 
-// addUser adds a new user to the users table
-func (m *UserModel) addUser(user User) (User, error) {
-	err := m.DB.QueryRow(`INSERT INTO users(logon_name, full_name, email) VALUES ($1, $2, $3) RETURNING user_id`, user.LogonName, user.FullName, user.Email).Scan(&user.UserID)
+// AddUser adds a new user to the users table, recording a user.created event in the same transaction
+func (m *UserModel) AddUser(ctx context.Context, user User) (User, error) {
+	err := m.inTx(ctx, func(tx *UserModel) error {
+		err := tx.conn().QueryRowContext(ctx, `INSERT INTO users(logon_name, full_name, email) VALUES ($1, $2, $3) RETURNING user_id`, user.LogonName, user.FullName, user.Email).Scan(&user.UserID)
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == uniqueViolation {
+			return ErrLogonNameTaken
+		}
+		if err != nil {
+			return fmt.Errorf("inserting logon_name '%s' into users table: %w", user.LogonName, err)
+		}
+		return tx.recordEvent(ctx, EventUserCreated, user)
+	})
+
+	return user, err
+}
+
+// DeleteUser deletes a user from the users table, recording a user.deleted event in the same transaction.
+// Returns ErrUserNotFound if there is no user with logonName
+func (m *UserModel) DeleteUser(ctx context.Context, logonName string) error {
+	return m.inTx(ctx, func(tx *UserModel) error {
+		var user User
+		err := tx.conn().QueryRowContext(ctx, `DELETE FROM users WHERE logon_name = $1 RETURNING user_id, logon_name, full_name, email`, logonName).Scan(&user.UserID, &user.LogonName, &user.FullName, &user.Email)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUserNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("deleting record with logon_name = '%s' from users table: %w", logonName, err)
+		}
+		return tx.recordEvent(ctx, EventUserDeleted, user)
+	})
+}
+
+// UpdateUser updates a single record in the users table based on the logon_name, recording a user.updated event in the same transaction
+// Supports updating email or logon_name fields or both. Returns ErrUserNotFound if there is no user with the logon_name
+func (m *UserModel) UpdateUser(ctx context.Context, user User) (User, error) {
+	log.Debugf("user: %#v", user)
+	if user.Email == "" && user.FullName == "" {
+		return user, fmt.Errorf("email and/or full_name fields need to be set in the user object")
+	}
+
+	err := m.inTx(ctx, func(tx *UserModel) error {
+		var err error
+		if user.Email != "" && user.FullName != "" {
+			err = tx.conn().QueryRowContext(ctx, `UPDATE users SET email = $1, full_name = $2 WHERE logon_name = $3 RETURNING user_id, logon_name, full_name, email`, user.Email, user.FullName, user.LogonName).Scan(&user.UserID, &user.LogonName, &user.FullName, &user.Email)
+		} else if user.Email != "" {
+			err = tx.conn().QueryRowContext(ctx, `UPDATE users SET email = $1 WHERE logon_name = $2 RETURNING user_id, logon_name, full_name, email`, user.Email, user.LogonName).Scan(&user.UserID, &user.LogonName, &user.FullName, &user.Email)
+		} else {
+			err = tx.conn().QueryRowContext(ctx, `UPDATE users SET full_name = $1 WHERE logon_name = $2 RETURNING user_id, logon_name, full_name, email`, user.FullName, user.LogonName).Scan(&user.UserID, &user.LogonName, &user.FullName, &user.Email)
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUserNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("updating record: %w", err)
+		}
+		return tx.recordEvent(ctx, EventUserUpdated, user)
+	})
+
+	return user, err
+}
+
+// inTx runs fn inside a transaction, reusing the current one if the model is already scoped to a transaction
+func (m *UserModel) inTx(ctx context.Context, fn func(tx *UserModel) error) error {
+	return m.WithTx(ctx, func(s UserStore) error {
+		return fn(s.(*UserModel))
+	})
+}
+
+// recordEvent writes a user lifecycle event to the user_events outbox table. Must be called within a transaction
+func (m *UserModel) recordEvent(ctx context.Context, eventType string, user User) error {
+	payload, err := json.Marshal(user)
+	if err != nil {
+		return fmt.Errorf("marshalling %s event payload: %w", eventType, err)
+	}
+	_, err = m.conn().ExecContext(ctx, `INSERT INTO user_events(event_type, logon_name, payload) VALUES ($1, $2, $3)`, eventType, user.LogonName, payload)
 	if err != nil {
-		return user, fmt.Errorf("inserting logon_name '%s' into users table: %v", user.LogonName, err)
+		return fmt.Errorf("inserting %s event for logon_name '%s' into user_events table: %w", eventType, user.LogonName, err)
 	}
+	return nil
+}
 
-	return user, nil
+// processOutbox passes up to limit unpublished events to fn in the order they were recorded, then marks the events whose
+// IDs fn returns as published. Events for any user in excludeLogonNames are skipped. fn is called outside of any transaction,
+// so a slow publisher doesn't hold one open. A session advisory lock, held on a dedicated connection from reading the batch until
+// it has been marked, ensures that only one replica relays events at a time, which keeps events for the same user in order.
+// Returns the number of events which were marked as published
+func (m *UserModel) processOutbox(ctx context.Context, limit int, excludeLogonNames []string, fn func([]UserEvent) []int64) (int, error) {
+	session, err := m.DB.Conn(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("acquiring outbox connection: %v", err)
+	}
+	defer func() { _ = session.Close() }()
+	conn := tracedConn{conn: session, system: semconv.DBSystemPostgreSQL}
+
+	var locked bool
+	if err = conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, outboxAdvisoryLockID).Scan(&locked); err != nil {
+		return 0, fmt.Errorf("acquiring outbox advisory lock: %v", err)
+	}
+	if !locked {
+		log.Debug("outbox is locked by another replica")
+		return 0, nil
+	}
+	defer func() {
+		// The lock belongs to the session, so it would outlive this call if the connection went back to the pool still holding it
+		if _, err := conn.ExecContext(context.WithoutCancel(ctx), `SELECT pg_advisory_unlock($1)`, outboxAdvisoryLockID); err != nil {
+			log.WithError(err).Error("releasing outbox advisory lock. Discarding the connection")
+			_ = session.Raw(func(any) error { return driver.ErrBadConn })
+		}
+	}()
+
+	rows, err := conn.QueryContext(ctx, `SELECT event_id, event_type, logon_name, payload, created_at, feed_position FROM user_events
+		WHERE published_at IS NULL AND NOT (logon_name = ANY($1)) ORDER BY event_id LIMIT $2`, pq.Array(excludeLogonNames), limit)
+	if err != nil {
+		return 0, fmt.Errorf("querying user_events table: %v", err)
+	}
+	events, err := scanUserEvents(rows, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	ids := fn(events)
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	// Mark the events even if ctx has been cancelled whilst publishing, as they have already been accepted by the publisher
+	if _, err = conn.ExecContext(context.WithoutCancel(ctx), `UPDATE user_events SET published_at = now() WHERE event_id = ANY($1)`, pq.Array(ids)); err != nil {
+		return 0, fmt.Errorf("marking events as published: %v", err)
+	}
+	return len(ids), nil
 }
 
-// deleteUser deletes a user from the users table
-func (m *UserModel) deleteUser(logonName string) error {
-	_, err := m.DB.Exec(`DELETE FROM users WHERE logon_name = $1`, logonName)
+// scanUserEvents reads every row of a user_events query and closes rows
+func scanUserEvents(rows *sql.Rows, capacity int) ([]UserEvent, error) {
+	defer func() { _ = rows.Close() }()
+
+	events := make([]UserEvent, 0, capacity)
+	for rows.Next() {
+		var event UserEvent
+		var payload []byte
+		var position sql.NullInt64
+		if err := rows.Scan(&event.EventID, &event.EventType, &event.LogonName, &payload, &event.CreatedAt, &position); err != nil {
+			return nil, fmt.Errorf("scanning over the user_events results: %v", err)
+		}
+		if err := json.Unmarshal(payload, &event.User); err != nil {
+			return nil, fmt.Errorf("unmarshalling payload of event %d: %v", event.EventID, err)
+		}
+		event.Position = position.Int64
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating over the user_events results: %v", err)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, fmt.Errorf("closing user_events rows: %v", err)
+	}
+	return events, nil
+}
+
+// runSequencer gives newly committed events their feed positions whenever wake fires, and at least every
+// changeFeedSequencerInterval in case a notification was missed. It runs on a dedicated session which holds the sequencer's
+// advisory lock for as long as it runs, so that only one replica assigns positions. It returns nil straight away if another
+// replica holds the lock
+func (m *UserModel) runSequencer(ctx context.Context, wake <-chan struct{}) error {
+	session, err := m.DB.Conn(ctx)
 	if err != nil {
-		return fmt.Errorf("deleting record with logon_name = '%s' from users table: %v", logonName, err)
+		return fmt.Errorf("acquiring change feed sequencer connection: %v", err)
 	}
+	defer func() { _ = session.Close() }()
+	conn := tracedConn{conn: session, system: semconv.DBSystemPostgreSQL}
 
+	var locked bool
+	if err = conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, changeFeedSequencerLockID).Scan(&locked); err != nil {
+		return fmt.Errorf("acquiring change feed sequencer advisory lock: %v", err)
+	}
+	if !locked {
+		log.Debug("change feed is sequenced by another replica")
+		return nil
+	}
+	defer func() {
+		// The lock belongs to the session, so it would outlive this call if the connection went back to the pool still holding it
+		if _, err := conn.ExecContext(context.WithoutCancel(ctx), `SELECT pg_advisory_unlock($1)`, changeFeedSequencerLockID); err != nil {
+			log.WithError(err).Error("releasing change feed sequencer advisory lock. Discarding the connection")
+			_ = session.Raw(func(any) error { return driver.ErrBadConn })
+		}
+	}()
+	log.Info("Sequencing the change feed")
+
+	ticker := time.NewTicker(changeFeedSequencerInterval)
+	defer ticker.Stop()
+	for {
+		if err = sequenceEvents(ctx, conn); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// sequenceEvents gives every committed event which doesn't have a feed position yet the next one, in event_id order, then
+// notifies changeFeedSequencedChannel if there were any. event_id is taken from its sequence when the event is inserted, so a
+// lower one can commit after a higher one has already been read. Positions are only assigned by the session holding the
+// sequencer lock, one statement at a time, so they follow the order in which events were committed. The notification is
+// sent when the statement commits, so listeners can read the new positions as soon as they hear it
+func sequenceEvents(ctx context.Context, conn dbConn) error {
+	_, err := conn.ExecContext(ctx, `WITH sequenced AS (
+			UPDATE user_events SET feed_position = numbered.feed_position
+			FROM (SELECT event_id, (SELECT COALESCE(MAX(feed_position), 0) FROM user_events) + row_number() OVER (ORDER BY event_id) AS feed_position
+				FROM user_events WHERE feed_position IS NULL) AS numbered
+			WHERE user_events.event_id = numbered.event_id
+			RETURNING user_events.feed_position)
+		SELECT pg_notify($1, MAX(feed_position)::text) FROM sequenced HAVING COUNT(*) > 0`, changeFeedSequencedChannel)
+	if err != nil {
+		return fmt.Errorf("assigning feed positions to user_events: %v", err)
+	}
 	return nil
 }
 
-// updateUser updates a single record in the users table based on the logon_name
-// Supports updating email or logon_name fields or both
-func (m *UserModel) updateUser(user User) (User, error) {
-	log.Debugf("user: %#v", user)
-	var err error
-	if user.Email != "" && user.FullName != "" {
-		err = m.DB.QueryRow(`UPDATE users SET email = $1, full_name = $2 WHERE logon_name = $3 RETURNING *`, user.Email, user.FullName, user.LogonName).Scan(&user.UserID, &user.LogonName, &user.FullName, &user.Email)
-	} else if user.Email != "" {
-		err = m.DB.QueryRow(`UPDATE users SET email = $1 WHERE logon_name = $2 RETURNING *`, user.Email, user.LogonName).Scan(&user.UserID, &user.LogonName, &user.FullName, &user.Email)
-	} else if user.FullName != "" {
-		err = m.DB.QueryRow(`UPDATE users SET full_name = $1 WHERE logon_name = $2 RETURNING *`, user.FullName, user.LogonName).Scan(&user.UserID, &user.LogonName, &user.FullName, &user.Email)
-	} else {
-		return user, fmt.Errorf("email and/or full_name fields need to be set in the user object")
+// queryEventsSince returns up to limit events with a feed position after afterPosition, in the order they were committed.
+// Events which haven't been given a position by the sequencer yet are left for a later read
+func (m *UserModel) queryEventsSince(ctx context.Context, afterPosition int64, limit int) ([]UserEvent, error) {
+	rows, err := m.conn().QueryContext(ctx, `SELECT event_id, event_type, logon_name, payload, created_at, feed_position FROM user_events
+		WHERE feed_position > $1 ORDER BY feed_position LIMIT $2`, afterPosition, limit)
+	if err != nil {
+		return nil, fmt.Errorf("querying user_events table: %v", err)
+	}
+	return scanUserEvents(rows, limit)
+}
+
+// latestPosition returns the highest feed position given out so far, or 0 if there is none
+func (m *UserModel) latestPosition(ctx context.Context) (int64, error) {
+	var position int64
+	if err := m.conn().QueryRowContext(ctx, `SELECT COALESCE(MAX(feed_position), 0) FROM user_events`).Scan(&position); err != nil {
+		return 0, fmt.Errorf("querying latest feed_position from user_events table: %v", err)
+	}
+	return position, nil
+}
+
+// reserveIdempotencyKey claims key for a new request, taking over any existing record which has expired.
+// If the key is still held then the existing record is returned instead
+func (m *IdempotencyModel) reserveIdempotencyKey(ctx context.Context, key, fingerprint string, ttl time.Duration) (idempotencyRecord, bool, error) {
+	var record idempotencyRecord
+	var returnedKey string
+
+	err := m.DB.QueryRowContext(ctx, `INSERT INTO idempotency_keys(idempotency_key, fingerprint, expires_at) VALUES ($1, $2, now() + $3 * interval '1 second')
+		ON CONFLICT (idempotency_key) DO UPDATE SET fingerprint = EXCLUDED.fingerprint, status_code = NULL, content_type = NULL, response_body = NULL, expires_at = EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at < now()
+		RETURNING idempotency_key`, key, fingerprint, ttl.Seconds()).Scan(&returnedKey)
+	if err == nil {
+		return record, true, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return record, false, fmt.Errorf("inserting idempotency key '%s': %v", key, err)
 	}
 
+	var statusCode sql.NullInt64
+	var contentType sql.NullString
+	err = m.DB.QueryRowContext(ctx, `SELECT fingerprint, status_code, content_type, response_body FROM idempotency_keys WHERE idempotency_key = $1`, key).
+		Scan(&record.fingerprint, &statusCode, &contentType, &record.body)
 	if err != nil {
-		return user, fmt.Errorf("updating record: %v", err)
+		return record, false, fmt.Errorf("querying idempotency key '%s': %v", key, err)
 	}
+	record.completed = statusCode.Valid
+	record.statusCode = int(statusCode.Int64)
+	record.contentType = contentType.String
 
-	return user, nil
+	return record, false, nil
+}
+
+// deleteExpiredIdempotencyKeys deletes up to limit keys which have expired. Keys which another replica is deleting, or a
+// request is taking over, are skipped rather than waited for. expires_at is checked again once each row is locked, so a key
+// which was taken over in the meantime is kept
+func (m *IdempotencyModel) deleteExpiredIdempotencyKeys(ctx context.Context, limit int) (int, error) {
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE expires_at < now() AND idempotency_key IN
+		(SELECT idempotency_key FROM idempotency_keys WHERE expires_at < now() LIMIT $1 FOR UPDATE SKIP LOCKED)`, limit)
+	if err != nil {
+		return 0, fmt.Errorf("deleting expired idempotency keys: %v", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("counting deleted idempotency keys: %v", err)
+	}
+	return int(deleted), nil
+}
+
+// completeIdempotencyKey stores the response which was returned for key
+func (m *IdempotencyModel) completeIdempotencyKey(ctx context.Context, key string, record idempotencyRecord) error {
+	_, err := m.DB.ExecContext(ctx, `UPDATE idempotency_keys SET status_code = $1, content_type = $2, response_body = $3 WHERE idempotency_key = $4`,
+		record.statusCode, record.contentType, record.body, key)
+	if err != nil {
+		return fmt.Errorf("updating idempotency key '%s': %v", key, err)
+	}
+	return nil
+}
+
+// releaseIdempotencyKey deletes key so that the request can be retried
+func (m *IdempotencyModel) releaseIdempotencyKey(ctx context.Context, key string) error {
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE idempotency_key = $1`, key)
+	if err != nil {
+		return fmt.Errorf("deleting idempotency key '%s': %v", key, err)
+	}
+	return nil
+}
+
+// createWebhookSubscription adds a new subscription to the webhook_subscriptions table
+func (m *WebhookModel) createWebhookSubscription(ctx context.Context, subscription WebhookSubscription) (WebhookSubscription, error) {
+	err := m.DB.QueryRowContext(ctx, `INSERT INTO webhook_subscriptions(url, event_types, secret) VALUES ($1, $2, $3) RETURNING subscription_id, created_at`,
+		subscription.URL, pq.Array(subscription.EventTypes), subscription.Secret).Scan(&subscription.SubscriptionID, &subscription.CreatedAt)
+	if err != nil {
+		return subscription, fmt.Errorf("inserting into webhook_subscriptions table: %v", err)
+	}
+	return subscription, nil
+}
+
+// listWebhookSubscriptions returns every subscription in the webhook_subscriptions table
+func (m *WebhookModel) listWebhookSubscriptions(ctx context.Context) ([]WebhookSubscription, error) {
+	subscriptions := make([]WebhookSubscription, 0)
+	rows, err := m.DB.QueryContext(ctx, `SELECT subscription_id, url, event_types, secret, created_at FROM webhook_subscriptions ORDER BY subscription_id`)
+	if err != nil {
+		return subscriptions, fmt.Errorf("querying webhook_subscriptions table: %v", err)
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			log.WithError(err).Error("closing DB rows response")
+		}
+	}(rows)
+
+	for rows.Next() {
+		var subscription WebhookSubscription
+		if err = rows.Scan(&subscription.SubscriptionID, &subscription.URL, pq.Array(&subscription.EventTypes), &subscription.Secret, &subscription.CreatedAt); err != nil {
+			return subscriptions, fmt.Errorf("scanning over the DB results: %v", err)
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+	if err = rows.Err(); err != nil {
+		return subscriptions, fmt.Errorf("iterating over the DB results: %v", err)
+	}
+
+	return subscriptions, nil
+}
+
+// deleteWebhookSubscription deletes a subscription along with any of its queued deliveries. Returns false if it did not exist
+func (m *WebhookModel) deleteWebhookSubscription(ctx context.Context, subscriptionID int) (bool, error) {
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM webhook_subscriptions WHERE subscription_id = $1`, subscriptionID)
+	if err != nil {
+		return false, fmt.Errorf("deleting subscription_id %d from webhook_subscriptions table: %v", subscriptionID, err)
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("counting deleted webhook subscriptions: %v", err)
+	}
+	return count > 0, nil
 }
 
-// OpenDBConnection opens a Postgres DB connection pool
-func OpenDBConnection() (*Env, error) {
-	EnvConfig = &Env{DBCredentials: DBCredentials{
-		HostName:   RequireStringEnvar("database_host_name"),
-		Port:       RequireIntEnvar("database_port"),
-		DBName:     RequireStringEnvar("database_name"),
-		DBUsername: RequireStringEnvar("database_username"),
-		DBPassword: RequireStringEnvar("database_password"),
-		SSLMode:    RequireStringEnvar("database_ssl_mode")}}
+// enqueueWebhookDeliveries queues a delivery of event for each subscription to its event type
+func (m *WebhookModel) enqueueWebhookDeliveries(ctx context.Context, event UserEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("marshalling event %d: %v", event.EventID, err)
+	}
+	_, err = m.DB.ExecContext(ctx, `INSERT INTO webhook_deliveries(subscription_id, event_id, event_type, payload)
+		SELECT subscription_id, $1, $2, $3 FROM webhook_subscriptions WHERE $2 = ANY(event_types)
+		ON CONFLICT (subscription_id, event_id) DO NOTHING`, event.EventID, event.EventType, payload)
+	if err != nil {
+		return fmt.Errorf("inserting event %d into webhook_deliveries table: %v", event.EventID, err)
+	}
+	return nil
+}
 
-	sqlConnection := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
-		EnvConfig.DBCredentials.HostName, EnvConfig.DBCredentials.Port, EnvConfig.DBCredentials.DBUsername,
-		EnvConfig.DBCredentials.DBPassword, EnvConfig.DBCredentials.DBName, EnvConfig.DBCredentials.SSLMode)
+// claimWebhookDeliveries returns the pending deliveries which are due, pushing their next attempt back by lease so that
+// other replicas do not pick them up at the same time
+func (m *WebhookModel) claimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]webhookDelivery, error) {
+	deliveries := make([]webhookDelivery, 0, limit)
+	rows, err := m.DB.QueryContext(ctx, `UPDATE webhook_deliveries d SET next_attempt_at = now() + $2 * interval '1 second'
+		FROM webhook_subscriptions s
+		WHERE d.subscription_id = s.subscription_id AND d.delivery_id IN (
+			SELECT delivery_id FROM webhook_deliveries WHERE status = 'pending' AND next_attempt_at <= now()
+			ORDER BY delivery_id LIMIT $1 FOR UPDATE SKIP LOCKED)
+		RETURNING d.delivery_id, d.subscription_id, d.event_id, d.event_type, d.status, d.attempts, d.created_at, d.payload, s.url, s.secret`,
+		limit, lease.Seconds())
+	if err != nil {
+		return deliveries, fmt.Errorf("claiming from webhook_deliveries table: %v", err)
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			log.WithError(err).Error("closing DB rows response")
+		}
+	}(rows)
 
-	db, err := sql.Open("postgres", sqlConnection)
+	for rows.Next() {
+		var d webhookDelivery
+		if err = rows.Scan(&d.DeliveryID, &d.SubscriptionID, &d.EventID, &d.EventType, &d.Status, &d.Attempts, &d.CreatedAt, &d.payload, &d.url, &d.secret); err != nil {
+			return deliveries, fmt.Errorf("scanning over the DB results: %v", err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err = rows.Err(); err != nil {
+		return deliveries, fmt.Errorf("iterating over the DB results: %v", err)
+	}
+
+	return deliveries, nil
+}
+
+// markWebhookDelivered records that a delivery was accepted by the subscriber
+func (m *WebhookModel) markWebhookDelivered(ctx context.Context, deliveryID int64) error {
+	_, err := m.DB.ExecContext(ctx, `UPDATE webhook_deliveries SET status = 'delivered', attempts = attempts + 1, last_error = NULL WHERE delivery_id = $1`, deliveryID)
+	if err != nil {
+		return fmt.Errorf("updating webhook delivery %d: %v", deliveryID, err)
+	}
+	return nil
+}
+
+// markWebhookDeliveryFailed records a failed attempt, scheduling the next one or moving the delivery to the dead-letter list
+func (m *WebhookModel) markWebhookDeliveryFailed(ctx context.Context, deliveryID int64, lastError string, nextAttempt time.Time, dead bool) error {
+	status := webhookStatusPending
+	if dead {
+		status = webhookStatusDead
+	}
+	_, err := m.DB.ExecContext(ctx, `UPDATE webhook_deliveries SET status = $1, attempts = attempts + 1, last_error = $2, next_attempt_at = $3 WHERE delivery_id = $4`,
+		status, lastError, nextAttempt, deliveryID)
 	if err != nil {
-		return EnvConfig, fmt.Errorf("opening DB connection: %v", err)
+		return fmt.Errorf("updating webhook delivery %d: %v", deliveryID, err)
+	}
+	return nil
+}
+
+// listDeadLetterDeliveries returns every delivery which has exhausted its retries
+func (m *WebhookModel) listDeadLetterDeliveries(ctx context.Context) ([]WebhookDelivery, error) {
+	deliveries := make([]WebhookDelivery, 0)
+	rows, err := m.DB.QueryContext(ctx, `SELECT delivery_id, subscription_id, event_id, event_type, status, attempts, COALESCE(last_error, ''), created_at
+		FROM webhook_deliveries WHERE status = 'dead' ORDER BY delivery_id`)
+	if err != nil {
+		return deliveries, fmt.Errorf("querying webhook_deliveries table: %v", err)
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			log.WithError(err).Error("closing DB rows response")
+		}
+	}(rows)
+
+	for rows.Next() {
+		var d WebhookDelivery
+		if err = rows.Scan(&d.DeliveryID, &d.SubscriptionID, &d.EventID, &d.EventType, &d.Status, &d.Attempts, &d.LastError, &d.CreatedAt); err != nil {
+			return deliveries, fmt.Errorf("scanning over the DB results: %v", err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err = rows.Err(); err != nil {
+		return deliveries, fmt.Errorf("iterating over the DB results: %v", err)
+	}
+
+	return deliveries, nil
+}
+
+// replayDeadLetterDelivery puts a dead-lettered delivery back on the queue with its attempts reset
+func (m *WebhookModel) replayDeadLetterDelivery(ctx context.Context, deliveryID int64) (bool, error) {
+	result, err := m.DB.ExecContext(ctx, `UPDATE webhook_deliveries SET status = 'pending', attempts = 0, next_attempt_at = now() WHERE delivery_id = $1 AND status = 'dead'`, deliveryID)
+	if err != nil {
+		return false, fmt.Errorf("updating webhook delivery %d: %v", deliveryID, err)
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("counting replayed webhook deliveries: %v", err)
+	}
+	return count > 0, nil
+}
+
+// connectionString returns the lib/pq connection string for the credentials
+func (c DBCredentials) connectionString() string {
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		c.HostName, c.Port, c.DBUsername, c.DBPassword, c.DBName, c.SSLMode)
+}
+
+// openPostgresEnv opens a Postgres DB connection pool and sets up the stores and background workers which depend on it
+func openPostgresEnv(cfg Config) (*Env, error) {
+	EnvConfig = &Env{Config: cfg}
+
+	// Connections are opened with the current credentials, and the idle ones are closed when the password is rotated so that
+	// the pool is rebuilt with the new one. Connections which are in use aren't interrupted
+	connector := newRotatingConnector(cfg.Database)
+	db := sql.OpenDB(connector)
+	pool := cfg.Database.Pool
+	pool.apply(db)
+	connector.onRotate = func() { pool.closeIdle(db) }
+	EnvConfig.DB = db
+	EnvConfig.Credentials = connector
+
+	// Only the users store reads from the replica. The other stores and the background workers always use the primary
+	if cfg.Database.ReplicaHostName != "" {
+		replicaCredentials := cfg.Database
+		replicaCredentials.HostName = cfg.Database.ReplicaHostName
+		replicaConnector := newRotatingConnector(replicaCredentials)
+		replicaDB := sql.OpenDB(replicaConnector)
+		pool.apply(replicaDB)
+		replicaConnector.onRotate = func() { pool.closeIdle(replicaDB) }
+		// The replica shares the password file, so picks up a rotation as soon as the primary does
+		connector.onRotate = func() {
+			pool.closeIdle(db)
+			if _, err := replicaConnector.reloadPassword(); err != nil {
+				log.WithError(err).Error("re-reading database password file for the replica")
+			}
+		}
+		EnvConfig.Replica = NewReplicaRouter(db, replicaDB, cfg.Database.ReplicaCheckInterval)
+		if pool.PreparedStatements {
+			EnvConfig.Replica.Stmts = newStmtCache(replicaDB)
+		}
+	}
+
+	// Only the users queries are prepared, as they are run on every list request
+	users := &UserModel{DB: db, Replica: EnvConfig.Replica, ApproximateCountAbove: cfg.Database.ApproximateCountAbove}
+	if pool.PreparedStatements {
+		users.Stmts = newStmtCache(db)
+	}
+
+	// Each query timeout covers every retry of the call
+	EnvConfig.Metrics = NewMetrics(db)
+	EnvConfig.Breaker = NewCircuitBreaker(cfg.CircuitBreaker)
+	EnvConfig.Metrics.registerCircuitBreaker(EnvConfig.Breaker)
+	EnvConfig.UsersDB = EnvConfig.Metrics.instrumentStore(withQueryTimeouts(
+		withRetries(users, cfg.Retries, EnvConfig.Breaker, EnvConfig.Metrics.observeRetry),
+		cfg.QueryTimeouts))
+	EnvConfig.enableCache(cfg.Cache)
+	EnvConfig.Idempotency = &IdempotencyModel{DB: db}
+	EnvConfig.IdempotencyKeyTTL = cfg.Idempotency.KeyTTL
+
+	publisher, err := NewPublisher(cfg.Events)
+	if err != nil {
+		return EnvConfig, fmt.Errorf("configuring event publisher: %v", err)
+	}
+
+	// Events are always fanned out to the webhook subscribers, as well as to the optional publisher from events.publisher
+	webhooks := &WebhookModel{DB: db}
+	publishers := MultiPublisher{&SubscriptionPublisher{Store: webhooks}}
+	if publisher != nil {
+		publishers = append(publishers, publisher)
+	}
+	EnvConfig.Webhooks = webhooks
+	EnvConfig.EventRelay = &EventRelay{
+		Store:     &UserModel{DB: db},
+		Publisher: publishers,
+		Interval:  cfg.Events.RelayInterval,
+	}
+	EnvConfig.WebhookDispatcher = &WebhookDispatcher{
+		Store:       webhooks,
+		MaxAttempts: cfg.Webhooks.MaxAttempts,
+		BaseBackoff: cfg.Webhooks.BaseBackoff,
+	}
+	EnvConfig.Changes = &ChangeFeed{
+		Store:            &UserModel{DB: db},
+		Sequencer:        &UserModel{DB: db},
+		ConnectionString: connector.connectionString,
 	}
-	EnvConfig.UsersDB = &UserModel{DB: db}
 
 	return EnvConfig, nil
 }
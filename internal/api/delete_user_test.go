@@ -11,37 +11,18 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-// mockDeleteUserModel is used to mock the Postgres DB calls
-type mockDeleteUserModel struct{}
-
-func (m *mockDeleteUserModel) queryUsers(_, _ int, _ string) (users []User, err error) {
-	return
-}
-
-func (m *mockDeleteUserModel) addUser(_ User) (user User, err error) {
-	return
-}
-
-func (m *mockDeleteUserModel) queryRecordCount(_, logonNameFilter string) (count int, err error) {
-	switch logonNameFilter {
-	case "testuser6":
-		return 1, nil
-	default:
-		return 0, nil
-	}
+// newDeleteUserTestStore returns an in-memory store seeded with the user which the DELETE tests remove
+func newDeleteUserTestStore() *MemoryUserModel {
+	return NewMemoryUserModel(User{LogonName: "testuser6", FullName: "Test User 6", Email: "testuser6@email.com"})
 }
 
-func (m *mockDeleteUserModel) deleteUser(_ string) (err error) { return }
-
-func (m *mockDeleteUserModel) updateUser(_ User) (user User, err error) { return }
-
-func setupMockDeleteUserHTTPHandler(logonName string) *httptest.ResponseRecorder {
+func setupMockDeleteUserHTTPHandler(store UserStore, logonName string) *httptest.ResponseRecorder {
 	recorder := httptest.NewRecorder()
 	req, err := http.NewRequest("DELETE", fmt.Sprintf("/users/%s", logonName), nil)
 	if err != nil {
 		log.Fatal("creating new DELETE users request")
 	}
-	env := &Env{UsersDB: &mockDeleteUserModel{}}
+	env := &Env{UsersDB: store}
 
 	// Need to create a router so that the URI parameters (logon_name) are picked up
 	router := mux.NewRouter()
@@ -52,12 +33,14 @@ func setupMockDeleteUserHTTPHandler(logonName string) *httptest.ResponseRecorder
 
 // TestDeleteUser tests deleting a user
 func TestDeleteUser(t *testing.T) {
-	rec := setupMockDeleteUserHTTPHandler("testuser6")
+	store := newDeleteUserTestStore()
+	rec := setupMockDeleteUserHTTPHandler(store, "testuser6")
 	assert.Equal(t, 204, rec.Code)
+	assert.False(t, userExists(t, store, "testuser6"))
 }
 
 // TestDeleteNotFoundUser tests attempting to delete a user which does not exist in the DB
 func TestDeleteNotFoundUser(t *testing.T) {
-	rec := setupMockDeleteUserHTTPHandler("testuser7")
+	rec := setupMockDeleteUserHTTPHandler(newDeleteUserTestStore(), "testuser7")
 	assert.Equal(t, 404, rec.Code)
 }
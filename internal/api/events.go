@@ -0,0 +1,130 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	EventUserCreated = "user.created"
+	EventUserUpdated = "user.updated"
+	EventUserDeleted = "user.deleted"
+
+	defaultEventRelayInterval   = time.Second
+	defaultEventRelayBatchSize  = 100
+	defaultEventRelayRetryDelay = time.Second * 10
+
+	// outboxAdvisoryLockID is an arbitrary key for the Postgres advisory lock which serialises the event relays across replicas
+	outboxAdvisoryLockID = 732584
+)
+
+// UserEvent is a user lifecycle change which is recorded in the outbox and published by the EventRelay
+type UserEvent struct {
+	EventID   int64     `json:"event_id"`
+	EventType string    `json:"event_type"`
+	LogonName string    `json:"logon_name"`
+	User      User      `json:"user"`
+	CreatedAt time.Time `json:"created_at"`
+	// Position is the event's place in the change feed, which follows the order events were committed in. It is sent as the
+	// SSE id rather than in the payload, and is 0 until the change feed has read the event
+	Position int64 `json:"-"`
+}
+
+// outboxStore is the source of unpublished events for the EventRelay
+type outboxStore interface {
+	processOutbox(ctx context.Context, limit int, excludeLogonNames []string, fn func([]UserEvent) []int64) (int, error)
+}
+
+// EventRelay polls the outbox for unpublished events and passes them to a Publisher.
+// Events are only marked as published once the Publisher has accepted them, so delivery is at-least-once.
+// If an event fails to publish, later events for the same user are held back until it succeeds to preserve their order.
+// The user's events are then left out of the batches fetched for RetryDelay, so that they don't hold up other users
+type EventRelay struct {
+	Store      outboxStore
+	Publisher  Publisher
+	Interval   time.Duration
+	BatchSize  int
+	RetryDelay time.Duration
+
+	blockedUntil map[string]time.Time
+}
+
+// Run relays events until ctx is cancelled
+func (e *EventRelay) Run(ctx context.Context) {
+	interval := e.Interval
+	if interval == 0 {
+		interval = defaultEventRelayInterval
+	}
+	batchSize := e.BatchSize
+	if batchSize == 0 {
+		batchSize = defaultEventRelayBatchSize
+	}
+	e.blockedUntil = make(map[string]time.Time)
+
+	log.Infof("Starting event relay (interval: %s, batch size: %d)", interval, batchSize)
+	for {
+		published, err := e.Store.processOutbox(ctx, batchSize, e.blockedLogonNames(), func(events []UserEvent) []int64 {
+			return e.publishEvents(ctx, events)
+		})
+		if err != nil && ctx.Err() == nil {
+			log.WithError(err).Error("relaying events from outbox")
+		}
+
+		// Carry straight on if there is likely to be a backlog, otherwise wait for new events
+		if published == batchSize {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			log.Info("Event relay stopped")
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// publishEvents publishes events in order, returning the IDs of those which were published successfully.
+// Once an event for a user fails, the remaining events for that user are skipped so that they are not delivered out of order
+func (e *EventRelay) publishEvents(ctx context.Context, events []UserEvent) []int64 {
+	published := make([]int64, 0, len(events))
+	blocked := make(map[string]bool)
+
+	for _, event := range events {
+		if blocked[event.LogonName] {
+			continue
+		}
+		if err := e.Publisher.Publish(ctx, event); err != nil {
+			log.WithError(err).WithFields(log.Fields{"event_id": event.EventID, "event_type": event.EventType, "logon_name": event.LogonName}).Error("publishing event")
+			blocked[event.LogonName] = true
+			if e.blockedUntil != nil {
+				e.blockedUntil[event.LogonName] = time.Now().Add(e.retryDelay())
+			}
+			continue
+		}
+		published = append(published, event.EventID)
+	}
+
+	return published
+}
+
+// blockedLogonNames returns the users whose events recently failed to publish and are waiting to be retried
+func (e *EventRelay) blockedLogonNames() []string {
+	names := make([]string, 0, len(e.blockedUntil))
+	for name, until := range e.blockedUntil {
+		if time.Now().After(until) {
+			delete(e.blockedUntil, name)
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func (e *EventRelay) retryDelay() time.Duration {
+	if e.RetryDelay == 0 {
+		return defaultEventRelayRetryDelay
+	}
+	return e.RetryDelay
+}
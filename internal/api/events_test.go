@@ -0,0 +1,135 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mockOutboxStore is used to mock the Postgres user_events table
+type mockOutboxStore struct {
+	mu        sync.Mutex
+	events    []UserEvent
+	published map[int64]bool
+}
+
+func newMockOutboxStore(events ...UserEvent) *mockOutboxStore {
+	return &mockOutboxStore{events: events, published: make(map[int64]bool)}
+}
+
+func (m *mockOutboxStore) processOutbox(_ context.Context, limit int, excludeLogonNames []string, fn func([]UserEvent) []int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	excluded := make(map[string]bool)
+	for _, name := range excludeLogonNames {
+		excluded[name] = true
+	}
+	var pending []UserEvent
+	for _, event := range m.events {
+		if !m.published[event.EventID] && !excluded[event.LogonName] && len(pending) < limit {
+			pending = append(pending, event)
+		}
+	}
+	ids := fn(pending)
+	for _, id := range ids {
+		m.published[id] = true
+	}
+	return len(ids), nil
+}
+
+func (m *mockOutboxStore) unpublished() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.events) - len(m.published)
+}
+
+// mockPublisher records published events and fails for any logon_name in failFor
+type mockPublisher struct {
+	mu        sync.Mutex
+	published []UserEvent
+	failFor   map[string]bool
+}
+
+func (p *mockPublisher) Publish(_ context.Context, event UserEvent) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.failFor[event.LogonName] {
+		return fmt.Errorf("downstream unavailable for %s", event.LogonName)
+	}
+	p.published = append(p.published, event)
+	return nil
+}
+
+func testUserEvents() []UserEvent {
+	return []UserEvent{
+		{EventID: 1, EventType: EventUserCreated, LogonName: "mark9"},
+		{EventID: 2, EventType: EventUserCreated, LogonName: "bob44"},
+		{EventID: 3, EventType: EventUserUpdated, LogonName: "mark9"},
+		{EventID: 4, EventType: EventUserUpdated, LogonName: "bob44"},
+		{EventID: 5, EventType: EventUserDeleted, LogonName: "mark9"},
+	}
+}
+
+// TestEventRelayPublishesInOrder tests that all events are published in the order they were recorded
+func TestEventRelayPublishesInOrder(t *testing.T) {
+	publisher := &mockPublisher{}
+	relay := &EventRelay{Store: newMockOutboxStore(testUserEvents()...), Publisher: publisher}
+
+	published := relay.publishEvents(context.Background(), testUserEvents())
+
+	assert.Equal(t, []int64{1, 2, 3, 4, 5}, published)
+	assert.Equal(t, 5, len(publisher.published))
+	assert.Equal(t, EventUserDeleted, publisher.published[4].EventType)
+}
+
+// TestEventRelayHoldsBackFailedUser tests that once an event fails, later events for the same user are not published out of order
+func TestEventRelayHoldsBackFailedUser(t *testing.T) {
+	publisher := &mockPublisher{failFor: map[string]bool{"mark9": true}}
+	relay := &EventRelay{Publisher: publisher}
+
+	published := relay.publishEvents(context.Background(), testUserEvents())
+
+	assert.Equal(t, []int64{2, 4}, published)
+}
+
+// TestEventRelayRun tests that a failing user does not hold up other users, that the relay keeps retrying failed events
+// until they are delivered, and that it stops on cancellation
+func TestEventRelayRun(t *testing.T) {
+	store := newMockOutboxStore(testUserEvents()...)
+	publisher := &mockPublisher{failFor: map[string]bool{"mark9": true}}
+	relay := &EventRelay{Store: store, Publisher: publisher, Interval: time.Millisecond, BatchSize: 2, RetryDelay: time.Millisecond * 20}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		relay.Run(ctx)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool { return store.unpublished() == 3 }, time.Second, time.Millisecond)
+
+	// The downstream system recovers, so the held back events are delivered in order
+	publisher.mu.Lock()
+	publisher.failFor = nil
+	publisher.mu.Unlock()
+	assert.Eventually(t, func() bool { return store.unpublished() == 0 }, time.Second, time.Millisecond)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("event relay did not stop after the context was cancelled")
+	}
+
+	var markEvents []int64
+	for _, event := range publisher.published {
+		if event.LogonName == "mark9" {
+			markEvents = append(markEvents, event.EventID)
+		}
+	}
+	assert.Equal(t, []int64{1, 3, 5}, markEvents)
+}
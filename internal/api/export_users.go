@@ -0,0 +1,191 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	exportFormatCSV    = "csv"
+	exportFormatNDJSON = "ndjson"
+	exportFormatJSON   = "json"
+
+	// exportProgressInterval is how many rows are written between each progress log line and flush to the client
+	exportProgressInterval = 1000
+)
+
+// exportEncoder writes users to the HTTP response in one of the supported export formats
+type exportEncoder interface {
+	begin() error
+	encode(User) error
+	flush() error
+	end() error
+}
+
+// exportUsers is an HTTP handler for GET /users:export
+// Users are streamed straight from the database to the client, so the full result set is never held in memory
+func (env *Env) exportUsers(w http.ResponseWriter, r *http.Request) {
+	var err error
+	var params queryParameters
+
+	queryStrings := r.URL.Query()
+	params, err = extractAndValidateQueryParams(queryStrings, env.maxPageSize())
+	if err != nil {
+		jsonHTTPErrorResponseWriter(w, r, 400, CodeInvalidQueryParameter, fmt.Sprintf("processing query parameters: %v", err))
+		return
+	}
+
+	format := queryStrings.Get("format")
+	if format == "" {
+		format = exportFormatNDJSON
+	}
+
+	var contentType string
+	var encoder exportEncoder
+	switch format {
+	case exportFormatCSV:
+		contentType = "text/csv"
+		encoder = &csvExportEncoder{w: csv.NewWriter(w)}
+	case exportFormatNDJSON:
+		contentType = "application/x-ndjson"
+		encoder = &ndjsonExportEncoder{enc: json.NewEncoder(w)}
+	case exportFormatJSON:
+		contentType = "application/json"
+		encoder = &jsonExportEncoder{w: w}
+	default:
+		jsonHTTPErrorResponseWriter(w, r, 400, CodeInvalidQueryParameter, fmt.Sprintf("format query string must be one of '%s', '%s' or '%s'", exportFormatCSV, exportFormatNDJSON, exportFormatJSON))
+		return
+	}
+
+	// An export can legitimately take longer than the server wide WriteTimeout, so lift it for this response only.
+	// Not all ResponseWriters support this (e.g. httptest.ResponseRecorder), in which case carry on regardless
+	rc := http.NewResponseController(w)
+	if err = rc.SetWriteDeadline(time.Time{}); err != nil {
+		log.WithError(err).Debug("unable to clear the write deadline for users export")
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"users.%s\"", format))
+	w.WriteHeader(200)
+
+	start := time.Now()
+	rowCount := 0
+	logger := log.WithContext(r.Context()).WithField("format", format)
+
+	if err = encoder.begin(); err != nil {
+		logger.WithError(err).Error("writing users export header")
+		return
+	}
+
+	// The request context is cancelled when the client disconnects, which in turn cancels the database query
+	err = env.UsersDB.StreamUsers(r.Context(), params.nameFilter, func(user User) error {
+		if err := encoder.encode(user); err != nil {
+			return fmt.Errorf("writing user '%s' to export: %v", user.LogonName, err)
+		}
+		rowCount++
+
+		if rowCount%exportProgressInterval == 0 {
+			if err := encoder.flush(); err != nil {
+				return fmt.Errorf("flushing users export: %v", err)
+			}
+			if err := rc.Flush(); err != nil {
+				logger.WithError(err).Debug("unable to flush users export")
+			}
+			logger.WithFields(log.Fields{"rows": rowCount, "elapsed": time.Since(start).String()}).Info("users export in progress")
+		}
+		return nil
+	})
+	if err != nil {
+		// The status code has already been sent so the best we can do is stop writing and log the reason
+		logger.WithError(err).WithFields(log.Fields{"rows": rowCount, "client_gone": r.Context().Err() != nil}).Error("users export aborted")
+		return
+	}
+
+	if err = encoder.end(); err != nil {
+		logger.WithError(err).Error("writing users export trailer")
+		return
+	}
+
+	logger.WithFields(log.Fields{
+		"rows":        rowCount,
+		"elapsed":     time.Since(start).String(),
+		"status_code": 200,
+	}).Infof("users export complete")
+}
+
+// csvExportEncoder writes users as CSV rows, preceded by a header row
+type csvExportEncoder struct {
+	w *csv.Writer
+}
+
+func (e *csvExportEncoder) begin() error {
+	return e.w.Write([]string{"user_id", "logon_name", "full_name", "email"})
+}
+
+func (e *csvExportEncoder) encode(user User) error {
+	return e.w.Write([]string{strconv.Itoa(user.UserID), user.LogonName, user.FullName, user.Email})
+}
+
+func (e *csvExportEncoder) flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+func (e *csvExportEncoder) end() error {
+	return e.flush()
+}
+
+// ndjsonExportEncoder writes users as newline delimited JSON objects
+type ndjsonExportEncoder struct {
+	enc *json.Encoder
+}
+
+func (e *ndjsonExportEncoder) begin() error { return nil }
+
+func (e *ndjsonExportEncoder) encode(user User) error {
+	return e.enc.Encode(user)
+}
+
+func (e *ndjsonExportEncoder) flush() error { return nil }
+
+func (e *ndjsonExportEncoder) end() error { return nil }
+
+// jsonExportEncoder writes users as a single JSON array, one element at a time
+type jsonExportEncoder struct {
+	w     io.Writer
+	count int
+}
+
+func (e *jsonExportEncoder) begin() error {
+	_, err := io.WriteString(e.w, "[")
+	return err
+}
+
+func (e *jsonExportEncoder) encode(user User) error {
+	b, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	if e.count > 0 {
+		if _, err = io.WriteString(e.w, ","); err != nil {
+			return err
+		}
+	}
+	e.count++
+	_, err = e.w.Write(b)
+	return err
+}
+
+func (e *jsonExportEncoder) flush() error { return nil }
+
+func (e *jsonExportEncoder) end() error {
+	_, err := io.WriteString(e.w, "]\n")
+	return err
+}
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// exportUsersTestFixtures are the users exported by the tests
+var exportUsersTestFixtures = []User{
+	{UserID: 1, LogonName: "mark9", FullName: "mark", Email: "mark@email.com"},
+	{UserID: 2, LogonName: "bob44", FullName: "bob", Email: "bob@email.com"},
+	{UserID: 3, LogonName: "bobby8", FullName: "bobby, jr", Email: "bobby@email.com"},
+}
+
+func setupMockExportUsersHTTPHandler(url string, store UserStore) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", url, nil)
+	env := &Env{UsersDB: store}
+	http.HandlerFunc(env.exportUsers).ServeHTTP(recorder, req)
+
+	return recorder
+}
+
+// TestExportUsersNDJSON tests exporting all users with the default (NDJSON) format
+func TestExportUsersNDJSON(t *testing.T) {
+	rec := setupMockExportUsersHTTPHandler("/users:export", NewMemoryUserModel(exportUsersTestFixtures...))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/x-ndjson", rec.Header().Get("Content-Type"))
+
+	var users []User
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		var user User
+		if err := json.Unmarshal(scanner.Bytes(), &user); err != nil {
+			t.Fatalf("unable to unmarshal NDJSON line: %v", err)
+		}
+		users = append(users, user)
+	}
+	assert.Equal(t, 3, len(users))
+	assert.Equal(t, "mark9", users[0].LogonName)
+	assert.Equal(t, "bobby@email.com", users[2].Email)
+}
+
+// TestExportUsersCSV tests exporting users as CSV, including a header row and fields which need quoting
+func TestExportUsersCSV(t *testing.T) {
+	rec := setupMockExportUsersHTTPHandler("/users:export?format=csv", NewMemoryUserModel(exportUsersTestFixtures...))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/csv", rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Header().Get("Content-Disposition"), "users.csv")
+
+	records, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("unable to parse CSV response: %v", err)
+	}
+	assert.Equal(t, 4, len(records))
+	assert.Equal(t, []string{"user_id", "logon_name", "full_name", "email"}, records[0])
+	assert.Equal(t, []string{"3", "bobby8", "bobby, jr", "bobby@email.com"}, records[3])
+}
+
+// TestExportUsersJSONWithNameFilter tests exporting as a JSON array whilst honouring the name_filter query parameter
+func TestExportUsersJSONWithNameFilter(t *testing.T) {
+	rec := setupMockExportUsersHTTPHandler("/users:export?format=json&name_filter=bob", NewMemoryUserModel(exportUsersTestFixtures...))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var users []User
+	if err := json.Unmarshal(rec.Body.Bytes(), &users); err != nil {
+		t.Fatal("unable to unmarshal JSON response")
+	}
+	assert.Equal(t, 2, len(users))
+	assert.Equal(t, "bob44", users[0].LogonName)
+}
+
+// TestExportUsersEmpty tests that an export with no matching users is still valid output
+func TestExportUsersEmpty(t *testing.T) {
+	rec := setupMockExportUsersHTTPHandler("/users:export?format=json&name_filter=nobody", NewMemoryUserModel(exportUsersTestFixtures...))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "[]\n", rec.Body.String())
+}
+
+// TestExportUsersLargeResultSet tests that exports spanning multiple progress intervals are written in full
+func TestExportUsersLargeResultSet(t *testing.T) {
+	var users []User
+	for i := 1; i <= exportProgressInterval*2+5; i++ {
+		users = append(users, User{UserID: i, LogonName: fmt.Sprintf("user%d", i), FullName: "user", Email: "user@email.com"})
+	}
+	rec := setupMockExportUsersHTTPHandler("/users:export?format=csv", NewMemoryUserModel(users...))
+
+	records, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("unable to parse CSV response: %v", err)
+	}
+	assert.Equal(t, len(users)+1, len(records))
+}
+
+// TestExportUsersClientDisconnect tests that the export stops streaming once the request context has been cancelled
+func TestExportUsersClientDisconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(ctx, "GET", "/users:export?format=ndjson", nil)
+	env := &Env{UsersDB: NewMemoryUserModel(exportUsersTestFixtures...)}
+	http.HandlerFunc(env.exportUsers).ServeHTTP(recorder, req)
+
+	assert.Empty(t, recorder.Body.String())
+}
+
+// TestExportUsersInvalidFormat tests requesting an export format which is not supported
+func TestExportUsersInvalidFormat(t *testing.T) {
+	rec := setupMockExportUsersHTTPHandler("/users:export?format=xml", NewMemoryUserModel(exportUsersTestFixtures...))
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	var resp Problem
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal("unable to unmarshal JSON response")
+	}
+	assert.Contains(t, resp.Detail, "format query string must be one of")
+}
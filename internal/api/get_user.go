@@ -0,0 +1,31 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// getUser is an HTTP handler for GET /users/<user>
+func (env *Env) getUser(w http.ResponseWriter, r *http.Request) {
+	logonName := mux.Vars(r)["logon_name"]
+
+	user, err := env.UsersDB.GetUser(r.Context(), logonName)
+	if errors.Is(err, ErrUserNotFound) {
+		jsonHTTPErrorResponseWriter(w, r, 404, CodeUserNotFound, fmt.Sprintf("'%s' does not exist", logonName))
+		return
+	}
+	if err != nil {
+		databaseErrorResponseWriter(w, r, err, 500, fmt.Sprintf("querying user from DB: %v", err))
+		return
+	}
+
+	// GetUser doesn't return when the user was last written, so a single user is only validated by its ETag
+	if err = writeCacheableJSONResponse(w, r, user, time.Time{}, env.Config.HTTPCache.GetUser); err != nil {
+		jsonHTTPErrorResponseWriter(w, r, 500, CodeInternalError, fmt.Sprintf("writing HTTP response: %v", err))
+		return
+	}
+}
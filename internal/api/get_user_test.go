@@ -0,0 +1,34 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestGetUser tests getting a single user by their logon_name
+func TestGetUser(t *testing.T) {
+	env := &Env{UsersDB: newTestMemoryStore()}
+	router := mux.NewRouter()
+	router.HandleFunc("/users/{logon_name}", env.getUser).Methods("GET")
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/users/mark9", nil)
+	router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var user User
+	if err := json.Unmarshal(recorder.Body.Bytes(), &user); err != nil {
+		t.Fatal("unable to unmarshal JSON response")
+	}
+	assert.Equal(t, User{UserID: 1, LogonName: "mark9", FullName: "mark", Email: "mark@email.com"}, user)
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/users/unknown", nil)
+	router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "'unknown' does not exist")
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const defaultCacheControl = "private, no-cache"
+
+// HTTPCacheConfig is the Cache-Control header sent with each cacheable route. An empty value sends no header
+type HTTPCacheConfig struct {
+	ListUsers string `yaml:"list_users"` // GET /users
+	GetUser   string `yaml:"get_user"`   // GET /users/{logon_name}
+}
+
+// strongETag returns a strong entity tag for body, which changes whenever any byte of it does
+func strongETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches reports whether the If-None-Match header value matches etag. As RFC 9110 requires for If-None-Match, weak
+// tags are compared by their value
+func etagMatches(ifNoneMatch, etag string) bool {
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified reports whether a GET request's validators show that the client already has the current representation.
+// If-Modified-Since is only used when there is no If-None-Match, and Last-Modified only has a resolution of a second
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		return etagMatches(ifNoneMatch, etag)
+	}
+	if lastModified.IsZero() {
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return !lastModified.Truncate(time.Second).After(since)
+}
+
+// writeCacheableJSONResponse writes payload as a 200 JSON response with a strong ETag computed from the body, Last-Modified
+// unless lastModified is zero, and cacheControl unless it is empty. A request whose If-None-Match or If-Modified-Since
+// header matches gets a 304 with the same headers and no body
+func writeCacheableJSONResponse(w http.ResponseWriter, r *http.Request, payload any, lastModified time.Time, cacheControl string) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("marshalling JSON in preparation for HTTP response")
+	}
+
+	// Last-Modified is truncated to the second, so one sent within the second of the last write would still be current after
+	// another write in the same second. It isn't sent until that second is over
+	if time.Since(lastModified) < time.Second {
+		lastModified = time.Time{}
+	}
+
+	etag := strongETag(body)
+	w.Header().Set("ETag", etag)
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+	if cacheControl != "" {
+		w.Header().Set("Cache-Control", cacheControl)
+	}
+
+	if notModified(r, etag, lastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err = w.Write(body); err != nil {
+		return fmt.Errorf("writing JSON formatted HTTP response")
+	}
+	return nil
+}
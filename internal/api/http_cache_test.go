@@ -0,0 +1,125 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupHTTPCacheRouter() (*mux.Router, *MemoryUserModel) {
+	store := newTestMemoryStore()
+	env := &Env{UsersDB: store, Config: DefaultConfig()}
+	env.Config.HTTPCache.GetUser = "public, max-age=30"
+
+	router := mux.NewRouter()
+	router.HandleFunc("/users", env.listUsers).Methods("GET")
+	router.HandleFunc("/users/{logon_name}", env.getUser).Methods("GET")
+	return router, store
+}
+
+func conditionalGet(router *mux.Router, path string, headers map[string]string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", path, nil)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+// TestListUsersIfNoneMatch tests that a page is only sent again once it has changed
+func TestListUsersIfNoneMatch(t *testing.T) {
+	router, store := setupHTTPCacheRouter()
+
+	first := conditionalGet(router, "/users", nil)
+	assert.Equal(t, 200, first.Code)
+	assert.Equal(t, defaultCacheControl, first.Header().Get("Cache-Control"))
+	etag := first.Header().Get("ETag")
+	assert.Regexp(t, `^"[0-9a-f]{32}"$`, etag)
+
+	for _, ifNoneMatch := range []string{etag, `"other", ` + etag, "W/" + etag, "*"} {
+		recorder := conditionalGet(router, "/users", map[string]string{"If-None-Match": ifNoneMatch})
+		assert.Equal(t, 304, recorder.Code, ifNoneMatch)
+		assert.Empty(t, recorder.Body.String())
+		assert.Equal(t, etag, recorder.Header().Get("ETag"))
+		assert.Equal(t, defaultCacheControl, recorder.Header().Get("Cache-Control"))
+	}
+
+	// Other pages have their own ETag
+	assert.Equal(t, 200, conditionalGet(router, "/users?per_page=1", map[string]string{"If-None-Match": etag}).Code)
+
+	_, err := store.UpdateUser(context.Background(), User{LogonName: "bob44", Email: "bob@new.com"})
+	assert.NoError(t, err)
+	recorder := conditionalGet(router, "/users", map[string]string{"If-None-Match": etag})
+	assert.Equal(t, 200, recorder.Code)
+	assert.NotEqual(t, etag, recorder.Header().Get("ETag"))
+	assert.Contains(t, recorder.Body.String(), "bob@new.com")
+}
+
+// TestListUsersIfModifiedSince tests that Last-Modified moves on with every write, and that If-None-Match takes precedence
+func TestListUsersIfModifiedSince(t *testing.T) {
+	router, store := setupHTTPCacheRouter()
+	store.lastModified = time.Now().Add(-time.Minute)
+
+	first := conditionalGet(router, "/users", nil)
+	lastModified := first.Header().Get("Last-Modified")
+	modifiedAt, err := http.ParseTime(lastModified)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 304, conditionalGet(router, "/users", map[string]string{"If-Modified-Since": lastModified}).Code)
+	assert.Equal(t, 200, conditionalGet(router, "/users", map[string]string{
+		"If-Modified-Since": lastModified,
+		"If-None-Match":     `"stale"`,
+	}).Code)
+	assert.Equal(t, 200, conditionalGet(router, "/users", map[string]string{
+		"If-Modified-Since": modifiedAt.Add(-time.Second).Format(http.TimeFormat),
+	}).Code)
+	assert.Equal(t, 200, conditionalGet(router, "/users", map[string]string{"If-Modified-Since": "yesterday"}).Code)
+
+	// Deleting a user changes the page even though no remaining user was written. Last-Modified isn't sent until the second
+	// of the write is over, as another write within it couldn't be told apart
+	assert.NoError(t, store.DeleteUser(context.Background(), "bob44"))
+	recorder := conditionalGet(router, "/users", map[string]string{"If-Modified-Since": lastModified})
+	assert.Equal(t, 200, recorder.Code)
+	assert.NotContains(t, recorder.Body.String(), "bob44")
+	assert.Empty(t, recorder.Header().Get("Last-Modified"))
+	assert.Equal(t, 200, conditionalGet(router, "/users", map[string]string{"If-Modified-Since": time.Now().Format(http.TimeFormat)}).Code)
+}
+
+// TestGetUserIfNoneMatch tests that a single user is validated by its ETag, with the Cache-Control configured for its route
+func TestGetUserIfNoneMatch(t *testing.T) {
+	router, _ := setupHTTPCacheRouter()
+
+	first := conditionalGet(router, "/users/bob44", nil)
+	assert.Equal(t, 200, first.Code)
+	assert.Equal(t, "public, max-age=30", first.Header().Get("Cache-Control"))
+	assert.Empty(t, first.Header().Get("Last-Modified"))
+
+	recorder := conditionalGet(router, "/users/bob44", map[string]string{"If-None-Match": first.Header().Get("ETag")})
+	assert.Equal(t, 304, recorder.Code)
+	assert.Equal(t, 200, conditionalGet(router, "/users/bob44", map[string]string{"If-Modified-Since": time.Now().Format(http.TimeFormat)}).Code)
+}
+
+// TestListUsersCachedLastModified tests that pages served from the users cache keep their Last-Modified
+func TestListUsersCachedLastModified(t *testing.T) {
+	store := newTestMemoryStore()
+	store.lastModified = time.Now().Add(-time.Minute)
+	env := &Env{UsersDB: NewUsersCache(store, CacheConfig{Enabled: true, MaxEntries: 10, MaxStaleness: time.Minute}, nil), Config: DefaultConfig()}
+	router := mux.NewRouter()
+	router.HandleFunc("/users", env.listUsers).Methods("GET")
+
+	first := conditionalGet(router, "/users", nil)
+	lastModified := first.Header().Get("Last-Modified")
+	assert.Equal(t, store.lastModified.UTC().Format(http.TimeFormat), lastModified)
+
+	cached := conditionalGet(router, "/users", nil)
+	assert.Equal(t, 200, cached.Code)
+	assert.Equal(t, lastModified, cached.Header().Get("Last-Modified"))
+	assert.Equal(t, first.Header().Get("ETag"), cached.Header().Get("ETag"))
+	assert.Equal(t, 304, conditionalGet(router, "/users", map[string]string{"If-Modified-Since": lastModified}).Code)
+}
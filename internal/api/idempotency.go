@@ -0,0 +1,202 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+	idempotencyKeyMaxLength   = 255
+	defaultIdempotencyKeyTTL  = time.Hour * 24
+
+	// idempotencyKeySweepInterval is how often expired keys are deleted, and idempotencyKeySweepBatch how many are deleted at a time
+	idempotencyKeySweepInterval = time.Minute * 10
+	idempotencyKeySweepBatch    = 1000
+)
+
+// idempotencyStore persists the outcome of requests sent with an Idempotency-Key header so that retries can be replayed
+type idempotencyStore interface {
+	// reserveIdempotencyKey claims key for a new request. If the key is already held (and has not expired) the existing
+	// record is returned along with false
+	reserveIdempotencyKey(ctx context.Context, key, fingerprint string, ttl time.Duration) (idempotencyRecord, bool, error)
+	// completeIdempotencyKey stores the response for a key previously claimed by reserveIdempotencyKey
+	completeIdempotencyKey(ctx context.Context, key string, record idempotencyRecord) error
+	// releaseIdempotencyKey removes a claimed key, allowing the request to be retried from scratch
+	releaseIdempotencyKey(ctx context.Context, key string) error
+	// deleteExpiredIdempotencyKeys deletes up to limit keys which have expired, returning how many were deleted
+	deleteExpiredIdempotencyKeys(ctx context.Context, limit int) (int, error)
+}
+
+type idempotencyRecord struct {
+	fingerprint string
+	completed   bool
+	statusCode  int
+	contentType string
+	body        []byte
+}
+
+// responseCapture passes a response through to the client whilst keeping a copy of the status code and body
+type responseCapture struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (c *responseCapture) WriteHeader(statusCode int) {
+	c.statusCode = statusCode
+	c.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (c *responseCapture) Write(b []byte) (int, error) {
+	if c.statusCode == 0 {
+		c.statusCode = 200
+	}
+	c.body.Write(b)
+	return c.ResponseWriter.Write(b)
+}
+
+// idempotent wraps a handler so that requests carrying an Idempotency-Key header are only processed once.
+// Retries with the same key and body replay the original response, whilst reusing a key with a different body is rejected with a 422.
+// 5xx responses and panics are not stored, so that the client is able to retry them
+func (env *Env) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" || env.Idempotency == nil {
+			next(w, r)
+			return
+		}
+
+		if len(key) > idempotencyKeyMaxLength {
+			jsonHTTPErrorResponseWriter(w, r, 400, CodeInvalidIdempotencyKey, fmt.Sprintf("%s header maximum length is %d. Currently %d", idempotencyKeyHeader, idempotencyKeyMaxLength, len(key)))
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			jsonHTTPErrorResponseWriter(w, r, 400, CodeInvalidRequestBody, fmt.Sprintf("reading http request body: %v", err))
+			return
+		}
+		// Allow the wrapped handler to read the body again
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		fingerprint := requestFingerprint(r, body)
+		ttl := env.IdempotencyKeyTTL
+		if ttl == 0 {
+			ttl = defaultIdempotencyKeyTTL
+		}
+
+		existing, reserved, err := env.Idempotency.reserveIdempotencyKey(r.Context(), key, fingerprint, ttl)
+		if err != nil {
+			jsonHTTPErrorResponseWriter(w, r, 500, CodeInternalError, fmt.Sprintf("reserving %s: %v", idempotencyKeyHeader, err))
+			return
+		}
+
+		if !reserved {
+			switch {
+			case existing.fingerprint != fingerprint:
+				jsonHTTPErrorResponseWriter(w, r, 422, CodeIdempotencyKeyReused, fmt.Sprintf("%s '%s' has already been used with a different request", idempotencyKeyHeader, key))
+			case !existing.completed:
+				jsonHTTPErrorResponseWriter(w, r, 409, CodeIdempotencyKeyInProgress, fmt.Sprintf("a request with %s '%s' is still being processed", idempotencyKeyHeader, key))
+			default:
+				log.WithContext(r.Context()).WithFields(log.Fields{"idempotency_key": key, "status_code": existing.statusCode}).Info("replaying stored response")
+				if existing.contentType != "" {
+					w.Header().Set("Content-Type", existing.contentType)
+				}
+				w.Header().Set(idempotencyReplayedHeader, "true")
+				w.WriteHeader(existing.statusCode)
+				if _, err = w.Write(existing.body); err != nil {
+					log.WithError(err).Error("writing replayed HTTP response")
+				}
+			}
+			return
+		}
+
+		// Use a fresh context so the outcome is still recorded if the client has gone away, which is when a retry is most likely
+		ctx := context.WithoutCancel(r.Context())
+		release := func() {
+			if err := env.Idempotency.releaseIdempotencyKey(ctx, key); err != nil {
+				log.WithError(err).WithField("idempotency_key", key).Error("releasing idempotency key")
+			}
+		}
+		// A panicking handler would otherwise leave the key in progress until it expires, rejecting every retry
+		defer func() {
+			if p := recover(); p != nil {
+				release()
+				panic(p)
+			}
+		}()
+
+		capture := &responseCapture{ResponseWriter: w}
+		next(capture, r)
+
+		if capture.statusCode >= 500 || capture.statusCode == 0 {
+			release()
+			return
+		}
+
+		err = env.Idempotency.completeIdempotencyKey(ctx, key, idempotencyRecord{
+			fingerprint: fingerprint,
+			completed:   true,
+			statusCode:  capture.statusCode,
+			contentType: capture.Header().Get("Content-Type"),
+			body:        capture.body.Bytes(),
+		})
+		if err != nil {
+			log.WithError(err).WithField("idempotency_key", key).Error("storing response for idempotency key")
+		}
+	}
+}
+
+// requestFingerprint returns a hash which identifies the method, path and body of a request
+func requestFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method))
+	h.Write([]byte{0})
+	h.Write([]byte(getFullPathIncludingQueryParams(r.URL)))
+	h.Write([]byte{0})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// sweepIdempotencyKeys deletes expired idempotency keys every idempotencyKeySweepInterval until ctx is cancelled. Clients
+// send a new key with every request, so expired keys would otherwise only be removed if they happened to be reused
+func (env *Env) sweepIdempotencyKeys(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		deleted := 0
+		for {
+			// Deleted in batches, so that no single statement holds up the requests reserving keys
+			n, err := env.Idempotency.deleteExpiredIdempotencyKeys(ctx, idempotencyKeySweepBatch)
+			deleted += n
+			if err != nil {
+				if ctx.Err() == nil {
+					log.WithError(err).Error("deleting expired idempotency keys")
+				}
+				break
+			}
+			if n < idempotencyKeySweepBatch {
+				break
+			}
+		}
+		if deleted > 0 {
+			log.Debugf("Deleted %d expired idempotency keys", deleted)
+		}
+	}
+}
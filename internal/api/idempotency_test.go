@@ -0,0 +1,239 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func sendIdempotentPostUser(env *Env, key string, user User) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	_ = json.NewEncoder(&buf).Encode(user)
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/users", &buf)
+	if key != "" {
+		req.Header.Set(idempotencyKeyHeader, key)
+	}
+	env.idempotent(env.postUser).ServeHTTP(recorder, req)
+	return recorder
+}
+
+// TestIdempotentPostUserReplay tests that retrying a POST with the same key replays the original response rather than failing validation
+func TestIdempotentPostUserReplay(t *testing.T) {
+	env := &Env{UsersDB: newTestMemoryStore(), Idempotency: NewMemoryIdempotencyStore()}
+	user := User{LogonName: "testuser1", FullName: "Test User 1", Email: "test1@email.com"}
+
+	first := sendIdempotentPostUser(env, "key-1", user)
+	assert.Equal(t, 201, first.Code)
+
+	retry := sendIdempotentPostUser(env, "key-1", user)
+	assert.Equal(t, 201, retry.Code)
+	assert.Equal(t, "true", retry.Header().Get(idempotencyReplayedHeader))
+	assert.Equal(t, "application/json", retry.Header().Get("Content-Type"))
+	assert.Equal(t, first.Body.String(), retry.Body.String())
+
+	// Without the key the duplicate is rejected as usual
+	withoutKey := sendIdempotentPostUser(env, "", user)
+	assert.Equal(t, 422, withoutKey.Code)
+}
+
+// TestIdempotentPostUserDifferentBody tests that reusing a key with a different request body is rejected
+func TestIdempotentPostUserDifferentBody(t *testing.T) {
+	env := &Env{UsersDB: newTestMemoryStore(), Idempotency: NewMemoryIdempotencyStore()}
+
+	first := sendIdempotentPostUser(env, "key-2", User{LogonName: "testuser2", FullName: "Test User 2", Email: "test2@email.com"})
+	assert.Equal(t, 201, first.Code)
+
+	second := sendIdempotentPostUser(env, "key-2", User{LogonName: "testuser3", FullName: "Test User 3", Email: "test3@email.com"})
+	assert.Equal(t, 422, second.Code)
+	var resp Problem
+	if err := json.Unmarshal(second.Body.Bytes(), &resp); err != nil {
+		t.Fatal("unable to unmarshal JSON response")
+	}
+	assert.Contains(t, resp.Detail, "has already been used with a different request")
+}
+
+// TestIdempotentKeyExpired tests that a key can be reused once its TTL has passed
+func TestIdempotentKeyExpired(t *testing.T) {
+	env := &Env{UsersDB: newTestMemoryStore(), Idempotency: NewMemoryIdempotencyStore(), IdempotencyKeyTTL: time.Nanosecond}
+
+	first := sendIdempotentPostUser(env, "key-3", User{LogonName: "testuser4", FullName: "Test User 4", Email: "test4@email.com"})
+	assert.Equal(t, 201, first.Code)
+	time.Sleep(time.Millisecond)
+
+	second := sendIdempotentPostUser(env, "key-3", User{LogonName: "testuser5", FullName: "Test User 5", Email: "test5@email.com"})
+	assert.Equal(t, 201, second.Code)
+	assert.Empty(t, second.Header().Get(idempotencyReplayedHeader))
+}
+
+// TestIdempotentRequestInProgress tests that a retry which arrives whilst the original request is still running is rejected
+func TestIdempotentRequestInProgress(t *testing.T) {
+	store := NewMemoryIdempotencyStore()
+	env := &Env{UsersDB: newTestMemoryStore(), Idempotency: store}
+	user := User{LogonName: "testuser6", FullName: "Test User 6", Email: "test6@email.com"}
+
+	var buf bytes.Buffer
+	_ = json.NewEncoder(&buf).Encode(user)
+	req, _ := http.NewRequest("POST", "/users", &buf)
+	_, _, _ = store.reserveIdempotencyKey(context.Background(), "key-4", requestFingerprint(req, buf.Bytes()), time.Minute)
+
+	rec := sendIdempotentPostUser(env, "key-4", user)
+	assert.Equal(t, 409, rec.Code)
+}
+
+// TestIdempotentServerErrorNotStored tests that 5xx responses release the key so that the client can retry
+func TestIdempotentServerErrorNotStored(t *testing.T) {
+	store := NewMemoryIdempotencyStore()
+	env := &Env{Idempotency: store}
+	calls := 0
+	handler := env.idempotent(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			jsonHTTPErrorResponseWriter(w, r, 500, CodeInternalError, "database unavailable")
+			return
+		}
+		w.WriteHeader(201)
+	})
+
+	for _, expected := range []int{500, 201, 201} {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/users", strings.NewReader(`{}`))
+		req.Header.Set(idempotencyKeyHeader, "key-5")
+		handler.ServeHTTP(recorder, req)
+		assert.Equal(t, expected, recorder.Code)
+	}
+	assert.Equal(t, 2, calls)
+}
+
+// TestIdempotentPanicReleasesKey tests that a key is released when the handler panics, so that the client can retry
+func TestIdempotentPanicReleasesKey(t *testing.T) {
+	env := &Env{Idempotency: NewMemoryIdempotencyStore()}
+	panicked := env.idempotent(func(http.ResponseWriter, *http.Request) {
+		panic("handler failed")
+	})
+	succeeded := env.idempotent(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(201)
+	})
+
+	newRequest := func() *http.Request {
+		req, _ := http.NewRequest("POST", "/users", strings.NewReader(`{}`))
+		req.Header.Set(idempotencyKeyHeader, "key-6")
+		return req
+	}
+
+	assert.PanicsWithValue(t, "handler failed", func() {
+		panicked.ServeHTTP(httptest.NewRecorder(), newRequest())
+	})
+
+	recorder := httptest.NewRecorder()
+	succeeded.ServeHTTP(recorder, newRequest())
+	assert.Equal(t, 201, recorder.Code)
+}
+
+// TestIdempotencyStores tests the idempotency key stores of the sqlite and memory backends
+func TestIdempotencyStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) idempotencyStore{
+		BackendMemory: func(*testing.T) idempotencyStore { return NewMemoryIdempotencyStore() },
+		BackendSQLite: func(t *testing.T) idempotencyStore {
+			store, err := OpenSQLiteUserModel(filepath.Join(t.TempDir(), "users.db"))
+			if err != nil {
+				t.Fatalf("opening SQLite store: %v", err)
+			}
+			t.Cleanup(func() { _ = store.DB.Close() })
+			return &SQLiteIdempotencyModel{DB: store.DB}
+		},
+	}
+
+	for backend, newStore := range stores {
+		t.Run(backend, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+
+			_, reserved, err := store.reserveIdempotencyKey(ctx, "key-1", "fingerprint-1", time.Minute)
+			assert.NoError(t, err)
+			assert.True(t, reserved)
+
+			existing, reserved, err := store.reserveIdempotencyKey(ctx, "key-1", "fingerprint-2", time.Minute)
+			assert.NoError(t, err)
+			assert.False(t, reserved)
+			assert.Equal(t, idempotencyRecord{fingerprint: "fingerprint-1"}, existing)
+
+			completed := idempotencyRecord{fingerprint: "fingerprint-1", completed: true, statusCode: 201, contentType: "application/json", body: []byte(`{}`)}
+			assert.NoError(t, store.completeIdempotencyKey(ctx, "key-1", completed))
+			existing, reserved, err = store.reserveIdempotencyKey(ctx, "key-1", "fingerprint-1", time.Minute)
+			assert.NoError(t, err)
+			assert.False(t, reserved)
+			assert.Equal(t, completed, existing)
+
+			assert.NoError(t, store.releaseIdempotencyKey(ctx, "key-1"))
+			_, reserved, err = store.reserveIdempotencyKey(ctx, "key-1", "fingerprint-2", time.Millisecond)
+			assert.NoError(t, err)
+			assert.True(t, reserved)
+
+			// An expired key is taken over by the next request
+			time.Sleep(time.Millisecond * 5)
+			_, reserved, err = store.reserveIdempotencyKey(ctx, "key-1", "fingerprint-3", time.Minute)
+			assert.NoError(t, err)
+			assert.True(t, reserved)
+
+			// Only expired keys are deleted, up to the limit
+			for _, key := range []string{"key-2", "key-3", "key-4"} {
+				_, _, err = store.reserveIdempotencyKey(ctx, key, "fingerprint-1", time.Millisecond)
+				assert.NoError(t, err)
+			}
+			time.Sleep(time.Millisecond * 5)
+			deleted, err := store.deleteExpiredIdempotencyKeys(ctx, 2)
+			assert.NoError(t, err)
+			assert.Equal(t, 2, deleted)
+			deleted, err = store.deleteExpiredIdempotencyKeys(ctx, 2)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, deleted)
+
+			existing, reserved, err = store.reserveIdempotencyKey(ctx, "key-1", "fingerprint-4", time.Minute)
+			assert.NoError(t, err)
+			assert.False(t, reserved)
+			assert.Equal(t, idempotencyRecord{fingerprint: "fingerprint-3"}, existing)
+		})
+	}
+}
+
+// TestSweepIdempotencyKeys tests that expired keys are deleted in the background, in batches
+func TestSweepIdempotencyKeys(t *testing.T) {
+	store := NewMemoryIdempotencyStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for i := 0; i < idempotencyKeySweepBatch+1; i++ {
+		_, _, err := store.reserveIdempotencyKey(ctx, fmt.Sprintf("expired-%d", i), "fingerprint", time.Millisecond)
+		assert.NoError(t, err)
+	}
+	_, _, err := store.reserveIdempotencyKey(ctx, "live", "fingerprint", time.Minute)
+	assert.NoError(t, err)
+
+	env := &Env{Idempotency: store}
+	done := make(chan struct{})
+	go func() {
+		env.sweepIdempotencyKeys(ctx, time.Millisecond*10)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		return len(store.records) == 1
+	}, time.Second, time.Millisecond*10)
+	_, reserved, err := store.reserveIdempotencyKey(ctx, "live", "fingerprint", time.Minute)
+	assert.NoError(t, err)
+	assert.False(t, reserved)
+
+	cancel()
+	<-done
+}
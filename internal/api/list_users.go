@@ -5,84 +5,81 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
-
-	log "github.com/sirupsen/logrus"
+	"strings"
 )
 
 const (
-	defaultPageSize = 4
-	maxPageSize     = 10
+	defaultPageSize    = 4
+	defaultMaxPageSize = 10
+
+	// maxSearchQueryLength bounds q, as the cost of a trigram search grows with the length of the query
+	maxSearchQueryLength = 100
 )
 
+// maxPageSize returns the largest per_page allowed, falling back to the default if the Env has not been configured
+func (env *Env) maxPageSize() int {
+	if env.Config.Server.MaxPageSize > 0 {
+		return env.Config.Server.MaxPageSize
+	}
+	return defaultMaxPageSize
+}
+
 // listUsers is an HTTP handler got GET /users
 func (env *Env) listUsers(w http.ResponseWriter, r *http.Request) {
 	var err error
 	var params queryParameters
-	var recordCount int
 	var startingIndex int
-	var dbResults []User
 
 	queryStrings := r.URL.Query()
-	params, err = extractAndValidateQueryParams(queryStrings)
+	params, err = extractAndValidateQueryParams(queryStrings, env.maxPageSize())
 	if err != nil {
-		jsonHTTPErrorResponseWriter(w, r, 400, fmt.Sprintf("processing query parameters: %v", err))
+		jsonHTTPErrorResponseWriter(w, r, 400, CodeInvalidQueryParameter, fmt.Sprintf("processing query parameters: %v", err))
 		return
 	}
 
-	recordCount, err = env.UsersDB.queryRecordCount(params.nameFilter, "")
+	if params.page == 1 {
+		startingIndex = 0
+	} else {
+		startingIndex = (params.page * params.perPage) - params.perPage
+	}
+
+	// The page and the total number of users come from a single query, so that total_pages always agrees with the page
+	var page UsersPage
+	if params.query != "" {
+		page, err = env.UsersDB.SearchUsers(r.Context(), params.query, params.minScore, startingIndex, params.perPage)
+	} else {
+		page, err = env.UsersDB.QueryUsers(r.Context(), startingIndex, params.perPage, params.nameFilter)
+	}
 	if err != nil {
-		jsonHTTPErrorResponseWriter(w, r, 500, fmt.Sprintf("calculating the number of records in database: %v", err))
+		databaseErrorResponseWriter(w, r, err, 500, fmt.Sprintf("querying the users table: %v", err))
 		return
 	}
 
-	numberOfPages := recordCount / params.perPage
-	if recordCount%params.perPage != 0 {
+	numberOfPages := page.Total / params.perPage
+	if page.Total%params.perPage != 0 {
 		// Add a non-full page
 		numberOfPages++
 	}
 
 	// Can only be performed after the number of records is obtained and so can't be part of the extractAndValidateQueryParams function
 	if params.page > numberOfPages {
-		jsonHTTPErrorResponseWriter(w, r, 404, fmt.Sprintf("page %d not found", params.page))
+		jsonHTTPErrorResponseWriter(w, r, 404, CodePageNotFound, fmt.Sprintf("page %d not found", params.page))
 		return
 	}
 
-	response := UsersResponse{}
-	if params.page == 1 {
-		startingIndex = 0
-	} else {
-		startingIndex = (params.page * params.perPage) - params.perPage
-	}
-
+	response := UsersResponse{Users: page.Users, ApproximateTotal: page.Approximate}
 	if params.page != numberOfPages {
 		response.MorePages = true
 	}
 
 	response.TotalPages = numberOfPages
 	response.CurrentPage = params.page
-	dbResults, err = env.UsersDB.queryUsers(startingIndex, params.perPage, params.nameFilter)
-	if err != nil {
-		jsonHTTPErrorResponseWriter(w, r, 500, fmt.Sprintf("querying the users table: %v", err))
-		return
-	}
 
-	response.Users = dbResults
-
-	err = writeJSONHTTPResponse(w, 200, response)
+	err = writeCacheableJSONResponse(w, r, response, page.LastModified, env.Config.HTTPCache.ListUsers)
 	if err != nil {
-		jsonHTTPErrorResponseWriter(w, r, 500, fmt.Sprintf("writing HTTP response: %v", err))
+		jsonHTTPErrorResponseWriter(w, r, 500, CodeInternalError, fmt.Sprintf("writing HTTP response: %v", err))
 		return
 	}
-
-	log.WithFields(log.Fields{
-		"url":           getFullPathIncludingQueryParams(r.URL),
-		"totalItems":    recordCount,
-		"numberOfPages": numberOfPages,
-		"perPage":       params.perPage,
-		"page":          params.page,
-		"status_code":   200,
-		"method":        r.Method,
-	}).Infof("serving page")
 }
 
 // getFullPathIncludingQueryParams returns either uri, or the uri including the query parameters if they are present
@@ -94,14 +91,14 @@ func getFullPathIncludingQueryParams(url *url.URL) string {
 }
 
 // extractAndValidateQueryParams extracts any query strings and validates them
-func extractAndValidateQueryParams(queryStrings url.Values) (queryParameters, error) {
+func extractAndValidateQueryParams(queryStrings url.Values, maxPageSize int) (queryParameters, error) {
 	var err error
 	var perPage64, page64 int64
 	var params queryParameters
 
 	if perPageEnv := queryStrings.Get("per_page"); perPageEnv != "" {
 		perPage64, err = strconv.ParseInt(perPageEnv, 10, 64)
-		if err != nil || perPage64 <= 0 || perPage64 > maxPageSize {
+		if err != nil || perPage64 <= 0 || perPage64 > int64(maxPageSize) {
 			if err != nil {
 				return params, fmt.Errorf("per_page query string must be an integer between 1 and %d: %v", maxPageSize, err)
 			}
@@ -129,5 +126,23 @@ func extractAndValidateQueryParams(queryStrings url.Values) (queryParameters, er
 
 	params.nameFilter = queryStrings.Get("name_filter")
 
+	params.query = strings.TrimSpace(queryStrings.Get("q"))
+	if params.query != "" && params.nameFilter != "" {
+		return params, fmt.Errorf("only one of the q and name_filter query strings can be used")
+	}
+	if len(params.query) > maxSearchQueryLength {
+		return params, fmt.Errorf("q query string must be no longer than %d characters", maxSearchQueryLength)
+	}
+
+	if minScore := queryStrings.Get("min_score"); minScore != "" {
+		if params.query == "" {
+			return params, fmt.Errorf("min_score query string can only be used with q")
+		}
+		params.minScore, err = strconv.ParseFloat(minScore, 64)
+		if err != nil || params.minScore < 0 || params.minScore > 1 {
+			return params, fmt.Errorf("min_score query string must be a number between 0 and 1")
+		}
+	}
+
 	return params, nil
 }
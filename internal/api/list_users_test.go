@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -10,59 +11,20 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-// mockGetUsersModel is used to mock the Postgres DB calls
-type mockGetUsersModel struct{}
-
-func (m *mockGetUsersModel) queryRecordCount(nameFilter, _ string) (int, error) {
-	if nameFilter == "bob" {
-		return 2, nil
-	}
-	return 5, nil
+// listUsersTestFixtures are the users which the list tests page through and filter
+var listUsersTestFixtures = []User{
+	{UserID: 1, LogonName: "mark9", FullName: "mark", Email: "mark@email.com"},
+	{UserID: 2, LogonName: "bob44", FullName: "bob", Email: "bob@email.com"},
+	{UserID: 3, LogonName: "bobby8", FullName: "bobby", Email: "bobby@email.com"},
+	{UserID: 4, LogonName: "jayne2234", FullName: "jayne", Email: "jayne@email.com"},
+	{UserID: 5, LogonName: "mike1", FullName: "mike", Email: "mike@email.com"},
 }
 
-func (m *mockGetUsersModel) queryUsers(offset, limit int, nameFilter string) ([]User, error) {
-	var users []User
-
-	if nameFilter == "bob" {
-		users = []User{
-			{UserID: 2, LogonName: "bob44", FullName: "bob", Email: "bob@email.com"},
-			{UserID: 3, LogonName: "bobby8", FullName: "bobby", Email: "bobby@email.com"},
-		}
-	} else {
-		if offset == 3 && limit == 3 {
-			users = []User{
-				{UserID: 4, LogonName: "jayne2234", FullName: "jayne", Email: "jayne@email.com"},
-				{UserID: 5, LogonName: "mike1", FullName: "mike", Email: "mike@email.com"},
-			}
-		} else {
-			users = []User{
-				{UserID: 1, LogonName: "mark9", FullName: "mark", Email: "mark@email.com"},
-				{UserID: 2, LogonName: "bob44", FullName: "bob", Email: "bob@email.com"},
-				{UserID: 3, LogonName: "bobby8", FullName: "bobby", Email: "bobby@email.com"},
-				{UserID: 4, LogonName: "jayne2234", FullName: "jayne", Email: "jayne@email.com"},
-				{UserID: 5, LogonName: "mike1", FullName: "mike", Email: "mike@email.com"},
-			}
-		}
-
-	}
-
-	return users, nil
-}
-
-func (m *mockGetUsersModel) addUser(_ User) (user User, err error) {
-	return
-}
-func (m *mockGetUsersModel) deleteUser(_ string) (err error) {
-	return
-}
-
-func (m *mockGetUsersModel) updateUser(_ User) (user User, err error) { return }
-
 // setupMockGetUsersHTTPHandler is helper function to remove duplication in setting up the HTTP test handlers in the unit tests
 func setupMockGetUsersHTTPHandler(url string) *httptest.ResponseRecorder {
 	recorder := httptest.NewRecorder()
 	req, _ := http.NewRequest("GET", url, nil)
-	env := &Env{UsersDB: &mockGetUsersModel{}}
+	env := &Env{UsersDB: NewMemoryUserModel(listUsersTestFixtures...)}
 	http.HandlerFunc(env.listUsers).ServeHTTP(recorder, req)
 
 	return recorder
@@ -79,9 +41,10 @@ func TestListUsersWithoutQueryParams(t *testing.T) {
 	if err != nil {
 		t.Fatal("unable to unmarshal JSON response")
 	}
-	assert.Equal(t, 5, len(resp.Users))
+	assert.Equal(t, 4, len(resp.Users))
+	assert.Equal(t, 2, resp.TotalPages)
 	assert.Equal(t, "mark", resp.Users[0].FullName)
-	assert.Equal(t, "mike@email.com", resp.Users[4].Email)
+	assert.Equal(t, "jayne@email.com", resp.Users[3].Email)
 	assert.Equal(t, "mark9", resp.Users[0].LogonName)
 	assert.Equal(t, 1, resp.Users[0].UserID)
 }
@@ -128,13 +91,13 @@ func TestListUsersPerPageTooLarge(t *testing.T) {
 	rec := setupMockGetUsersHTTPHandler("/users?per_page=3000")
 
 	assert.Equal(t, http.StatusBadRequest, rec.Code)
-	var resp JSONHTTPErrorResponse
+	var resp Problem
 	err = json.Unmarshal(rec.Body.Bytes(), &resp)
 	if err != nil {
 		t.Fatal("unable to unmarshal JSON response")
 	}
-	assert.Equal(t, 400, resp.Code)
-	assert.Contains(t, resp.Message, "per_page query string must be an integer between")
+	assert.Equal(t, 400, resp.Status)
+	assert.Contains(t, resp.Detail, "per_page query string must be an integer between")
 }
 
 // TestListUsersPageNotFound tests for when a page has been requested which exceeds the number of user resources stored (based on total count)
@@ -143,11 +106,70 @@ func TestListUsersPageNotFound(t *testing.T) {
 	rec := setupMockGetUsersHTTPHandler("/users?page=1000")
 
 	assert.Equal(t, http.StatusNotFound, rec.Code)
-	var resp JSONHTTPErrorResponse
+	var resp Problem
 	err = json.Unmarshal(rec.Body.Bytes(), &resp)
 	if err != nil {
 		t.Fatal("unable to unmarshal JSON response")
 	}
-	assert.Equal(t, 404, resp.Code)
-	assert.Contains(t, resp.Message, fmt.Sprintf("page %d not found", 1000))
+	assert.Equal(t, 404, resp.Status)
+	assert.Contains(t, resp.Detail, fmt.Sprintf("page %d not found", 1000))
+}
+
+// approximateUsersStore returns a total estimated from the table statistics, as Postgres does for large tables
+type approximateUsersStore struct {
+	UserStore
+}
+
+func (approximateUsersStore) QueryUsers(_ context.Context, _, limit int, _ string) (UsersPage, error) {
+	users := make([]User, limit)
+	return UsersPage{Users: users, Total: 1000001, Approximate: true}, nil
+}
+
+// TestListUsersApproximateTotal tests that an estimated total is flagged in the response
+func TestListUsersApproximateTotal(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/users?per_page=10&page=3", nil)
+	env := &Env{UsersDB: approximateUsersStore{UserStore: NewMemoryUserModel()}}
+	http.HandlerFunc(env.listUsers).ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var resp UsersResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatal("unable to unmarshal JSON response")
+	}
+	assert.Equal(t, 100001, resp.TotalPages)
+	assert.True(t, resp.MorePages)
+	assert.True(t, resp.ApproximateTotal)
+	assert.Contains(t, recorder.Body.String(), `"approximate_total":true`)
+
+	// Exact totals leave the field out
+	rec := setupMockGetUsersHTTPHandler("/users")
+	assert.NotContains(t, rec.Body.String(), "approximate_total")
+}
+
+// TestListUsersSearch tests searching with the q and min_score query parameters
+func TestListUsersSearch(t *testing.T) {
+	rec := setupMockGetUsersHTTPHandler("/users?q=BOB")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var resp UsersResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal("unable to unmarshal JSON response")
+	}
+	assert.Equal(t, []string{"bob44", "bobby8"}, []string{resp.Users[0].LogonName, resp.Users[1].LogonName})
+	assert.Equal(t, 1, resp.TotalPages)
+
+	rec = setupMockGetUsersHTTPHandler("/users?q=bob&min_score=0.9")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "bob44")
+	assert.NotContains(t, rec.Body.String(), "bobby8")
+
+	for url, expected := range map[string]string{
+		"/users?q=bob&name_filter=bob": "only one of the q and name_filter query strings can be used",
+		"/users?q=bob&min_score=2":     "min_score query string must be a number between 0 and 1",
+		"/users?min_score=0.5":         "min_score query string can only be used with q",
+	} {
+		rec = setupMockGetUsersHTTPHandler(url)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, url)
+		assert.Contains(t, rec.Body.String(), expected, url)
+	}
 }
@@ -0,0 +1,299 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryUserModel is a UserStore which keeps the users in memory, for local development and tests.
+// Nothing is persisted and user events are not recorded
+type MemoryUserModel struct {
+	// writeMu serialises writers, so that committing a transaction can't overwrite a concurrent write
+	writeMu      sync.Mutex
+	mu           sync.RWMutex // guards users, nextID and lastModified
+	users        []User       // ordered by UserID
+	nextID       int
+	lastModified time.Time // when a user was last added, updated or deleted
+	inTx         bool      // set when the model is a transaction's working copy
+}
+
+// NewMemoryUserModel returns a MemoryUserModel seeded with users. Any seeded user without a UserID is assigned the next one
+func NewMemoryUserModel(users ...User) *MemoryUserModel {
+	m := &MemoryUserModel{nextID: 1, lastModified: time.Now()}
+	for _, user := range users {
+		if user.UserID == 0 {
+			user.UserID = m.nextID
+		}
+		m.nextID = max(m.nextID, user.UserID+1)
+		m.users = append(m.users, user)
+	}
+	slices.SortFunc(m.users, func(a, b User) int { return a.UserID - b.UserID })
+	return m
+}
+
+// lockForWrite locks the model for a single write. A transaction's working copy is already covered by its parent's writeMu
+func (m *MemoryUserModel) lockForWrite() func() {
+	if !m.inTx {
+		m.writeMu.Lock()
+	}
+	m.mu.Lock()
+	return func() {
+		m.mu.Unlock()
+		if !m.inTx {
+			m.writeMu.Unlock()
+		}
+	}
+}
+
+// modified returns when a user was last added, updated or deleted
+func (m *MemoryUserModel) modified() time.Time {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.lastModified
+}
+
+// matchUsers returns the users whose full_name contains nameFilter, in UserID order
+func (m *MemoryUserModel) matchUsers(nameFilter string) []User {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	matched := make([]User, 0, len(m.users))
+	for _, user := range m.users {
+		if strings.Contains(user.FullName, nameFilter) {
+			matched = append(matched, user)
+		}
+	}
+	return matched
+}
+
+// indexOf returns the position of logonName in m.users, or -1 if it isn't present. Must be called with mu held
+func (m *MemoryUserModel) indexOf(logonName string) int {
+	return slices.IndexFunc(m.users, func(user User) bool { return user.LogonName == logonName })
+}
+
+// QueryRecordCount returns the count of users whose full_name contains nameFilter, or whose logon_name is logonNameFilter.
+// Only 1 filter can be used at once. With neither filter every user is counted
+func (m *MemoryUserModel) QueryRecordCount(ctx context.Context, nameFilter, logonNameFilter string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if nameFilter != "" && logonNameFilter != "" {
+		return 0, fmt.Errorf("cannot define both nameFilter and logonNameFilter for queryRecordCount function")
+	}
+
+	if logonNameFilter != "" {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+		if m.indexOf(logonNameFilter) == -1 {
+			return 0, nil
+		}
+		return 1, nil
+	}
+	return len(m.matchUsers(nameFilter)), nil
+}
+
+// QueryUsers returns a page of users whose full_name contains nameFilter, ordered by UserID, along with the total number
+// which match
+func (m *MemoryUserModel) QueryUsers(ctx context.Context, offset, limit int, nameFilter string) (UsersPage, error) {
+	if err := ctx.Err(); err != nil {
+		return UsersPage{Users: make([]User, 0)}, err
+	}
+
+	lastModified := m.modified()
+	matched := m.matchUsers(nameFilter)
+	start := min(max(offset, 0), len(matched))
+	end := min(start+max(limit, 0), len(matched))
+	return UsersPage{Users: matched[start:end], Total: len(matched), LastModified: lastModified}, nil
+}
+
+// SearchUsers returns a page of the users which match query, ranked by similarity. It approximates the Postgres pg_trgm search
+func (m *MemoryUserModel) SearchUsers(ctx context.Context, query string, minScore float64, offset, limit int) (UsersPage, error) {
+	if err := ctx.Err(); err != nil {
+		return UsersPage{Users: make([]User, 0)}, err
+	}
+	lastModified := m.modified()
+	page := rankUsers(m.matchUsers(""), query, minScore, offset, limit)
+	page.LastModified = lastModified
+	return page, nil
+}
+
+// StreamUsers calls fn for every user whose full_name contains nameFilter, in UserID order, stopping early if ctx is done
+func (m *MemoryUserModel) StreamUsers(ctx context.Context, nameFilter string, fn func(User) error) error {
+	for _, user := range m.matchUsers(nameFilter) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddUser adds a new user, returning ErrLogonNameTaken if the logon_name is already in use
+func (m *MemoryUserModel) AddUser(ctx context.Context, user User) (User, error) {
+	if err := ctx.Err(); err != nil {
+		return user, err
+	}
+	defer m.lockForWrite()()
+
+	if m.indexOf(user.LogonName) != -1 {
+		return user, ErrLogonNameTaken
+	}
+	user.UserID = m.nextID
+	m.nextID++
+	m.users = append(m.users, user)
+	m.lastModified = time.Now()
+	return user, nil
+}
+
+// GetUser returns the user with logonName, or ErrUserNotFound if there is none
+func (m *MemoryUserModel) GetUser(ctx context.Context, logonName string) (User, error) {
+	if err := ctx.Err(); err != nil {
+		return User{}, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	i := m.indexOf(logonName)
+	if i == -1 {
+		return User{}, ErrUserNotFound
+	}
+	return m.users[i], nil
+}
+
+// DeleteUser deletes a user, returning ErrUserNotFound if there is no user with logonName
+func (m *MemoryUserModel) DeleteUser(ctx context.Context, logonName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer m.lockForWrite()()
+
+	i := m.indexOf(logonName)
+	if i == -1 {
+		return ErrUserNotFound
+	}
+	m.users = slices.Delete(m.users, i, i+1)
+	m.lastModified = time.Now()
+	return nil
+}
+
+// UpdateUser updates the email and/or full_name of the user with the same logon_name, returning ErrUserNotFound if there is none
+func (m *MemoryUserModel) UpdateUser(ctx context.Context, user User) (User, error) {
+	if user.Email == "" && user.FullName == "" {
+		return user, fmt.Errorf("email and/or full_name fields need to be set in the user object")
+	}
+	if err := ctx.Err(); err != nil {
+		return user, err
+	}
+	defer m.lockForWrite()()
+
+	i := m.indexOf(user.LogonName)
+	if i == -1 {
+		return user, ErrUserNotFound
+	}
+	if user.Email != "" {
+		m.users[i].Email = user.Email
+	}
+	if user.FullName != "" {
+		m.users[i].FullName = user.FullName
+	}
+	m.lastModified = time.Now()
+	return m.users[i], nil
+}
+
+// WithTx runs fn against a working copy of the users, which replaces them if fn returns nil. Writers outside the
+// transaction wait until it has finished. Calls on a model which is already scoped to a transaction reuse it rather than nesting
+func (m *MemoryUserModel) WithTx(ctx context.Context, fn func(UserStore) error) error {
+	if m.inTx {
+		return fn(m)
+	}
+
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+
+	m.mu.RLock()
+	tx := &MemoryUserModel{users: slices.Clone(m.users), nextID: m.nextID, lastModified: m.lastModified, inTx: true}
+	m.mu.RUnlock()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("committing transaction: %v", err)
+	}
+
+	m.mu.Lock()
+	m.users, m.nextID, m.lastModified = tx.users, tx.nextID, tx.lastModified
+	m.mu.Unlock()
+	return nil
+}
+
+// MemoryIdempotencyStore keeps idempotency keys in memory, for use with MemoryUserModel. Expired keys are replaced if they
+// are reused, and otherwise removed by deleteExpiredIdempotencyKeys
+type MemoryIdempotencyStore struct {
+	mu      sync.Mutex
+	records map[string]idempotencyRecord
+	expires map[string]time.Time
+}
+
+// NewMemoryIdempotencyStore returns an empty MemoryIdempotencyStore
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{records: make(map[string]idempotencyRecord), expires: make(map[string]time.Time)}
+}
+
+// reserveIdempotencyKey claims key for a new request, taking over any existing record which has expired.
+// If the key is still held then the existing record is returned instead
+func (m *MemoryIdempotencyStore) reserveIdempotencyKey(_ context.Context, key, fingerprint string, ttl time.Duration) (idempotencyRecord, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if record, found := m.records[key]; found && time.Now().Before(m.expires[key]) {
+		return record, false, nil
+	}
+	m.records[key] = idempotencyRecord{fingerprint: fingerprint}
+	m.expires[key] = time.Now().Add(ttl)
+	return idempotencyRecord{}, true, nil
+}
+
+// completeIdempotencyKey stores the response for key
+func (m *MemoryIdempotencyStore) completeIdempotencyKey(_ context.Context, key string, record idempotencyRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, found := m.records[key]; found {
+		m.records[key] = record
+	}
+	return nil
+}
+
+// releaseIdempotencyKey deletes key so that the request can be retried
+func (m *MemoryIdempotencyStore) releaseIdempotencyKey(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.records, key)
+	delete(m.expires, key)
+	return nil
+}
+
+// deleteExpiredIdempotencyKeys deletes up to limit keys which have expired
+func (m *MemoryIdempotencyStore) deleteExpiredIdempotencyKeys(_ context.Context, limit int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	deleted := 0
+	for key, expires := range m.expires {
+		if deleted == limit {
+			break
+		}
+		if now.Before(expires) {
+			continue
+		}
+		delete(m.records, key)
+		delete(m.expires, key)
+		deleted++
+	}
+	return deleted, nil
+}
@@ -0,0 +1,281 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricsNamespace = "user_mgmt"
+
+	// unmatchedRoute labels requests which did not match a route (404s and 405s), so that scanning for random paths can't
+	// create unbounded label values
+	unmatchedRoute = "unmatched"
+)
+
+// Metrics holds the Prometheus collectors for the HTTP server and database
+type Metrics struct {
+	registry       *prometheus.Registry
+	httpRequests   *prometheus.CounterVec
+	httpDuration   *prometheus.HistogramVec
+	httpInFlight   *prometheus.GaugeVec
+	dbCallDuration *prometheus.HistogramVec
+	dbRetries      *prometheus.CounterVec
+	cacheRequests  *prometheus.CounterVec
+	cacheInvalid   *prometheus.CounterVec
+	buildInfo      *prometheus.GaugeVec
+}
+
+// NewMetrics creates and registers the collectors. If db is not nil then its connection pool stats are also exported
+func NewMetrics(db *sql.DB) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "Total number of HTTP requests, by route template, method and status code",
+		}, []string{"route", "method", "code"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP request latency, by route template, method and status code",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method", "code"}),
+		httpInFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_in_flight",
+			Help:      "Number of HTTP requests currently being served, by route template and method",
+		}, []string{"route", "method"}),
+		dbCallDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "db_call_duration_seconds",
+			Help:      "Latency of the users store calls, by method and whether they returned an error",
+			Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		}, []string{"method", "outcome"}),
+		dbRetries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "db_retries_total",
+			Help:      "Number of users store calls retried after a transient database error, by method",
+		}, []string{"method"}),
+		cacheRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "cache_requests_total",
+			Help:      "Number of users cache lookups, by cache (user or page) and result (hit or miss)",
+		}, []string{"cache", "result"}),
+		cacheInvalid: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "cache_invalidations_total",
+			Help:      "Number of users cache invalidations, by source (local writes or notifications from other replicas)",
+		}, []string{"source"}),
+		buildInfo: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "build_info",
+			Help:      "Always 1. Labelled with the build version of the running binary",
+		}, []string{"version", "goversion"}),
+	}
+
+	m.registry.MustRegister(
+		m.httpRequests, m.httpDuration, m.httpInFlight, m.dbCallDuration, m.dbRetries, m.cacheRequests, m.cacheInvalid, m.buildInfo,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	if db != nil {
+		m.registry.MustRegister(collectors.NewDBStatsCollector(db, ServiceName))
+	}
+
+	return m
+}
+
+// observeRetry counts a users store call being retried
+func (m *Metrics) observeRetry(method string) {
+	m.dbRetries.WithLabelValues(method).Inc()
+}
+
+// registerCircuitBreaker exports the state of the database circuit breaker
+func (m *Metrics) registerCircuitBreaker(breaker *CircuitBreaker) {
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "db_circuit_breaker_state",
+		Help:      "State of the database circuit breaker. 0 is closed, 1 is half-open and 2 is open",
+	}, func() float64 { return float64(breaker.currentState()) }))
+}
+
+// observeCacheLookup counts a users cache hit or miss
+func (m *Metrics) observeCacheLookup(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.cacheRequests.WithLabelValues(cache, result).Inc()
+}
+
+// observeCacheInvalidation counts a users cache invalidation
+func (m *Metrics) observeCacheInvalidation(source string) {
+	m.cacheInvalid.WithLabelValues(source).Inc()
+}
+
+// registerCache exports the number of entries in each users cache
+func (m *Metrics) registerCache(cache *UsersCache) {
+	entries := map[string]func() int{cacheUsers: cache.users.len, cachePages: cache.pages.len}
+	for name, count := range entries {
+		m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "cache_entries",
+			Help:        "Number of entries in the users cache, by cache",
+			ConstLabels: prometheus.Labels{"cache": name},
+		}, func() float64 { return float64(count()) }))
+	}
+}
+
+// setBuildInfo records the build version. The version is only known once the DB connection has been opened
+func (m *Metrics) setBuildInfo(version string) {
+	m.buildInfo.Reset()
+	m.buildInfo.WithLabelValues(version, runtime.Version()).Set(1)
+}
+
+// handler returns the /metrics endpoint in the Prometheus exposition format
+func (m *Metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+// instrumentHandler is mux middleware which records the RED metrics for each request.
+// Requests are labelled with the route template (e.g. /users/{logon_name}) rather than the raw path to keep cardinality low
+func (m *Metrics) instrumentHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+		inFlight := m.httpInFlight.WithLabelValues(route, r.Method)
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		code := strconv.Itoa(recorder.status())
+		m.httpRequests.WithLabelValues(route, r.Method, code).Inc()
+		m.httpDuration.WithLabelValues(route, r.Method, code).Observe(time.Since(start).Seconds())
+	})
+}
+
+// routeTemplate returns the template of the mux route which matched r, e.g. /users/{logon_name}
+func routeTemplate(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if template, err := current.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return unmatchedRoute
+}
+
+// observeDBCall records the duration of a single users store call. A missing or duplicate user is an expected outcome rather than an error
+func (m *Metrics) observeDBCall(method string, start time.Time, err error) {
+	outcome := "success"
+	if err != nil && !errors.Is(err, ErrUserNotFound) && !errors.Is(err, ErrLogonNameTaken) {
+		outcome = "error"
+	}
+	m.dbCallDuration.WithLabelValues(method, outcome).Observe(time.Since(start).Seconds())
+}
+
+// statusRecorder keeps the status code and number of bytes written by a handler. Unwrap allows http.ResponseController to reach the
+// underlying writer, which streaming handlers use to flush and lift the write deadline
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	bytes      int
+}
+
+func (s *statusRecorder) WriteHeader(statusCode int) {
+	if s.statusCode == 0 {
+		s.statusCode = statusCode
+	}
+	s.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.statusCode == 0 {
+		s.statusCode = 200
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += n
+	return n, err
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+func (s *statusRecorder) status() int {
+	if s.statusCode == 0 {
+		return 200
+	}
+	return s.statusCode
+}
+
+// instrumentedUsersStore times every call to the wrapped UserStore
+type instrumentedUsersStore struct {
+	next    UserStore
+	metrics *Metrics
+}
+
+// instrumentStore wraps store so that the duration of each call is recorded
+func (m *Metrics) instrumentStore(store UserStore) UserStore {
+	return &instrumentedUsersStore{next: store, metrics: m}
+}
+
+func (s *instrumentedUsersStore) QueryRecordCount(ctx context.Context, nameFilter, logonNameFilter string) (count int, err error) {
+	defer func(start time.Time) { s.metrics.observeDBCall("queryRecordCount", start, err) }(time.Now())
+	return s.next.QueryRecordCount(ctx, nameFilter, logonNameFilter)
+}
+
+func (s *instrumentedUsersStore) QueryUsers(ctx context.Context, offset, limit int, nameFilter string) (page UsersPage, err error) {
+	defer func(start time.Time) { s.metrics.observeDBCall("queryUsers", start, err) }(time.Now())
+	return s.next.QueryUsers(ctx, offset, limit, nameFilter)
+}
+
+func (s *instrumentedUsersStore) GetUser(ctx context.Context, logonName string) (user User, err error) {
+	defer func(start time.Time) { s.metrics.observeDBCall("getUser", start, err) }(time.Now())
+	return s.next.GetUser(ctx, logonName)
+}
+
+func (s *instrumentedUsersStore) SearchUsers(ctx context.Context, query string, minScore float64, offset, limit int) (page UsersPage, err error) {
+	defer func(start time.Time) { s.metrics.observeDBCall("searchUsers", start, err) }(time.Now())
+	return s.next.SearchUsers(ctx, query, minScore, offset, limit)
+}
+
+func (s *instrumentedUsersStore) StreamUsers(ctx context.Context, nameFilter string, fn func(User) error) (err error) {
+	defer func(start time.Time) { s.metrics.observeDBCall("streamUsers", start, err) }(time.Now())
+	return s.next.StreamUsers(ctx, nameFilter, fn)
+}
+
+func (s *instrumentedUsersStore) AddUser(ctx context.Context, user User) (added User, err error) {
+	defer func(start time.Time) { s.metrics.observeDBCall("addUser", start, err) }(time.Now())
+	return s.next.AddUser(ctx, user)
+}
+
+func (s *instrumentedUsersStore) DeleteUser(ctx context.Context, logonName string) (err error) {
+	defer func(start time.Time) { s.metrics.observeDBCall("deleteUser", start, err) }(time.Now())
+	return s.next.DeleteUser(ctx, logonName)
+}
+
+func (s *instrumentedUsersStore) UpdateUser(ctx context.Context, user User) (updated User, err error) {
+	defer func(start time.Time) { s.metrics.observeDBCall("updateUser", start, err) }(time.Now())
+	return s.next.UpdateUser(ctx, user)
+}
+
+// WithTx times the whole transaction, and also each call made within it
+func (s *instrumentedUsersStore) WithTx(ctx context.Context, fn func(UserStore) error) (err error) {
+	defer func(start time.Time) { s.metrics.observeDBCall("withTx", start, err) }(time.Now())
+	return s.next.WithTx(ctx, func(tx UserStore) error {
+		return fn(s.metrics.instrumentStore(tx))
+	})
+}
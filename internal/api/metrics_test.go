@@ -0,0 +1,73 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupMetricsRouter() *mux.Router {
+	metrics := NewMetrics(nil)
+	metrics.setBuildInfo("v1.2.3")
+	env := &Env{UsersDB: metrics.instrumentStore(newTestMemoryStore())}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/users/{logon_name}", env.deleteUser).Methods("DELETE")
+	router.Handle("/metrics", metrics.handler()).Methods("GET")
+	router.Use(metrics.instrumentHandler)
+	router.NotFoundHandler = metrics.instrumentHandler(http.NotFoundHandler())
+	return router
+}
+
+func scrapeMetrics(t *testing.T, router *mux.Router) string {
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	router.ServeHTTP(recorder, req)
+	if recorder.Code != 200 {
+		t.Fatalf("scraping metrics returned status code %d", recorder.Code)
+	}
+	return recorder.Body.String()
+}
+
+// TestMetricsRouteTemplate tests that requests are labelled with the route template rather than the raw path
+func TestMetricsRouteTemplate(t *testing.T) {
+	router := setupMetricsRouter()
+
+	for _, path := range []string{"/users/mark9", "/users/bob44", "/users/unknown", "/not-a-route"} {
+		req, _ := http.NewRequest("DELETE", path, nil)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	body := scrapeMetrics(t, router)
+	assert.Contains(t, body, `user_mgmt_http_requests_total{code="204",method="DELETE",route="/users/{logon_name}"} 2`)
+	assert.Contains(t, body, `user_mgmt_http_requests_total{code="404",method="DELETE",route="/users/{logon_name}"} 1`)
+	assert.Contains(t, body, `user_mgmt_http_requests_total{code="404",method="DELETE",route="unmatched"} 1`)
+	assert.Contains(t, body, `user_mgmt_http_request_duration_seconds_count{code="204",method="DELETE",route="/users/{logon_name}"} 2`)
+	assert.Contains(t, body, `user_mgmt_http_requests_in_flight{method="DELETE",route="/users/{logon_name}"} 0`)
+	assert.NotContains(t, body, "mark9")
+}
+
+// TestMetricsDBCalls tests that each users store call is timed by method
+func TestMetricsDBCalls(t *testing.T) {
+	router := setupMetricsRouter()
+
+	req, _ := http.NewRequest("DELETE", "/users/mark9", nil)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	// A 404 is an expected outcome, so isn't counted as a failed call
+	req, _ = http.NewRequest("DELETE", "/users/unknown", nil)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	body := scrapeMetrics(t, router)
+	assert.Contains(t, body, `user_mgmt_db_call_duration_seconds_count{method="deleteUser",outcome="success"} 2`)
+	assert.NotContains(t, body, `outcome="error"`)
+}
+
+// TestMetricsBuildInfo tests that the build version is exported
+func TestMetricsBuildInfo(t *testing.T) {
+	router := setupMetricsRouter()
+
+	assert.Regexp(t, `user_mgmt_build_info\{goversion="go[^"]+",version="v1.2.3"\} 1`, scrapeMetrics(t, router))
+}
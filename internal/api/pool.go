@@ -0,0 +1,121 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultMaxOpenConns    = 20
+	defaultMaxIdleConns    = 10
+	defaultConnMaxLifetime = time.Minute * 30
+	defaultConnMaxIdleTime = time.Minute * 5
+)
+
+// PoolConfig sizes a database connection pool. Recycling connections after ConnMaxLifetime also spreads them across the
+// Aurora reader instances, and retires connections opened with a rotated password
+type PoolConfig struct {
+	MaxOpenConns    int           `yaml:"max_open_conns"` // 0 is unlimited
+	MaxIdleConns    int           `yaml:"max_idle_conns"` // 0 keeps no idle connections
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
+	ConnMaxIdleTime time.Duration `yaml:"conn_max_idle_time"`
+	// PreparedStatements prepares the users queries once per connection. Disable it behind a proxy which doesn't support
+	// prepared statements, such as PgBouncer in transaction mode
+	PreparedStatements bool `yaml:"prepared_statements"`
+}
+
+// apply sets the pool limits on db
+func (p PoolConfig) apply(db *sql.DB) {
+	db.SetMaxOpenConns(p.MaxOpenConns)
+	db.SetMaxIdleConns(p.MaxIdleConns)
+	db.SetConnMaxLifetime(p.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(p.ConnMaxIdleTime)
+}
+
+// closeIdle closes the idle connections in db, so that the pool is rebuilt as connections are needed. Connections which
+// are in use aren't affected
+func (p PoolConfig) closeIdle(db *sql.DB) {
+	db.SetMaxIdleConns(0)
+	db.SetMaxIdleConns(p.MaxIdleConns)
+}
+
+// stmtCache is a dbConn which prepares each query the first time it is run, and reuses the prepared statement after that.
+// database/sql prepares the statement on each connection in the pool as it is first needed there, which saves Postgres from
+// parsing & planning the query on every call, and saves a round trip per query
+type stmtCache struct {
+	db    *sql.DB
+	mu    sync.RWMutex
+	stmts map[string]*sql.Stmt
+}
+
+func newStmtCache(db *sql.DB) *stmtCache {
+	return &stmtCache{db: db, stmts: make(map[string]*sql.Stmt)}
+}
+
+// prepare returns the prepared statement for query, preparing it if this is the first time it has been run
+func (c *stmtCache) prepare(ctx context.Context, query string) (*sql.Stmt, error) {
+	c.mu.RLock()
+	stmt, ok := c.stmts[query]
+	c.mu.RUnlock()
+	if ok {
+		return stmt, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if stmt, ok = c.stmts[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := c.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	c.stmts[query] = stmt
+	return stmt, nil
+}
+
+// QueryRowContext runs the prepared statement for query. If it can't be prepared, e.g. because the database is down, the
+// query is run directly instead so that the caller gets the same error it would without the cache
+func (c *stmtCache) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	stmt, err := c.prepare(ctx, query)
+	if err != nil {
+		log.WithContext(ctx).WithError(err).Debug("preparing statement. Running the query directly")
+		return c.db.QueryRowContext(ctx, query, args...)
+	}
+	return stmt.QueryRowContext(ctx, args...)
+}
+
+func (c *stmtCache) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	stmt, err := c.prepare(ctx, query)
+	if err != nil {
+		log.WithContext(ctx).WithError(err).Debug("preparing statement. Running the query directly")
+		return c.db.QueryContext(ctx, query, args...)
+	}
+	return stmt.QueryContext(ctx, args...)
+}
+
+func (c *stmtCache) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	stmt, err := c.prepare(ctx, query)
+	if err != nil {
+		log.WithContext(ctx).WithError(err).Debug("preparing statement. Running the query directly")
+		return c.db.ExecContext(ctx, query, args...)
+	}
+	return stmt.ExecContext(ctx, args...)
+}
+
+// Close closes every prepared statement
+func (c *stmtCache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var errs []error
+	for query, stmt := range c.stmts {
+		errs = append(errs, stmt.Close())
+		delete(c.stmts, query)
+	}
+	return errors.Join(errs...)
+}
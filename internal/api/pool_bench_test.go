@@ -0,0 +1,71 @@
+//go:build integration
+
+package api
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+// benchmarkUsers is how many users are in the table while benchmarking, which is enough for the filtered queries to scan
+const benchmarkUsers = 10000
+
+// BenchmarkListUsersQueries runs the query behind GET /users, for a page of users and their total, from many goroutines at once,
+// with and without prepared statements and with different pool sizes. It replaces the contents of the users table, so must
+// only be pointed at a disposable database:
+//
+//	go test -tags=integration -run '^$' -bench ListUsersQueries -benchtime 10s ./internal/api
+func BenchmarkListUsersQueries(b *testing.B) {
+	db := openPostgresTestDB(b)
+	if _, err := db.Exec(`TRUNCATE users, user_events RESTART IDENTITY CASCADE`); err != nil {
+		b.Fatalf("emptying users table: %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO users (logon_name, full_name, email)
+		SELECT 'user' || i, 'User ' || i, 'user' || i || '@email.com' FROM generate_series(1, $1) AS i`, benchmarkUsers); err != nil {
+		b.Fatalf("seeding users table: %v", err)
+	}
+
+	pools := []PoolConfig{
+		{MaxOpenConns: 0, MaxIdleConns: 2}, // the database/sql defaults, which churn through connections under load
+		{MaxOpenConns: 10, MaxIdleConns: 10, ConnMaxLifetime: defaultConnMaxLifetime},
+		{MaxOpenConns: defaultMaxOpenConns, MaxIdleConns: defaultMaxIdleConns, ConnMaxLifetime: defaultConnMaxLifetime},
+	}
+	for _, pool := range pools {
+		for _, prepared := range []bool{false, true} {
+			name := fmt.Sprintf("max_open=%d/max_idle=%d/prepared=%t", pool.MaxOpenConns, pool.MaxIdleConns, prepared)
+			b.Run(name, func(b *testing.B) {
+				pool.apply(db)
+				model := &UserModel{DB: db}
+				if prepared {
+					model.Stmts = newStmtCache(db)
+					defer func() { _ = model.Stmts.Close() }()
+				}
+				benchmarkListUsersQueries(b, model)
+			})
+		}
+	}
+}
+
+func benchmarkListUsersQueries(b *testing.B, model *UserModel) {
+	ctx := context.Background()
+	b.SetParallelism(8) // 8 goroutines per CPU, so that the pool is contended
+	before := model.DB.Stats()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			nameFilter := ""
+			if i%2 == 1 {
+				nameFilter = fmt.Sprintf("User %d", i%100)
+			}
+			if _, err := model.QueryUsers(ctx, (i%50)*10, 10, nameFilter); err != nil {
+				b.Errorf("querying users: %v", err)
+				return
+			}
+		}
+	})
+	b.StopTimer()
+	after := model.DB.Stats()
+	b.ReportMetric(float64(after.MaxIdleClosed+after.MaxLifetimeClosed-before.MaxIdleClosed-before.MaxLifetimeClosed)/float64(b.N), "conns_closed/op")
+	b.ReportMetric(float64(after.WaitCount-before.WaitCount)/float64(b.N), "pool_waits/op")
+}
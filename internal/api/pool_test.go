@@ -0,0 +1,43 @@
+package api
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestStmtCache tests that each query is prepared once and reused, and that a query which can't be prepared is run directly
+func TestStmtCache(t *testing.T) {
+	ctx := context.Background()
+	store := newTestSQLiteDB(t, conformanceUsers...)
+	stmts := newStmtCache(store.DB)
+	model := &UserModel{DB: store.DB, Stmts: stmts}
+
+	for range 2 {
+		count, err := model.QueryRecordCount(ctx, "", "")
+		assert.NoError(t, err)
+		assert.Equal(t, 3, count)
+	}
+	assert.Len(t, stmts.stmts, 1)
+
+	// Transactions don't use the prepared statements
+	err := model.WithTx(ctx, func(tx UserStore) error {
+		_, err := tx.QueryRecordCount(ctx, "", "")
+		return err
+	})
+	assert.NoError(t, err)
+	assert.Len(t, stmts.stmts, 1)
+
+	assert.NoError(t, stmts.Close())
+	assert.Empty(t, stmts.stmts)
+
+	// The caller gets the query's error when the statement can't be prepared
+	closed := newTestSQLiteDB(t)
+	_ = closed.DB.Close()
+	stmts = newStmtCache(closed.DB)
+	var count int
+	err = stmts.QueryRowContext(ctx, "SELECT COUNT(*) FROM users").Scan(&count)
+	assert.ErrorContains(t, err, "database is closed")
+	assert.Empty(t, stmts.stmts)
+}
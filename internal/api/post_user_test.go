@@ -2,6 +2,7 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -12,43 +13,35 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-// mockPostUserModel is used to mock the Postgres DB calls
-type mockPostUserModel struct{}
-
-func (m *mockPostUserModel) queryUsers(_, _ int, _ string) (users []User, err error) {
-	return
+// newPostUserTestStore returns a store which already holds testuser2 and testuser3, with the next user_id being 11
+func newPostUserTestStore() UserStore {
+	store := NewMemoryUserModel(
+		User{UserID: 9, LogonName: "testuser2", FullName: "Test User 2", Email: "test2@email.com"},
+		User{UserID: 10, LogonName: "testuser3", FullName: "Test User 3", Email: "test3@email.com"},
+	)
+	return &racingUsersStore{UserStore: store, logonName: "testuser3"}
 }
 
-func (m *mockPostUserModel) queryRecordCount(_, logonNameFilter string) (count int, err error) {
-	switch logonNameFilter {
-	case "testuser2":
-		return 1, nil
-	default:
-		return 0, nil
-	}
+// racingUsersStore hides logonName from the uniqueness check, as if another request created it after the check passed
+type racingUsersStore struct {
+	UserStore
+	logonName string
 }
 
-func (m *mockPostUserModel) addUser(user User) (User, error) {
-	switch user.LogonName {
-	case "testuser1":
-		user.UserID = 11
+func (s *racingUsersStore) QueryRecordCount(ctx context.Context, nameFilter, logonNameFilter string) (int, error) {
+	if logonNameFilter == s.logonName {
+		return 0, nil
 	}
-	return user, nil
-}
-
-func (m *mockPostUserModel) deleteUser(_ string) (err error) {
-	return
+	return s.UserStore.QueryRecordCount(ctx, nameFilter, logonNameFilter)
 }
 
-func (m *mockPostUserModel) updateUser(_ User) (user User, err error) { return }
-
 func setupMockPostUserHTTPHandler(body bytes.Buffer) *httptest.ResponseRecorder {
 	recorder := httptest.NewRecorder()
 	req, err := http.NewRequest("POST", "/users", &body)
 	if err != nil {
 		log.Fatal("creating new HTTP POST /users request")
 	}
-	env := &Env{UsersDB: &mockPostUserModel{}}
+	env := &Env{UsersDB: newPostUserTestStore()}
 	http.HandlerFunc(env.postUser).ServeHTTP(recorder, req)
 
 	return recorder
@@ -69,7 +62,7 @@ func postRequestHelperSuccess(user User, t *testing.T) (*httptest.ResponseRecord
 	return rec, resp
 }
 
-func postRequestHelperFailure(user User, t *testing.T) (*httptest.ResponseRecorder, JSONHTTPErrorResponse) {
+func postRequestHelperFailure(user User, t *testing.T) (*httptest.ResponseRecorder, Problem) {
 	var buf bytes.Buffer
 	err := json.NewEncoder(&buf).Encode(user)
 	if err != nil {
@@ -77,7 +70,7 @@ func postRequestHelperFailure(user User, t *testing.T) (*httptest.ResponseRecord
 	}
 	rec := setupMockPostUserHTTPHandler(buf)
 
-	var resp JSONHTTPErrorResponse
+	var resp Problem
 	err = json.Unmarshal(rec.Body.Bytes(), &resp)
 	if err != nil {
 		t.Fatal("unable to unmarshal JSON response")
@@ -109,9 +102,24 @@ func TestAddUserLogonAlreadyTaken(t *testing.T) {
 	}
 	rec, resp := postRequestHelperFailure(user, t)
 
-	assert.Equal(t, 400, rec.Code)
-	assert.Equal(t, 400, resp.Code)
-	assert.Contains(t, fmt.Sprintf("logon_name '%s' already taken. Please choose another one", user.LogonName), resp.Message)
+	assert.Equal(t, 422, rec.Code)
+	assert.Equal(t, 422, resp.Status)
+	assert.Contains(t, fmt.Sprintf("logon_name '%s' already taken. Please choose another one", user.LogonName), resp.Detail)
+	assert.Equal(t, CodeLogonNameTaken, resp.Code)
+	assert.Equal(t, []FieldError{logonNameTakenError(user.LogonName)}, resp.Errors)
+}
+
+// TestAddUserLogonTakenConcurrently tests that a unique violation from the DB is returned as a 422 rather than a 500
+func TestAddUserLogonTakenConcurrently(t *testing.T) {
+	user := User{
+		LogonName: "testuser3",
+		FullName:  "Test User 3",
+		Email:     "test3@email.com",
+	}
+	rec, resp := postRequestHelperFailure(user, t)
+
+	assert.Equal(t, 422, rec.Code)
+	assert.Equal(t, fmt.Sprintf("logon_name '%s' already taken. Please choose another one", user.LogonName), resp.Detail)
 }
 
 // TestAddUserFieldLengthTooLong tests that the validation around field lengths is working as expected
@@ -124,9 +132,9 @@ func TestAddUserFieldLengthTooLong(t *testing.T) {
 	}
 	rec, resp := postRequestHelperFailure(user, t)
 
-	assert.Equal(t, 400, rec.Code)
-	assert.Equal(t, 400, resp.Code)
-	assert.Contains(t, resp.Message, fmt.Sprintf("validating request payload field lengths: logon_name maximum lengh is 20. Currently %d", len(longFieldName)))
+	assert.Equal(t, 422, rec.Code)
+	assert.Equal(t, 422, resp.Status)
+	assert.Contains(t, resp.Detail, fmt.Sprintf("logon_name maximum length is 20. Currently %d", len(longFieldName)))
 }
 
 // TestAddUserInvalidEmailFieldFormat tests that the validation around email field format is working as expected
@@ -139,9 +147,13 @@ func TestAddUserInvalidEmailFieldFormat(t *testing.T) {
 	}
 	rec, resp := postRequestHelperFailure(user, t)
 
-	assert.Equal(t, 400, rec.Code)
-	assert.Equal(t, 400, resp.Code)
-	assert.Contains(t, resp.Message, fmt.Sprintf("'%s' not a valid email address field:", badEmailFormat))
+	assert.Equal(t, 422, rec.Code)
+	assert.Equal(t, 422, resp.Status)
+	assert.Contains(t, resp.Detail, fmt.Sprintf("'%s' not a valid email address field:", badEmailFormat))
+	assert.Equal(t, CodeInvalidEmail, resp.Code)
+	if assert.Len(t, resp.Errors, 1) {
+		assert.Equal(t, "email", resp.Errors[0].Field)
+	}
 }
 
 // TestAddUserPassedTheUserLogonField tests that an unsupported field - user_id - is handled correctly
@@ -154,7 +166,27 @@ func TestAddUserPassedTheUserLogonField(t *testing.T) {
 	}
 	rec, resp := postRequestHelperFailure(user, t)
 
-	assert.Equal(t, 400, rec.Code)
-	assert.Equal(t, 400, resp.Code)
-	assert.Equal(t, "passing a user_id in the request payload is not supported", resp.Message)
+	assert.Equal(t, 422, rec.Code)
+	assert.Equal(t, 422, resp.Status)
+	assert.Equal(t, "user_id is generated by the service and can't be passed in the request payload", resp.Detail)
+	assert.Equal(t, CodeFieldNotAllowed, resp.Code)
+}
+
+// TestAddUserMultipleInvalidFields tests that every invalid field is reported in a single response
+func TestAddUserMultipleInvalidFields(t *testing.T) {
+	user := User{
+		LogonName: "qwertyuiopqwertyuiopqwertyuiop",
+		FullName:  "Test User 5",
+		Email:     "test5@",
+	}
+	rec, resp := postRequestHelperFailure(user, t)
+
+	assert.Equal(t, 422, rec.Code)
+	assert.Equal(t, CodeValidationFailed, resp.Code)
+	if assert.Len(t, resp.Errors, 2) {
+		assert.Equal(t, "logon_name", resp.Errors[0].Field)
+		assert.Equal(t, CodeFieldTooLong, resp.Errors[0].Code)
+		assert.Equal(t, "email", resp.Errors[1].Field)
+		assert.Equal(t, CodeInvalidEmail, resp.Errors[1].Code)
+	}
 }
@@ -0,0 +1,179 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// expectedSchemaVersion is the version of the latest script in sql/. It must be bumped whenever a script is added
+	expectedSchemaVersion = 12
+
+	defaultEventBacklogThreshold = 1000
+	defaultReadinessDrainDelay   = time.Second * 5
+
+	checkPrimary      = "primary"
+	checkReplica      = "replica"
+	checkMigrations   = "migrations"
+	checkEventBacklog = "event_backlog"
+
+	probeStatusOK      = "ok"
+	probeStatusFailing = "failing"
+)
+
+// knownChecks are the dependency checks which can be made critical
+var knownChecks = []string{checkPrimary, checkReplica, checkMigrations, checkEventBacklog}
+
+// ProbesConfig sets which dependency checks fail readiness, and how the event backlog and shutdown are handled
+type ProbesConfig struct {
+	// CriticalChecks fail readiness when they fail. Any other check is reported in /readyz without affecting the status
+	CriticalChecks        []string `yaml:"critical_checks"`
+	EventBacklogThreshold int      `yaml:"event_backlog_threshold"`
+	// DrainDelay is how long readiness reports false during a graceful shutdown before the server stops accepting
+	// connections, so that load balancers stop sending new requests first
+	DrainDelay time.Duration `yaml:"drain_delay"`
+}
+
+// ReadinessResponse is the body of GET /readyz
+type ReadinessResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// CheckResult is the outcome of a single dependency check
+type CheckResult struct {
+	Status     string  `json:"status"`
+	Critical   bool    `json:"critical"`
+	DurationMS float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+type dependencyCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// Probes serves the liveness and readiness endpoints. Liveness only shows that the server is responding, so that a database
+// outage makes the service unready rather than getting it restarted. Readiness runs every registered dependency check
+type Probes struct {
+	critical     map[string]bool
+	timeout      time.Duration
+	checks       []dependencyCheck
+	shuttingDown atomic.Bool
+}
+
+// NewProbes returns probes which time out each dependency check after timeout
+func NewProbes(cfg ProbesConfig, timeout time.Duration) *Probes {
+	critical := make(map[string]bool, len(cfg.CriticalChecks))
+	for _, name := range cfg.CriticalChecks {
+		critical[name] = true
+	}
+	return &Probes{critical: critical, timeout: timeout}
+}
+
+// register adds a dependency check to readiness
+func (p *Probes) register(name string, check func(ctx context.Context) error) {
+	p.checks = append(p.checks, dependencyCheck{name: name, check: check})
+}
+
+// startShutdown makes readiness fail, so that no new requests are routed to the server while it shuts down
+func (p *Probes) startShutdown() {
+	p.shuttingDown.Store(true)
+}
+
+// livez is an HTTP handler for GET /livez. It doesn't check any dependencies
+func (p *Probes) livez(w http.ResponseWriter, _ *http.Request) {
+	if err := writeJSONHTTPResponse(w, 200, map[string]string{"status": "alive"}); err != nil {
+		log.WithError(err).Error("writing liveness response")
+	}
+}
+
+// readyz is an HTTP handler for GET /readyz. It returns a 503 if any critical check fails or the server is shutting down.
+// The checks run concurrently, and every result is included in the response
+func (p *Probes) readyz(w http.ResponseWriter, r *http.Request) {
+	resp := ReadinessResponse{Status: "ready", Checks: make(map[string]CheckResult, len(p.checks))}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, dependency := range p.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(r.Context(), p.timeout)
+			defer cancel()
+
+			start := time.Now()
+			err := dependency.check(ctx)
+			result := CheckResult{Status: probeStatusOK, Critical: p.critical[dependency.name], DurationMS: float64(time.Since(start).Microseconds()) / 1000}
+			if err != nil {
+				result.Status = probeStatusFailing
+				result.Error = err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			resp.Checks[dependency.name] = result
+			if err != nil && result.Critical {
+				resp.Status = "not ready"
+			}
+		}()
+	}
+	wg.Wait()
+
+	statusCode := 200
+	if p.shuttingDown.Load() {
+		resp.Status = "shutting down"
+	}
+	if resp.Status != "ready" {
+		statusCode = http.StatusServiceUnavailable
+	}
+	if err := writeJSONHTTPResponse(w, statusCode, resp); err != nil {
+		log.WithError(err).Error("writing readiness response")
+	}
+}
+
+// postgresCheck returns a check which queries the database through the connection pool, so that it uses the current credentials
+func postgresCheck(db *sql.DB) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		var version string
+		if err := db.QueryRowContext(ctx, "SELECT VERSION()").Scan(&version); err != nil {
+			return fmt.Errorf("querying postgres version: %v", err)
+		}
+		return nil
+	}
+}
+
+// migrationsCheck returns a check which fails if the latest script applied to the database is older than expectedSchemaVersion
+func migrationsCheck(db *sql.DB) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		var version int
+		if err := db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version); err != nil {
+			return fmt.Errorf("querying schema_migrations table: %v", err)
+		}
+		if version < expectedSchemaVersion {
+			return fmt.Errorf("schema version is %d. Expected at least %d", version, expectedSchemaVersion)
+		}
+		return nil
+	}
+}
+
+// eventBacklogCheck returns a check which fails if more than threshold events are waiting to be relayed
+func eventBacklogCheck(db *sql.DB, threshold int) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		var backlog int
+		if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM user_events WHERE published_at IS NULL").Scan(&backlog); err != nil {
+			return fmt.Errorf("counting unpublished user events: %v", err)
+		}
+		if backlog > threshold {
+			return fmt.Errorf("%d events are waiting to be relayed. The threshold is %d", backlog, threshold)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func getReadiness(t *testing.T, probes *Probes) (int, ReadinessResponse) {
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/readyz", nil)
+	probes.readyz(recorder, req)
+
+	var resp ReadinessResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("unmarshalling readiness response: %v", err)
+	}
+	return recorder.Code, resp
+}
+
+// TestReadyz tests that only critical checks fail readiness, that every check is reported and that shutting down fails readiness
+func TestReadyz(t *testing.T) {
+	probes := NewProbes(ProbesConfig{CriticalChecks: []string{checkPrimary}}, time.Second)
+	primaryErr := errors.New("connection refused")
+	var primaryFailing bool
+	probes.register(checkPrimary, func(context.Context) error {
+		if primaryFailing {
+			return primaryErr
+		}
+		return nil
+	})
+	probes.register(checkReplica, func(context.Context) error { return errors.New("replica lagging") })
+
+	code, resp := getReadiness(t, probes)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "ready", resp.Status)
+	assert.Equal(t, probeStatusOK, resp.Checks[checkPrimary].Status)
+	assert.True(t, resp.Checks[checkPrimary].Critical)
+	assert.Equal(t, CheckResult{Status: probeStatusFailing, Error: "replica lagging", DurationMS: resp.Checks[checkReplica].DurationMS}, resp.Checks[checkReplica])
+
+	primaryFailing = true
+	code, resp = getReadiness(t, probes)
+	assert.Equal(t, 503, code)
+	assert.Equal(t, "not ready", resp.Status)
+	assert.Equal(t, "connection refused", resp.Checks[checkPrimary].Error)
+
+	primaryFailing = false
+	probes.startShutdown()
+	code, resp = getReadiness(t, probes)
+	assert.Equal(t, 503, code)
+	assert.Equal(t, "shutting down", resp.Status)
+
+	// Liveness doesn't depend on anything
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/livez", nil)
+	probes.livez(recorder, req)
+	assert.Equal(t, 200, recorder.Code)
+}
+
+// TestReadyzCheckTimeout tests that a check which hangs is failed once it exceeds the timeout
+func TestReadyzCheckTimeout(t *testing.T) {
+	probes := NewProbes(ProbesConfig{CriticalChecks: []string{checkMigrations}}, time.Millisecond*10)
+	probes.register(checkMigrations, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	code, resp := getReadiness(t, probes)
+	assert.Equal(t, 503, code)
+	assert.Equal(t, context.DeadlineExceeded.Error(), resp.Checks[checkMigrations].Error)
+}
+
+// TestDependencyChecks tests the migrations and event backlog queries. SQLite stands in for Postgres, as the queries are the same in both
+func TestDependencyChecks(t *testing.T) {
+	ctx := context.Background()
+	db := newTestSQLiteDB(t).DB
+	for _, statement := range []string{
+		`CREATE TABLE schema_migrations (version INT PRIMARY KEY)`,
+		`CREATE TABLE user_events (event_id INTEGER PRIMARY KEY, published_at TIMESTAMP)`,
+		`INSERT INTO schema_migrations (version) VALUES (1), (2)`,
+		`INSERT INTO user_events (published_at) VALUES (NULL), (NULL), (CURRENT_TIMESTAMP)`,
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("setting up tables: %v", err)
+		}
+	}
+
+	assert.ErrorContains(t, migrationsCheck(db)(ctx), "schema version is 2")
+	if _, err := db.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, expectedSchemaVersion); err != nil {
+		t.Fatalf("inserting schema version: %v", err)
+	}
+	assert.NoError(t, migrationsCheck(db)(ctx))
+
+	assert.NoError(t, eventBacklogCheck(db, 2)(ctx))
+	assert.ErrorContains(t, eventBacklogCheck(db, 1)(ctx), "2 events are waiting to be relayed")
+}
@@ -0,0 +1,179 @@
+package api
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	problemContentType = "application/problem+json"
+	// problemTypeBase is prefixed to the lowercased code to make each problem's type URI. Each code has a heading in docs/errors.md
+	problemTypeBase = "https://github.com/michaelprice232/user-mgmt-service-api/blob/main/docs/errors.md#"
+)
+
+// ErrorCode identifies the kind of error in a response. Codes are stable, so clients can rely on them rather than the message
+type ErrorCode string
+
+const (
+	CodeInvalidRequestBody       ErrorCode = "INVALID_REQUEST_BODY"
+	CodeInvalidQueryParameter    ErrorCode = "INVALID_QUERY_PARAMETER"
+	CodeInvalidPathParameter     ErrorCode = "INVALID_PATH_PARAMETER"
+	CodeValidationFailed         ErrorCode = "VALIDATION_FAILED"
+	CodeFieldTooLong             ErrorCode = "FIELD_TOO_LONG"
+	CodeFieldTooShort            ErrorCode = "FIELD_TOO_SHORT"
+	CodeFieldPatternMismatch     ErrorCode = "FIELD_PATTERN_MISMATCH"
+	CodeFieldNotAllowed          ErrorCode = "FIELD_NOT_ALLOWED"
+	CodeFieldRequired            ErrorCode = "FIELD_REQUIRED"
+	CodeInvalidEmail             ErrorCode = "INVALID_EMAIL"
+	CodeLogonNameTaken           ErrorCode = "LOGON_NAME_TAKEN"
+	CodeLogonNameReserved        ErrorCode = "LOGON_NAME_RESERVED"
+	CodeEmailDomainNotAllowed    ErrorCode = "EMAIL_DOMAIN_NOT_ALLOWED"
+	CodeUserNotFound             ErrorCode = "USER_NOT_FOUND"
+	CodePageNotFound             ErrorCode = "PAGE_NOT_FOUND"
+	CodeInvalidBatch             ErrorCode = "INVALID_BATCH"
+	CodeBatchRolledBack          ErrorCode = "BATCH_ROLLED_BACK"
+	CodeUnsupportedMethod        ErrorCode = "UNSUPPORTED_METHOD"
+	CodeInvalidIdempotencyKey    ErrorCode = "INVALID_IDEMPOTENCY_KEY"
+	CodeIdempotencyKeyReused     ErrorCode = "IDEMPOTENCY_KEY_REUSED"
+	CodeIdempotencyKeyInProgress ErrorCode = "IDEMPOTENCY_KEY_IN_PROGRESS"
+	CodeInvalidConsistencyToken  ErrorCode = "INVALID_CONSISTENCY_TOKEN"
+	CodeInvalidLastEventID       ErrorCode = "INVALID_LAST_EVENT_ID"
+	CodeInvalidWebhook           ErrorCode = "INVALID_WEBHOOK"
+	CodeWebhookNotFound          ErrorCode = "WEBHOOK_NOT_FOUND"
+	CodeDeliveryNotFound         ErrorCode = "DELIVERY_NOT_FOUND"
+	CodeInternalError            ErrorCode = "INTERNAL_ERROR"
+	CodeServiceUnavailable       ErrorCode = "SERVICE_UNAVAILABLE"
+	CodeDatabaseTimeout          ErrorCode = "DATABASE_TIMEOUT"
+)
+
+// Problem is an RFC 9457 (formerly RFC 7807) problem details response, extended with the error code, request ID and any
+// field errors
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      ErrorCode    `json:"code"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError is a problem with a single field of a request payload. It is also an error, so that validation functions can
+// return it and handlers can find it with errors.As
+type FieldError struct {
+	Field   string    `json:"field"`
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+func (e FieldError) Error() string {
+	return e.Message
+}
+
+// newProblem returns the problem for an error response. Server errors get a generic detail, as their message can contain
+// internal details such as database errors. The full message is still logged
+func newProblem(r *http.Request, statusCode int, code ErrorCode, message string, fieldErrors []FieldError) Problem {
+	return Problem{
+		Type:      problemTypeBase + strings.ToLower(string(code)),
+		Title:     http.StatusText(statusCode),
+		Status:    statusCode,
+		Detail:    publicErrorMessage(statusCode, message),
+		Instance:  r.URL.Path,
+		Code:      code,
+		RequestID: requestIDFromContext(r.Context()),
+		Errors:    fieldErrors,
+	}
+}
+
+// publicErrorMessage returns message, unless statusCode is a server error, in which case a generic message for it is returned
+func publicErrorMessage(statusCode int, message string) string {
+	switch {
+	case statusCode == http.StatusServiceUnavailable:
+		return "the service is temporarily unavailable. Please try again later"
+	case statusCode == http.StatusGatewayTimeout:
+		return "the database did not respond in time"
+	case statusCode >= 500:
+		return "an internal error occurred. Quote the request ID if reporting it"
+	}
+	return message
+}
+
+// databaseErrorCode returns the error code for a database error response with statusCode, from databaseErrorStatus
+func databaseErrorCode(statusCode int, defaultCode ErrorCode) ErrorCode {
+	switch statusCode {
+	case http.StatusGatewayTimeout:
+		return CodeDatabaseTimeout
+	case http.StatusServiceUnavailable:
+		return CodeServiceUnavailable
+	case http.StatusInternalServerError:
+		return CodeInternalError
+	}
+	return defaultCode
+}
+
+// fieldErrorDetails returns the field errors within err, which is either a ValidationError or a single FieldError. The code
+// is the field error's own when there is exactly one, so that e.g. an invalid email is reported as INVALID_EMAIL, otherwise
+// fallback
+func fieldErrorDetails(err error, fallback ErrorCode) (ErrorCode, []FieldError) {
+	var invalid ValidationError
+	var fieldErr FieldError
+	switch {
+	case errors.As(err, &invalid):
+		if len(invalid.Errors) == 1 {
+			return invalid.Errors[0].Code, invalid.Errors
+		}
+		return fallback, invalid.Errors
+	case errors.As(err, &fieldErr):
+		return fieldErr.Code, []FieldError{fieldErr}
+	}
+	return fallback, nil
+}
+
+// wantsLegacyErrors reports whether the client prefers the legacy error format, served as application/json, over
+// application/problem+json. Clients which accept both equally, or send no Accept header, get problem+json
+func wantsLegacyErrors(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return false
+	}
+	return acceptQuality(accept, "application/json") > acceptQuality(accept, problemContentType)
+}
+
+// acceptQuality returns the quality which the Accept header value gives mediaType, using the most specific matching range
+func acceptQuality(accept, mediaType string) float64 {
+	mainType, _, _ := strings.Cut(mediaType, "/")
+	quality, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		rangeType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		var rangeSpecificity int
+		switch rangeType {
+		case mediaType:
+			rangeSpecificity = 2
+		case mainType + "/*":
+			rangeSpecificity = 1
+		case "*/*":
+			rangeSpecificity = 0
+		default:
+			continue
+		}
+		if rangeSpecificity <= specificity {
+			continue
+		}
+
+		specificity, quality = rangeSpecificity, 1
+		if q, ok := params["q"]; ok {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				quality = 0
+			}
+		}
+	}
+	return quality
+}
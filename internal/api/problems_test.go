@@ -0,0 +1,135 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// brokenUsersStore fails every GetUser call with an error containing internal details
+type brokenUsersStore struct {
+	UserStore
+}
+
+func (brokenUsersStore) GetUser(context.Context, string) (User, error) {
+	return User{}, errors.New("pq: password authentication failed for user \"admin\"")
+}
+
+func setupProblemsRouter(store UserStore) *mux.Router {
+	env := &Env{UsersDB: store, Config: DefaultConfig()}
+	router := mux.NewRouter()
+	router.Use(requestIDHandler)
+	router.HandleFunc("/users", env.listUsers).Methods("GET")
+	router.HandleFunc("/users/{logon_name}", env.getUser).Methods("GET")
+	return router
+}
+
+func problemRequest(router *mux.Router, path, accept string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", path, nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+// TestProblemResponse tests that errors are returned as application/problem+json with a stable code and type
+func TestProblemResponse(t *testing.T) {
+	router := setupProblemsRouter(newTestMemoryStore())
+
+	recorder := problemRequest(router, "/users?page=100", "")
+	assert.Equal(t, 404, recorder.Code)
+	assert.Equal(t, problemContentType, recorder.Header().Get("Content-Type"))
+	assert.Equal(t, "Accept", recorder.Header().Get("Vary"))
+
+	var resp Problem
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &resp))
+	assert.Equal(t, problemTypeBase+"page_not_found", resp.Type)
+	assert.Equal(t, "Not Found", resp.Title)
+	assert.Equal(t, 404, resp.Status)
+	assert.Equal(t, "page 100 not found", resp.Detail)
+	assert.Equal(t, "/users", resp.Instance)
+	assert.Equal(t, CodePageNotFound, resp.Code)
+	assert.Equal(t, recorder.Header().Get(requestIDHeader), resp.RequestID)
+	assert.Empty(t, resp.Errors)
+}
+
+// TestLegacyErrorResponse tests that clients which prefer application/json get the legacy error format
+func TestLegacyErrorResponse(t *testing.T) {
+	router := setupProblemsRouter(newTestMemoryStore())
+
+	for _, accept := range []string{"application/json", "application/problem+json;q=0.5, application/json"} {
+		recorder := problemRequest(router, "/users/missing", accept)
+		assert.Equal(t, 404, recorder.Code, accept)
+		assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"), accept)
+
+		var resp JSONHTTPErrorResponse
+		assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &resp))
+		assert.Equal(t, 404, resp.Code)
+		assert.Equal(t, "'missing' does not exist", resp.Message)
+		assert.Equal(t, recorder.Header().Get(requestIDHeader), resp.RequestID)
+	}
+
+	for _, accept := range []string{"*/*", "application/*", "application/json, application/problem+json", "text/html"} {
+		recorder := problemRequest(router, "/users/missing", accept)
+		assert.Equal(t, problemContentType, recorder.Header().Get("Content-Type"), accept)
+	}
+}
+
+// TestServerErrorSanitised tests that server errors don't return internal details, in either format
+func TestServerErrorSanitised(t *testing.T) {
+	router := setupProblemsRouter(brokenUsersStore{})
+
+	recorder := problemRequest(router, "/users/mark9", "")
+	assert.Equal(t, 500, recorder.Code)
+	var resp Problem
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &resp))
+	assert.Equal(t, CodeInternalError, resp.Code)
+	assert.Equal(t, "an internal error occurred. Quote the request ID if reporting it", resp.Detail)
+	assert.NotEmpty(t, resp.RequestID)
+
+	recorder = problemRequest(router, "/users/mark9", "application/json")
+	assert.Equal(t, 500, recorder.Code)
+	assert.NotContains(t, recorder.Body.String(), "password")
+}
+
+// TestAcceptQuality tests that the most specific media range in an Accept header sets the quality
+func TestAcceptQuality(t *testing.T) {
+	tests := []struct {
+		accept    string
+		mediaType string
+		want      float64
+	}{
+		{"application/json", "application/json", 1},
+		{"application/json", problemContentType, 0},
+		{"*/*;q=0.2", problemContentType, 0.2},
+		{"application/*;q=0.5, */*;q=0.1", "application/json", 0.5},
+		{"application/*;q=0.5, application/json;q=0.8", "application/json", 0.8},
+		{"application/json;q=0, */*", "application/json", 0},
+		{"application/json;q=oops", "application/json", 0},
+		{"text/html, not a media type", "application/json", 0},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.want, acceptQuality(test.accept, test.mediaType), test.accept)
+	}
+}
+
+// TestFieldErrorDetails tests that a single field error's code is used for the problem
+func TestFieldErrorDetails(t *testing.T) {
+	code, fieldErrors := fieldErrorDetails(validateEmailField("not-an-email"), CodeValidationFailed)
+	assert.Equal(t, CodeInvalidEmail, code)
+	if assert.Len(t, fieldErrors, 1) {
+		assert.Equal(t, "email", fieldErrors[0].Field)
+	}
+
+	code, fieldErrors = fieldErrorDetails(errors.New("something else"), CodeValidationFailed)
+	assert.Equal(t, CodeValidationFailed, code)
+	assert.Nil(t, fieldErrors)
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	eventPublisherNone    = "none"
+	eventPublisherStdout  = "stdout"
+	eventPublisherFile    = "file"
+	eventPublisherWebhook = "webhook"
+
+	webhookPublisherTimeout = time.Second * 10
+)
+
+// Publisher delivers user lifecycle events to downstream systems
+type Publisher interface {
+	Publish(ctx context.Context, event UserEvent) error
+}
+
+// WebhookPublisher publishes each event as a JSON HTTP POST request to URL. Any non-2xx response is treated as a failure
+type WebhookPublisher struct {
+	URL    string
+	Client *http.Client
+}
+
+// Publish sends event to the webhook URL. The X-Event-ID header allows receivers to discard duplicate deliveries
+func (p *WebhookPublisher) Publish(ctx context.Context, event UserEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("marshalling event %d: %v", event.EventID, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", p.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating webhook request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-ID", strconv.FormatInt(event.EventID, 10))
+	req.Header.Set("X-Event-Type", event.EventType)
+
+	client := p.Client
+	if client == nil {
+		client = &http.Client{Timeout: webhookPublisherTimeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending event %d to webhook: %v", event.EventID, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status code %d for event %d", resp.StatusCode, event.EventID)
+	}
+	return nil
+}
+
+// WriterPublisher writes each event as a line of JSON to W. Useful for running locally
+type WriterPublisher struct {
+	mu sync.Mutex
+	W  io.Writer
+}
+
+// Publish writes event to the underlying writer
+func (p *WriterPublisher) Publish(_ context.Context, event UserEvent) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := json.NewEncoder(p.W).Encode(event); err != nil {
+		return fmt.Errorf("writing event %d: %v", event.EventID, err)
+	}
+	return nil
+}
+
+// MultiPublisher publishes each event to every one of its publishers, failing if any of them fail.
+// As the event is retried in full, publishers which succeeded may receive it more than once
+type MultiPublisher []Publisher
+
+// Publish passes event to each publisher in turn
+func (p MultiPublisher) Publish(ctx context.Context, event UserEvent) error {
+	for _, publisher := range p {
+		if err := publisher.Publish(ctx, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewPublisher returns the Publisher selected by cfg.Publisher, or nil if publishing is disabled
+func NewPublisher(cfg EventsConfig) (Publisher, error) {
+	switch cfg.Publisher {
+	case "", eventPublisherNone:
+		return nil, nil
+	case eventPublisherStdout:
+		return &WriterPublisher{W: os.Stdout}, nil
+	case eventPublisherFile:
+		f, err := os.OpenFile(cfg.FilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("opening event publisher file '%s': %v", cfg.FilePath, err)
+		}
+		return &WriterPublisher{W: f}, nil
+	case eventPublisherWebhook:
+		return &WebhookPublisher{URL: cfg.WebhookURL}, nil
+	default:
+		return nil, fmt.Errorf("event publisher must be one of '%s', '%s', '%s' or '%s'. Currently '%s'",
+			eventPublisherNone, eventPublisherStdout, eventPublisherFile, eventPublisherWebhook, cfg.Publisher)
+	}
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestWebhookPublisher tests that events are POSTed to the webhook as JSON
+func TestWebhookPublisher(t *testing.T) {
+	var received UserEvent
+	var eventIDHeader string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		eventIDHeader = r.Header.Get("X-Event-ID")
+		body, _ := io.ReadAll(r.Body)
+		_ = json.Unmarshal(body, &received)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	publisher := &WebhookPublisher{URL: server.URL}
+	err := publisher.Publish(context.Background(), UserEvent{EventID: 7, EventType: EventUserCreated, LogonName: "mark9", User: User{UserID: 1, LogonName: "mark9"}})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "7", eventIDHeader)
+	assert.Equal(t, EventUserCreated, received.EventType)
+	assert.Equal(t, 1, received.User.UserID)
+}
+
+// TestWebhookPublisherFailure tests that a non-2xx response from the webhook is reported as an error
+func TestWebhookPublisherFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	publisher := &WebhookPublisher{URL: server.URL}
+	err := publisher.Publish(context.Background(), UserEvent{EventID: 8, EventType: EventUserDeleted, LogonName: "mark9"})
+
+	assert.ErrorContains(t, err, "webhook returned status code 503")
+}
+
+// TestWriterPublisher tests that events are written as newline delimited JSON
+func TestWriterPublisher(t *testing.T) {
+	var buf bytes.Buffer
+	publisher := &WriterPublisher{W: &buf}
+
+	assert.NoError(t, publisher.Publish(context.Background(), UserEvent{EventID: 1, EventType: EventUserCreated, LogonName: "mark9"}))
+	assert.NoError(t, publisher.Publish(context.Background(), UserEvent{EventID: 2, EventType: EventUserUpdated, LogonName: "mark9"}))
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	assert.Equal(t, 2, len(lines))
+	var event UserEvent
+	assert.NoError(t, json.Unmarshal(lines[1], &event))
+	assert.Equal(t, EventUserUpdated, event.EventType)
+}
@@ -1,7 +1,9 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -14,86 +16,60 @@ import (
 func (env *Env) putUser(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	targetLogonName := vars["logon_name"]
-	log.Infof("Received PUT request for logon_name '%s'", targetLogonName)
 
-	exists, err := checkLogonNameExists(targetLogonName, env)
+	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		jsonHTTPErrorResponseWriter(w, r, 500, fmt.Sprintf("checking logon_name against database: %v", err))
+		jsonHTTPErrorResponseWriter(w, r, 400, CodeInvalidRequestBody, fmt.Sprintf("reading http request body: %v", err))
 		return
 	}
 
-	if exists {
-		log.Infof("'%s' exists. Updating user in the DB", targetLogonName)
-
-		body, err := io.ReadAll(r.Body)
-		if err != nil {
-			jsonHTTPErrorResponseWriter(w, r, 400, fmt.Sprintf("reading http request body: %v", err))
-			return
-		}
-
-		user := User{}
-		err = json.Unmarshal(body, &user)
-		if err != nil {
-			jsonHTTPErrorResponseWriter(w, r, 400, fmt.Sprintf("unmarshalling http request body: %v", err))
-			return
-		}
-		log.Debugf("Unmarshaled payload: %#v", user)
-
-		// Set LogonName based on URI so that the DB query can locate the user's record
-		user.LogonName = targetLogonName
-
-		err = validatePutRequestPayload(user, w, r)
-		if err != nil {
-			return
-		}
+	user := User{}
+	err = json.Unmarshal(body, &user)
+	if err != nil {
+		jsonHTTPErrorResponseWriter(w, r, 400, CodeInvalidRequestBody, fmt.Sprintf("unmarshalling http request body: %v", err))
+		return
+	}
+	log.WithContext(r.Context()).Debugf("Unmarshaled payload: %#v", user)
 
-		userResp, err := env.UsersDB.updateUser(user)
-		if err != nil {
-			jsonHTTPErrorResponseWriter(w, r, 500, fmt.Sprintf("updating record for user '%s' in DB: %v", targetLogonName, err))
-			return
-		}
+	// Set LogonName based on URI so that the DB query can locate the user's record
+	user.LogonName = targetLogonName
 
-		// Return the updated record back to the client
-		err = writeJSONHTTPResponse(w, 200, userResp)
-		if err != nil {
-			jsonHTTPErrorResponseWriter(w, r, 500, fmt.Sprintf("writing HTTP response: %v", err))
+	err = env.validateUser(r.Context(), user, validateUpdate)
+	if err != nil {
+		if env.userNotFound(r.Context(), targetLogonName) {
+			jsonHTTPErrorResponseWriter(w, r, 404, CodeUserNotFound, fmt.Sprintf("'%s' does not exist. No action required", targetLogonName))
 			return
 		}
-
-		log.WithFields(log.Fields{
-			"url":         getFullPathIncludingQueryParams(r.URL),
-			"status_code": 200,
-			"method":      r.Method,
-			"logon_name":  user.LogonName,
-		}).Infof("serving page")
-
-	} else {
-		jsonHTTPErrorResponseWriter(w, r, 404, fmt.Sprintf("'%s' does not exist. No action required", targetLogonName))
+		validationErrorResponseWriter(w, r, err)
 		return
 	}
-}
 
-// validatePutRequestPayload validates the request payload of the PUT /users/<logon_name> operation
-func validatePutRequestPayload(user User, w http.ResponseWriter, r *http.Request) error {
-	err := validateFieldLengths(user)
+	// The existence check and update are a single statement, so a concurrent delete can't turn a 404 into a 500
+	userResp, err := env.UsersDB.UpdateUser(r.Context(), user)
+	if errors.Is(err, ErrUserNotFound) {
+		jsonHTTPErrorResponseWriter(w, r, 404, CodeUserNotFound, fmt.Sprintf("'%s' does not exist. No action required", targetLogonName))
+		return
+	}
 	if err != nil {
-		jsonHTTPErrorResponseWriter(w, r, 400, fmt.Sprintf("validating PUT request payload field lengths: %v", err))
-		return err
+		databaseErrorResponseWriter(w, r, err, 500, fmt.Sprintf("updating record for user '%s' in DB: %v", targetLogonName, err))
+		return
 	}
 
-	if user.UserID != 0 {
-		resp := "logon_name and user_id are not supported request body fields for this operation"
-		jsonHTTPErrorResponseWriter(w, r, 400, resp)
-		return fmt.Errorf("%s", resp)
+	// Return the updated record back to the client
+	err = writeJSONHTTPResponse(w, 200, userResp)
+	if err != nil {
+		jsonHTTPErrorResponseWriter(w, r, 500, CodeInternalError, fmt.Sprintf("writing HTTP response: %v", err))
+		return
 	}
+}
 
-	// optional field to pass
-	if user.Email != "" {
-		err = validateEmailField(user.Email)
-		if err != nil {
-			jsonHTTPErrorResponseWriter(w, r, 400, fmt.Sprintf("validating email field format: %v", err))
-			return err
-		}
+// userNotFound returns true if there is no user with logonName. Updates of a user which doesn't exist are a 404 whatever is
+// wrong with their payload, so this is checked before reporting validation errors. A valid update finds out from UpdateUser
+// instead. Any other error is left for the caller to report
+func (env *Env) userNotFound(ctx context.Context, logonName string) bool {
+	if logonName == "" {
+		return false
 	}
-	return nil
+	_, err := env.UsersDB.GetUser(ctx, logonName)
+	return errors.Is(err, ErrUserNotFound)
 }
@@ -17,61 +17,19 @@ const (
 	testuser10 = "testuser10"
 )
 
-// mockPutUserModel is used to mock the Postgres DB calls
-type mockPutUserModel struct{}
-
-func (m *mockPutUserModel) queryUsers(_, _ int, _ string) (users []User, err error) {
-	return
-}
-
-func (m *mockPutUserModel) addUser(_ User) (user User, err error) {
-	return
-}
-
-func (m *mockPutUserModel) deleteUser(_ string) (err error) {
-	return
-}
-
-func (m *mockPutUserModel) queryRecordCount(_, logonNameFilter string) (count int, err error) {
-	switch logonNameFilter {
-	case testuser8:
-		return 1, nil
-	case testuser9:
-		return 1, nil
-	case testuser10:
-		return 1, nil
-	default:
-		return 0, nil
-	}
-}
-func (m *mockPutUserModel) updateUser(user User) (User, error) {
-	if user.LogonName == testuser8 {
-		// Both full_name and email being updated
-		user.Email = "testuser8.updated@email.com"
-		user.FullName = "Test User 8 Updated"
-		user.UserID = 10
-		user.LogonName = testuser8
-	} else if user.LogonName == testuser9 {
-		// Just the email address updated
-		user.Email = "testuser9.updated@email.com"
-		user.FullName = "Test User 9"
-		user.UserID = 11
-		user.LogonName = "testuser9"
-	} else if user.LogonName == testuser10 {
-		// Just the email address updated
-		user.Email = "testuser10@email.com"
-		user.FullName = "Test User 10"
-		user.UserID = 12
-		user.LogonName = testuser10
-	}
-
-	return user, nil
+// newPutUserTestStore returns a store holding the users which the PUT tests update
+func newPutUserTestStore() *MemoryUserModel {
+	return NewMemoryUserModel(
+		User{UserID: 10, LogonName: testuser8, FullName: "Test User 8", Email: "testuser8@email.com"},
+		User{UserID: 11, LogonName: testuser9, FullName: "Test User 9", Email: "testuser9@email.com"},
+		User{UserID: 12, LogonName: testuser10, FullName: "Test User 10 Old", Email: "testuser10@email.com"},
+	)
 }
 
 func setupMockPutUserHTTPHandler(logonName string, body bytes.Buffer) *httptest.ResponseRecorder {
 	recorder := httptest.NewRecorder()
 	req, _ := http.NewRequest("PUT", fmt.Sprintf("/users/%s", logonName), &body)
-	env := &Env{UsersDB: &mockPutUserModel{}}
+	env := &Env{UsersDB: newPutUserTestStore()}
 
 	// Need to create a router so that the URI parameters (logon_name) are picked up
 	router := mux.NewRouter()
@@ -95,14 +53,14 @@ func putRequestHelperSuccess(user User, logonName string, t *testing.T) (*httpte
 	return rec, resp
 }
 
-func putRequestHelperFailure(user User, logonName string, t *testing.T) (*httptest.ResponseRecorder, JSONHTTPErrorResponse) {
+func putRequestHelperFailure(user User, logonName string, t *testing.T) (*httptest.ResponseRecorder, Problem) {
 	var buf bytes.Buffer
 	err := json.NewEncoder(&buf).Encode(user)
 	if err != nil {
 		t.Fatal("unable to encode into buffer")
 	}
 	rec := setupMockPutUserHTTPHandler(logonName, buf)
-	var resp JSONHTTPErrorResponse
+	var resp Problem
 	err = json.Unmarshal(rec.Body.Bytes(), &resp)
 	if err != nil {
 		t.Fatal("unable to unmarshal JSON response")
@@ -163,8 +121,34 @@ func TestPutUserBadUser(t *testing.T) {
 	}
 	rec, respUser := putRequestHelperFailure(user, logonName, t)
 	assert.Equal(t, 404, rec.Code)
-	assert.Equal(t, 404, respUser.Code)
-	assert.Equal(t, fmt.Sprintf("'%s' does not exist. No action required", logonName), respUser.Message)
+	assert.Equal(t, 404, respUser.Status)
+	assert.Equal(t, fmt.Sprintf("'%s' does not exist. No action required", logonName), respUser.Detail)
+	assert.Equal(t, CodeUserNotFound, respUser.Code)
+}
+
+// TestPutUserBadUserInvalidPayload tests that updating a user which is not present in the DB is a 404, even when the payload is invalid
+func TestPutUserBadUserInvalidPayload(t *testing.T) {
+	logonName := "baduser"
+	user := User{
+		Email: "bad.email@",
+	}
+	rec, respUser := putRequestHelperFailure(user, logonName, t)
+	assert.Equal(t, 404, rec.Code)
+	assert.Equal(t, CodeUserNotFound, respUser.Code)
+}
+
+// TestPutUserNoFields tests that an update which doesn't pass email or full_name is a validation error rather than a 500
+func TestPutUserNoFields(t *testing.T) {
+	for _, body := range []string{`{}`, `{"email": "", "full_name": ""}`} {
+		rec := setupMockPutUserHTTPHandler(testuser8, *bytes.NewBufferString(body))
+		var resp Problem
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal("unable to unmarshal JSON response")
+		}
+		assert.Equal(t, 422, rec.Code, body)
+		assert.Equal(t, CodeFieldRequired, resp.Code, body)
+		assert.Equal(t, []FieldError{{Field: "email", Code: CodeFieldRequired, Message: "email and/or full_name is required when updating a user"}}, resp.Errors, body)
+	}
 }
 
 // TestPutUserBadUser tests trying to update a user with an email address format which is invalid
@@ -175,9 +159,9 @@ func TestPutUserBadEmailAddressFormat(t *testing.T) {
 		Email: "bad.email@",
 	}
 	rec, respUser := putRequestHelperFailure(user, logonName, t)
-	assert.Equal(t, 400, rec.Code)
-	assert.Equal(t, 400, respUser.Code)
-	assert.Contains(t, respUser.Message, "validating email field format")
+	assert.Equal(t, 422, rec.Code)
+	assert.Equal(t, 422, respUser.Status)
+	assert.Contains(t, respUser.Detail, "not a valid email address field")
 }
 
 // TestPutUserBadUser tests trying to update a user with a full_name which exceeds the limits
@@ -189,9 +173,9 @@ func TestPutUserTooLongField(t *testing.T) {
 		FullName: tooLongFieldName,
 	}
 	rec, respUser := putRequestHelperFailure(user, logonName, t)
-	assert.Equal(t, 400, rec.Code)
-	assert.Equal(t, 400, respUser.Code)
-	assert.Contains(t, respUser.Message, "full_name maximum length is 100")
+	assert.Equal(t, 422, rec.Code)
+	assert.Equal(t, 422, respUser.Status)
+	assert.Contains(t, respUser.Detail, "full_name maximum length is 100")
 }
 
 // TestPutUserInvalidPayloadFields tests trying to update a user with request payload fields which are not supported (user_id & logon_name)
@@ -205,7 +189,7 @@ func TestPutUserInvalidPayloadFields(t *testing.T) {
 		UserID:    2,
 	}
 	rec, respUser := putRequestHelperFailure(user, logonName, t)
-	assert.Equal(t, 400, rec.Code)
-	assert.Equal(t, 400, respUser.Code)
-	assert.Contains(t, respUser.Message, "logon_name and user_id are not supported request body fields for this operation")
+	assert.Equal(t, 422, rec.Code)
+	assert.Equal(t, 422, respUser.Status)
+	assert.Contains(t, respUser.Detail, "user_id is generated by the service")
 }
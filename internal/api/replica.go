@@ -0,0 +1,209 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+const (
+	consistencyTokenHeader       = "X-Consistency-Token"
+	defaultReplicaCheckInterval  = time.Second * 5
+	replicaCheckTimeout          = time.Second * 2
+	consistencyTokenQueryTimeout = time.Second * 2
+)
+
+// consistencyTokenPattern matches a Postgres LSN, which is what consistency tokens are
+var consistencyTokenPattern = regexp.MustCompile(`^[0-9A-F]{1,8}/[0-9A-F]{1,8}$`)
+
+// readOnlyPaths are requests which don't use GET but never write, so don't need a consistency token
+var readOnlyPaths = map[string]bool{"/users:validate": true}
+
+type consistencyTokenKey struct{}
+
+// ReplicaRouter decides whether read-only queries can go to the replica. The replica is used while its last health check
+// passed and, when the client passed a consistency token, once it has replayed the write which returned the token.
+// Otherwise reads go to the primary
+type ReplicaRouter struct {
+	DB            *sql.DB // the replica connection pool
+	Primary       *sql.DB
+	CheckInterval time.Duration
+	Stmts         *stmtCache // optional. Queries on the replica run as prepared statements
+
+	healthy atomic.Bool
+	// The database queries are replaced in tests so that no database is needed
+	check       func(ctx context.Context) error
+	hasReplayed func(ctx context.Context, token string) (bool, error)
+	walPosition func(ctx context.Context) (string, error)
+}
+
+// NewReplicaRouter returns a router for reads to replica. The replica isn't used until its first health check passes
+func NewReplicaRouter(primary, replica *sql.DB, checkInterval time.Duration) *ReplicaRouter {
+	r := &ReplicaRouter{DB: replica, Primary: primary, CheckInterval: checkInterval}
+	r.check = func(ctx context.Context) error {
+		return r.DB.PingContext(ctx)
+	}
+	r.hasReplayed = func(ctx context.Context, token string) (bool, error) {
+		// pg_last_wal_replay_lsn is NULL if the replica isn't a streaming standby, in which case it can't be known to have caught up
+		var replayed bool
+		err := tracedConn{conn: r.DB, system: semconv.DBSystemPostgreSQL}.QueryRowContext(ctx,
+			`SELECT COALESCE(pg_last_wal_replay_lsn() >= $1::pg_lsn, false)`, token).Scan(&replayed)
+		return replayed, err
+	}
+	r.walPosition = func(ctx context.Context) (string, error) {
+		var token string
+		err := tracedConn{conn: r.Primary, system: semconv.DBSystemPostgreSQL}.QueryRowContext(ctx, `SELECT pg_current_wal_lsn()::text`).Scan(&token)
+		return token, err
+	}
+	return r
+}
+
+// Run checks the health of the replica every CheckInterval until ctx is cancelled
+func (r *ReplicaRouter) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.CheckInterval)
+	defer ticker.Stop()
+	for {
+		r.checkHealth(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkHealth runs a single health check, logging when the replica becomes healthy or unhealthy
+func (r *ReplicaRouter) checkHealth(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, replicaCheckTimeout)
+	defer cancel()
+
+	err := r.check(ctx)
+	if err != nil {
+		r.markUnhealthy(err)
+		return
+	}
+	if !r.healthy.Swap(true) {
+		log.Info("Database replica is healthy. Sending reads to the replica")
+	}
+}
+
+func (r *ReplicaRouter) markUnhealthy(err error) {
+	if r.healthy.Swap(false) {
+		log.WithError(err).Warn("Database replica is unhealthy. Sending reads to the primary until it recovers")
+	}
+}
+
+// conn returns the traced replica connection pool, through the prepared statements if there are any
+func (r *ReplicaRouter) conn() dbConn {
+	if r.Stmts != nil {
+		return tracedConn{conn: r.Stmts, system: semconv.DBSystemPostgreSQL}
+	}
+	return tracedConn{conn: r.DB, system: semconv.DBSystemPostgreSQL}
+}
+
+// useReplica returns true if a read with ctx can go to the replica
+func (r *ReplicaRouter) useReplica(ctx context.Context) bool {
+	if !r.healthy.Load() {
+		return false
+	}
+	token, ok := ctx.Value(consistencyTokenKey{}).(string)
+	if !ok {
+		return true
+	}
+
+	replayed, err := r.hasReplayed(ctx, token)
+	if err != nil {
+		log.WithError(err).Warn("checking whether the database replica has replayed the consistency token. Reading from the primary")
+		return false
+	}
+	return replayed
+}
+
+// fallBack returns true if a read which failed on the replica with err should be retried on the primary. The replica is
+// marked as unhealthy until its next health check passes
+func (r *ReplicaRouter) fallBack(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	r.markUnhealthy(err)
+	return true
+}
+
+// consistencyToken returns the current WAL position of the primary. Any write which has already been committed is at or
+// before it, so a replica which has replayed up to the token can see the write
+func (r *ReplicaRouter) consistencyToken(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, consistencyTokenQueryTimeout)
+	defer cancel()
+
+	token, err := r.walPosition(ctx)
+	if err != nil {
+		return "", fmt.Errorf("querying primary WAL position: %v", err)
+	}
+	return token, nil
+}
+
+// consistencyHandler is mux middleware for read-your-writes. Successful writes return a consistency token in the
+// X-Consistency-Token header, and reads which pass it back are only sent to the replica once it has caught up with the write
+func (r *ReplicaRouter) consistencyHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodGet {
+			if token := req.Header.Get(consistencyTokenHeader); token != "" {
+				if !consistencyTokenPattern.MatchString(token) {
+					jsonHTTPErrorResponseWriter(w, req, 400, CodeInvalidConsistencyToken, fmt.Sprintf("%s header '%s' is not a consistency token returned by this API", consistencyTokenHeader, token))
+					return
+				}
+				req = req.WithContext(context.WithValue(req.Context(), consistencyTokenKey{}, token))
+			}
+			next.ServeHTTP(w, req)
+			return
+		}
+		if readOnlyPaths[req.URL.Path] {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		next.ServeHTTP(&consistencyTokenWriter{ResponseWriter: w, ctx: req.Context(), router: r}, req)
+	})
+}
+
+// consistencyTokenWriter adds the consistency token header to successful responses, just before the status code is written
+type consistencyTokenWriter struct {
+	http.ResponseWriter
+	ctx         context.Context
+	router      *ReplicaRouter
+	wroteHeader bool
+}
+
+func (c *consistencyTokenWriter) WriteHeader(statusCode int) {
+	if !c.wroteHeader {
+		c.wroteHeader = true
+		if statusCode >= 200 && statusCode < 300 {
+			// Clients without a token still get their response, and just lose read-your-writes for this write
+			token, err := c.router.consistencyToken(c.ctx)
+			if err != nil {
+				log.WithError(err).Error("getting consistency token")
+			} else {
+				c.Header().Set(consistencyTokenHeader, token)
+			}
+		}
+	}
+	c.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (c *consistencyTokenWriter) Write(b []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(200)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *consistencyTokenWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
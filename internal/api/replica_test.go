@@ -0,0 +1,140 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestSQLiteDB returns a SQLite store containing users. SQLite stands in for Postgres in the replica tests, as the
+// unfiltered count query is the same in both
+func newTestSQLiteDB(t *testing.T, users ...User) *SQLiteUserModel {
+	store, err := OpenSQLiteUserModel(filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatalf("opening SQLite store: %v", err)
+	}
+	t.Cleanup(func() { _ = store.DB.Close() })
+	for _, user := range users {
+		if _, err = store.AddUser(context.Background(), user); err != nil {
+			t.Fatalf("adding user '%s': %v", user.LogonName, err)
+		}
+	}
+	return store
+}
+
+// TestUserModelReadsFromReplica tests that reads go to the replica once it is healthy, and fall back to the primary if it fails
+func TestUserModelReadsFromReplica(t *testing.T) {
+	ctx := context.Background()
+	primary := newTestSQLiteDB(t, conformanceUsers...)
+	replica := newTestSQLiteDB(t, conformanceUsers[0]) // lagging behind the primary
+	router := NewReplicaRouter(primary.DB, replica.DB, defaultReplicaCheckInterval)
+	model := &UserModel{DB: primary.DB, Replica: router}
+
+	// The replica isn't used until it has passed a health check
+	count, err := model.QueryRecordCount(ctx, "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	router.checkHealth(ctx)
+	count, err = model.QueryRecordCount(ctx, "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// Transactions always use the primary
+	err = model.WithTx(ctx, func(tx UserStore) error {
+		count, err = tx.QueryRecordCount(ctx, "", "")
+		return err
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	_ = replica.DB.Close()
+	count, err = model.QueryRecordCount(ctx, "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+	assert.False(t, router.healthy.Load())
+}
+
+// TestReplicaRouterConsistencyToken tests that reads with a consistency token only use the replica once it has replayed the token
+func TestReplicaRouterConsistencyToken(t *testing.T) {
+	router := NewReplicaRouter(nil, nil, defaultReplicaCheckInterval)
+	router.check = func(context.Context) error { return nil }
+	replayed := map[string]bool{"0/20": true, "0/30": false}
+	router.hasReplayed = func(_ context.Context, token string) (bool, error) {
+		if _, ok := replayed[token]; !ok {
+			return false, errors.New("unknown token")
+		}
+		return replayed[token], nil
+	}
+	router.checkHealth(context.Background())
+
+	withToken := func(token string) context.Context {
+		return context.WithValue(context.Background(), consistencyTokenKey{}, token)
+	}
+	assert.True(t, router.useReplica(context.Background()))
+	assert.True(t, router.useReplica(withToken("0/20")))
+	assert.False(t, router.useReplica(withToken("0/30")))
+	assert.False(t, router.useReplica(withToken("0/40")))
+
+	router.check = func(context.Context) error { return errors.New("connection refused") }
+	router.checkHealth(context.Background())
+	assert.False(t, router.useReplica(context.Background()))
+}
+
+// TestConsistencyHandler tests that successful writes return a consistency token, and that tokens passed to reads are validated
+func TestConsistencyHandler(t *testing.T) {
+	router := NewReplicaRouter(nil, nil, defaultReplicaCheckInterval)
+	walQueries := 0
+	router.walPosition = func(context.Context) (string, error) {
+		walQueries++
+		return "16/B374D848", nil
+	}
+
+	var readToken any
+	handler := router.consistencyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		readToken = r.Context().Value(consistencyTokenKey{})
+		switch r.URL.Path {
+		case "/created":
+			w.WriteHeader(201)
+		case "/invalid":
+			jsonHTTPErrorResponseWriter(w, r, 400, CodeValidationFailed, "invalid user")
+		default:
+			_, _ = w.Write([]byte("[]"))
+		}
+	}))
+
+	tests := []struct {
+		method, path, requestToken string
+		expectedStatus             int
+		expectedToken              string
+		expectedReadToken          any
+	}{
+		{"POST", "/created", "", 201, "16/B374D848", nil},
+		{"DELETE", "/invalid", "", 400, "", nil},
+		{"POST", "/users:validate", "", 200, "", nil},
+		{"GET", "/users", "", 200, "", nil},
+		{"GET", "/users", "16/B374D848", 200, "", "16/B374D848"},
+		{"GET", "/users", "not-a-token", 400, "", nil},
+	}
+	for _, test := range tests {
+		readToken = nil
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest(test.method, test.path, nil)
+		if test.requestToken != "" {
+			req.Header.Set(consistencyTokenHeader, test.requestToken)
+		}
+		handler.ServeHTTP(recorder, req)
+
+		assert.Equal(t, test.expectedStatus, recorder.Code, "%s %s", test.method, test.path)
+		assert.Equal(t, test.expectedToken, recorder.Header().Get(consistencyTokenHeader), "%s %s", test.method, test.path)
+		assert.Equal(t, test.expectedReadToken, readToken, "%s %s", test.method, test.path)
+	}
+
+	// The primary is only queried for the one write which returned a token
+	assert.Equal(t, 1, walQueries)
+}
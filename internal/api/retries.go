@@ -0,0 +1,343 @@
+package api
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultRetryMaxAttempts               = 3
+	defaultRetryBaseBackoff               = time.Millisecond * 50
+	defaultRetryMaxBackoff                = time.Second
+	defaultCircuitBreakerFailureThreshold = 5
+	defaultCircuitBreakerOpenDuration     = time.Second * 10
+
+	pqSerializationFailure     = "40001"
+	pqDeadlockDetected         = "40P01"
+	pqReadOnlyTransaction      = "25006" // a write sent to a writer which has just been demoted by a failover
+	pqAdminShutdown            = "57P01"
+	pqCrashShutdown            = "57P02"
+	pqCannotConnectNow         = "57P03"
+	pqConnectionExceptionClass = "08"
+)
+
+// errDatabaseUnavailable is returned while the circuit breaker is open, or when a transient database error persists
+// through every retry
+var errDatabaseUnavailable = errors.New("database unavailable")
+
+// unavailableError is an errDatabaseUnavailable along with how long clients should wait before retrying.
+// The driver error which caused it is logged rather than returned, so that it doesn't reach clients
+type unavailableError struct {
+	retryAfter time.Duration
+}
+
+func (e *unavailableError) Error() string {
+	return fmt.Sprintf("%v. Retry after %s", errDatabaseUnavailable, e.retryAfter)
+}
+
+func (e *unavailableError) Unwrap() error {
+	return errDatabaseUnavailable
+}
+
+// RetriesConfig bounds the retries of idempotent users store calls which fail with a transient error
+type RetriesConfig struct {
+	MaxAttempts int           `yaml:"max_attempts"`
+	BaseBackoff time.Duration `yaml:"base_backoff"`
+	MaxBackoff  time.Duration `yaml:"max_backoff"`
+}
+
+// CircuitBreakerConfig sets when the circuit breaker opens, and for how long
+type CircuitBreakerConfig struct {
+	FailureThreshold int           `yaml:"failure_threshold"`
+	OpenDuration     time.Duration `yaml:"open_duration"`
+}
+
+// isTransientError returns true if err is a database error which is likely to succeed if retried, such as the connection
+// being reset, the server shutting down during a failover or the transaction losing out to a concurrent one. The UserModel
+// methods wrap driver errors with %w so that they can be classified here
+func isTransientError(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case pqSerializationFailure, pqDeadlockDetected, pqReadOnlyTransaction:
+			return true
+		}
+	}
+	return isUnavailableError(err)
+}
+
+// isUnavailableError returns true if err shows that the database couldn't be reached or is shutting down. Unlike the
+// other transient errors, these say that the database itself is unhealthy, so are the ones counted by the circuit breaker
+func isUnavailableError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case pqAdminShutdown, pqCrashShutdown, pqCannotConnectNow:
+			return true
+		}
+		return strings.HasPrefix(string(pqErr.Code), pqConnectionExceptionClass)
+	}
+
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) ||
+		errors.As(err, &netErr)
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitHalfOpen
+	circuitOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitHalfOpen:
+		return "half-open"
+	case circuitOpen:
+		return "open"
+	}
+	return "closed"
+}
+
+// CircuitBreaker fails database calls fast while the database is down. It opens after FailureThreshold consecutive calls
+// fail to reach the database or time out. Serialization failures, deadlocks and read-only errors are retried but not counted,
+// as the database answered them. Once OpenDuration has passed it lets a single call through to probe whether the
+// database has recovered, closing again if it succeeds and re-opening if it doesn't
+type CircuitBreaker struct {
+	FailureThreshold int
+	OpenDuration     time.Duration
+
+	mu       sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+	probing  bool
+	now      func() time.Time // replaced in tests
+}
+
+// NewCircuitBreaker returns a closed circuit breaker
+func NewCircuitBreaker(cfg CircuitBreakerConfig) *CircuitBreaker {
+	return &CircuitBreaker{FailureThreshold: cfg.FailureThreshold, OpenDuration: cfg.OpenDuration, now: time.Now}
+}
+
+// allow returns nil if a call can go ahead, otherwise an unavailableError. Calls which are allowed must be passed to record
+func (b *CircuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == circuitOpen && b.now().Sub(b.openedAt) >= b.OpenDuration {
+		b.state = circuitHalfOpen
+		log.Info("Database circuit breaker is half-open. Probing whether the database has recovered")
+	}
+	if b.state == circuitClosed || (b.state == circuitHalfOpen && !b.probing) {
+		b.probing = b.state == circuitHalfOpen
+		return nil
+	}
+	return &unavailableError{retryAfter: b.retryAfterLocked()}
+}
+
+// record updates the breaker with the outcome of a call. Calls cancelled by the client don't say anything about the database,
+// whilst errors which the database answered with show that it is up
+func (b *CircuitBreaker) record(ctx context.Context, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	wasProbe := b.probing
+	b.probing = false
+	failed := isUnavailableError(err) || (err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded))
+	switch {
+	case failed && (wasProbe || b.state == circuitClosed && b.failures+1 >= b.FailureThreshold):
+		if b.state != circuitOpen {
+			log.WithError(err).Errorf("Database circuit breaker is open. Failing database calls fast for %s", b.OpenDuration)
+		}
+		b.state = circuitOpen
+		b.openedAt = b.now()
+		b.failures = 0
+	case failed:
+		b.failures++
+	case err != nil && ctx.Err() != nil:
+	default:
+		if b.state != circuitClosed {
+			log.Info("Database circuit breaker is closed. The database has recovered")
+		}
+		b.state = circuitClosed
+		b.failures = 0
+	}
+}
+
+func (b *CircuitBreaker) currentState() circuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// retryAfterLocked returns how long until the breaker lets a probe through. It is never less than a second, as that is the
+// resolution of the Retry-After header
+func (b *CircuitBreaker) retryAfterLocked() time.Duration {
+	remaining := b.OpenDuration - b.now().Sub(b.openedAt)
+	if b.state != circuitOpen || remaining < time.Second {
+		return time.Second
+	}
+	return remaining.Round(time.Second)
+}
+
+// healthCheck fails while the breaker is open, so that its state is shown in /health
+func (b *CircuitBreaker) healthCheck(context.Context) error {
+	if state := b.currentState(); state != circuitClosed {
+		return fmt.Errorf("database circuit breaker is %s", state)
+	}
+	return nil
+}
+
+// retryingUsersStore retries idempotent calls to the wrapped UserStore which fail with a transient error, and fails every
+// call fast while the circuit breaker is open
+type retryingUsersStore struct {
+	next    UserStore
+	retries RetriesConfig
+	breaker *CircuitBreaker
+	onRetry func(operation string) // optional. Called before each retry
+}
+
+// withRetries wraps store with retries and breaker
+func withRetries(store UserStore, retries RetriesConfig, breaker *CircuitBreaker, onRetry func(operation string)) UserStore {
+	return &retryingUsersStore{next: store, retries: retries, breaker: breaker, onRetry: onRetry}
+}
+
+// alwaysRetry and neverRetry are the canRetry functions for idempotent and non-idempotent calls
+func alwaysRetry() bool { return true }
+func neverRetry() bool  { return false }
+
+// call runs fn through the circuit breaker. Transient errors are retried up to MaxAttempts times, with exponential backoff
+// and jitter, as long as canRetry returns true. A transient error which persists is returned as an unavailableError
+func (s *retryingUsersStore) call(ctx context.Context, operation string, canRetry func() bool, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		if err := s.breaker.allow(); err != nil {
+			return err
+		}
+		err := fn()
+		s.breaker.record(ctx, err)
+		if !isTransientError(err) {
+			return err
+		}
+		if attempt >= s.retries.MaxAttempts || !canRetry() {
+			log.WithContext(ctx).WithError(err).WithField("attempts", attempt).Errorf("%s failed with a transient database error", operation)
+			return &unavailableError{retryAfter: time.Second}
+		}
+
+		if s.onRetry != nil {
+			s.onRetry(operation)
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(s.backoff(attempt)):
+		}
+	}
+}
+
+// backoff returns how long to wait before retrying after attempt, doubling with each attempt up to MaxBackoff. The wait is
+// picked at random from the top half of that range, so that requests which failed together don't all retry together
+func (s *retryingUsersStore) backoff(attempt int) time.Duration {
+	backoff := s.retries.BaseBackoff
+	for i := 1; i < attempt && backoff < s.retries.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, s.retries.MaxBackoff)
+	return backoff/2 + rand.N(backoff/2+1)
+}
+
+func (s *retryingUsersStore) QueryRecordCount(ctx context.Context, nameFilter, logonNameFilter string) (count int, err error) {
+	err = s.call(ctx, "queryRecordCount", alwaysRetry, func() error {
+		count, err = s.next.QueryRecordCount(ctx, nameFilter, logonNameFilter)
+		return err
+	})
+	return count, err
+}
+
+func (s *retryingUsersStore) QueryUsers(ctx context.Context, offset, limit int, nameFilter string) (page UsersPage, err error) {
+	err = s.call(ctx, "queryUsers", alwaysRetry, func() error {
+		page, err = s.next.QueryUsers(ctx, offset, limit, nameFilter)
+		return err
+	})
+	return page, err
+}
+
+func (s *retryingUsersStore) GetUser(ctx context.Context, logonName string) (user User, err error) {
+	err = s.call(ctx, "getUser", alwaysRetry, func() error {
+		user, err = s.next.GetUser(ctx, logonName)
+		return err
+	})
+	return user, err
+}
+
+func (s *retryingUsersStore) SearchUsers(ctx context.Context, query string, minScore float64, offset, limit int) (page UsersPage, err error) {
+	err = s.call(ctx, "searchUsers", alwaysRetry, func() error {
+		page, err = s.next.SearchUsers(ctx, query, minScore, offset, limit)
+		return err
+	})
+	return page, err
+}
+
+// StreamUsers is only retried if no users have been passed to fn yet, as they would otherwise be passed to it twice
+func (s *retryingUsersStore) StreamUsers(ctx context.Context, nameFilter string, fn func(User) error) error {
+	streamed := false
+	canRetry := func() bool { return !streamed }
+	return s.call(ctx, "streamUsers", canRetry, func() error {
+		return s.next.StreamUsers(ctx, nameFilter, func(user User) error {
+			streamed = true
+			return fn(user)
+		})
+	})
+}
+
+// The writes aren't retried, as a write which failed with a transient error may still have been committed. Their errors
+// are classified all the same, so that clients get a 503 and can retry with an idempotency key
+
+func (s *retryingUsersStore) AddUser(ctx context.Context, user User) (added User, err error) {
+	err = s.call(ctx, "addUser", neverRetry, func() error {
+		added, err = s.next.AddUser(ctx, user)
+		return err
+	})
+	return added, err
+}
+
+func (s *retryingUsersStore) DeleteUser(ctx context.Context, logonName string) error {
+	return s.call(ctx, "deleteUser", neverRetry, func() error {
+		return s.next.DeleteUser(ctx, logonName)
+	})
+}
+
+func (s *retryingUsersStore) UpdateUser(ctx context.Context, user User) (updated User, err error) {
+	err = s.call(ctx, "updateUser", neverRetry, func() error {
+		updated, err = s.next.UpdateUser(ctx, user)
+		return err
+	})
+	return updated, err
+}
+
+// WithTx goes through the circuit breaker as a single call. The calls within the transaction aren't retried, as the
+// transaction is aborted by the first error
+func (s *retryingUsersStore) WithTx(ctx context.Context, fn func(UserStore) error) error {
+	return s.call(ctx, "withTx", neverRetry, func() error {
+		return s.next.WithTx(ctx, fn)
+	})
+}
@@ -0,0 +1,216 @@
+package api
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyUsersStore fails the next failures calls with err, before passing calls through to the wrapped store
+type flakyUsersStore struct {
+	UserStore
+	failures int
+	err      error
+	calls    int
+}
+
+func (s *flakyUsersStore) fail() error {
+	s.calls++
+	if s.failures > 0 {
+		s.failures--
+		return s.err
+	}
+	return nil
+}
+
+func (s *flakyUsersStore) QueryRecordCount(ctx context.Context, nameFilter, logonNameFilter string) (int, error) {
+	if err := s.fail(); err != nil {
+		return 0, err
+	}
+	return s.UserStore.QueryRecordCount(ctx, nameFilter, logonNameFilter)
+}
+
+func (s *flakyUsersStore) QueryUsers(ctx context.Context, offset, limit int, nameFilter string) (UsersPage, error) {
+	if err := s.fail(); err != nil {
+		return UsersPage{}, err
+	}
+	return s.UserStore.QueryUsers(ctx, offset, limit, nameFilter)
+}
+
+func (s *flakyUsersStore) AddUser(ctx context.Context, user User) (User, error) {
+	if err := s.fail(); err != nil {
+		return user, err
+	}
+	return s.UserStore.AddUser(ctx, user)
+}
+
+// StreamUsers streams the first user before failing
+func (s *flakyUsersStore) StreamUsers(ctx context.Context, nameFilter string, fn func(User) error) error {
+	s.calls++
+	return s.UserStore.StreamUsers(ctx, nameFilter, func(user User) error {
+		if err := fn(user); err != nil {
+			return err
+		}
+		if s.failures > 0 {
+			s.failures--
+			return s.err
+		}
+		return nil
+	})
+}
+
+var testRetries = RetriesConfig{MaxAttempts: 3, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond * 4}
+
+// TestIsTransientError tests the classification of the errors which are worth retrying, and of those which also count
+// towards opening the circuit breaker
+func TestIsTransientError(t *testing.T) {
+	tests := []struct {
+		err         error
+		transient   bool
+		unavailable bool
+	}{
+		{&pq.Error{Code: pqAdminShutdown}, true, true},
+		{&pq.Error{Code: pqSerializationFailure}, true, false},
+		{&pq.Error{Code: pqDeadlockDetected}, true, false},
+		{&pq.Error{Code: "08006"}, true, true}, // connection_failure
+		{fmt.Errorf("querying database for users: %w", &pq.Error{Code: pqReadOnlyTransaction}), true, false},
+		{fmt.Errorf("querying database for users: %w", syscall.ECONNRESET), true, true},
+		{driver.ErrBadConn, true, true},
+		{io.ErrUnexpectedEOF, true, true},
+		{&pq.Error{Code: uniqueViolation}, false, false},
+		{&pq.Error{Code: "57014"}, false, false}, // query_canceled
+		{ErrUserNotFound, false, false},
+		{context.DeadlineExceeded, false, false},
+		{nil, false, false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.transient, isTransientError(test.err), "%v", test.err)
+		assert.Equal(t, test.unavailable, isUnavailableError(test.err), "%v", test.err)
+	}
+}
+
+// TestRetriesIdempotentCalls tests that reads are retried after a transient error, whilst writes and streams which have
+// already passed users to the caller are not
+func TestRetriesIdempotentCalls(t *testing.T) {
+	ctx := context.Background()
+	flaky := &flakyUsersStore{UserStore: newTestMemoryStore(), err: &pq.Error{Code: pqAdminShutdown}}
+	var retried []string
+	store := withRetries(flaky, testRetries, NewCircuitBreaker(CircuitBreakerConfig{FailureThreshold: 10, OpenDuration: time.Second}),
+		func(operation string) { retried = append(retried, operation) })
+
+	flaky.failures = 2
+	count, err := store.QueryRecordCount(ctx, "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, 3, flaky.calls)
+	assert.Equal(t, []string{"queryRecordCount", "queryRecordCount"}, retried)
+
+	flaky.calls, flaky.failures, retried = 0, 3, nil
+	_, err = store.QueryRecordCount(ctx, "", "")
+	assert.True(t, errors.Is(err, errDatabaseUnavailable))
+	assert.Equal(t, 3, flaky.calls)
+
+	flaky.calls, flaky.failures, retried = 0, 1, nil
+	_, err = store.AddUser(ctx, User{LogonName: "alice1", FullName: "Alice", Email: "alice@email.com"})
+	assert.True(t, errors.Is(err, errDatabaseUnavailable))
+	assert.Equal(t, 1, flaky.calls)
+	assert.Empty(t, retried)
+
+	flaky.calls, flaky.failures = 0, 1
+	streamed := 0
+	err = store.StreamUsers(ctx, "", func(User) error {
+		streamed++
+		return nil
+	})
+	assert.True(t, errors.Is(err, errDatabaseUnavailable))
+	assert.Equal(t, 1, flaky.calls)
+	assert.Equal(t, 1, streamed)
+
+	// Errors which aren't transient are returned as they are
+	_, err = store.AddUser(ctx, User{LogonName: "mark9", FullName: "Mark", Email: "mark@email.com"})
+	assert.True(t, errors.Is(err, ErrLogonNameTaken))
+}
+
+// TestCircuitBreaker tests that the breaker opens after consecutive failures, fails fast, and closes after a successful probe
+func TestCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	breaker := NewCircuitBreaker(CircuitBreakerConfig{FailureThreshold: 2, OpenDuration: time.Second * 10})
+	breaker.now = func() time.Time { return now }
+	transient := &pq.Error{Code: pqCannotConnectNow}
+
+	assert.NoError(t, breaker.allow())
+	breaker.record(ctx, transient)
+	assert.NoError(t, breaker.allow())
+	breaker.record(ctx, ErrUserNotFound) // the database answered, so the failures start again
+	assert.NoError(t, breaker.allow())
+	breaker.record(ctx, transient)
+	assert.NoError(t, breaker.allow())
+	breaker.record(ctx, transient)
+	assert.Equal(t, circuitOpen, breaker.currentState())
+
+	now = now.Add(time.Second * 3)
+	var unavailable *unavailableError
+	assert.True(t, errors.As(breaker.allow(), &unavailable))
+	assert.Equal(t, time.Second*7, unavailable.retryAfter)
+	assert.Error(t, breaker.healthCheck(ctx))
+
+	// Only one probe is let through at a time, and a failed probe re-opens the breaker
+	now = now.Add(time.Second * 7)
+	assert.NoError(t, breaker.allow())
+	assert.Error(t, breaker.allow())
+	breaker.record(ctx, transient)
+	assert.Equal(t, circuitOpen, breaker.currentState())
+
+	now = now.Add(time.Second * 10)
+	assert.NoError(t, breaker.allow())
+	breaker.record(ctx, nil)
+	assert.Equal(t, circuitClosed, breaker.currentState())
+	assert.NoError(t, breaker.healthCheck(ctx))
+}
+
+// TestCircuitBreakerIgnoresContention tests that serialization failures are retried without opening the breaker, as the
+// database answered them
+func TestCircuitBreakerIgnoresContention(t *testing.T) {
+	breaker := NewCircuitBreaker(CircuitBreakerConfig{FailureThreshold: 1, OpenDuration: time.Second * 30})
+	flaky := &flakyUsersStore{UserStore: newTestMemoryStore(), err: &pq.Error{Code: pqSerializationFailure}, failures: 5}
+	store := withRetries(flaky, testRetries, breaker, nil)
+
+	_, err := store.QueryRecordCount(context.Background(), "", "")
+	assert.True(t, errors.Is(err, errDatabaseUnavailable))
+	assert.Equal(t, 3, flaky.calls)
+	assert.Equal(t, circuitClosed, breaker.currentState())
+
+	flaky.failures = 0
+	count, err := store.QueryRecordCount(context.Background(), "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+}
+
+// TestDatabaseUnavailableResponse tests that clients are sent a 503 with Retry-After, without the driver error
+func TestDatabaseUnavailableResponse(t *testing.T) {
+	breaker := NewCircuitBreaker(CircuitBreakerConfig{FailureThreshold: 1, OpenDuration: time.Second * 30})
+	flaky := &flakyUsersStore{UserStore: newTestMemoryStore(), err: &pq.Error{Code: pqAdminShutdown, Message: "terminating connection due to administrator command"}, failures: 1}
+	env := &Env{UsersDB: withRetries(flaky, RetriesConfig{MaxAttempts: 1, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond}, breaker, nil)}
+
+	for _, expectedRetryAfter := range []string{"1", "30"} {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/users", nil)
+		env.listUsers(recorder, req)
+
+		assert.Equal(t, 503, recorder.Code)
+		assert.Equal(t, expectedRetryAfter, recorder.Header().Get("Retry-After"))
+		assert.Contains(t, recorder.Body.String(), `"code":"SERVICE_UNAVAILABLE"`)
+		assert.NotContains(t, recorder.Body.String(), "administrator command")
+	}
+}
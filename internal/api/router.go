@@ -3,8 +3,8 @@ package api
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
 	"syscall"
@@ -12,23 +12,17 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/hellofresh/health-go/v5"
-	healthPg "github.com/hellofresh/health-go/v5/checks/postgres"
 	log "github.com/sirupsen/logrus"
 )
 
-const (
-	dbHealthCheckTimeOutSeconds = 5
-	webServerPort               = 8080
-	gracefulShutdownTime        = time.Second * 10
-)
-
 var EnvConfig *Env
 
 // RunAPIServer starts an HTTP server after setting up any dependencies using *Env
 func RunAPIServer() {
-	serverAddr := fmt.Sprintf("0.0.0.0:%d", webServerPort)
+	cfg := EnvConfig.Config
+	serverAddr := fmt.Sprintf("0.0.0.0:%d", cfg.Server.Port)
 
-	// Register a /health endpoint which polls the Postgres DB. Also display system & git build info
+	// Register a /health endpoint which polls the Postgres DB, if it is being used. Also display system & git build info
 	h, err := health.New(health.WithSystemInfo(), health.WithComponent(health.Component{
 		Name:    ServiceName,
 		Version: EnvConfig.BuildVersion,
@@ -36,25 +30,94 @@ func RunAPIServer() {
 	if err != nil {
 		log.WithError(err).Fatalf("unable to load health container")
 	}
-	err = h.Register(health.Config{
-		Name:      "postgres-check",
-		Timeout:   time.Second * dbHealthCheckTimeOutSeconds,
-		SkipOnErr: false,
-		Check: healthPg.New(healthPg.Config{
-			DSN: fmt.Sprintf("postgres://%s:%s@%s:%d/%s?sslmode=%s",
-				// Escape to avoid issues with special characters as we cannot quote in URLs
-				url.QueryEscape(EnvConfig.DBCredentials.DBUsername), url.QueryEscape(EnvConfig.DBCredentials.DBPassword),
-				EnvConfig.DBCredentials.HostName,
-				EnvConfig.DBCredentials.Port, EnvConfig.DBCredentials.DBName, EnvConfig.DBCredentials.SSLMode),
-		}),
-	})
+	if cfg.Storage.Backend == BackendPostgres {
+		err = h.Register(health.Config{
+			Name:      "postgres-check",
+			Timeout:   cfg.Server.HealthCheckTimeout,
+			SkipOnErr: false,
+			// Checked through the connection pool, so that the check uses the current credentials when the password is rotated
+			Check: postgresCheck(EnvConfig.DB),
+		})
+	}
+	if EnvConfig.Breaker != nil {
+		err = h.Register(health.Config{
+			Name:      "postgres-circuit-breaker",
+			Timeout:   cfg.Server.HealthCheckTimeout,
+			SkipOnErr: false,
+			Check:     EnvConfig.Breaker.healthCheck,
+		})
+	}
+	if EnvConfig.Replica != nil {
+		// Reads fall back to the primary while the replica is down, so it doesn't fail the health check
+		err = h.Register(health.Config{
+			Name:      "postgres-replica-check",
+			Timeout:   cfg.Server.HealthCheckTimeout,
+			SkipOnErr: true,
+			Check:     EnvConfig.Replica.check,
+		})
+	}
+
+	// /livez and /readyz are split so that a database outage makes the service unready rather than getting it restarted
+	probes := NewProbes(cfg.Probes, cfg.Server.HealthCheckTimeout)
+	if cfg.Storage.Backend == BackendPostgres {
+		probes.register(checkPrimary, postgresCheck(EnvConfig.DB))
+		probes.register(checkMigrations, migrationsCheck(EnvConfig.DB))
+		probes.register(checkEventBacklog, eventBacklogCheck(EnvConfig.DB, cfg.Probes.EventBacklogThreshold))
+	}
+	if EnvConfig.Replica != nil {
+		probes.register(checkReplica, EnvConfig.Replica.check)
+	}
+
+	shutdownTracing, err := InitTracing(context.Background(), cfg.Tracing.Exporter, EnvConfig.BuildVersion)
+	if err != nil {
+		log.WithError(err).Fatal("initialising tracing")
+	}
 
 	r := mux.NewRouter()
 	r.HandleFunc("/users", EnvConfig.listUsers).Methods("GET")
-	r.HandleFunc("/users", EnvConfig.postUser).Methods("POST")
+	r.HandleFunc("/users", EnvConfig.idempotent(EnvConfig.postUser)).Methods("POST")
+	r.HandleFunc("/users:export", EnvConfig.exportUsers).Methods("GET")
+	r.HandleFunc("/users:batch", EnvConfig.idempotent(EnvConfig.batchUsers)).Methods("POST")
+	r.HandleFunc("/users:validate", EnvConfig.validateUserRequest).Methods("POST")
+	// Webhooks and the change feed are built on the Postgres user events, so are only available with the postgres backend
+	if EnvConfig.Changes != nil {
+		r.HandleFunc("/users/changes", EnvConfig.streamUserChanges).Methods("GET")
+	}
+	r.HandleFunc("/users/{logon_name}", EnvConfig.getUser).Methods("GET")
 	r.HandleFunc("/users/{logon_name}", EnvConfig.deleteUser).Methods("DELETE")
 	r.HandleFunc("/users/{logon_name}", EnvConfig.putUser).Methods("PUT")
+	if EnvConfig.Webhooks != nil {
+		r.HandleFunc("/webhooks", EnvConfig.postWebhook).Methods("POST")
+		r.HandleFunc("/webhooks", EnvConfig.listWebhooks).Methods("GET")
+		r.HandleFunc("/webhooks/dead-letters", EnvConfig.listDeadLetters).Methods("GET")
+		r.HandleFunc("/webhooks/dead-letters/{delivery_id:[0-9]+}/replay", EnvConfig.replayDeadLetter).Methods("POST")
+		r.HandleFunc("/webhooks/{subscription_id:[0-9]+}", EnvConfig.deleteWebhook).Methods("DELETE")
+	}
 	r.HandleFunc("/health", h.HandlerFunc)
+	r.HandleFunc("/livez", probes.livez).Methods("GET")
+	r.HandleFunc("/readyz", probes.readyz).Methods("GET")
+
+	// Every request is traced, given a request ID, access logged and counted in the metrics. Mux only runs middleware for
+	// requests which match a route, so the 404 & 405 handlers are wrapped in the same middleware explicitly
+	middleware := []mux.MiddlewareFunc{traceHandler, requestIDHandler, accessLogHandler}
+	if EnvConfig.Metrics != nil {
+		EnvConfig.Metrics.setBuildInfo(EnvConfig.BuildVersion)
+		r.Handle("/metrics", EnvConfig.Metrics.handler()).Methods("GET")
+		middleware = append(middleware, EnvConfig.Metrics.instrumentHandler)
+	}
+	if EnvConfig.Replica != nil {
+		middleware = append(middleware, EnvConfig.Replica.consistencyHandler)
+	}
+	log.AddHook(requestIDHook{})
+	r.Use(middleware...)
+	r.NotFoundHandler = withMiddleware(http.NotFoundHandler(), middleware)
+	r.MethodNotAllowedHandler = withMiddleware(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}), middleware)
+
+	// Every request context derives from requestsCtx, so that cancelling it interrupts any queries which are still running
+	requestsCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
 
 	srv := &http.Server{
 		Addr:         serverAddr,
@@ -62,10 +125,37 @@ func RunAPIServer() {
 		ReadTimeout:  time.Second * 15,
 		IdleTimeout:  time.Second * 60,
 		Handler:      r,
+		BaseContext:  func(net.Listener) context.Context { return requestsCtx },
 	}
 
 	log.Infof("Running webserver on: %s\n", serverAddr)
 
+	// Relay events from the outbox, send webhook deliveries, listen for changes, invalidate the cache, delete expired idempotency keys and
+	// watch for a rotated database password until the server is shutting down
+	backgroundCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	if EnvConfig.EventRelay != nil {
+		go EnvConfig.EventRelay.Run(backgroundCtx)
+	}
+	if EnvConfig.WebhookDispatcher != nil {
+		go EnvConfig.WebhookDispatcher.Run(backgroundCtx)
+	}
+	if EnvConfig.Changes != nil {
+		go EnvConfig.Changes.Run(backgroundCtx)
+		if EnvConfig.Cache != nil {
+			go EnvConfig.Cache.Run(backgroundCtx, EnvConfig.Changes)
+		}
+	}
+	if EnvConfig.Replica != nil {
+		go EnvConfig.Replica.Run(backgroundCtx)
+	}
+	if EnvConfig.Idempotency != nil {
+		go EnvConfig.sweepIdempotencyKeys(backgroundCtx, idempotencyKeySweepInterval)
+	}
+	if EnvConfig.Credentials != nil {
+		go EnvConfig.Credentials.Watch(backgroundCtx, cfg.Database.PasswordFilePollInterval)
+	}
+
 	go func() {
 		if err = srv.ListenAndServe(); err != http.ErrServerClosed {
 			log.WithError(err).Error("Problems shutting down HTTP server")
@@ -79,7 +169,34 @@ func RunAPIServer() {
 	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 	signalReceived := <-c
 	log.Infof("OS signal received: %v", signalReceived)
-	ctx, cancel := context.WithTimeout(context.Background(), gracefulShutdownTime)
+
+	// Stop being ready, and keep serving whilst the load balancers notice, before no longer accepting connections
+	probes.startShutdown()
+	if cfg.Probes.DrainDelay > 0 {
+		log.Infof("Waiting %s for load balancers to stop sending requests", cfg.Probes.DrainDelay)
+		time.Sleep(cfg.Probes.DrainDelay)
+	}
+	stopBackground()
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
 	defer cancel()
-	_ = srv.Shutdown(ctx)
+	if err = srv.Shutdown(ctx); err != nil {
+		// Requests are still running after the grace period, so cancel their queries and close the connections
+		log.WithError(err).Warn("graceful shutdown timed out. Cancelling in-flight requests")
+		cancelRequests()
+		_ = srv.Close()
+	}
+	// The shutdown context may already have expired, so give the remaining spans a grace period of their own
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancelFlush()
+	if err = shutdownTracing(flushCtx); err != nil {
+		log.WithError(err).Error("flushing traces")
+	}
+}
+
+// withMiddleware wraps h in middleware, with the first entry being the outermost, in the same way as mux.Router.Use
+func withMiddleware(h http.Handler, middleware []mux.MiddlewareFunc) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
 }
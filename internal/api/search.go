@@ -0,0 +1,127 @@
+package api
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// fuzzySearchThreshold is the score at which a word which doesn't contain the query still matches it. It is the default of
+// the Postgres pg_trgm.word_similarity_threshold setting, which the <% operator uses
+const fuzzySearchThreshold = 0.6
+
+// userSearchCondition matches the users for the query $1, whose LIKE pattern is $2, with a score of at least $3. The SQL
+// functions are created by sql/09-user-search.sql. Both sides of the OR can use the GIN index on user_search_text
+const userSearchCondition = `(user_search_text(logon_name, full_name, email) LIKE '%' || lower(immutable_unaccent($2)) || '%'
+		OR lower(immutable_unaccent($1)) <% user_search_text(logon_name, full_name, email))
+	AND word_similarity(lower(immutable_unaccent($1)), user_search_text(logon_name, full_name, email)) >= $3`
+
+// escapeLikePattern escapes the LIKE wildcards in s, so that it is matched literally
+func escapeLikePattern(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// The stores without pg_trgm approximate its behaviour with the functions below, so that they return the same results for
+// typical searches. The scores can differ slightly from Postgres for queries spanning more than one word
+
+// normaliseSearchText lowercases s and removes its accents, like lower(unaccent(s)) in Postgres
+func normaliseSearchText(s string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(s) {
+		if !unicode.Is(unicode.Mn, r) {
+			b.WriteRune(unicode.ToLower(r))
+		}
+	}
+	return b.String()
+}
+
+// userSearchText is the text of user which is searched, matching the user_search_text SQL function
+func userSearchText(user User) string {
+	return normaliseSearchText(user.LogonName + " " + user.FullName + " " + user.Email)
+}
+
+// searchWords splits s into the alphanumeric words which pg_trgm extracts trigrams from
+func searchWords(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+}
+
+// wordTrigrams returns the trigrams of word in order, padded with two spaces before and one after as pg_trgm does
+func wordTrigrams(word string) []string {
+	padded := []rune("  " + word + " ")
+	trigrams := make([]string, 0, len(padded)-2)
+	for i := 0; i+3 <= len(padded); i++ {
+		trigrams = append(trigrams, string(padded[i:i+3]))
+	}
+	return trigrams
+}
+
+// wordSimilarity approximates the pg_trgm word_similarity function: the greatest similarity between the trigrams of query
+// and those of any continuous extent of a word in text. It is 1 when text contains every word of query
+func wordSimilarity(query, text string) float64 {
+	queryTrigrams := make(map[string]bool)
+	for _, word := range searchWords(query) {
+		for _, trigram := range wordTrigrams(word) {
+			queryTrigrams[trigram] = true
+		}
+	}
+	if len(queryTrigrams) == 0 {
+		return 0
+	}
+
+	best := 0.0
+	for _, word := range searchWords(text) {
+		trigrams := wordTrigrams(word)
+		for start := range trigrams {
+			extent := make(map[string]bool)
+			for _, trigram := range trigrams[start:] {
+				extent[trigram] = true
+				shared := 0
+				for t := range extent {
+					if queryTrigrams[t] {
+						shared++
+					}
+				}
+				best = max(best, float64(shared)/float64(len(queryTrigrams)+len(extent)-shared))
+			}
+		}
+	}
+	return best
+}
+
+// searchScore returns how well user matches the normalised query, and whether it matches at all. Users match if their search
+// text contains the query, or has a word which is close to it
+func searchScore(query string, user User) (float64, bool) {
+	text := userSearchText(user)
+	score := wordSimilarity(query, text)
+	return score, strings.Contains(text, query) || score >= fuzzySearchThreshold
+}
+
+// rankUsers returns the page of users which match query with at least minScore, ordered by score and then user_id, along with
+// the total number which match
+func rankUsers(users []User, query string, minScore float64, offset, limit int) UsersPage {
+	type scoredUser struct {
+		user  User
+		score float64
+	}
+	query = normaliseSearchText(query)
+	matched := make([]scoredUser, 0)
+	for _, user := range users {
+		if score, ok := searchScore(query, user); ok && score >= minScore {
+			matched = append(matched, scoredUser{user: user, score: score})
+		}
+	}
+	slices.SortStableFunc(matched, func(a, b scoredUser) int {
+		return cmp.Or(cmp.Compare(b.score, a.score), cmp.Compare(a.user.UserID, b.user.UserID))
+	})
+
+	page := UsersPage{Users: make([]User, 0), Total: len(matched)}
+	start := min(max(offset, 0), len(matched))
+	end := min(start+max(limit, 0), len(matched))
+	for _, scored := range matched[start:end] {
+		page.Users = append(page.Users, scored.user)
+	}
+	return page
+}
@@ -0,0 +1,35 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestNormaliseSearchText tests that search text is compared without case or accents
+func TestNormaliseSearchText(t *testing.T) {
+	assert.Equal(t, "jose muller", normaliseSearchText("José Müller"))
+	assert.Equal(t, "francois@email.com", normaliseSearchText("FRANÇOIS@email.com"))
+}
+
+// TestWordSimilarity tests the approximation of pg_trgm word_similarity
+func TestWordSimilarity(t *testing.T) {
+	tests := []struct {
+		query, text string
+		expected    float64
+	}{
+		{"word", "two words", 0.8}, // the example in the pg_trgm docs
+		{"bob", "bob44 bob jones bob@email.com", 1},
+		{"bob", "bobby8 bobby jones, jr bobby@email.com", 0.75},
+		{"smithh", "mark9 mark smith mark@email.com", 0.714}, // 5 shared trigrams out of 7 in total
+		{"%", "mark9 mark smith mark@email.com", 0},
+	}
+	for _, test := range tests {
+		assert.InDelta(t, test.expected, wordSimilarity(test.query, test.text), 0.001, "'%s' in '%s'", test.query, test.text)
+	}
+}
+
+// TestEscapeLikePattern tests that the LIKE wildcards in a search are matched literally
+func TestEscapeLikePattern(t *testing.T) {
+	assert.Equal(t, `50\% off\_now \\o/`, escapeLikePattern(`50% off_now \o/`))
+}
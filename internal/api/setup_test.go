@@ -3,9 +3,11 @@ package api
 import (
 	log "github.com/sirupsen/logrus"
 
+	"os"
 	"testing"
 )
 
-func TestMain(_ *testing.M) {
+func TestMain(m *testing.M) {
 	log.SetLevel(log.ErrorLevel)
+	os.Exit(m.Run())
 }
@@ -0,0 +1,343 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// sqliteSchema mirrors the Postgres users & idempotency_keys tables, including the unique index on logon_name. Timestamps
+// are kept as unix milliseconds. Rather than an updated_at
+// column, the time that any user was last written is kept in users_modified as unix milliseconds, which also covers deletions
+const sqliteSchema = `CREATE TABLE IF NOT EXISTS users (
+	user_id INTEGER PRIMARY KEY AUTOINCREMENT,
+	logon_name VARCHAR (20) NOT NULL UNIQUE,
+	full_name VARCHAR (100) NOT NULL,
+	email VARCHAR (100) NOT NULL
+);
+CREATE TABLE IF NOT EXISTS users_modified (
+	id INTEGER PRIMARY KEY CHECK (id = 1),
+	modified_at INTEGER NOT NULL
+);
+INSERT OR IGNORE INTO users_modified VALUES (1, ` + sqliteNowMillis + `);
+CREATE TRIGGER IF NOT EXISTS users_modified_insert AFTER INSERT ON users BEGIN UPDATE users_modified SET modified_at = ` + sqliteNowMillis + `; END;
+CREATE TRIGGER IF NOT EXISTS users_modified_update AFTER UPDATE ON users BEGIN UPDATE users_modified SET modified_at = ` + sqliteNowMillis + `; END;
+CREATE TRIGGER IF NOT EXISTS users_modified_delete AFTER DELETE ON users BEGIN UPDATE users_modified SET modified_at = ` + sqliteNowMillis + `; END;
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	idempotency_key VARCHAR (255) PRIMARY KEY,
+	fingerprint VARCHAR (64) NOT NULL,
+	status_code INTEGER,
+	content_type VARCHAR (100),
+	response_body BLOB,
+	expires_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);`
+
+// sqliteNowMillis is the current time in unix milliseconds
+const sqliteNowMillis = `CAST((julianday('now') - 2440587.5) * 86400000 AS INTEGER)`
+
+// SQLiteUserModel is a UserStore backed by a SQLite database file, so that the service can run locally without Postgres.
+// User events are not recorded
+type SQLiteUserModel struct {
+	DB *sql.DB
+	tx *sql.Tx // set when the model is scoped to a transaction by WithTx
+}
+
+// OpenSQLiteUserModel opens the SQLite database at path, creating it and the users table if they don't already exist.
+// LIKE is made case-sensitive to match Postgres, and transactions take the write lock up front so that concurrent
+// transactions wait for each other rather than failing
+func OpenSQLiteUserModel(path string) (*SQLiteUserModel, error) {
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=case_sensitive_like(1)&_txlock=immediate", path)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("opening SQLite database '%s': %v", path, err)
+	}
+	if _, err = db.Exec(sqliteSchema); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("creating users table in SQLite database '%s': %v", path, err)
+	}
+	return &SQLiteUserModel{DB: db}, nil
+}
+
+// conn returns the transaction if the model has been scoped to one by WithTx, otherwise the connection pool.
+// Every query is traced
+func (m *SQLiteUserModel) conn() dbConn {
+	if m.tx != nil {
+		return tracedConn{conn: m.tx, system: semconv.DBSystemSqlite}
+	}
+	return tracedConn{conn: m.DB, system: semconv.DBSystemSqlite}
+}
+
+// WithTx runs fn inside a database transaction, committing if fn returns nil and rolling back otherwise.
+// Calls on a model which is already scoped to a transaction reuse it rather than nesting
+func (m *SQLiteUserModel) WithTx(ctx context.Context, fn func(UserStore) error) error {
+	if m.tx != nil {
+		return fn(m)
+	}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %v", err)
+	}
+
+	if err = fn(&SQLiteUserModel{DB: m.DB, tx: tx}); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			log.WithError(rbErr).Error("rolling back transaction")
+		}
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("committing transaction: %v", err)
+	}
+	return nil
+}
+
+// QueryRecordCount returns the count of users whose full_name contains nameFilter, or whose logon_name is logonNameFilter.
+// Only 1 filter can be used at once. With neither filter every user is counted
+func (m *SQLiteUserModel) QueryRecordCount(ctx context.Context, nameFilter, logonNameFilter string) (int, error) {
+	var count int
+	var row *sql.Row
+
+	if nameFilter != "" && logonNameFilter != "" {
+		return 0, fmt.Errorf("cannot define both nameFilter and logonNameFilter for queryRecordCount function")
+	}
+
+	if nameFilter != "" {
+		row = m.conn().QueryRowContext(ctx, "SELECT COUNT(*) FROM users WHERE full_name LIKE '%' || ? || '%'", nameFilter)
+	} else if logonNameFilter != "" {
+		row = m.conn().QueryRowContext(ctx, "SELECT COUNT(*) FROM users WHERE logon_name = ?", logonNameFilter)
+	} else {
+		row = m.conn().QueryRowContext(ctx, "SELECT COUNT(*) FROM users")
+	}
+
+	if err := row.Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// QueryUsers returns a page of users whose full_name contains nameFilter, ordered by user_id, along with the total number
+// which match. As with Postgres, COUNT(*) OVER() returns the total with the page
+func (m *SQLiteUserModel) QueryUsers(ctx context.Context, offset, limit int, nameFilter string) (UsersPage, error) {
+	page := UsersPage{Users: make([]User, 0)}
+	var err error
+	if page.LastModified, err = m.lastModified(ctx); err != nil {
+		return page, err
+	}
+	rows, err := m.conn().QueryContext(ctx, `SELECT user_id, logon_name, full_name, email, COUNT(*) OVER() FROM users
+		WHERE full_name LIKE '%' || ? || '%' ORDER BY user_id LIMIT ? OFFSET ?`, nameFilter, limit, offset)
+	if err != nil {
+		return page, fmt.Errorf("querying database for users: %v", err)
+	}
+	if page.Users, err = scanUsers(rows, &page.Total); err != nil {
+		return page, err
+	}
+
+	if len(page.Users) == 0 && offset > 0 {
+		if page.Total, err = m.QueryRecordCount(ctx, nameFilter, ""); err != nil {
+			return page, fmt.Errorf("counting users: %v", err)
+		}
+	}
+	return page, nil
+}
+
+// SearchUsers returns a page of the users which match query, ranked by similarity. SQLite has no trigram matching, so every
+// user is read and ranked in the same way as MemoryUserModel, which approximates the Postgres search
+func (m *SQLiteUserModel) SearchUsers(ctx context.Context, query string, minScore float64, offset, limit int) (UsersPage, error) {
+	lastModified, err := m.lastModified(ctx)
+	if err != nil {
+		return UsersPage{Users: make([]User, 0)}, err
+	}
+	users := make([]User, 0)
+	err = m.StreamUsers(ctx, "", func(user User) error {
+		users = append(users, user)
+		return nil
+	})
+	if err != nil {
+		return UsersPage{Users: make([]User, 0)}, err
+	}
+	page := rankUsers(users, query, minScore, offset, limit)
+	page.LastModified = lastModified
+	return page, nil
+}
+
+// lastModified returns when any user was last added, updated or deleted
+func (m *SQLiteUserModel) lastModified(ctx context.Context) (time.Time, error) {
+	var millis int64
+	if err := m.conn().QueryRowContext(ctx, `SELECT modified_at FROM users_modified`).Scan(&millis); err != nil {
+		return time.Time{}, fmt.Errorf("querying when users were last modified: %v", err)
+	}
+	return time.UnixMilli(millis), nil
+}
+
+// StreamUsers calls fn for every user whose full_name contains nameFilter, in user_id order.
+// Rows are read one at a time rather than buffered, and the query is cancelled if ctx is done
+func (m *SQLiteUserModel) StreamUsers(ctx context.Context, nameFilter string, fn func(User) error) error {
+	// A negative LIMIT has no upper bound in SQLite
+	return m.streamUsersPage(ctx, 0, -1, nameFilter, fn)
+}
+
+// streamUsersPage calls fn for each user in a page of the users whose full_name contains nameFilter, in user_id order
+func (m *SQLiteUserModel) streamUsersPage(ctx context.Context, offset, limit int, nameFilter string, fn func(User) error) error {
+	rows, err := m.conn().QueryContext(ctx, `SELECT user_id, logon_name, full_name, email FROM users
+		WHERE full_name LIKE '%' || ? || '%' ORDER BY user_id LIMIT ? OFFSET ?`, nameFilter, limit, offset)
+	if err != nil {
+		return fmt.Errorf("querying database for users: %v", err)
+	}
+	defer func(rows *sql.Rows) {
+		if err := rows.Close(); err != nil {
+			log.WithError(err).Error("closing DB rows response")
+		}
+	}(rows)
+
+	for rows.Next() {
+		user := User{}
+		if err = rows.Scan(&user.UserID, &user.LogonName, &user.FullName, &user.Email); err != nil {
+			return fmt.Errorf("scanning over the DB results: %v", err)
+		}
+		if err = fn(user); err != nil {
+			return err
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("iterating over the DB results: %v", err)
+	}
+	return nil
+}
+
+// AddUser adds a new user to the users table, returning ErrLogonNameTaken if the logon_name is already in use
+func (m *SQLiteUserModel) AddUser(ctx context.Context, user User) (User, error) {
+	err := m.conn().QueryRowContext(ctx, `INSERT INTO users(logon_name, full_name, email) VALUES (?, ?, ?) RETURNING user_id`, user.LogonName, user.FullName, user.Email).Scan(&user.UserID)
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE {
+		return user, ErrLogonNameTaken
+	}
+	if err != nil {
+		return user, fmt.Errorf("inserting logon_name '%s' into users table: %v", user.LogonName, err)
+	}
+	return user, nil
+}
+
+// GetUser returns the user with logonName, or ErrUserNotFound if there is none
+func (m *SQLiteUserModel) GetUser(ctx context.Context, logonName string) (User, error) {
+	var user User
+	err := m.conn().QueryRowContext(ctx, `SELECT user_id, logon_name, full_name, email FROM users WHERE logon_name = ?`, logonName).
+		Scan(&user.UserID, &user.LogonName, &user.FullName, &user.Email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return user, ErrUserNotFound
+	}
+	if err != nil {
+		return user, fmt.Errorf("querying database for logon_name '%s': %v", logonName, err)
+	}
+	return user, nil
+}
+
+// DeleteUser deletes a user from the users table, returning ErrUserNotFound if there is no user with logonName
+func (m *SQLiteUserModel) DeleteUser(ctx context.Context, logonName string) error {
+	var userID int
+	err := m.conn().QueryRowContext(ctx, `DELETE FROM users WHERE logon_name = ? RETURNING user_id`, logonName).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("deleting record with logon_name = '%s' from users table: %v", logonName, err)
+	}
+	return nil
+}
+
+// UpdateUser updates the email and/or full_name of the user with the same logon_name, returning ErrUserNotFound if there is none
+func (m *SQLiteUserModel) UpdateUser(ctx context.Context, user User) (User, error) {
+	if user.Email == "" && user.FullName == "" {
+		return user, fmt.Errorf("email and/or full_name fields need to be set in the user object")
+	}
+
+	// Empty fields keep their current value
+	err := m.conn().QueryRowContext(ctx, `UPDATE users SET email = COALESCE(NULLIF(?, ''), email), full_name = COALESCE(NULLIF(?, ''), full_name)
+		WHERE logon_name = ? RETURNING user_id, logon_name, full_name, email`, user.Email, user.FullName, user.LogonName).Scan(&user.UserID, &user.LogonName, &user.FullName, &user.Email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return user, ErrUserNotFound
+	}
+	if err != nil {
+		return user, fmt.Errorf("updating record: %v", err)
+	}
+	return user, nil
+}
+
+// SQLiteIdempotencyModel keeps idempotency keys in the same SQLite database as a SQLiteUserModel
+type SQLiteIdempotencyModel struct {
+	DB *sql.DB
+}
+
+// reserveIdempotencyKey claims key for a new request, taking over any existing record which has expired.
+// If the key is still held then the existing record is returned instead
+func (m *SQLiteIdempotencyModel) reserveIdempotencyKey(ctx context.Context, key, fingerprint string, ttl time.Duration) (idempotencyRecord, bool, error) {
+	var record idempotencyRecord
+	var returnedKey string
+	now := time.Now().UnixMilli()
+
+	err := m.DB.QueryRowContext(ctx, `INSERT INTO idempotency_keys(idempotency_key, fingerprint, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (idempotency_key) DO UPDATE SET fingerprint = excluded.fingerprint, status_code = NULL, content_type = NULL, response_body = NULL, expires_at = excluded.expires_at
+		WHERE idempotency_keys.expires_at < ?
+		RETURNING idempotency_key`, key, fingerprint, now+ttl.Milliseconds(), now).Scan(&returnedKey)
+	if err == nil {
+		return record, true, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return record, false, fmt.Errorf("inserting idempotency key '%s': %v", key, err)
+	}
+
+	var statusCode sql.NullInt64
+	var contentType sql.NullString
+	err = m.DB.QueryRowContext(ctx, `SELECT fingerprint, status_code, content_type, response_body FROM idempotency_keys WHERE idempotency_key = ?`, key).
+		Scan(&record.fingerprint, &statusCode, &contentType, &record.body)
+	if err != nil {
+		return record, false, fmt.Errorf("querying idempotency key '%s': %v", key, err)
+	}
+	record.completed = statusCode.Valid
+	record.statusCode = int(statusCode.Int64)
+	record.contentType = contentType.String
+
+	return record, false, nil
+}
+
+// completeIdempotencyKey stores the response for key
+func (m *SQLiteIdempotencyModel) completeIdempotencyKey(ctx context.Context, key string, record idempotencyRecord) error {
+	_, err := m.DB.ExecContext(ctx, `UPDATE idempotency_keys SET status_code = ?, content_type = ?, response_body = ? WHERE idempotency_key = ?`,
+		record.statusCode, record.contentType, record.body, key)
+	if err != nil {
+		return fmt.Errorf("updating idempotency key '%s': %v", key, err)
+	}
+	return nil
+}
+
+// releaseIdempotencyKey deletes key so that the request can be retried
+func (m *SQLiteIdempotencyModel) releaseIdempotencyKey(ctx context.Context, key string) error {
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE idempotency_key = ?`, key)
+	if err != nil {
+		return fmt.Errorf("deleting idempotency key '%s': %v", key, err)
+	}
+	return nil
+}
+
+// deleteExpiredIdempotencyKeys deletes up to limit keys which have expired
+func (m *SQLiteIdempotencyModel) deleteExpiredIdempotencyKeys(ctx context.Context, limit int) (int, error) {
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE idempotency_key IN
+		(SELECT idempotency_key FROM idempotency_keys WHERE expires_at < ? LIMIT ?)`, time.Now().UnixMilli(), limit)
+	if err != nil {
+		return 0, fmt.Errorf("deleting expired idempotency keys: %v", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("counting deleted idempotency keys: %v", err)
+	}
+	return int(deleted), nil
+}
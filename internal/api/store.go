@@ -0,0 +1,57 @@
+package api
+
+import (
+	"fmt"
+)
+
+// Storage backends selectable with storage.backend
+const (
+	BackendPostgres = "postgres"
+	BackendSQLite   = "sqlite"
+	BackendMemory   = "memory"
+)
+
+const defaultSQLitePath = "user-mgmt.db"
+
+// OpenDBConnection sets up the *Env using the storage backend selected by cfg.Storage.Backend.
+// Every backend stores idempotency keys. User events, webhooks and the change feed all depend on Postgres, so are not
+// available with the sqlite or memory backends
+func OpenDBConnection(cfg Config) (*Env, error) {
+	validator, err := NewUserValidator(cfg.Validation)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cfg.Storage.Backend {
+	case BackendPostgres:
+		env, err := openPostgresEnv(cfg)
+		if err != nil {
+			return nil, err
+		}
+		env.Validator = validator
+		return env, nil
+
+	case BackendSQLite:
+		store, err := OpenSQLiteUserModel(cfg.Storage.SQLitePath)
+		if err != nil {
+			return nil, err
+		}
+		EnvConfig = &Env{Config: cfg, Metrics: NewMetrics(store.DB), Validator: validator}
+		EnvConfig.UsersDB = EnvConfig.Metrics.instrumentStore(withQueryTimeouts(store, cfg.QueryTimeouts))
+		EnvConfig.enableCache(cfg.Cache)
+		EnvConfig.Idempotency = &SQLiteIdempotencyModel{DB: store.DB}
+		EnvConfig.IdempotencyKeyTTL = cfg.Idempotency.KeyTTL
+		return EnvConfig, nil
+
+	case BackendMemory:
+		EnvConfig = &Env{Config: cfg, Metrics: NewMetrics(nil), Validator: validator}
+		EnvConfig.UsersDB = EnvConfig.Metrics.instrumentStore(withQueryTimeouts(NewMemoryUserModel(), cfg.QueryTimeouts))
+		EnvConfig.enableCache(cfg.Cache)
+		EnvConfig.Idempotency = NewMemoryIdempotencyStore()
+		EnvConfig.IdempotencyKeyTTL = cfg.Idempotency.KeyTTL
+		return EnvConfig, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported storage backend '%s'. Must be one of: %s, %s or %s", cfg.Storage.Backend, BackendPostgres, BackendSQLite, BackendMemory)
+	}
+}
@@ -0,0 +1,257 @@
+//go:build integration
+
+package api
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+// postgresTestCredentials reads the same database_* envars as the service, skipping the test if they aren't set
+func postgresTestCredentials(tb testing.TB) DBCredentials {
+	if os.Getenv("database_host_name") == "" {
+		tb.Skip("database_host_name not set")
+	}
+	port, err := strconv.ParseInt(os.Getenv("database_port"), 10, 64)
+	if err != nil {
+		tb.Fatalf("parsing database_port: %v", err)
+	}
+	return DBCredentials{
+		HostName:   os.Getenv("database_host_name"),
+		Port:       port,
+		DBName:     os.Getenv("database_name"),
+		DBUsername: os.Getenv("database_username"),
+		DBPassword: os.Getenv("database_password"),
+		SSLMode:    os.Getenv("database_ssl_mode"),
+	}
+}
+
+// openPostgresTestDB opens the database from the same database_* envars as the service, skipping the test if they aren't set
+func openPostgresTestDB(tb testing.TB) *sql.DB {
+	db, err := sql.Open("postgres", postgresTestCredentials(tb).connectionString())
+	if err != nil {
+		tb.Fatalf("opening DB connection: %v", err)
+	}
+	tb.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+// TestPostgresUserStoreConformance tests UserModel against the UserStore conformance suite. It empties the users & user_events
+// tables before every test, so must only be pointed at a disposable database
+func TestPostgresUserStoreConformance(t *testing.T) {
+	db := openPostgresTestDB(t)
+	testUserStoreConformance(t, func(t *testing.T) UserStore {
+		if _, err := db.Exec(`TRUNCATE users, user_events RESTART IDENTITY CASCADE`); err != nil {
+			t.Fatalf("emptying users table: %v", err)
+		}
+		return &UserModel{DB: db}
+	})
+}
+
+// TestPostgresApproximateUserCount tests that the total is estimated from the table statistics for large tables, and is exact
+// on the last page. It replaces the contents of the users table
+func TestPostgresApproximateUserCount(t *testing.T) {
+	ctx := context.Background()
+	db := openPostgresTestDB(t)
+	if _, err := db.Exec(`TRUNCATE users, user_events RESTART IDENTITY CASCADE`); err != nil {
+		t.Fatalf("emptying users table: %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO users (logon_name, full_name, email)
+		SELECT 'user' || i, 'User ' || i, 'user' || i || '@email.com' FROM generate_series(1, 100) AS i`); err != nil {
+		t.Fatalf("seeding users table: %v", err)
+	}
+	if _, err := db.Exec(`ANALYZE users`); err != nil {
+		t.Fatalf("analysing users table: %v", err)
+	}
+	model := &UserModel{DB: db, ApproximateCountAbove: 50}
+
+	page, err := model.QueryUsers(ctx, 0, 10, "")
+	assert.NoError(t, err)
+	assert.Len(t, page.Users, 10)
+	assert.True(t, page.Approximate)
+	assert.Equal(t, 100, page.Total)
+
+	page, err = model.QueryUsers(ctx, 95, 10, "")
+	assert.NoError(t, err)
+	assert.Len(t, page.Users, 5)
+	assert.Equal(t, UsersPage{Users: page.Users, Total: 100}, page)
+
+	// Filtered totals are always counted
+	page, err = model.QueryUsers(ctx, 0, 10, "User 1")
+	assert.NoError(t, err)
+	assert.False(t, page.Approximate)
+	assert.Equal(t, 12, page.Total) // User 1, 10-19 & 100
+
+	model.ApproximateCountAbove = 1000
+	page, err = model.QueryUsers(ctx, 0, 10, "")
+	assert.NoError(t, err)
+	assert.False(t, page.Approximate)
+}
+
+// TestPostgresProcessOutbox tests that the relay lock is held whilst a batch is published, and that the published events
+// are marked. It empties the users & user_events tables
+func TestPostgresProcessOutbox(t *testing.T) {
+	ctx := context.Background()
+	db := openPostgresTestDB(t)
+	if _, err := db.Exec(`TRUNCATE users, user_events RESTART IDENTITY CASCADE`); err != nil {
+		t.Fatalf("emptying users table: %v", err)
+	}
+	model := &UserModel{DB: db}
+	_, err := model.AddUser(ctx, User{LogonName: "mark9", FullName: "mark", Email: "mark@email.com"})
+	assert.NoError(t, err)
+
+	published, err := model.processOutbox(ctx, 10, nil, func(events []UserEvent) []int64 {
+		// Another relay can't take the lock whilst this batch is being published
+		concurrent, err := model.processOutbox(ctx, 10, nil, func([]UserEvent) []int64 {
+			t.Error("the outbox lock should be held whilst publishing")
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 0, concurrent)
+
+		ids := make([]int64, 0, len(events))
+		for _, event := range events {
+			ids = append(ids, event.EventID)
+		}
+		return ids
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, published)
+
+	published, err = model.processOutbox(ctx, 10, nil, func(events []UserEvent) []int64 {
+		assert.Empty(t, events)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, published)
+}
+
+// TestPostgresChangeFeedCommitOrder tests that an event which commits after a later event has already been read is still
+// returned to a reader resuming from that later event. It empties the users & user_events tables
+func TestPostgresChangeFeedCommitOrder(t *testing.T) {
+	ctx := context.Background()
+	db := openPostgresTestDB(t)
+	if _, err := db.Exec(`TRUNCATE users, user_events RESTART IDENTITY CASCADE`); err != nil {
+		t.Fatalf("emptying users table: %v", err)
+	}
+	model := &UserModel{DB: db}
+
+	// The first transaction takes the lower event_id, but commits after the second
+	first, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("starting transaction: %v", err)
+	}
+	defer func() { _ = first.Rollback() }()
+	_, err = (&UserModel{DB: db, tx: first}).AddUser(ctx, User{LogonName: "mark9", FullName: "mark", Email: "mark@email.com"})
+	assert.NoError(t, err)
+
+	_, err = model.AddUser(ctx, User{LogonName: "sally1", FullName: "sally", Email: "sally@email.com"})
+	assert.NoError(t, err)
+
+	assert.NoError(t, sequenceEvents(ctx, model.conn()))
+	events, err := model.queryEventsSince(ctx, 0, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, "sally1", events[0].LogonName)
+		assert.Equal(t, int64(2), events[0].EventID)
+	}
+	latest, err := model.latestPosition(ctx)
+	assert.NoError(t, err)
+
+	if err = first.Commit(); err != nil {
+		t.Fatalf("committing transaction: %v", err)
+	}
+	events, err = model.queryEventsSince(ctx, latest, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, events, "events are only read once they have a position")
+
+	assert.NoError(t, sequenceEvents(ctx, model.conn()))
+	events, err = model.queryEventsSince(ctx, latest, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, "mark9", events[0].LogonName)
+		assert.Equal(t, int64(1), events[0].EventID)
+		assert.Greater(t, events[0].Position, latest)
+	}
+}
+
+// TestPostgresSequencerLock tests that only one sequencer runs at a time, and that it announces the positions it assigns
+func TestPostgresSequencerLock(t *testing.T) {
+	db := openPostgresTestDB(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	model := &UserModel{DB: db}
+
+	listener := pq.NewListener(postgresTestCredentials(t).connectionString(), time.Second, time.Second, nil)
+	defer func() { _ = listener.Close() }()
+	if err := listener.Listen(changeFeedSequencedChannel); err != nil {
+		t.Fatalf("listening on %s: %v", changeFeedSequencedChannel, err)
+	}
+
+	wake := make(chan struct{}, 1)
+	running := make(chan error, 1)
+	go func() { running <- model.runSequencer(ctx, wake) }()
+	time.Sleep(time.Millisecond * 200)
+
+	// Another sequencer returns straight away whilst the first holds the lock
+	assert.NoError(t, model.runSequencer(context.Background(), make(chan struct{})))
+
+	_, err := model.AddUser(ctx, User{LogonName: "seq1", FullName: "seq", Email: "seq@email.com"})
+	assert.NoError(t, err)
+	wake <- struct{}{}
+	select {
+	case notification := <-listener.Notify:
+		assert.Equal(t, changeFeedSequencedChannel, notification.Channel)
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for the sequencer's notification")
+	}
+
+	cancel()
+	assert.NoError(t, <-running)
+}
+
+// TestPostgresDeleteExpiredIdempotencyKeys tests that only expired idempotency keys are deleted, up to the limit
+func TestPostgresDeleteExpiredIdempotencyKeys(t *testing.T) {
+	db := openPostgresTestDB(t)
+	ctx := context.Background()
+	store := &IdempotencyModel{DB: db}
+	t.Cleanup(func() {
+		_, _ = db.Exec(`DELETE FROM idempotency_keys WHERE idempotency_key LIKE 'sweep-%'`)
+	})
+
+	for _, key := range []string{"sweep-1", "sweep-2", "sweep-3"} {
+		_, reserved, err := store.reserveIdempotencyKey(ctx, key, "fingerprint", time.Millisecond)
+		assert.NoError(t, err)
+		assert.True(t, reserved)
+	}
+	_, _, err := store.reserveIdempotencyKey(ctx, "sweep-live", "fingerprint", time.Minute)
+	assert.NoError(t, err)
+	time.Sleep(time.Millisecond * 5)
+
+	deleted, err := store.deleteExpiredIdempotencyKeys(ctx, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+	deleted, err = store.deleteExpiredIdempotencyKeys(ctx, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+
+	var remaining []string
+	rows, err := db.Query(`SELECT idempotency_key FROM idempotency_keys WHERE idempotency_key LIKE 'sweep-%'`)
+	if err != nil {
+		t.Fatalf("querying idempotency keys: %v", err)
+	}
+	defer func() { _ = rows.Close() }()
+	for rows.Next() {
+		var key string
+		assert.NoError(t, rows.Scan(&key))
+		remaining = append(remaining, key)
+	}
+	assert.Equal(t, []string{"sweep-live"}, remaining)
+}
@@ -0,0 +1,329 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var conformanceUsers = []User{
+	{LogonName: "mark9", FullName: "Mark Smith", Email: "mark@email.com"},
+	{LogonName: "bob44", FullName: "Bob Jones", Email: "bob@email.com"},
+	{LogonName: "bobby8", FullName: "Bobby Jones, jr", Email: "bobby@email.com"},
+}
+
+// withoutLastModified clears page.LastModified, which depends on when the test ran
+func withoutLastModified(page UsersPage) UsersPage {
+	page.LastModified = time.Time{}
+	return page
+}
+
+// testUserStoreConformance checks the behaviour which every UserStore implementation must share. newStore must return an empty store
+func testUserStoreConformance(t *testing.T, newStore func(t *testing.T) UserStore) {
+	ctx := context.Background()
+
+	// seededStore returns a store containing conformanceUsers, added in order
+	seededStore := func(t *testing.T) (UserStore, []User) {
+		store := newStore(t)
+		added := make([]User, 0, len(conformanceUsers))
+		for _, user := range conformanceUsers {
+			user, err := store.AddUser(ctx, user)
+			if err != nil {
+				t.Fatalf("adding user '%s': %v", user.LogonName, err)
+			}
+			added = append(added, user)
+		}
+		return store, added
+	}
+
+	t.Run("AddUser", func(t *testing.T) {
+		store, added := seededStore(t)
+		assert.Greater(t, added[0].UserID, 0)
+		assert.Greater(t, added[1].UserID, added[0].UserID)
+		assert.Greater(t, added[2].UserID, added[1].UserID)
+		assert.Equal(t, conformanceUsers[0].Email, added[0].Email)
+
+		_, err := store.AddUser(ctx, User{LogonName: "mark9", FullName: "Another Mark", Email: "mark2@email.com"})
+		assert.True(t, errors.Is(err, ErrLogonNameTaken))
+		count, _ := store.QueryRecordCount(ctx, "", "")
+		assert.Equal(t, 3, count)
+	})
+
+	t.Run("QueryRecordCount", func(t *testing.T) {
+		store, _ := seededStore(t)
+		tests := []struct {
+			nameFilter, logonNameFilter string
+			expected                    int
+		}{
+			{"", "", 3},
+			{"Jones", "", 2},
+			{"jones", "", 0}, // filters are case-sensitive
+			{"", "bob44", 1},
+			{"", "bob", 0},
+		}
+		for _, test := range tests {
+			count, err := store.QueryRecordCount(ctx, test.nameFilter, test.logonNameFilter)
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, count, "nameFilter '%s', logonNameFilter '%s'", test.nameFilter, test.logonNameFilter)
+		}
+
+		_, err := store.QueryRecordCount(ctx, "Jones", "bob44")
+		assert.Error(t, err)
+	})
+
+	t.Run("QueryUsers", func(t *testing.T) {
+		store, added := seededStore(t)
+
+		page, err := store.QueryUsers(ctx, 0, 2, "")
+		assert.NoError(t, err)
+		assert.Equal(t, UsersPage{Users: added[:2], Total: 3}, withoutLastModified(page))
+
+		page, err = store.QueryUsers(ctx, 2, 2, "")
+		assert.NoError(t, err)
+		assert.Equal(t, UsersPage{Users: added[2:], Total: 3}, withoutLastModified(page))
+
+		page, err = store.QueryUsers(ctx, 1, 5, "Jones")
+		assert.NoError(t, err)
+		assert.Equal(t, UsersPage{Users: added[2:], Total: 2}, withoutLastModified(page))
+
+		// The total is still returned for a page past the end
+		page, err = store.QueryUsers(ctx, 10, 5, "")
+		assert.NoError(t, err)
+		assert.NotNil(t, page.Users)
+		assert.Empty(t, page.Users)
+		assert.Equal(t, 3, page.Total)
+
+		page, err = store.QueryUsers(ctx, 0, 5, "Nobody")
+		assert.NoError(t, err)
+		assert.Equal(t, UsersPage{Users: []User{}, Total: 0}, withoutLastModified(page))
+	})
+
+	t.Run("LastModified", func(t *testing.T) {
+		store, _ := seededStore(t)
+
+		page, err := store.QueryUsers(ctx, 0, 5, "")
+		assert.NoError(t, err)
+		lastModified := page.LastModified
+		if lastModified.IsZero() {
+			t.Skip("the store doesn't report when users were last modified")
+		}
+
+		// Deleting a user has to move it on too, even though the user is no longer there
+		for _, write := range []func() error{
+			func() error {
+				_, err := store.AddUser(ctx, User{LogonName: "alice1", FullName: "Alice", Email: "alice@email.com"})
+				return err
+			},
+			func() error {
+				_, err := store.UpdateUser(ctx, User{LogonName: "alice1", Email: "alice@new.com"})
+				return err
+			},
+			func() error { return store.DeleteUser(ctx, "alice1") },
+		} {
+			time.Sleep(time.Millisecond * 5)
+			assert.NoError(t, write())
+			page, err = store.SearchUsers(ctx, "bob", 0, 0, 5)
+			assert.NoError(t, err)
+			assert.True(t, page.LastModified.After(lastModified), "%s should be after %s", page.LastModified, lastModified)
+			lastModified = page.LastModified
+		}
+	})
+
+	t.Run("GetUser", func(t *testing.T) {
+		store, added := seededStore(t)
+
+		user, err := store.GetUser(ctx, "bob44")
+		assert.NoError(t, err)
+		assert.Equal(t, added[1], user)
+
+		_, err = store.GetUser(ctx, "unknown")
+		assert.True(t, errors.Is(err, ErrUserNotFound))
+	})
+
+	t.Run("SearchUsers", func(t *testing.T) {
+		store, added := seededStore(t)
+
+		// Case insensitive, with exact words ranked above partial ones
+		page, err := store.SearchUsers(ctx, "BOB", 0, 0, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, UsersPage{Users: []User{added[1], added[2]}, Total: 2}, withoutLastModified(page))
+
+		page, err = store.SearchUsers(ctx, "bob", 0.9, 0, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, []User{added[1]}, page.Users)
+
+		// Accent insensitive, across every field
+		page, err = store.SearchUsers(ctx, "Jönes", 0, 1, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, UsersPage{Users: []User{added[2]}, Total: 2}, withoutLastModified(page))
+
+		page, err = store.SearchUsers(ctx, "mark@email", 0, 0, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, []User{added[0]}, page.Users)
+
+		// Close words match without being contained
+		page, err = store.SearchUsers(ctx, "smithh", 0, 0, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, []User{added[0]}, page.Users)
+
+		// LIKE wildcards are matched literally
+		page, err = store.SearchUsers(ctx, "%", 0, 0, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, UsersPage{Users: []User{}, Total: 0}, withoutLastModified(page))
+
+		page, err = store.SearchUsers(ctx, "bob", 0, 10, 10)
+		assert.NoError(t, err)
+		assert.Empty(t, page.Users)
+		assert.Equal(t, 2, page.Total)
+	})
+
+	t.Run("StreamUsers", func(t *testing.T) {
+		store, added := seededStore(t)
+
+		var streamed []User
+		err := store.StreamUsers(ctx, "Jones", func(user User) error {
+			streamed = append(streamed, user)
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, added[1:], streamed)
+
+		stop := errors.New("stop")
+		calls := 0
+		err = store.StreamUsers(ctx, "", func(User) error {
+			calls++
+			return stop
+		})
+		assert.True(t, errors.Is(err, stop))
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("UpdateUser", func(t *testing.T) {
+		store, added := seededStore(t)
+
+		updated, err := store.UpdateUser(ctx, User{LogonName: "mark9", Email: "mark.smith@email.com"})
+		assert.NoError(t, err)
+		assert.Equal(t, User{UserID: added[0].UserID, LogonName: "mark9", FullName: "Mark Smith", Email: "mark.smith@email.com"}, updated)
+
+		updated, err = store.UpdateUser(ctx, User{LogonName: "mark9", FullName: "Mark Smith-Jones"})
+		assert.NoError(t, err)
+		assert.Equal(t, "mark.smith@email.com", updated.Email)
+		assert.Equal(t, "Mark Smith-Jones", updated.FullName)
+
+		updated, err = store.UpdateUser(ctx, User{LogonName: "bob44", FullName: "Robert Jones", Email: "robert@email.com"})
+		assert.NoError(t, err)
+		assert.Equal(t, User{UserID: added[1].UserID, LogonName: "bob44", FullName: "Robert Jones", Email: "robert@email.com"}, updated)
+
+		page, _ := store.QueryUsers(ctx, 0, 1, "Robert")
+		assert.Equal(t, []User{updated}, page.Users)
+
+		_, err = store.UpdateUser(ctx, User{LogonName: "unknown", Email: "unknown@email.com"})
+		assert.True(t, errors.Is(err, ErrUserNotFound))
+
+		_, err = store.UpdateUser(ctx, User{LogonName: "mark9"})
+		assert.Error(t, err)
+	})
+
+	t.Run("DeleteUser", func(t *testing.T) {
+		store, _ := seededStore(t)
+
+		assert.NoError(t, store.DeleteUser(ctx, "bob44"))
+		count, _ := store.QueryRecordCount(ctx, "", "bob44")
+		assert.Equal(t, 0, count)
+
+		assert.True(t, errors.Is(store.DeleteUser(ctx, "bob44"), ErrUserNotFound))
+		count, _ = store.QueryRecordCount(ctx, "", "")
+		assert.Equal(t, 2, count)
+	})
+
+	t.Run("WithTxCommit", func(t *testing.T) {
+		store, _ := seededStore(t)
+
+		err := store.WithTx(ctx, func(tx UserStore) error {
+			if _, err := tx.AddUser(ctx, User{LogonName: "alice1", FullName: "Alice", Email: "alice@email.com"}); err != nil {
+				return err
+			}
+			// Changes are visible within the transaction straight away
+			if count, err := tx.QueryRecordCount(ctx, "", "alice1"); err != nil || count != 1 {
+				return fmt.Errorf("expected alice1 within the transaction. count %d: %v", count, err)
+			}
+			return tx.DeleteUser(ctx, "mark9")
+		})
+		assert.NoError(t, err)
+
+		count, _ := store.QueryRecordCount(ctx, "", "alice1")
+		assert.Equal(t, 1, count)
+		count, _ = store.QueryRecordCount(ctx, "", "mark9")
+		assert.Equal(t, 0, count)
+	})
+
+	t.Run("WithTxRollback", func(t *testing.T) {
+		store, added := seededStore(t)
+
+		err := store.WithTx(ctx, func(tx UserStore) error {
+			if _, err := tx.AddUser(ctx, User{LogonName: "alice1", FullName: "Alice", Email: "alice@email.com"}); err != nil {
+				return err
+			}
+			if _, err := tx.UpdateUser(ctx, User{LogonName: "bob44", Email: "robert@email.com"}); err != nil {
+				return err
+			}
+			return tx.DeleteUser(ctx, "unknown")
+		})
+		assert.True(t, errors.Is(err, ErrUserNotFound))
+
+		page, _ := store.QueryUsers(ctx, 0, 10, "")
+		assert.Equal(t, added, page.Users)
+	})
+
+	t.Run("ConcurrentAddUser", func(t *testing.T) {
+		store := newStore(t)
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 5)
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := store.AddUser(ctx, User{LogonName: "alice1", FullName: "Alice", Email: "alice@email.com"})
+				errs <- err
+			}()
+		}
+		wg.Wait()
+		close(errs)
+
+		succeeded := 0
+		for err := range errs {
+			if err == nil {
+				succeeded++
+			} else {
+				assert.True(t, errors.Is(err, ErrLogonNameTaken), "unexpected error: %v", err)
+			}
+		}
+		assert.Equal(t, 1, succeeded)
+	})
+}
+
+// TestMemoryUserStoreConformance tests MemoryUserModel against the UserStore conformance suite
+func TestMemoryUserStoreConformance(t *testing.T) {
+	testUserStoreConformance(t, func(*testing.T) UserStore {
+		return NewMemoryUserModel()
+	})
+}
+
+// TestSQLiteUserStoreConformance tests SQLiteUserModel against the UserStore conformance suite, using a new database file per test
+func TestSQLiteUserStoreConformance(t *testing.T) {
+	testUserStoreConformance(t, func(t *testing.T) UserStore {
+		store, err := OpenSQLiteUserModel(filepath.Join(t.TempDir(), "users.db"))
+		if err != nil {
+			t.Fatalf("opening SQLite store: %v", err)
+		}
+		t.Cleanup(func() { _ = store.DB.Close() })
+		return store
+	})
+}
@@ -0,0 +1,154 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const defaultQueryTimeout = time.Second * 5
+
+var (
+	// errQueryTimeout is returned when a database call takes longer than its configured timeout
+	errQueryTimeout = errors.New("database query timed out")
+	// errQueryCancelled is returned when a database call is abandoned because the client went away or the server is shutting down
+	errQueryCancelled = errors.New("database query cancelled")
+)
+
+// QueryTimeouts is the maximum duration of each users store operation. A zero duration means no timeout
+type QueryTimeouts struct {
+	Count  time.Duration `yaml:"count"`
+	List   time.Duration `yaml:"list"`
+	Export time.Duration `yaml:"export"`
+	Add    time.Duration `yaml:"add"`
+	Update time.Duration `yaml:"update"`
+	Delete time.Duration `yaml:"delete"`
+}
+
+// timeoutUsersStore applies the configured timeout to each call to the wrapped UserStore
+type timeoutUsersStore struct {
+	next     UserStore
+	timeouts QueryTimeouts
+}
+
+// withQueryTimeouts wraps store so that each call is cancelled once it exceeds its timeout
+func withQueryTimeouts(store UserStore, timeouts QueryTimeouts) UserStore {
+	return &timeoutUsersStore{next: store, timeouts: timeouts}
+}
+
+// runWithTimeout calls fn with a context which is cancelled after timeout, translating any resulting error into errQueryTimeout
+// or errQueryCancelled so that handlers can respond with the appropriate status code
+func runWithTimeout(ctx context.Context, operation string, timeout time.Duration, fn func(context.Context) error) error {
+	callCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		callCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	err := fn(callCtx)
+	switch {
+	case err == nil:
+		return nil
+	case ctx.Err() != nil:
+		return fmt.Errorf("%w: %s: %v", errQueryCancelled, operation, err)
+	case callCtx.Err() != nil:
+		return fmt.Errorf("%w: %s exceeded %s: %v", errQueryTimeout, operation, timeout, err)
+	}
+	return err
+}
+
+func (s *timeoutUsersStore) QueryRecordCount(ctx context.Context, nameFilter, logonNameFilter string) (count int, err error) {
+	err = runWithTimeout(ctx, "queryRecordCount", s.timeouts.Count, func(ctx context.Context) error {
+		count, err = s.next.QueryRecordCount(ctx, nameFilter, logonNameFilter)
+		return err
+	})
+	return count, err
+}
+
+func (s *timeoutUsersStore) QueryUsers(ctx context.Context, offset, limit int, nameFilter string) (page UsersPage, err error) {
+	err = runWithTimeout(ctx, "queryUsers", s.timeouts.List, func(ctx context.Context) error {
+		page, err = s.next.QueryUsers(ctx, offset, limit, nameFilter)
+		return err
+	})
+	return page, err
+}
+
+// GetUser shares the count timeout, as both look up a single logon_name
+func (s *timeoutUsersStore) GetUser(ctx context.Context, logonName string) (user User, err error) {
+	err = runWithTimeout(ctx, "getUser", s.timeouts.Count, func(ctx context.Context) error {
+		user, err = s.next.GetUser(ctx, logonName)
+		return err
+	})
+	return user, err
+}
+
+// SearchUsers shares the list timeout, as it serves the same endpoint
+func (s *timeoutUsersStore) SearchUsers(ctx context.Context, query string, minScore float64, offset, limit int) (page UsersPage, err error) {
+	err = runWithTimeout(ctx, "searchUsers", s.timeouts.List, func(ctx context.Context) error {
+		page, err = s.next.SearchUsers(ctx, query, minScore, offset, limit)
+		return err
+	})
+	return page, err
+}
+
+func (s *timeoutUsersStore) StreamUsers(ctx context.Context, nameFilter string, fn func(User) error) error {
+	return runWithTimeout(ctx, "streamUsers", s.timeouts.Export, func(ctx context.Context) error {
+		return s.next.StreamUsers(ctx, nameFilter, fn)
+	})
+}
+
+func (s *timeoutUsersStore) AddUser(ctx context.Context, user User) (added User, err error) {
+	err = runWithTimeout(ctx, "addUser", s.timeouts.Add, func(ctx context.Context) error {
+		added, err = s.next.AddUser(ctx, user)
+		return err
+	})
+	return added, err
+}
+
+func (s *timeoutUsersStore) DeleteUser(ctx context.Context, logonName string) error {
+	return runWithTimeout(ctx, "deleteUser", s.timeouts.Delete, func(ctx context.Context) error {
+		return s.next.DeleteUser(ctx, logonName)
+	})
+}
+
+func (s *timeoutUsersStore) UpdateUser(ctx context.Context, user User) (updated User, err error) {
+	err = runWithTimeout(ctx, "updateUser", s.timeouts.Update, func(ctx context.Context) error {
+		updated, err = s.next.UpdateUser(ctx, user)
+		return err
+	})
+	return updated, err
+}
+
+// WithTx has no timeout of its own, as each operation within the transaction has one
+func (s *timeoutUsersStore) WithTx(ctx context.Context, fn func(UserStore) error) error {
+	return s.next.WithTx(ctx, func(tx UserStore) error {
+		return fn(withQueryTimeouts(tx, s.timeouts))
+	})
+}
+
+// databaseErrorStatus returns the HTTP status code to respond with when a database call fails: 504 if it timed out,
+// 503 if it was cancelled or the database is unavailable, otherwise defaultCode
+func databaseErrorStatus(err error, defaultCode int) int {
+	switch {
+	case errors.Is(err, errQueryTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, errQueryCancelled), errors.Is(err, errDatabaseUnavailable):
+		return http.StatusServiceUnavailable
+	}
+	return defaultCode
+}
+
+// databaseErrorResponseWriter writes the error response for a failed database call, using the status code from
+// databaseErrorStatus. If the database is unavailable the Retry-After header tells clients when to try again
+func databaseErrorResponseWriter(w http.ResponseWriter, r *http.Request, err error, defaultCode int, message string) {
+	var unavailable *unavailableError
+	if errors.As(err, &unavailable) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(unavailable.retryAfter.Seconds())))
+	}
+	statusCode := databaseErrorStatus(err, defaultCode)
+	jsonHTTPErrorResponseWriter(w, r, statusCode, databaseErrorCode(statusCode, CodeInternalError), message)
+}
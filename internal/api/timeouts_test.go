@@ -0,0 +1,108 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// slowUsersStore is used to mock a database which is too slow to respond. Listing, adding and deleting users block until their context is done
+type slowUsersStore struct {
+	UserStore
+}
+
+func newSlowUsersStore() *slowUsersStore {
+	return &slowUsersStore{UserStore: newTestMemoryStore()}
+}
+
+func (s *slowUsersStore) QueryUsers(ctx context.Context, _, _ int, _ string) (UsersPage, error) {
+	<-ctx.Done()
+	return UsersPage{}, ctx.Err()
+}
+
+func (s *slowUsersStore) QueryRecordCount(ctx context.Context, _, _ string) (int, error) {
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+func (s *slowUsersStore) AddUser(ctx context.Context, user User) (User, error) {
+	<-ctx.Done()
+	return user, ctx.Err()
+}
+
+func (s *slowUsersStore) DeleteUser(ctx context.Context, _ string) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (s *slowUsersStore) WithTx(_ context.Context, fn func(UserStore) error) error {
+	return fn(s)
+}
+
+var testQueryTimeouts = QueryTimeouts{Count: time.Millisecond * 20, List: time.Millisecond * 20, Add: time.Millisecond * 20, Update: time.Millisecond * 20, Delete: time.Millisecond * 20}
+
+// TestQueryTimeoutResponse tests that a query which exceeds its timeout is cancelled and returned as a 504
+func TestQueryTimeoutResponse(t *testing.T) {
+	env := &Env{UsersDB: withQueryTimeouts(newSlowUsersStore(), testQueryTimeouts)}
+	router := mux.NewRouter()
+	router.HandleFunc("/users/{logon_name}", env.deleteUser).Methods("DELETE")
+	router.HandleFunc("/users", env.listUsers).Methods("GET")
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest("DELETE", "/users/mark9", nil),
+		httptest.NewRequest("GET", "/users", nil),
+	} {
+		start := time.Now()
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+
+		assert.Equal(t, 504, recorder.Code)
+		assert.Less(t, time.Since(start), time.Second)
+		var resp Problem
+		if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+			t.Fatal("unable to unmarshal JSON response")
+		}
+		assert.Equal(t, CodeDatabaseTimeout, resp.Code)
+	}
+}
+
+// TestQueryCancelledResponse tests that a query abandoned because the request context was cancelled is returned as a 503
+func TestQueryCancelledResponse(t *testing.T) {
+	env := &Env{UsersDB: withQueryTimeouts(newSlowUsersStore(), QueryTimeouts{})}
+	router := mux.NewRouter()
+	router.HandleFunc("/users/{logon_name}", env.deleteUser).Methods("DELETE")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*20, cancel)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("DELETE", "/users/mark9", nil).WithContext(ctx))
+
+	assert.Equal(t, 503, recorder.Code)
+}
+
+// TestQueryTimeoutsInTransaction tests that operations within a transaction still have their own timeout
+func TestQueryTimeoutsInTransaction(t *testing.T) {
+	store := withQueryTimeouts(newSlowUsersStore(), testQueryTimeouts)
+
+	err := store.WithTx(context.Background(), func(tx UserStore) error {
+		_, err := tx.AddUser(context.Background(), User{LogonName: "mark9"})
+		return err
+	})
+
+	assert.True(t, errors.Is(err, errQueryTimeout))
+}
+
+// TestDatabaseErrorStatus tests the mapping of database errors to HTTP status codes
+func TestDatabaseErrorStatus(t *testing.T) {
+	assert.Equal(t, 504, databaseErrorStatus(errQueryTimeout, 500))
+	assert.Equal(t, 503, databaseErrorStatus(errQueryCancelled, 500))
+	assert.Equal(t, 500, databaseErrorStatus(errors.New("connection refused"), 500))
+	assert.Equal(t, 400, databaseErrorStatus(errors.New("connection refused"), 400))
+}
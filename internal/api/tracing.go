@@ -0,0 +1,190 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracingExporterNone   = "none"
+	tracingExporterStdout = "stdout"
+	tracingExporterOTLP   = "otlp"
+
+	tracerName = "github.com/michaelprice232/user-mgmt-service-api/internal/api"
+)
+
+var (
+	sqlStringLiteral  = regexp.MustCompile(`'(?:[^']|'')*'`)
+	sqlNumericLiteral = regexp.MustCompile(`\$?\b\d+(?:\.\d+)?\b`)
+	sqlWhitespace     = regexp.MustCompile(`\s+`)
+	sqlTableName      = regexp.MustCompile(`(?i)\b(?:FROM|INTO|UPDATE)\s+([a-z_][a-z0-9_]*)`)
+)
+
+// tracer returns the tracer used for all spans. Fetched on each use so that spans go to whichever provider InitTracing installed
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// InitTracing installs the global OpenTelemetry tracer provider using exporterType (none, stdout or otlp).
+// The OTLP exporter and the sampler are configured using the standard OTEL_* envars. The returned function flushes any
+// remaining spans and must be called before exiting
+func InitTracing(ctx context.Context, exporterType, version string) (func(context.Context) error, error) {
+	// Always propagate W3C trace context so that traces pass through this service even when it doesn't export its own spans
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	log.AddHook(traceContextHook{})
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch exporterType {
+	case "", tracingExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case tracingExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case tracingExporterOTLP:
+		exporter, err = otlptracehttp.New(ctx)
+	default:
+		return nil, fmt.Errorf("tracing exporter must be one of '%s', '%s' or '%s'. Currently '%s'",
+			tracingExporterNone, tracingExporterStdout, tracingExporterOTLP, exporterType)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("creating %s trace exporter: %v", exporterType, err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(ServiceName), semconv.ServiceVersion(version)))
+	if err != nil {
+		return nil, fmt.Errorf("creating trace resource: %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	log.Infof("Exporting traces using the %s exporter", exporterType)
+
+	return provider.Shutdown, nil
+}
+
+// traceHandler is mux middleware which starts a server span for each request, continuing any trace passed in the
+// W3C traceparent header. Spans are named after the route template to keep their cardinality low
+func traceHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer().Start(ctx, fmt.Sprintf("%s %s", r.Method, route),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPRequestMethodKey.String(r.Method), semconv.HTTPRoute(route), semconv.URLPath(r.URL.Path)))
+		defer span.End()
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPResponseStatusCode(recorder.status()))
+		if recorder.status() >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status()))
+		}
+	})
+}
+
+// traceContextHook adds the trace and span IDs to log entries made using log.WithContext, so logs can be matched to traces
+type traceContextHook struct{}
+
+func (traceContextHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (traceContextHook) Fire(entry *log.Entry) error {
+	if entry.Context == nil {
+		return nil
+	}
+	spanContext := trace.SpanContextFromContext(entry.Context)
+	if spanContext.IsValid() {
+		entry.Data["trace_id"] = spanContext.TraceID().String()
+		entry.Data["span_id"] = spanContext.SpanID().String()
+	}
+	return nil
+}
+
+// tracedConn starts a client span for every query, as a child of the span in the query's context.
+// system identifies the database, e.g. semconv.DBSystemPostgreSQL
+type tracedConn struct {
+	conn   dbConn
+	system attribute.KeyValue
+}
+
+func (c tracedConn) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	ctx, span := startQuerySpan(ctx, c.system, query)
+	// Errors from QueryRow are only returned by Scan, so can't be recorded on the span
+	defer span.End()
+	return c.conn.QueryRowContext(ctx, query, args...)
+}
+
+func (c tracedConn) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	ctx, span := startQuerySpan(ctx, c.system, query)
+	defer span.End()
+	rows, err := c.conn.QueryContext(ctx, query, args...)
+	recordSpanError(span, err)
+	return rows, err
+}
+
+func (c tracedConn) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	ctx, span := startQuerySpan(ctx, c.system, query)
+	defer span.End()
+	result, err := c.conn.ExecContext(ctx, query, args...)
+	recordSpanError(span, err)
+	return result, err
+}
+
+// startQuerySpan starts a span named after the SQL operation and table, e.g. "SELECT users"
+func startQuerySpan(ctx context.Context, system attribute.KeyValue, query string) (context.Context, trace.Span) {
+	statement := sanitiseSQL(query)
+	operation, _, _ := strings.Cut(statement, " ")
+	operation = strings.ToUpper(operation)
+
+	name := operation
+	attributes := []attribute.KeyValue{semconv.DBOperationName(operation), semconv.DBQueryText(statement)}
+	if system.Valid() {
+		attributes = append(attributes, system)
+	}
+	if match := sqlTableName.FindStringSubmatch(statement); match != nil {
+		name = fmt.Sprintf("%s %s", operation, match[1])
+		attributes = append(attributes, semconv.DBCollectionName(match[1]))
+	}
+
+	return tracer().Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attributes...))
+}
+
+// sanitiseSQL replaces any literals in query with '?' and collapses whitespace. Placeholders such as $1 are kept, as
+// the values bound to them are never recorded
+func sanitiseSQL(query string) string {
+	query = sqlStringLiteral.ReplaceAllString(query, "?")
+	query = sqlNumericLiteral.ReplaceAllStringFunc(query, func(literal string) string {
+		if strings.HasPrefix(literal, "$") {
+			return literal
+		}
+		return "?"
+	})
+	return strings.TrimSpace(sqlWhitespace.ReplaceAllString(query, " "))
+}
+
+func recordSpanError(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
@@ -0,0 +1,145 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// mockTracedDBConn is used to mock the Postgres connection underneath tracedConn
+type mockTracedDBConn struct{}
+
+func (mockTracedDBConn) QueryRowContext(_ context.Context, _ string, _ ...any) *sql.Row { return nil }
+
+func (mockTracedDBConn) QueryContext(_ context.Context, _ string, _ ...any) (*sql.Rows, error) {
+	return nil, sql.ErrConnDone
+}
+
+func (mockTracedDBConn) ExecContext(_ context.Context, _ string, _ ...any) (sql.Result, error) {
+	return nil, nil
+}
+
+// setupSpanRecorder installs a tracer provider which keeps finished spans in memory for the duration of the test
+func setupSpanRecorder(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	previousProvider, previousPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previousProvider)
+		otel.SetTextMapPropagator(previousPropagator)
+	})
+	return recorder
+}
+
+func spanAttribute(span sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+// TestTraceHandlerPropagation tests that server spans continue the trace from the traceparent header and are named after the route
+func TestTraceHandlerPropagation(t *testing.T) {
+	spans := setupSpanRecorder(t)
+	env := &Env{UsersDB: newTestMemoryStore()}
+	router := mux.NewRouter()
+	router.HandleFunc("/users/{logon_name}", env.deleteUser).Methods("DELETE")
+	router.Use(traceHandler)
+
+	req, _ := http.NewRequest("DELETE", "/users/mark9", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	ended := spans.Ended()
+	if len(ended) != 1 {
+		t.Fatalf("expected 1 span. Got %d", len(ended))
+	}
+	assert.Equal(t, "DELETE /users/{logon_name}", ended[0].Name())
+	assert.Equal(t, trace.SpanKindServer, ended[0].SpanKind())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", ended[0].SpanContext().TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", ended[0].Parent().SpanID().String())
+	assert.Equal(t, int64(204), spanAttribute(ended[0], "http.response.status_code").AsInt64())
+}
+
+// TestTracedConnChildSpan tests that queries are recorded as child spans with sanitised SQL
+func TestTracedConnChildSpan(t *testing.T) {
+	spans := setupSpanRecorder(t)
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "PUT /users/{logon_name}")
+
+	conn := tracedConn{conn: mockTracedDBConn{}}
+	_, _ = conn.ExecContext(ctx, `UPDATE users SET email = 'mark@email.com'
+		WHERE user_id = 5 AND logon_name = $1`, "mark9")
+	_, err := conn.QueryContext(ctx, `SELECT COUNT(*) FROM users WHERE logon_name = $1`, "mark9")
+	parent.End()
+
+	assert.Error(t, err)
+	ended := spans.Ended()
+	if len(ended) != 3 {
+		t.Fatalf("expected 3 spans. Got %d", len(ended))
+	}
+
+	update := ended[0]
+	assert.Equal(t, "UPDATE users", update.Name())
+	assert.Equal(t, trace.SpanKindClient, update.SpanKind())
+	assert.Equal(t, parent.SpanContext().SpanID(), update.Parent().SpanID())
+	assert.Equal(t, "UPDATE users SET email = ? WHERE user_id = ? AND logon_name = $1", spanAttribute(update, "db.query.text").AsString())
+	assert.Equal(t, "users", spanAttribute(update, "db.collection.name").AsString())
+
+	count := ended[1]
+	assert.Equal(t, "SELECT users", count.Name())
+	assert.Equal(t, "Error", count.Status().Code.String())
+}
+
+// TestSanitiseSQL tests that literals are removed from SQL statements whilst placeholders are kept
+func TestSanitiseSQL(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"SELECT COUNT(*) FROM users WHERE full_name like '%' || $1 || '%'", "SELECT COUNT(*) FROM users WHERE full_name like ? || $1 || ?"},
+		{"SELECT * FROM users WHERE full_name = 'O''Brien' LIMIT 10", "SELECT * FROM users WHERE full_name = ? LIMIT ?"},
+		{"INSERT INTO user_events(event_type) VALUES ($1)", "INSERT INTO user_events(event_type) VALUES ($1)"},
+		{"SELECT   user_id\n\t FROM users  ", "SELECT user_id FROM users"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, sanitiseSQL(test.query))
+	}
+}
+
+// TestTraceContextHook tests that trace and span IDs are added to logs made with a traced context
+func TestTraceContextHook(t *testing.T) {
+	_ = setupSpanRecorder(t)
+	ctx, span := otel.Tracer("test").Start(context.Background(), "test")
+	defer span.End()
+
+	var buf bytes.Buffer
+	logger := log.New()
+	logger.SetOutput(&buf)
+	logger.SetFormatter(&log.JSONFormatter{})
+	logger.AddHook(traceContextHook{})
+
+	logger.WithContext(ctx).Info("traced")
+	logger.Info("untraced")
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	assert.Contains(t, string(lines[0]), `"trace_id":"`+span.SpanContext().TraceID().String()+`"`)
+	assert.Contains(t, string(lines[0]), `"span_id":"`+span.SpanContext().SpanID().String()+`"`)
+	assert.NotContains(t, string(lines[1]), "trace_id")
+}
@@ -1,29 +1,79 @@
 package api
 
-import "database/sql"
+import (
+	"context"
+	"database/sql"
+	"time"
+)
 
 type Env struct {
-	UsersDB interface {
-		queryRecordCount(string, string) (int, error)
-		queryUsers(int, int, string) ([]User, error)
-		addUser(User) (User, error)
-		deleteUser(string) error
-		updateUser(User) (User, error)
-	}
-	DBCredentials DBCredentials
-	BuildVersion  string
+	UsersDB           UserStore
+	Idempotency       idempotencyStore
+	IdempotencyKeyTTL time.Duration
+	EventRelay        *EventRelay
+	Webhooks          webhookStore
+	WebhookDispatcher *WebhookDispatcher
+	Changes           *ChangeFeed
+	Metrics           *Metrics
+	DB                *sql.DB            // the Postgres connection pool. Only set with the postgres backend
+	Credentials       *rotatingConnector // opens the connections in DB using the current credentials
+	Replica           *ReplicaRouter     // set if there is a read replica
+	Breaker           *CircuitBreaker    // fails users store calls fast while the database is down
+	Cache             *UsersCache        // set if cache.enabled. Already in front of UsersDB
+	Validator         *UserValidator     // the configured validation rules. Only the built-in rules apply if nil
+	Config            Config
+	BuildVersion      string
+}
+
+// UserStore is the data layer used by the HTTP handlers. It is implemented by UserModel (Postgres), SQLiteUserModel and
+// MemoryUserModel. UpdateUser and DeleteUser return ErrUserNotFound if the logon_name doesn't exist, and AddUser returns
+// ErrLogonNameTaken if it already does
+type UserStore interface {
+	QueryRecordCount(context.Context, string, string) (int, error)
+	QueryUsers(context.Context, int, int, string) (UsersPage, error)
+	// GetUser returns ErrUserNotFound if there is no user with the logon_name
+	GetUser(ctx context.Context, logonName string) (User, error)
+	// SearchUsers ranks the users matching a case & accent insensitive fuzzy search, returning those scoring at least minScore
+	SearchUsers(ctx context.Context, query string, minScore float64, offset, limit int) (UsersPage, error)
+	StreamUsers(context.Context, string, func(User) error) error
+	AddUser(context.Context, User) (User, error)
+	DeleteUser(context.Context, string) error
+	UpdateUser(context.Context, User) (User, error)
+	// WithTx runs fn against a store scoped to a single database transaction.
+	// The transaction is committed if fn returns nil and rolled back otherwise
+	WithTx(context.Context, func(UserStore) error) error
 }
 
 type DBCredentials struct {
-	HostName   string
-	Port       int64
-	DBName     string
-	DBUsername string
-	DBPassword string
-	SSLMode    string
+	HostName   string `yaml:"host_name"`
+	Port       int64  `yaml:"port"`
+	DBName     string `yaml:"name"`
+	DBUsername string `yaml:"username"`
+	DBPassword string `yaml:"password"`
+	SSLMode    string `yaml:"ssl_mode"`
+	// PasswordFile, when set, is watched for a rotated password which replaces DBPassword without a restart
+	PasswordFile             string        `yaml:"password_file"`
+	PasswordFilePollInterval time.Duration `yaml:"password_file_poll_interval"`
+	// ReplicaHostName, when set, is a read replica which uses the same port, database & credentials as HostName
+	ReplicaHostName      string        `yaml:"replica_host_name"`
+	ReplicaCheckInterval time.Duration `yaml:"replica_check_interval"`
+	// Pool applies to the primary & replica connection pools separately
+	Pool PoolConfig `yaml:"pool"`
+	// ApproximateCountAbove sets UserModel.ApproximateCountAbove. 0 always counts exactly
+	ApproximateCountAbove int `yaml:"approximate_count_above"`
 }
 
 type UserModel struct {
+	DB      *sql.DB
+	Replica *ReplicaRouter // optional. Read-only queries go to the replica when it allows
+	Stmts   *stmtCache     // optional. Queries outside a transaction run as prepared statements
+	// ApproximateCountAbove, when greater than 0, lists every user with a total estimated from the table statistics once
+	// the table has more rows than this, rather than counting them all
+	ApproximateCountAbove int
+	tx                    *sql.Tx // set when the model is scoped to a transaction by withTx
+}
+
+type IdempotencyModel struct {
 	DB *sql.DB
 }
 
@@ -34,20 +84,97 @@ type User struct {
 	Email     string `json:"email"`
 }
 
+// UsersPage is a page of users along with the total number of users which match the filter
+type UsersPage struct {
+	Users []User
+	Total int
+	// Approximate is true if Total is estimated from the table statistics rather than counted
+	Approximate bool
+	// LastModified is when any user was last added, updated or deleted. Zero if the store can't tell it in commit order
+	LastModified time.Time
+}
+
 type UsersResponse struct {
 	Users       []User
 	TotalPages  int  `json:"total_pages"`
 	CurrentPage int  `json:"current_page"`
 	MorePages   bool `json:"more_pages"`
+	// ApproximateTotal is true if TotalPages is an estimate, which is only the case for very large tables
+	ApproximateTotal bool `json:"approximate_total,omitempty"`
 }
 
+// JSONHTTPErrorResponse is the legacy error format, still served to clients which prefer application/json over
+// application/problem+json. New clients should use Problem
 type JSONHTTPErrorResponse struct {
-	Code    int
-	Message string
+	Code      int
+	Message   string
+	RequestID string `json:",omitempty"`
+}
+
+// ValidationResult is the response to a valid payload sent to POST /users:validate. Invalid payloads get a 422 problem
+type ValidationResult struct {
+	Valid bool `json:"valid"`
 }
 
 type queryParameters struct {
 	perPage    int
 	page       int
 	nameFilter string
+	query      string  // q. Searches instead of filtering by name
+	minScore   float64 // min_score. Only used with query
+}
+
+type BatchRequest struct {
+	Operations []BatchOperation `json:"operations"`
+}
+
+// BatchOperation is a single create (POST), update (PUT) or delete (DELETE) within a batch request.
+// LogonName identifies the target user for updates and deletes. User holds the payload for creates and updates
+type BatchOperation struct {
+	Method    string `json:"method"`
+	LogonName string `json:"logon_name,omitempty"`
+	User      User   `json:"user"`
+}
+
+type BatchResponse struct {
+	Atomic    bool                   `json:"atomic"`
+	Committed bool                   `json:"committed"`
+	Results   []BatchOperationResult `json:"results"`
+}
+
+// BatchOperationResult mirrors the response which the equivalent single user endpoint would have returned
+type BatchOperationResult struct {
+	Index     int    `json:"index"`
+	Method    string `json:"method"`
+	LogonName string `json:"logon_name"`
+	Status    int    `json:"status"`
+	User      *User  `json:"user,omitempty"`
+	Message   string `json:"message,omitempty"`
+	// Code and Errors match those of the problem which the single user endpoint would have returned
+	Code   ErrorCode    `json:"code,omitempty"`
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+type WebhookModel struct {
+	DB *sql.DB
+}
+
+// WebhookSubscription registers URL to receive the listed event types. Secret is used to sign each delivery and is never returned by the API
+type WebhookSubscription struct {
+	SubscriptionID int       `json:"subscription_id"`
+	URL            string    `json:"url"`
+	EventTypes     []string  `json:"event_types"`
+	Secret         string    `json:"secret,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type WebhookDelivery struct {
+	DeliveryID     int64     `json:"delivery_id"`
+	SubscriptionID int       `json:"subscription_id"`
+	EventID        int64     `json:"event_id"`
+	EventType      string    `json:"event_type"`
+	Status         string    `json:"status"`
+	Attempts       int       `json:"attempts"`
+	LastError      string    `json:"last_error,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
 }
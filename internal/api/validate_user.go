@@ -0,0 +1,66 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// validateUserRequest is an HTTP handler for POST /users:validate. It runs the same validation as POST /users, or
+// PUT /users/<logon_name> when operation=update, without persisting anything. A valid payload gets a 200 and an invalid one
+// the same 422 which the write would have returned. Updates take the logon_name from the logon_name query string, standing
+// in for the PUT path, or else from the payload, and get the same 404 as PUT if the user doesn't exist
+func (env *Env) validateUserRequest(w http.ResponseWriter, r *http.Request) {
+	mode := validateCreate
+	switch operation := r.URL.Query().Get("operation"); operation {
+	case "", "create":
+	case "update":
+		mode = validateUpdate
+	default:
+		jsonHTTPErrorResponseWriter(w, r, 400, CodeInvalidQueryParameter, fmt.Sprintf("operation query string must be either create or update. Currently '%s'", operation))
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		jsonHTTPErrorResponseWriter(w, r, 400, CodeInvalidRequestBody, fmt.Sprintf("reading http request body: %v", err))
+		return
+	}
+	user := User{}
+	err = json.Unmarshal(body, &user)
+	if err != nil {
+		jsonHTTPErrorResponseWriter(w, r, 400, CodeInvalidRequestBody, fmt.Sprintf("unmarshalling http request body: %v", err))
+		return
+	}
+
+	if mode == validateUpdate {
+		if logonName := r.URL.Query().Get("logon_name"); logonName != "" {
+			user.LogonName = logonName
+		}
+		if user.LogonName != "" {
+			_, err = env.UsersDB.GetUser(r.Context(), user.LogonName)
+			if errors.Is(err, ErrUserNotFound) {
+				jsonHTTPErrorResponseWriter(w, r, 404, CodeUserNotFound, fmt.Sprintf("'%s' does not exist. No action required", user.LogonName))
+				return
+			}
+			if err != nil {
+				databaseErrorResponseWriter(w, r, err, 500, fmt.Sprintf("querying user from DB: %v", err))
+				return
+			}
+		}
+	}
+
+	err = env.validateUser(r.Context(), user, mode)
+	if err != nil {
+		validationErrorResponseWriter(w, r, err)
+		return
+	}
+
+	err = writeJSONHTTPResponse(w, 200, ValidationResult{Valid: true})
+	if err != nil {
+		jsonHTTPErrorResponseWriter(w, r, 500, CodeInternalError, fmt.Sprintf("writing HTTP response: %v", err))
+		return
+	}
+}
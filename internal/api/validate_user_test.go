@@ -0,0 +1,77 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func setupMockValidateUserHTTPHandler(env *Env, query string, user User) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	_ = json.NewEncoder(&buf).Encode(user)
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/users:validate"+query, &buf)
+	http.HandlerFunc(env.validateUserRequest).ServeHTTP(recorder, req)
+	return recorder
+}
+
+// TestValidateUserDryRun tests that a valid payload is accepted without being persisted
+func TestValidateUserDryRun(t *testing.T) {
+	store := newTestMemoryStore()
+	env := &Env{UsersDB: store}
+
+	rec := setupMockValidateUserHTTPHandler(env, "", User{LogonName: "testuser1", FullName: "Test User 1", Email: "test1@email.com"})
+	assert.Equal(t, 200, rec.Code)
+	assert.JSONEq(t, `{"valid": true}`, rec.Body.String())
+	assert.False(t, userExists(t, store, "testuser1"))
+}
+
+// TestValidateUserDryRunInvalid tests that an invalid payload gets the same 422 as the write, including the uniqueness check
+// and the configured rules
+func TestValidateUserDryRunInvalid(t *testing.T) {
+	validator, err := NewUserValidator(ValidationConfig{AllowedEmailDomains: []string{"example.com"}})
+	assert.NoError(t, err)
+	env := &Env{UsersDB: newTestMemoryStore(), Validator: validator}
+
+	rec := setupMockValidateUserHTTPHandler(env, "?operation=create", User{LogonName: "mark9", Email: "mark@email.com"})
+	assert.Equal(t, 422, rec.Code)
+	var resp Problem
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, CodeValidationFailed, resp.Code)
+	assert.Equal(t, map[string]ErrorCode{"logon_name": CodeLogonNameTaken, "email": CodeEmailDomainNotAllowed}, fieldCodes(resp.Errors))
+
+	// Updates don't check that logon_name is free
+	rec = setupMockValidateUserHTTPHandler(env, "?operation=update", User{LogonName: "mark9", Email: "mark@example.com"})
+	assert.Equal(t, 200, rec.Code)
+
+	rec = setupMockValidateUserHTTPHandler(env, "?operation=delete", User{LogonName: "mark9"})
+	assert.Equal(t, 400, rec.Code)
+}
+
+// TestValidateUserDryRunUpdateNotFound tests that validating an update of a user which doesn't exist gets the same 404 as
+// PUT /users/<logon_name>, whether or not the payload is valid
+func TestValidateUserDryRunUpdateNotFound(t *testing.T) {
+	env := &Env{UsersDB: newTestMemoryStore()}
+
+	for _, test := range []struct {
+		query string
+		user  User
+	}{
+		{"?operation=update", User{LogonName: "baduser", Email: "bad.user@email.com"}},
+		{"?operation=update&logon_name=baduser", User{Email: "bad.user@email.com"}},
+		{"?operation=update&logon_name=baduser", User{Email: "bad.email@"}},
+	} {
+		rec := setupMockValidateUserHTTPHandler(env, test.query, test.user)
+		assert.Equal(t, 404, rec.Code, test.query)
+		var resp Problem
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		assert.Equal(t, CodeUserNotFound, resp.Code)
+	}
+
+	rec := setupMockValidateUserHTTPHandler(env, "?operation=update&logon_name=bob44", User{FullName: "Bob"})
+	assert.Equal(t, 200, rec.Code)
+}
@@ -0,0 +1,329 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// userColumnSizes are the sizes of the VARCHAR columns in sql/01-create-table.sql. Configured max lengths can't exceed them
+var userColumnSizes = map[string]int{"logon_name": 20, "full_name": 100, "email": 100}
+
+// userFields are the fields of a user payload which have rules, in the order of the User fields
+var userFields = []string{"logon_name", "full_name", "email"}
+
+// validationMode selects the rules which apply to a user payload
+type validationMode int
+
+const (
+	validateCreate validationMode = iota // logon_name & email are required, and logon_name must not be reserved or already taken
+	validateUpdate                       // logon_name and at least one of email & full_name are required, as only the fields which are passed are updated
+)
+
+// ValidationConfig is the organisation's rules for user payloads, enforced on top of the built-in rules by every endpoint which
+// writes users
+type ValidationConfig struct {
+	LogonName FieldRule `yaml:"logon_name"`
+	FullName  FieldRule `yaml:"full_name"`
+	Email     FieldRule `yaml:"email"`
+	// ReservedLogonNames can't be taken by new users. Compared case insensitively
+	ReservedLogonNames []string `yaml:"reserved_logon_names"`
+	// AllowedEmailDomains, when set, are the only domains which emails can use. Subdomains must be listed separately
+	AllowedEmailDomains []string `yaml:"allowed_email_domains"`
+	// DeniedEmailDomains are domains which emails can't use
+	DeniedEmailDomains []string `yaml:"denied_email_domains"`
+}
+
+// FieldRule limits the values of a single user field. Lengths are in characters, and a zero value doesn't apply
+type FieldRule struct {
+	MinLength int    `yaml:"min_length"`
+	MaxLength int    `yaml:"max_length"` // 0 uses the column size
+	Pattern   string `yaml:"pattern"`    // RE2 regular expression which the value must match. Anchor it to match the whole value
+}
+
+// rule returns the rule for one of userFields
+func (c ValidationConfig) rule(field string) FieldRule {
+	switch field {
+	case "logon_name":
+		return c.LogonName
+	case "full_name":
+		return c.FullName
+	}
+	return c.Email
+}
+
+// validate returns every problem with the rules
+func (c ValidationConfig) validate() []error {
+	var errs []error
+	for _, field := range userFields {
+		rule, columnSize := c.rule(field), userColumnSizes[field]
+		if rule.MinLength < 0 {
+			errs = append(errs, fmt.Errorf("validation.%s.min_length must not be negative. Currently %d", field, rule.MinLength))
+		}
+		if rule.MaxLength < 0 || rule.MaxLength > columnSize {
+			errs = append(errs, fmt.Errorf("validation.%s.max_length must be between 0 and %d, the column size. Currently %d", field, columnSize, rule.MaxLength))
+		}
+		if rule.MinLength > maxLength(rule, columnSize) {
+			errs = append(errs, fmt.Errorf("validation.%s.min_length must not be greater than its max_length. Currently %d", field, rule.MinLength))
+		}
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			errs = append(errs, fmt.Errorf("validation.%s.pattern: %v", field, err))
+		}
+	}
+	return errs
+}
+
+// maxLength returns the configured max length of a field, or its column size if there is none
+func maxLength(rule FieldRule, columnSize int) int {
+	if rule.MaxLength == 0 {
+		return columnSize
+	}
+	return rule.MaxLength
+}
+
+// UserValidator checks user payloads against the built-in rules and the configured ValidationConfig
+type UserValidator struct {
+	fields              []fieldValidator
+	reservedLogonNames  map[string]bool
+	allowedEmailDomains map[string]bool
+	deniedEmailDomains  map[string]bool
+}
+
+// fieldValidator is the compiled rule of a single user field
+type fieldValidator struct {
+	field     string
+	minLength int
+	maxLength int
+	pattern   *regexp.Regexp // nil if there is no pattern
+	value     func(User) string
+}
+
+// builtinUserValidator only enforces the built-in rules. It is used by an Env without a Validator
+var builtinUserValidator, _ = NewUserValidator(ValidationConfig{})
+
+// NewUserValidator compiles cfg. Config.validate has already reported any problems with it
+func NewUserValidator(cfg ValidationConfig) (*UserValidator, error) {
+	values := map[string]func(User) string{
+		"logon_name": func(u User) string { return u.LogonName },
+		"full_name":  func(u User) string { return u.FullName },
+		"email":      func(u User) string { return u.Email },
+	}
+
+	v := &UserValidator{
+		reservedLogonNames:  lowerSet(cfg.ReservedLogonNames),
+		allowedEmailDomains: lowerSet(cfg.AllowedEmailDomains),
+		deniedEmailDomains:  lowerSet(cfg.DeniedEmailDomains),
+	}
+	for _, field := range userFields {
+		rule := cfg.rule(field)
+		fv := fieldValidator{
+			field:     field,
+			minLength: rule.MinLength,
+			maxLength: maxLength(rule, userColumnSizes[field]),
+			value:     values[field],
+		}
+		if rule.Pattern != "" {
+			pattern, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("compiling validation.%s.pattern: %v", field, err)
+			}
+			fv.pattern = pattern
+		}
+		v.fields = append(v.fields, fv)
+	}
+	return v, nil
+}
+
+// lowerSet returns the set of values, lowercased
+func lowerSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[strings.ToLower(strings.TrimSpace(value))] = true
+	}
+	return set
+}
+
+// validator returns the configured validator, or the built-in rules if there isn't one
+func (env *Env) validator() *UserValidator {
+	if env.Validator == nil {
+		return builtinUserValidator
+	}
+	return env.Validator
+}
+
+// ValidationError lists every field of a payload which failed validation. It is returned as a 422
+type ValidationError struct {
+	Errors []FieldError
+}
+
+func (e ValidationError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, fieldErr := range e.Errors {
+		messages[i] = fieldErr.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// validateUser checks user against every rule for mode, returning a ValidationError which lists all of the violations rather
+// than just the first. When creating, logon_name is checked for uniqueness once it is otherwise valid. An error querying the
+// store is returned as is
+func (env *Env) validateUser(ctx context.Context, user User, mode validationMode) error {
+	fieldErrors := env.validator().fieldErrors(user, mode)
+
+	if mode == validateCreate && !hasFieldError(fieldErrors, "logon_name") {
+		found, err := checkForUniqueLogonName(ctx, user.LogonName, env)
+		if err != nil {
+			return fmt.Errorf("validating logon_name uniqueness: %w", err)
+		}
+		if found {
+			fieldErrors = append(fieldErrors, logonNameTakenError(user.LogonName))
+		}
+	}
+
+	if len(fieldErrors) > 0 {
+		return ValidationError{Errors: fieldErrors}
+	}
+	return nil
+}
+
+// fieldErrors returns the field errors for each of the user's fields which break a rule for mode. Each field has at most one
+// error. The configured rules for logon_name only apply when creating, as updates can't change it
+func (v *UserValidator) fieldErrors(user User, mode validationMode) []FieldError {
+	var fieldErrors []FieldError
+
+	if user.UserID != 0 {
+		fieldErrors = append(fieldErrors, FieldError{Field: "user_id", Code: CodeFieldNotAllowed, Message: "user_id is generated by the service and can't be passed in the request payload"})
+	}
+
+	for _, fv := range v.fields {
+		value := fv.value(user)
+		if value == "" {
+			if fv.field == "logon_name" || (mode == validateCreate && fv.field == "email") {
+				fieldErrors = append(fieldErrors, requiredFieldError(fv.field))
+				continue
+			}
+			// Other fields are optional when updating, as only the fields which are passed are updated
+			if mode == validateUpdate {
+				continue
+			}
+		}
+		if fieldErr, failed := v.checkField(fv, value, mode); failed {
+			fieldErrors = append(fieldErrors, fieldErr)
+		}
+	}
+
+	// An update has to change something. It is reported against email, as the field which is required when creating
+	if mode == validateUpdate && user.Email == "" && user.FullName == "" {
+		fieldErrors = append(fieldErrors, FieldError{Field: "email", Code: CodeFieldRequired, Message: "email and/or full_name is required when updating a user"})
+	}
+
+	return fieldErrors
+}
+
+// checkField checks a single field's value against its rules, returning the first which fails
+func (v *UserValidator) checkField(fv fieldValidator, value string, mode validationMode) (FieldError, bool) {
+	length := utf8.RuneCountInString(value)
+	if fv.field == "logon_name" && mode == validateUpdate {
+		// Only the column size applies to an existing logon_name
+		if columnSize := userColumnSizes[fv.field]; length > columnSize {
+			return FieldError{Field: fv.field, Code: CodeFieldTooLong, Message: fmt.Sprintf("%s maximum length is %d. Currently %d", fv.field, columnSize, length)}, true
+		}
+		return FieldError{}, false
+	}
+
+	if length > fv.maxLength {
+		return FieldError{Field: fv.field, Code: CodeFieldTooLong, Message: fmt.Sprintf("%s maximum length is %d. Currently %d", fv.field, fv.maxLength, length)}, true
+	}
+	if length < fv.minLength {
+		return FieldError{Field: fv.field, Code: CodeFieldTooShort, Message: fmt.Sprintf("%s minimum length is %d. Currently %d", fv.field, fv.minLength, length)}, true
+	}
+	if fv.pattern != nil && !fv.pattern.MatchString(value) {
+		return FieldError{Field: fv.field, Code: CodeFieldPatternMismatch, Message: fmt.Sprintf("%s '%s' must match the pattern %s", fv.field, value, fv.pattern)}, true
+	}
+
+	switch fv.field {
+	case "logon_name":
+		if v.reservedLogonNames[strings.ToLower(value)] {
+			return FieldError{Field: fv.field, Code: CodeLogonNameReserved, Message: fmt.Sprintf("logon_name '%s' is reserved. Please choose another one", value)}, true
+		}
+	case "email":
+		if err := validateEmailField(value); err != nil {
+			var fieldErr FieldError
+			if errors.As(err, &fieldErr) {
+				return fieldErr, true
+			}
+		}
+		if domain := emailDomain(value); (len(v.allowedEmailDomains) > 0 && !v.allowedEmailDomains[domain]) || v.deniedEmailDomains[domain] {
+			return FieldError{Field: fv.field, Code: CodeEmailDomainNotAllowed, Message: fmt.Sprintf("email domain '%s' is not allowed", domain)}, true
+		}
+	}
+	return FieldError{}, false
+}
+
+// emailDomain returns the lowercased domain of a valid email address
+func emailDomain(email string) string {
+	address, err := mail.ParseAddress(email)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(address.Address[strings.LastIndex(address.Address, "@")+1:])
+}
+
+// validateEmailField validates that the parameter is in a valid email address format. The error is a FieldError
+func validateEmailField(email string) error {
+	_, err := mail.ParseAddress(email)
+	if err != nil {
+		return FieldError{Field: "email", Code: CodeInvalidEmail, Message: fmt.Sprintf("'%s' not a valid email address field: %v", email, err)}
+	}
+	return nil
+}
+
+// hasFieldError reports whether fieldErrors already contains an error for field
+func hasFieldError(fieldErrors []FieldError, field string) bool {
+	for _, fieldErr := range fieldErrors {
+		if fieldErr.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// requiredFieldError is the field error for a required field which is missing
+func requiredFieldError(field string) FieldError {
+	return FieldError{Field: field, Code: CodeFieldRequired, Message: fmt.Sprintf("%s is required", field)}
+}
+
+// logonNameTakenError is the field error for a logon_name which is already in use
+func logonNameTakenError(logonName string) FieldError {
+	return FieldError{Field: "logon_name", Code: CodeLogonNameTaken, Message: fmt.Sprintf("logon_name '%s' already taken. Please choose another one", logonName)}
+}
+
+// checkForUniqueLogonName queries the database to see if the logon_name is already present in the users table
+func checkForUniqueLogonName(ctx context.Context, logonName string, env *Env) (bool, error) {
+	count, err := env.UsersDB.QueryRecordCount(ctx, "", logonName)
+	if err != nil {
+		return false, fmt.Errorf("checking database for unique logon_name '%s': %w", logonName, err)
+	}
+	if count > 0 {
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// validationErrorResponseWriter writes the response for an error from validateUser. A ValidationError is a 422 listing
+// every field error, and anything else is a database error
+func validationErrorResponseWriter(w http.ResponseWriter, r *http.Request, err error) {
+	var invalid ValidationError
+	if errors.As(err, &invalid) {
+		code, fieldErrors := fieldErrorDetails(invalid, CodeValidationFailed)
+		jsonHTTPErrorResponseWriter(w, r, http.StatusUnprocessableEntity, code, invalid.Error(), fieldErrors...)
+		return
+	}
+	databaseErrorResponseWriter(w, r, err, 500, err.Error())
+}
@@ -0,0 +1,198 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// failingCountUsersStore fails every QueryRecordCount call
+type failingCountUsersStore struct {
+	UserStore
+}
+
+func (failingCountUsersStore) QueryRecordCount(context.Context, string, string) (int, error) {
+	return 0, errDatabaseUnavailable
+}
+
+// fieldCodes returns the field & code of each field error, to compare them without their messages
+func fieldCodes(fieldErrors []FieldError) map[string]ErrorCode {
+	codes := make(map[string]ErrorCode, len(fieldErrors))
+	for _, fieldErr := range fieldErrors {
+		codes[fieldErr.Field] = fieldErr.Code
+	}
+	return codes
+}
+
+// TestUserFieldErrors tests that every broken rule is reported, with at most one error per field
+func TestUserFieldErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		user User
+		mode validationMode
+		want map[string]ErrorCode
+	}{
+		{
+			name: "valid create",
+			user: User{LogonName: "mark9", FullName: "mark", Email: "mark@email.com"},
+			mode: validateCreate,
+			want: map[string]ErrorCode{},
+		},
+		{
+			name: "every field invalid",
+			user: User{UserID: 4, LogonName: strings.Repeat("a", 21), FullName: strings.Repeat("a", 101), Email: "not-an-email"},
+			mode: validateCreate,
+			want: map[string]ErrorCode{"user_id": CodeFieldNotAllowed, "logon_name": CodeFieldTooLong, "full_name": CodeFieldTooLong, "email": CodeInvalidEmail},
+		},
+		{
+			name: "missing create fields",
+			user: User{FullName: "mark"},
+			mode: validateCreate,
+			want: map[string]ErrorCode{"logon_name": CodeFieldRequired, "email": CodeFieldRequired},
+		},
+		{
+			name: "email too long isn't also reported as invalid",
+			user: User{LogonName: "mark9", Email: strings.Repeat("a", 101)},
+			mode: validateCreate,
+			want: map[string]ErrorCode{"email": CodeFieldTooLong},
+		},
+		{
+			name: "update with only full_name",
+			user: User{LogonName: "mark9", FullName: "mark"},
+			mode: validateUpdate,
+			want: map[string]ErrorCode{},
+		},
+		{
+			name: "update without logon_name",
+			user: User{Email: "bad.email@"},
+			mode: validateUpdate,
+			want: map[string]ErrorCode{"logon_name": CodeFieldRequired, "email": CodeInvalidEmail},
+		},
+		{
+			name: "update without email or full_name",
+			user: User{LogonName: "mark9"},
+			mode: validateUpdate,
+			want: map[string]ErrorCode{"email": CodeFieldRequired},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, fieldCodes(builtinUserValidator.fieldErrors(test.user, test.mode)))
+		})
+	}
+}
+
+// TestValidateUserUniqueness tests that logon_name is only checked for uniqueness when creating and once it is otherwise valid
+func TestValidateUserUniqueness(t *testing.T) {
+	env := &Env{UsersDB: newTestMemoryStore()}
+	ctx := context.Background()
+
+	err := env.validateUser(ctx, User{LogonName: "mark9", FullName: strings.Repeat("a", 101), Email: "mark@new.com"}, validateCreate)
+	var invalid ValidationError
+	if assert.ErrorAs(t, err, &invalid) {
+		assert.Equal(t, map[string]ErrorCode{"logon_name": CodeLogonNameTaken, "full_name": CodeFieldTooLong}, fieldCodes(invalid.Errors))
+		assert.Equal(t, "full_name maximum length is 100. Currently 101; logon_name 'mark9' already taken. Please choose another one", invalid.Error())
+	}
+
+	// A logon_name which is too long isn't looked up
+	err = env.validateUser(ctx, User{LogonName: strings.Repeat("a", 21), Email: "mark@new.com"}, validateCreate)
+	if assert.ErrorAs(t, err, &invalid) {
+		assert.Equal(t, map[string]ErrorCode{"logon_name": CodeFieldTooLong}, fieldCodes(invalid.Errors))
+	}
+
+	assert.NoError(t, env.validateUser(ctx, User{LogonName: "mark9", Email: "mark@new.com"}, validateUpdate))
+	assert.NoError(t, env.validateUser(ctx, User{LogonName: "testuser1", Email: "test1@email.com"}, validateCreate))
+
+	// An unreadable store isn't a validation failure
+	env.UsersDB = failingCountUsersStore{}
+	err = env.validateUser(ctx, User{LogonName: "testuser1", Email: "test1@email.com"}, validateCreate)
+	assert.ErrorIs(t, err, errDatabaseUnavailable)
+	assert.False(t, errors.As(err, &invalid))
+}
+
+// TestUserValidatorConfiguredRules tests the rules loaded from ValidationConfig, and that an existing logon_name isn't held
+// to them when updating
+func TestUserValidatorConfiguredRules(t *testing.T) {
+	validator, err := NewUserValidator(ValidationConfig{
+		LogonName:           FieldRule{MinLength: 3, Pattern: `^[a-z][a-z0-9._-]{2,19}$`},
+		FullName:            FieldRule{MaxLength: 10},
+		ReservedLogonNames:  []string{"Admin", " root "},
+		AllowedEmailDomains: []string{"Example.com", "corp.example.com"},
+		DeniedEmailDomains:  []string{"corp.example.com"},
+	})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name string
+		user User
+		mode validationMode
+		want map[string]ErrorCode
+	}{
+		{
+			name: "valid",
+			user: User{LogonName: "mark.9", FullName: "mark", Email: "mark@EXAMPLE.com"},
+			mode: validateCreate,
+			want: map[string]ErrorCode{},
+		},
+		{
+			name: "every configured rule broken",
+			user: User{LogonName: "ma", FullName: "mark the eleventh", Email: "mark@other.com"},
+			mode: validateCreate,
+			want: map[string]ErrorCode{"logon_name": CodeFieldTooShort, "full_name": CodeFieldTooLong, "email": CodeEmailDomainNotAllowed},
+		},
+		{
+			name: "pattern",
+			user: User{LogonName: "Mark9", Email: "mark@example.com"},
+			mode: validateCreate,
+			want: map[string]ErrorCode{"logon_name": CodeFieldPatternMismatch},
+		},
+		{
+			name: "reserved",
+			user: User{LogonName: "root", Email: "root@example.com"},
+			mode: validateCreate,
+			want: map[string]ErrorCode{"logon_name": CodeLogonNameReserved},
+		},
+		{
+			name: "denied domain",
+			user: User{LogonName: "mark9", Email: "Mark <mark@Corp.Example.com>"},
+			mode: validateCreate,
+			want: map[string]ErrorCode{"email": CodeEmailDomainNotAllowed},
+		},
+		{
+			name: "existing logon_name on update",
+			user: User{LogonName: "Admin", Email: "admin@example.com"},
+			mode: validateUpdate,
+			want: map[string]ErrorCode{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, fieldCodes(validator.fieldErrors(test.user, test.mode)))
+		})
+	}
+}
+
+// TestUserValidatorCountsCharacters tests that lengths are counted in characters, as the VARCHAR columns are
+func TestUserValidatorCountsCharacters(t *testing.T) {
+	user := User{LogonName: strings.Repeat("é", 20), Email: "e@example.com"}
+	assert.Empty(t, builtinUserValidator.fieldErrors(user, validateCreate))
+}
+
+// TestValidationConfigValidate tests that rules which could never be met, or which the column can't hold, are rejected
+func TestValidationConfigValidate(t *testing.T) {
+	assert.Empty(t, DefaultConfig().Validation.validate())
+
+	errs := ValidationConfig{
+		LogonName: FieldRule{MinLength: 15, MaxLength: 10},
+		FullName:  FieldRule{MinLength: -1, MaxLength: 101},
+		Email:     FieldRule{Pattern: "(unclosed"},
+	}.validate()
+	assert.Len(t, errs, 4)
+	assert.ErrorContains(t, errs[0], "validation.logon_name.min_length must not be greater than its max_length")
+	assert.ErrorContains(t, errs[1], "validation.full_name.min_length must not be negative")
+	assert.ErrorContains(t, errs[2], "validation.full_name.max_length must be between 0 and 100")
+	assert.ErrorContains(t, errs[3], "validation.email.pattern")
+}
@@ -0,0 +1,177 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	webhookSignatureHeader  = "X-Webhook-Signature"
+	webhookTimestampHeader  = "X-Webhook-Timestamp"
+	webhookDeliveryIDHeader = "X-Webhook-Delivery-ID"
+
+	defaultWebhookMaxAttempts   = 8
+	defaultWebhookBaseBackoff   = time.Second * 5
+	defaultWebhookMaxBackoff    = time.Hour
+	defaultWebhookPollInterval  = time.Second
+	defaultWebhookBatchSize     = 20
+	defaultWebhookClientTimeout = time.Second * 10
+)
+
+// WebhookDispatcher sends queued webhook deliveries. Failed deliveries are retried with exponential backoff
+// and moved to the dead-letter list once MaxAttempts have been made
+type WebhookDispatcher struct {
+	Store        webhookStore
+	Client       *http.Client
+	MaxAttempts  int
+	BaseBackoff  time.Duration
+	MaxBackoff   time.Duration
+	PollInterval time.Duration
+	BatchSize    int
+}
+
+// Run sends deliveries until ctx is cancelled
+func (d *WebhookDispatcher) Run(ctx context.Context) {
+	d.setDefaults()
+	log.Infof("Starting webhook dispatcher (max attempts: %d)", d.MaxAttempts)
+
+	for {
+		sent, err := d.dispatchDue(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.WithError(err).Error("dispatching webhook deliveries")
+		}
+
+		if sent == d.BatchSize {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			log.Info("Webhook dispatcher stopped")
+			return
+		case <-time.After(d.PollInterval):
+		}
+	}
+}
+
+// dispatchDue claims and attempts the deliveries which are due, returning how many were attempted
+func (d *WebhookDispatcher) dispatchDue(ctx context.Context) (int, error) {
+	// Hide the claimed deliveries from other replicas for longer than it could take to attempt them all
+	lease := d.Client.Timeout*time.Duration(d.BatchSize) + time.Minute
+	deliveries, err := d.Store.claimWebhookDeliveries(ctx, d.BatchSize, lease)
+	if err != nil {
+		return 0, fmt.Errorf("claiming webhook deliveries: %v", err)
+	}
+
+	for _, delivery := range deliveries {
+		d.attempt(ctx, delivery)
+	}
+	return len(deliveries), nil
+}
+
+// attempt sends a single delivery and records the outcome
+func (d *WebhookDispatcher) attempt(ctx context.Context, delivery webhookDelivery) {
+	logger := log.WithFields(log.Fields{"delivery_id": delivery.DeliveryID, "subscription_id": delivery.SubscriptionID, "event_id": delivery.EventID})
+
+	sendErr := d.send(ctx, delivery, time.Now())
+	if sendErr == nil {
+		if err := d.Store.markWebhookDelivered(ctx, delivery.DeliveryID); err != nil {
+			logger.WithError(err).Error("marking webhook delivery as delivered")
+		}
+		return
+	}
+
+	attempts := delivery.Attempts + 1
+	dead := attempts >= d.MaxAttempts
+	nextAttempt := time.Now().Add(d.backoff(attempts))
+	if dead {
+		logger.WithError(sendErr).WithField("attempts", attempts).Error("webhook delivery failed too many times. Moving to the dead-letter list")
+	} else {
+		logger.WithError(sendErr).WithFields(log.Fields{"attempts": attempts, "next_attempt": nextAttempt}).Warn("webhook delivery failed. Will retry")
+	}
+
+	if err := d.Store.markWebhookDeliveryFailed(ctx, delivery.DeliveryID, sendErr.Error(), nextAttempt, dead); err != nil {
+		logger.WithError(err).Error("recording failed webhook delivery")
+	}
+}
+
+// send POSTs the delivery payload to the subscriber, signed with the subscription secret
+func (d *WebhookDispatcher) send(ctx context.Context, delivery webhookDelivery, now time.Time) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", delivery.url, bytes.NewReader(delivery.payload))
+	if err != nil {
+		return fmt.Errorf("creating webhook request: %v", err)
+	}
+
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-ID", strconv.FormatInt(delivery.EventID, 10))
+	req.Header.Set("X-Event-Type", delivery.EventType)
+	req.Header.Set(webhookDeliveryIDHeader, strconv.FormatInt(delivery.DeliveryID, 10))
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, "sha256="+SignWebhookPayload(delivery.secret, timestamp, delivery.payload))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending webhook request: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// backoff returns how long to wait before the next attempt, doubling with each attempt up to MaxBackoff
+func (d *WebhookDispatcher) backoff(attempts int) time.Duration {
+	backoff := d.BaseBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= d.MaxBackoff {
+			return d.MaxBackoff
+		}
+	}
+	return backoff
+}
+
+func (d *WebhookDispatcher) setDefaults() {
+	if d.Client == nil {
+		d.Client = &http.Client{Timeout: defaultWebhookClientTimeout}
+	}
+	if d.MaxAttempts == 0 {
+		d.MaxAttempts = defaultWebhookMaxAttempts
+	}
+	if d.BaseBackoff == 0 {
+		d.BaseBackoff = defaultWebhookBaseBackoff
+	}
+	if d.MaxBackoff == 0 {
+		d.MaxBackoff = defaultWebhookMaxBackoff
+	}
+	if d.PollInterval == 0 {
+		d.PollInterval = defaultWebhookPollInterval
+	}
+	if d.BatchSize == 0 {
+		d.BatchSize = defaultWebhookBatchSize
+	}
+}
+
+// SignWebhookPayload returns the hex encoded HMAC-SHA256 of "<timestamp>.<payload>" using secret.
+// Receivers should recompute this from the X-Webhook-Timestamp header and raw body, compare it to X-Webhook-Signature
+// and reject stale timestamps to prevent replays
+func SignWebhookPayload(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
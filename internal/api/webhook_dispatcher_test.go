@@ -0,0 +1,140 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testWebhookSecret = "super-secret-signing-key"
+
+// webhookReceiver is an httptest receiver which verifies signatures and fails the first failCount requests
+type webhookReceiver struct {
+	mu        sync.Mutex
+	failCount int
+	requests  int
+	received  []UserEvent
+	badSigs   int
+}
+
+func (rc *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.requests++
+
+	body, _ := io.ReadAll(r.Body)
+	expected := "sha256=" + SignWebhookPayload(testWebhookSecret, r.Header.Get(webhookTimestampHeader), body)
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get(webhookSignatureHeader))) {
+		rc.badSigs++
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if rc.requests <= rc.failCount {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var event UserEvent
+	_ = json.Unmarshal(body, &event)
+	rc.received = append(rc.received, event)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func setupWebhookDispatcherTest(t *testing.T, receiver *webhookReceiver, maxAttempts int) (*mockWebhookStore, *WebhookDispatcher) {
+	server := httptest.NewServer(receiver)
+	t.Cleanup(server.Close)
+
+	store := newMockWebhookStore()
+	_, _ = store.createWebhookSubscription(context.Background(), WebhookSubscription{URL: server.URL, EventTypes: []string{EventUserCreated}, Secret: testWebhookSecret})
+	publisher := &SubscriptionPublisher{Store: store}
+	_ = publisher.Publish(context.Background(), UserEvent{EventID: 10, EventType: EventUserCreated, LogonName: "mark9", User: User{UserID: 1, LogonName: "mark9"}})
+	// Not subscribed to this event type, so should not be delivered
+	_ = publisher.Publish(context.Background(), UserEvent{EventID: 11, EventType: EventUserUpdated, LogonName: "mark9"})
+
+	dispatcher := &WebhookDispatcher{Store: store, MaxAttempts: maxAttempts, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond * 5}
+	dispatcher.setDefaults()
+	return store, dispatcher
+}
+
+// dispatchUntilIdle keeps dispatching until no deliveries are pending, waiting out any backoff in between
+func dispatchUntilIdle(t *testing.T, store *mockWebhookStore, dispatcher *WebhookDispatcher) {
+	deadline := time.Now().Add(time.Second)
+	for store.pending() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("webhook deliveries still pending")
+		}
+		if _, err := dispatcher.dispatchDue(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestWebhookDispatcherSignedDelivery tests that deliveries are signed with the subscription secret and only sent for subscribed event types
+func TestWebhookDispatcherSignedDelivery(t *testing.T) {
+	receiver := &webhookReceiver{}
+	store, dispatcher := setupWebhookDispatcherTest(t, receiver, 3)
+
+	sent, err := dispatcher.dispatchDue(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, sent)
+	assert.Equal(t, 0, receiver.badSigs)
+	assert.Equal(t, 1, len(receiver.received))
+	assert.Equal(t, int64(10), receiver.received[0].EventID)
+	assert.Equal(t, webhookStatusDelivered, store.delivery(2).Status)
+}
+
+// TestWebhookDispatcherRetries tests that failed deliveries are retried with backoff until they succeed
+func TestWebhookDispatcherRetries(t *testing.T) {
+	receiver := &webhookReceiver{failCount: 2}
+	store, dispatcher := setupWebhookDispatcherTest(t, receiver, 5)
+
+	dispatchUntilIdle(t, store, dispatcher)
+
+	delivery := store.delivery(2)
+	assert.Equal(t, webhookStatusDelivered, delivery.Status)
+	assert.Equal(t, 3, delivery.Attempts)
+	assert.Equal(t, 3, receiver.requests)
+	assert.Equal(t, 1, len(receiver.received))
+}
+
+// TestWebhookDispatcherDeadLetter tests that a delivery is dead-lettered after MaxAttempts, and is delivered once replayed
+func TestWebhookDispatcherDeadLetter(t *testing.T) {
+	receiver := &webhookReceiver{failCount: 3}
+	store, dispatcher := setupWebhookDispatcherTest(t, receiver, 3)
+
+	dispatchUntilIdle(t, store, dispatcher)
+
+	delivery := store.delivery(2)
+	assert.Equal(t, webhookStatusDead, delivery.Status)
+	assert.Equal(t, 3, delivery.Attempts)
+	assert.Equal(t, "webhook returned status code 500", delivery.LastError)
+	assert.Equal(t, 0, len(receiver.received))
+
+	replayed, _ := store.replayDeadLetterDelivery(context.Background(), 2)
+	assert.True(t, replayed)
+	dispatchUntilIdle(t, store, dispatcher)
+
+	assert.Equal(t, webhookStatusDelivered, store.delivery(2).Status)
+	assert.Equal(t, 1, len(receiver.received))
+}
+
+// TestWebhookDispatcherBackoff tests that the backoff doubles with each attempt up to the maximum
+func TestWebhookDispatcherBackoff(t *testing.T) {
+	dispatcher := &WebhookDispatcher{BaseBackoff: time.Second, MaxBackoff: time.Second * 10}
+
+	assert.Equal(t, time.Second, dispatcher.backoff(1))
+	assert.Equal(t, time.Second*2, dispatcher.backoff(2))
+	assert.Equal(t, time.Second*8, dispatcher.backoff(4))
+	assert.Equal(t, time.Second*10, dispatcher.backoff(5))
+}
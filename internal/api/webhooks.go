@@ -0,0 +1,201 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	webhookSecretMinLength = 16
+	webhookSecretMaxLength = 255
+	webhookURLMaxLength    = 2048
+
+	webhookStatusPending   = "pending"
+	webhookStatusDelivered = "delivered"
+	webhookStatusDead      = "dead"
+)
+
+// webhookStore persists webhook subscriptions and the queue of deliveries to them
+type webhookStore interface {
+	createWebhookSubscription(ctx context.Context, subscription WebhookSubscription) (WebhookSubscription, error)
+	listWebhookSubscriptions(ctx context.Context) ([]WebhookSubscription, error)
+	deleteWebhookSubscription(ctx context.Context, subscriptionID int) (bool, error)
+	// enqueueWebhookDeliveries queues event for every subscription to its event type. Enqueuing the same event twice is a no-op
+	enqueueWebhookDeliveries(ctx context.Context, event UserEvent) error
+	// claimWebhookDeliveries returns up to limit deliveries which are due, hiding them from other callers for lease
+	claimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]webhookDelivery, error)
+	markWebhookDelivered(ctx context.Context, deliveryID int64) error
+	// markWebhookDeliveryFailed records a failed attempt, either scheduling a retry at nextAttempt or moving it to the dead-letter list
+	markWebhookDeliveryFailed(ctx context.Context, deliveryID int64, lastError string, nextAttempt time.Time, dead bool) error
+	listDeadLetterDeliveries(ctx context.Context) ([]WebhookDelivery, error)
+	// replayDeadLetterDelivery moves a dead-lettered delivery back onto the queue, returning false if it is not dead-lettered
+	replayDeadLetterDelivery(ctx context.Context, deliveryID int64) (bool, error)
+}
+
+// webhookDelivery is a queued delivery along with what is needed to send it
+type webhookDelivery struct {
+	WebhookDelivery
+	url     string
+	secret  string
+	payload []byte
+}
+
+// SubscriptionPublisher publishes events by queueing a delivery for each matching webhook subscription
+type SubscriptionPublisher struct {
+	Store webhookStore
+}
+
+// Publish queues event for delivery to the webhook subscribers
+func (p *SubscriptionPublisher) Publish(ctx context.Context, event UserEvent) error {
+	return p.Store.enqueueWebhookDeliveries(ctx, event)
+}
+
+// postWebhook is an HTTP handler for POST /webhooks
+func (env *Env) postWebhook(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		jsonHTTPErrorResponseWriter(w, r, 400, CodeInvalidRequestBody, fmt.Sprintf("reading http request body: %v", err))
+		return
+	}
+	subscription := WebhookSubscription{}
+	err = json.Unmarshal(body, &subscription)
+	if err != nil {
+		jsonHTTPErrorResponseWriter(w, r, 400, CodeInvalidRequestBody, fmt.Sprintf("unmarshalling http request body: %v", err))
+		return
+	}
+
+	if err = validateWebhookSubscription(subscription); err != nil {
+		jsonHTTPErrorResponseWriter(w, r, 400, CodeInvalidWebhook, fmt.Sprintf("validating webhook subscription: %v", err))
+		return
+	}
+
+	subscription, err = env.Webhooks.createWebhookSubscription(r.Context(), subscription)
+	if err != nil {
+		jsonHTTPErrorResponseWriter(w, r, 500, CodeInternalError, fmt.Sprintf("adding webhook subscription to DB: %v", err))
+		return
+	}
+	subscription.Secret = ""
+
+	err = writeJSONHTTPResponse(w, 201, subscription)
+	if err != nil {
+		jsonHTTPErrorResponseWriter(w, r, 500, CodeInternalError, fmt.Sprintf("writing HTTP response: %v", err))
+		return
+	}
+}
+
+// listWebhooks is an HTTP handler for GET /webhooks
+func (env *Env) listWebhooks(w http.ResponseWriter, r *http.Request) {
+	subscriptions, err := env.Webhooks.listWebhookSubscriptions(r.Context())
+	if err != nil {
+		jsonHTTPErrorResponseWriter(w, r, 500, CodeInternalError, fmt.Sprintf("querying webhook subscriptions: %v", err))
+		return
+	}
+	for i := range subscriptions {
+		subscriptions[i].Secret = ""
+	}
+
+	err = writeJSONHTTPResponse(w, 200, subscriptions)
+	if err != nil {
+		jsonHTTPErrorResponseWriter(w, r, 500, CodeInternalError, fmt.Sprintf("writing HTTP response: %v", err))
+		return
+	}
+}
+
+// deleteWebhook is an HTTP handler for DELETE /webhooks/<subscription_id>
+func (env *Env) deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	subscriptionID, err := strconv.Atoi(mux.Vars(r)["subscription_id"])
+	if err != nil {
+		jsonHTTPErrorResponseWriter(w, r, 400, CodeInvalidPathParameter, fmt.Sprintf("subscription_id must be an integer: %v", err))
+		return
+	}
+
+	found, err := env.Webhooks.deleteWebhookSubscription(r.Context(), subscriptionID)
+	if err != nil {
+		jsonHTTPErrorResponseWriter(w, r, 500, CodeInternalError, fmt.Sprintf("deleting webhook subscription from DB: %v", err))
+		return
+	}
+	if !found {
+		jsonHTTPErrorResponseWriter(w, r, 404, CodeWebhookNotFound, fmt.Sprintf("webhook subscription %d does not exist. No deletion required", subscriptionID))
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// listDeadLetters is an HTTP handler for GET /webhooks/dead-letters
+func (env *Env) listDeadLetters(w http.ResponseWriter, r *http.Request) {
+	deliveries, err := env.Webhooks.listDeadLetterDeliveries(r.Context())
+	if err != nil {
+		jsonHTTPErrorResponseWriter(w, r, 500, CodeInternalError, fmt.Sprintf("querying dead-lettered webhook deliveries: %v", err))
+		return
+	}
+
+	err = writeJSONHTTPResponse(w, 200, deliveries)
+	if err != nil {
+		jsonHTTPErrorResponseWriter(w, r, 500, CodeInternalError, fmt.Sprintf("writing HTTP response: %v", err))
+		return
+	}
+}
+
+// replayDeadLetter is an HTTP handler for POST /webhooks/dead-letters/<delivery_id>/replay
+// The delivery is put back on the queue with its attempts reset, and is sent asynchronously by the WebhookDispatcher
+func (env *Env) replayDeadLetter(w http.ResponseWriter, r *http.Request) {
+	deliveryID, err := strconv.ParseInt(mux.Vars(r)["delivery_id"], 10, 64)
+	if err != nil {
+		jsonHTTPErrorResponseWriter(w, r, 400, CodeInvalidPathParameter, fmt.Sprintf("delivery_id must be an integer: %v", err))
+		return
+	}
+
+	found, err := env.Webhooks.replayDeadLetterDelivery(r.Context(), deliveryID)
+	if err != nil {
+		jsonHTTPErrorResponseWriter(w, r, 500, CodeInternalError, fmt.Sprintf("replaying webhook delivery: %v", err))
+		return
+	}
+	if !found {
+		jsonHTTPErrorResponseWriter(w, r, 404, CodeDeliveryNotFound, fmt.Sprintf("webhook delivery %d is not in the dead-letter list", deliveryID))
+		return
+	}
+
+	log.WithContext(r.Context()).WithField("delivery_id", deliveryID).Info("Replaying dead-lettered webhook delivery")
+	w.WriteHeader(202)
+}
+
+// validateWebhookSubscription validates the request payload of the POST /webhooks operation
+func validateWebhookSubscription(subscription WebhookSubscription) error {
+	if subscription.SubscriptionID != 0 {
+		return fmt.Errorf("passing a subscription_id in the request payload is not supported")
+	}
+
+	if len(subscription.URL) > webhookURLMaxLength {
+		return fmt.Errorf("url maximum length is %d. Currently %d", webhookURLMaxLength, len(subscription.URL))
+	}
+	u, err := url.Parse(subscription.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url '%s' must be an absolute http or https URL", subscription.URL)
+	}
+
+	if len(subscription.EventTypes) == 0 {
+		return fmt.Errorf("event_types must contain at least one of %s, %s or %s", EventUserCreated, EventUserUpdated, EventUserDeleted)
+	}
+	for _, eventType := range subscription.EventTypes {
+		switch eventType {
+		case EventUserCreated, EventUserUpdated, EventUserDeleted:
+		default:
+			return fmt.Errorf("event type '%s' is not supported. Must be one of %s, %s or %s", eventType, EventUserCreated, EventUserUpdated, EventUserDeleted)
+		}
+	}
+
+	if len(subscription.Secret) < webhookSecretMinLength || len(subscription.Secret) > webhookSecretMaxLength {
+		return fmt.Errorf("secret must be between %d and %d characters. Currently %d", webhookSecretMinLength, webhookSecretMaxLength, len(subscription.Secret))
+	}
+
+	return nil
+}
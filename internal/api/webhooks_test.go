@@ -0,0 +1,267 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockWebhookStore is used to mock the Postgres webhook tables
+type mockWebhookStore struct {
+	mu            sync.Mutex
+	subscriptions map[int]WebhookSubscription
+	deliveries    map[int64]*mockWebhookDelivery
+	nextID        int
+}
+
+type mockWebhookDelivery struct {
+	delivery    webhookDelivery
+	nextAttempt time.Time
+}
+
+func newMockWebhookStore() *mockWebhookStore {
+	return &mockWebhookStore{subscriptions: make(map[int]WebhookSubscription), deliveries: make(map[int64]*mockWebhookDelivery), nextID: 1}
+}
+
+func (m *mockWebhookStore) createWebhookSubscription(_ context.Context, subscription WebhookSubscription) (WebhookSubscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	subscription.SubscriptionID = m.nextID
+	subscription.CreatedAt = time.Now()
+	m.nextID++
+	m.subscriptions[subscription.SubscriptionID] = subscription
+	return subscription, nil
+}
+
+func (m *mockWebhookStore) listWebhookSubscriptions(_ context.Context) ([]WebhookSubscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	subscriptions := make([]WebhookSubscription, 0, len(m.subscriptions))
+	for _, subscription := range m.subscriptions {
+		subscriptions = append(subscriptions, subscription)
+	}
+	sort.Slice(subscriptions, func(i, j int) bool { return subscriptions[i].SubscriptionID < subscriptions[j].SubscriptionID })
+	return subscriptions, nil
+}
+
+func (m *mockWebhookStore) deleteWebhookSubscription(_ context.Context, subscriptionID int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, found := m.subscriptions[subscriptionID]
+	delete(m.subscriptions, subscriptionID)
+	return found, nil
+}
+
+func (m *mockWebhookStore) enqueueWebhookDeliveries(_ context.Context, event UserEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	payload, _ := json.Marshal(event)
+	for _, subscription := range m.subscriptions {
+		for _, eventType := range subscription.EventTypes {
+			if eventType != event.EventType {
+				continue
+			}
+			id := int64(m.nextID)
+			m.nextID++
+			m.deliveries[id] = &mockWebhookDelivery{delivery: webhookDelivery{
+				WebhookDelivery: WebhookDelivery{DeliveryID: id, SubscriptionID: subscription.SubscriptionID, EventID: event.EventID, EventType: event.EventType, Status: webhookStatusPending},
+				url:             subscription.URL,
+				secret:          subscription.Secret,
+				payload:         payload,
+			}}
+		}
+	}
+	return nil
+}
+
+func (m *mockWebhookStore) claimWebhookDeliveries(_ context.Context, limit int, lease time.Duration) ([]webhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var claimed []webhookDelivery
+	for _, d := range m.deliveries {
+		if d.delivery.Status == webhookStatusPending && !time.Now().Before(d.nextAttempt) && len(claimed) < limit {
+			d.nextAttempt = time.Now().Add(lease)
+			claimed = append(claimed, d.delivery)
+		}
+	}
+	return claimed, nil
+}
+
+func (m *mockWebhookStore) markWebhookDelivered(_ context.Context, deliveryID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d := m.deliveries[deliveryID]
+	d.delivery.Status = webhookStatusDelivered
+	d.delivery.Attempts++
+	return nil
+}
+
+func (m *mockWebhookStore) markWebhookDeliveryFailed(_ context.Context, deliveryID int64, lastError string, nextAttempt time.Time, dead bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d := m.deliveries[deliveryID]
+	d.delivery.Attempts++
+	d.delivery.LastError = lastError
+	d.nextAttempt = nextAttempt
+	if dead {
+		d.delivery.Status = webhookStatusDead
+	}
+	return nil
+}
+
+func (m *mockWebhookStore) listDeadLetterDeliveries(_ context.Context) ([]WebhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	deliveries := make([]WebhookDelivery, 0)
+	for _, d := range m.deliveries {
+		if d.delivery.Status == webhookStatusDead {
+			deliveries = append(deliveries, d.delivery.WebhookDelivery)
+		}
+	}
+	return deliveries, nil
+}
+
+func (m *mockWebhookStore) replayDeadLetterDelivery(_ context.Context, deliveryID int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, found := m.deliveries[deliveryID]
+	if !found || d.delivery.Status != webhookStatusDead {
+		return false, nil
+	}
+	d.delivery.Status = webhookStatusPending
+	d.delivery.Attempts = 0
+	d.nextAttempt = time.Now()
+	return true, nil
+}
+
+func (m *mockWebhookStore) delivery(deliveryID int64) WebhookDelivery {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.deliveries[deliveryID].delivery.WebhookDelivery
+}
+
+func (m *mockWebhookStore) pending() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	count := 0
+	for _, d := range m.deliveries {
+		if d.delivery.Status == webhookStatusPending {
+			count++
+		}
+	}
+	return count
+}
+
+func setupMockWebhooksRouter(store *mockWebhookStore) *mux.Router {
+	env := &Env{Webhooks: store}
+	router := mux.NewRouter()
+	router.HandleFunc("/webhooks", env.postWebhook).Methods("POST")
+	router.HandleFunc("/webhooks", env.listWebhooks).Methods("GET")
+	router.HandleFunc("/webhooks/dead-letters", env.listDeadLetters).Methods("GET")
+	router.HandleFunc("/webhooks/dead-letters/{delivery_id:[0-9]+}/replay", env.replayDeadLetter).Methods("POST")
+	router.HandleFunc("/webhooks/{subscription_id:[0-9]+}", env.deleteWebhook).Methods("DELETE")
+	return router
+}
+
+func sendWebhooksRequest(router *mux.Router, method, url string, body interface{}) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	if body != nil {
+		_ = json.NewEncoder(&buf).Encode(body)
+	}
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, url, &buf)
+	router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+// TestPostWebhook tests registering a subscription, and that the secret is not returned
+func TestPostWebhook(t *testing.T) {
+	store := newMockWebhookStore()
+	router := setupMockWebhooksRouter(store)
+
+	rec := sendWebhooksRequest(router, "POST", "/webhooks", WebhookSubscription{
+		URL:        "https://hr-sync.example.com/hooks/users",
+		EventTypes: []string{EventUserCreated, EventUserDeleted},
+		Secret:     "super-secret-signing-key",
+	})
+
+	assert.Equal(t, 201, rec.Code)
+	var resp WebhookSubscription
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal("unable to unmarshal JSON response")
+	}
+	assert.Equal(t, 1, resp.SubscriptionID)
+	assert.Empty(t, resp.Secret)
+	assert.NotContains(t, rec.Body.String(), "super-secret-signing-key")
+	assert.Equal(t, "super-secret-signing-key", store.subscriptions[1].Secret)
+
+	rec = sendWebhooksRequest(router, "GET", "/webhooks", nil)
+	assert.Equal(t, 200, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "super-secret-signing-key")
+}
+
+// TestPostWebhookValidation tests the validation of the POST /webhooks request payload
+func TestPostWebhookValidation(t *testing.T) {
+	router := setupMockWebhooksRouter(newMockWebhookStore())
+	tests := []struct {
+		subscription WebhookSubscription
+		message      string
+	}{
+		{WebhookSubscription{URL: "ftp://example.com", EventTypes: []string{EventUserCreated}, Secret: "super-secret-signing-key"}, "must be an absolute http or https URL"},
+		{WebhookSubscription{URL: "https://example.com", Secret: "super-secret-signing-key"}, "event_types must contain at least one of"},
+		{WebhookSubscription{URL: "https://example.com", EventTypes: []string{"user.renamed"}, Secret: "super-secret-signing-key"}, "event type 'user.renamed' is not supported"},
+		{WebhookSubscription{URL: "https://example.com", EventTypes: []string{EventUserCreated}, Secret: "short"}, "secret must be between 16 and 255 characters"},
+	}
+
+	for _, test := range tests {
+		rec := sendWebhooksRequest(router, "POST", "/webhooks", test.subscription)
+		assert.Equal(t, 400, rec.Code)
+		assert.Contains(t, rec.Body.String(), test.message)
+	}
+}
+
+// TestDeleteWebhook tests deleting a subscription which exists and one which does not
+func TestDeleteWebhook(t *testing.T) {
+	store := newMockWebhookStore()
+	_, _ = store.createWebhookSubscription(context.Background(), WebhookSubscription{URL: "https://example.com", EventTypes: []string{EventUserCreated}})
+	router := setupMockWebhooksRouter(store)
+
+	assert.Equal(t, 204, sendWebhooksRequest(router, "DELETE", "/webhooks/1", nil).Code)
+	assert.Equal(t, 404, sendWebhooksRequest(router, "DELETE", "/webhooks/1", nil).Code)
+}
+
+// TestReplayDeadLetter tests viewing the dead-letter list and replaying a delivery from it
+func TestReplayDeadLetter(t *testing.T) {
+	store := newMockWebhookStore()
+	_, _ = store.createWebhookSubscription(context.Background(), WebhookSubscription{URL: "https://example.com", EventTypes: []string{EventUserCreated}})
+	_ = store.enqueueWebhookDeliveries(context.Background(), UserEvent{EventID: 1, EventType: EventUserCreated, LogonName: "mark9"})
+	_ = store.markWebhookDeliveryFailed(context.Background(), 2, "webhook returned status code 500", time.Now(), true)
+	router := setupMockWebhooksRouter(store)
+
+	rec := sendWebhooksRequest(router, "GET", "/webhooks/dead-letters", nil)
+	assert.Equal(t, 200, rec.Code)
+	var deadLetters []WebhookDelivery
+	if err := json.Unmarshal(rec.Body.Bytes(), &deadLetters); err != nil {
+		t.Fatal("unable to unmarshal JSON response")
+	}
+	assert.Equal(t, 1, len(deadLetters))
+	assert.Equal(t, "webhook returned status code 500", deadLetters[0].LastError)
+
+	rec = sendWebhooksRequest(router, "POST", fmt.Sprintf("/webhooks/dead-letters/%d/replay", deadLetters[0].DeliveryID), nil)
+	assert.Equal(t, 202, rec.Code)
+	assert.Equal(t, webhookStatusPending, store.delivery(deadLetters[0].DeliveryID).Status)
+
+	// It is no longer dead-lettered so can't be replayed again
+	rec = sendWebhooksRequest(router, "POST", fmt.Sprintf("/webhooks/dead-letters/%d/replay", deadLetters[0].DeliveryID), nil)
+	assert.Equal(t, 404, rec.Code)
+}
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+      idempotency_key VARCHAR (255) PRIMARY KEY,
+      fingerprint VARCHAR (64) NOT NULL,
+      status_code INTEGER,
+      content_type VARCHAR (100),
+      response_body BYTEA,
+      expires_at TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,12 @@
+-- Outbox of user lifecycle events. Rows are written in the same transaction as the change to the users table
+-- and published asynchronously by the event relay
+CREATE TABLE IF NOT EXISTS user_events (
+      event_id BIGSERIAL PRIMARY KEY,
+      event_type VARCHAR (20) NOT NULL,
+      logon_name VARCHAR (20) NOT NULL,
+      payload JSONB NOT NULL,
+      created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+      published_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS user_events_unpublished_idx ON user_events (event_id) WHERE published_at IS NULL;
@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+      subscription_id serial PRIMARY KEY,
+      url VARCHAR (2048) NOT NULL,
+      event_types VARCHAR (20)[] NOT NULL,
+      secret VARCHAR (255) NOT NULL,
+      created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- One row per event per matching subscription. Rows move from pending to delivered, or to dead once the retries are exhausted
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+      delivery_id BIGSERIAL PRIMARY KEY,
+      subscription_id INTEGER NOT NULL REFERENCES webhook_subscriptions (subscription_id) ON DELETE CASCADE,
+      event_id BIGINT NOT NULL,
+      event_type VARCHAR (20) NOT NULL,
+      payload JSONB NOT NULL,
+      status VARCHAR (10) NOT NULL DEFAULT 'pending',
+      attempts INTEGER NOT NULL DEFAULT 0,
+      next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+      last_error TEXT,
+      created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+      UNIQUE (subscription_id, event_id)
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_pending_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
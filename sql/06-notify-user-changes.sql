@@ -0,0 +1,11 @@
+-- Notify every listening replica when a user event is recorded. NOTIFY is only delivered once the transaction commits,
+-- and the payload is the event_id so listeners can read anything newer than the last event they saw
+CREATE OR REPLACE FUNCTION notify_user_change() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('user_changes', NEW.event_id::text);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS user_events_notify ON user_events;
+CREATE TRIGGER user_events_notify AFTER INSERT ON user_events FOR EACH ROW EXECUTE FUNCTION notify_user_change();
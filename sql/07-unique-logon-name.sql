@@ -0,0 +1,2 @@
+-- Enforce logon_name uniqueness in the database, so that concurrent creates of the same logon_name can't both succeed
+CREATE UNIQUE INDEX IF NOT EXISTS users_logon_name_key ON users (logon_name);
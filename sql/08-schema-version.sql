@@ -0,0 +1,8 @@
+-- Records which of these scripts have been applied, so that /readyz can check that the schema is at the version the service
+-- expects. Every later script must insert its own version, which must match expectedSchemaVersion in the service
+CREATE TABLE IF NOT EXISTS schema_migrations (
+      version INT PRIMARY KEY,
+      applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+INSERT INTO schema_migrations (version) VALUES (1), (2), (3), (4), (5), (6), (7), (8) ON CONFLICT (version) DO NOTHING;
@@ -0,0 +1,20 @@
+-- Case and accent insensitive fuzzy search across logon_name, full_name and email for GET /users?q=. unaccent isn't
+-- immutable, as its dictionary can be changed, so it is wrapped to be usable in an index
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+CREATE EXTENSION IF NOT EXISTS unaccent;
+
+CREATE OR REPLACE FUNCTION immutable_unaccent(text) RETURNS text
+    LANGUAGE sql IMMUTABLE PARALLEL SAFE STRICT
+    AS $$ SELECT public.unaccent('public.unaccent'::regdictionary, $1) $$;
+
+-- The search queries must call this with the same arguments as the index, so that the index is used
+CREATE OR REPLACE FUNCTION user_search_text(logon_name text, full_name text, email text) RETURNS text
+    LANGUAGE sql IMMUTABLE PARALLEL SAFE
+    AS $$ SELECT lower(immutable_unaccent(concat_ws(' ', logon_name, full_name, email))) $$;
+
+CREATE INDEX IF NOT EXISTS users_search_trgm_idx ON users USING GIN (user_search_text(logon_name, full_name, email) gin_trgm_ops);
+
+-- Lets the LIKE of name_filter use an index too
+CREATE INDEX IF NOT EXISTS users_full_name_trgm_idx ON users USING GIN (full_name gin_trgm_ops);
+
+INSERT INTO schema_migrations (version) VALUES (9) ON CONFLICT (version) DO NOTHING;
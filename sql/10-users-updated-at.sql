@@ -0,0 +1,19 @@
+-- Records when each user was last written, so that GET /users can send a Last-Modified header. The index lets the latest
+-- write be found without scanning the table
+ALTER TABLE users ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+CREATE INDEX IF NOT EXISTS users_updated_at_idx ON users (updated_at);
+
+CREATE OR REPLACE FUNCTION set_user_updated_at() RETURNS trigger AS $$
+BEGIN
+    NEW.updated_at = now();
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS users_set_updated_at ON users;
+CREATE TRIGGER users_set_updated_at BEFORE UPDATE ON users FOR EACH ROW EXECUTE FUNCTION set_user_updated_at();
+
+-- Deleted users leave no updated_at behind, so the latest deletion is found from their user.deleted events
+CREATE INDEX IF NOT EXISTS user_events_deleted_idx ON user_events (created_at) WHERE event_type = 'user.deleted';
+
+INSERT INTO schema_migrations (version) VALUES (10) ON CONFLICT (version) DO NOTHING;
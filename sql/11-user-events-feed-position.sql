@@ -0,0 +1,12 @@
+-- Orders the change feed by when each event was committed. event_id is taken from its sequence when the event is inserted,
+-- so a lower event_id can commit after a higher one has already been streamed. feed_position is assigned to committed events
+-- one batch at a time, under an advisory lock, so it follows the commit order instead
+ALTER TABLE user_events ADD COLUMN IF NOT EXISTS feed_position BIGINT;
+
+-- Existing events keep their event_id as their position, so that the IDs change feed clients already hold stay valid
+UPDATE user_events SET feed_position = event_id WHERE feed_position IS NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS user_events_feed_position_idx ON user_events (feed_position);
+CREATE INDEX IF NOT EXISTS user_events_unsequenced_idx ON user_events (event_id) WHERE feed_position IS NULL;
+
+INSERT INTO schema_migrations (version) VALUES (11) ON CONFLICT (version) DO NOTHING;
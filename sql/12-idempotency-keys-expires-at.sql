@@ -0,0 +1,4 @@
+-- Expired idempotency keys are deleted in the background, a batch at a time, which looks them up by expires_at
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
+
+INSERT INTO schema_migrations (version) VALUES (12) ON CONFLICT (version) DO NOTHING;
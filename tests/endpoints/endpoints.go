@@ -25,8 +25,8 @@ func unmarshalJSONUsersResponse(t *testing.T, input string) api.UsersResponse {
 	return resp
 }
 
-func unmarshalJSONErrorResponse(t *testing.T, input string) api.JSONHTTPErrorResponse {
-	resp := api.JSONHTTPErrorResponse{}
+func unmarshalJSONErrorResponse(t *testing.T, input string) api.Problem {
+	resp := api.Problem{}
 	err := json.Unmarshal([]byte(input), &resp)
 	assert.NoError(t, err)
 	return resp
@@ -108,8 +108,9 @@ func CheckEndpoints(t *testing.T, baseURL string, maxRetries int, timeBetweenRet
 				return false
 			}
 			resp := unmarshalJSONErrorResponse(t, responseBody)
-			assert.Equal(t, http.StatusNotFound, resp.Code, "Expected bad response code to be in the response body")
-			assert.Contains(t, resp.Message, "not found", "Expected details to be in the error message")
+			assert.Equal(t, http.StatusNotFound, resp.Status, "Expected bad response code to be in the response body")
+			assert.Equal(t, api.CodePageNotFound, resp.Code, "Expected the error code to be in the response body")
+			assert.Contains(t, resp.Detail, "not found", "Expected details to be in the error message")
 			return true
 		})
 	})
@@ -187,7 +188,7 @@ func CheckEndpoints(t *testing.T, baseURL string, maxRetries int, timeBetweenRet
 				return false
 			}
 			resp := unmarshalJSONErrorResponse(t, responseBody)
-			assert.Equal(t, http.StatusNotFound, resp.Code, "Expected status code to be in the response body")
+			assert.Equal(t, http.StatusNotFound, resp.Status, "Expected status code to be in the response body")
 			return true
 		})
 	})
@@ -234,8 +235,8 @@ func CheckEndpoints(t *testing.T, baseURL string, maxRetries int, timeBetweenRet
 				return false
 			}
 			resp := unmarshalJSONErrorResponse(t, responseBody)
-			assert.Equal(t, http.StatusBadRequest, resp.Code, "Expected bad response code to be in the response body")
-			assert.Contains(t, resp.Message, "per_page query string must be an integer between", "Expected details to be in the error message")
+			assert.Equal(t, http.StatusBadRequest, resp.Status, "Expected bad response code to be in the response body")
+			assert.Contains(t, resp.Detail, "per_page query string must be an integer between", "Expected details to be in the error message")
 			return true
 		})
 	})
@@ -252,12 +253,12 @@ func CheckEndpoints(t *testing.T, baseURL string, maxRetries int, timeBetweenRet
 		assert.NoError(t, err)
 		bodyInput := bytes.NewReader(body)
 		http_helper.HTTPDoWithCustomValidation(t, "POST", url, bodyInput, map[string]string{"Content-Type": "application/json"}, func(statusCode int, responseBody string) bool {
-			if statusCode != http.StatusBadRequest {
+			if statusCode != http.StatusUnprocessableEntity {
 				return false
 			}
 			resp := unmarshalJSONErrorResponse(t, responseBody)
-			assert.Equal(t, http.StatusBadRequest, resp.Code, "Expected status code to also be in the response body")
-			assert.Contains(t, resp.Message, "already taken", "Expected some details to be in the response body")
+			assert.Equal(t, http.StatusUnprocessableEntity, resp.Status, "Expected status code to also be in the response body")
+			assert.Contains(t, resp.Detail, "already taken", "Expected some details to be in the response body")
 			return true
 		}, &tls.Config{})
 	})
@@ -274,12 +275,12 @@ func CheckEndpoints(t *testing.T, baseURL string, maxRetries int, timeBetweenRet
 		assert.NoError(t, err)
 		bodyInput := bytes.NewReader(body)
 		http_helper.HTTPDoWithCustomValidation(t, "POST", url, bodyInput, map[string]string{"Content-Type": "application/json"}, func(statusCode int, responseBody string) bool {
-			if statusCode != http.StatusBadRequest {
+			if statusCode != http.StatusUnprocessableEntity {
 				return false
 			}
 			resp := unmarshalJSONErrorResponse(t, responseBody)
-			assert.Equal(t, http.StatusBadRequest, resp.Code, "Expected status code to also be in the response body")
-			assert.Contains(t, resp.Message, "payload field lengths", "Expected some details to be in the response body")
+			assert.Equal(t, http.StatusUnprocessableEntity, resp.Status, "Expected status code to also be in the response body")
+			assert.Contains(t, resp.Detail, "logon_name maximum length is 20", "Expected some details to be in the response body")
 			return true
 		}, &tls.Config{})
 	})
@@ -296,12 +297,12 @@ func CheckEndpoints(t *testing.T, baseURL string, maxRetries int, timeBetweenRet
 		assert.NoError(t, err)
 		bodyInput := bytes.NewReader(body)
 		http_helper.HTTPDoWithCustomValidation(t, "POST", url, bodyInput, map[string]string{"Content-Type": "application/json"}, func(statusCode int, responseBody string) bool {
-			if statusCode != http.StatusBadRequest {
+			if statusCode != http.StatusUnprocessableEntity {
 				return false
 			}
 			resp := unmarshalJSONErrorResponse(t, responseBody)
-			assert.Equal(t, http.StatusBadRequest, resp.Code, "Expected status code to also be in the response body")
-			assert.Contains(t, resp.Message, "not a valid email address field", "Expected some details to be in the response body")
+			assert.Equal(t, http.StatusUnprocessableEntity, resp.Status, "Expected status code to also be in the response body")
+			assert.Contains(t, resp.Detail, "not a valid email address field", "Expected some details to be in the response body")
 			return true
 		}, &tls.Config{})
 	})